@@ -20,7 +20,7 @@ else
 fi
 
 echo "==> Building ${IMAGE}"
-docker build -t "$IMAGE" .
+docker build --build-arg VERSION="$TAG" -t "$IMAGE" .
 
 echo ""
 echo "Image built successfully: ${IMAGE}"
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"openai_gateway_proxy/proxy"
+)
+
+// settings is everything the binary is configured with.
+type settings struct {
+	cfg                          proxy.Config
+	addr, metricsAddr, adminAddr string
+	enableMetrics                bool
+	// healthAddr serves /healthz and /readyz over plain HTTP.
+	healthAddr string
+	// basePath, e.g. "/ai", is stripped from request paths under it.
+	basePath string
+	// tlsCertFile and tlsKeyFile, or the pairs in tlsCertDir, switch the
+	// API listener to HTTPS; the files are checked for changes every
+	// tlsReloadInterval.
+	tlsCertFile, tlsKeyFile string
+	tlsCertDir              string
+	tlsMinVersion           string
+	tlsReloadInterval       time.Duration
+	shutdownDelay           time.Duration
+	shutdownGrace           time.Duration
+}
+
+// version is the build version, set with -ldflags "-X main.version=...".
+// Without it, --version prints the module build info.
+var version string
+
+// loadConfig reads the settings from the command-line flags in args and
+// the environment. Every env var has a flag named after it in lower
+// kebab case (GATEWAY_URL is --gateway-url); flags take precedence.
+// Logging is set up from the result before the rest is read.
+func loadConfig(args []string) settings {
+	fs := flag.NewFlagSet("openai-gateway-proxy", flag.ExitOnError)
+	showVersion := fs.Bool("version", false, "print build information and exit")
+	for _, o := range collectOptions() {
+		usage := "env `" + o.env + "`"
+		if o.isBool {
+			usage = "env " + o.env
+		}
+		fs.Var(&optionValue{value: o.def, isBool: o.isBool}, flagName(o.env), usage)
+	}
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s [flags]\n\nEvery flag can also be set with the env var shown; flags take precedence.\n\n", fs.Name())
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if *showVersion {
+		fmt.Println(buildVersion())
+		os.Exit(0)
+	}
+	overrides = map[string]string{}
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name != "version" {
+			overrides[envName(f.Name)] = f.Value.String()
+		}
+	})
+	setupLogging(loggingSettings())
+	return readSettings()
+}
+
+// loggingSettings returns LOG_LEVEL (debug/info/warn/error) and
+// LOG_FORMAT (json/text/clf). clf logs like json but switches the access
+// log to common log format.
+func loggingSettings() (level, format string) {
+	return env("LOG_LEVEL", "info"), env("LOG_FORMAT", "json")
+}
+
+// readSettings builds the settings from lookup.
+func readSettings() settings {
+	s := settings{
+		addr:              env("PROXY_ADDR", ":8090"),
+		metricsAddr:       env("METRICS_ADDR", ""),
+		enableMetrics:     envBool("ENABLE_METRICS", false),
+		adminAddr:         env("ADMIN_ADDR", ""),
+		healthAddr:        env("HEALTH_ADDR", ""),
+		basePath:          strings.TrimRight(env("BASE_PATH", ""), "/"),
+		tlsCertFile:       env("TLS_CERT_FILE", ""),
+		tlsKeyFile:        env("TLS_KEY_FILE", ""),
+		tlsCertDir:        env("TLS_CERT_DIR", ""),
+		tlsMinVersion:     env("TLS_MIN_VERSION", "1.2"),
+		tlsReloadInterval: time.Duration(envInt("TLS_RELOAD_INTERVAL_SECONDS", 60)) * time.Second,
+		shutdownDelay:     time.Duration(envInt("SHUTDOWN_DELAY_SECONDS", 0)) * time.Second,
+		shutdownGrace:     time.Duration(envInt("SHUTDOWN_GRACE_SECONDS", 30)) * time.Second,
+	}
+
+	routes, err := loadRoutes()
+	if err != nil {
+		fatal("failed to load routes", err)
+	}
+
+	modelCapabilities := envJSONMap("MODEL_CAPABILITY_MAP")
+	modelAliases := envJSONMap("MODEL_ALIASES")
+
+	gatewayTLS, err := proxy.GatewayTLS{
+		CertFile:           env("GATEWAY_CLIENT_CERT_FILE", ""),
+		KeyFile:            env("GATEWAY_CLIENT_KEY_FILE", ""),
+		CAFile:             env("GATEWAY_CA_FILE", ""),
+		InsecureSkipVerify: envBool("GATEWAY_TLS_INSECURE_SKIP_VERIFY", false),
+	}.Load()
+	if err != nil {
+		fatal("invalid gateway TLS config", err)
+	}
+	if gatewayTLS != nil && gatewayTLS.InsecureSkipVerify {
+		slog.Warn("gateway TLS certificate verification is disabled")
+	}
+
+	gateways := envGateways("GATEWAY_URLS")
+	gatewayURL := env("GATEWAY_URL", "")
+	if gatewayURL == "" {
+		gatewayURL = "http://gateway:9935"
+		if len(gateways) > 0 {
+			gatewayURL = gateways[0].URL
+		}
+	}
+	s.cfg = proxy.Config{
+		GatewayURL:                   gatewayURL,
+		Gateways:                     gateways,
+		GatewayFailureThreshold:      envInt("GATEWAY_FAILURE_THRESHOLD", 3),
+		GatewayHealthPath:            env("GATEWAY_HEALTH_PATH", ""),
+		GatewayHealthTimeoutSeconds:  envInt("GATEWAY_HEALTH_TIMEOUT_SECONDS", 2),
+		GatewayHealthIntervalSeconds: envInt("GATEWAY_HEALTH_INTERVAL_SECONDS", 5),
+		GatewayDownSeconds:           envInt("GATEWAY_DOWN_SECONDS", 30),
+		ClientConfig: proxy.ClientConfig{
+			HTTP2:                        envBool("GATEWAY_HTTP2", false),
+			MaxIdleConns:                 envInt("GATEWAY_MAX_IDLE_CONNS", 200),
+			MaxIdleConnsPerHost:          envInt("GATEWAY_MAX_IDLE_CONNS_PER_HOST", 100),
+			MaxConnsPerHost:              envInt("GATEWAY_MAX_CONNS_PER_HOST", 0),
+			TLS:                          gatewayTLS,
+			DialTimeoutSeconds:           envInt("GATEWAY_DIAL_TIMEOUT_SECONDS", 10),
+			ResponseHeaderTimeoutSeconds: envInt("GATEWAY_RESPONSE_HEADER_TIMEOUT_SECONDS", 0),
+		},
+		Routes:                         routes,
+		LoadRoutes:                     loadRoutes,
+		Version:                        buildVersion(),
+		AllowedCapabilities:            envList("ALLOWED_CAPABILITIES"),
+		BYOCTimeoutSeconds:             envInt("BYOC_TIMEOUT_SECONDS", 120),
+		BYOCCapabilityTimeouts:         envIntMap("BYOC_CAPABILITY_TIMEOUTS"),
+		BYOCCapabilityConcurrency:      envIntMap("BYOC_CAPABILITY_CONCURRENCY"),
+		MaxPrice:                       env("MAX_PRICE", ""),
+		CapabilityMaxPrices:            envStringMap("CAPABILITY_MAX_PRICES"),
+		ConcurrencyMode:                env("CONCURRENCY_MODE", proxy.ConcurrencyReject),
+		ConcurrencyQueueTimeoutSeconds: envInt("CONCURRENCY_QUEUE_TIMEOUT_SECONDS", 5),
+		MaxStreamingConnections:        envInt("MAX_STREAMING_CONNECTIONS", 0),
+		MinTimeoutSeconds:              envInt("MIN_TIMEOUT_SECONDS", 1),
+		MaxTimeoutSeconds:              envInt("MAX_TIMEOUT_SECONDS", 1800),
+		LiveTranscodeCapability:        env("BYOC_LIVE_TRANSCODE_CAPABILITY", "transcode-live"),
+		LiveTranscodeTimeoutSeconds:    envInt("LIVE_TRANSCODE_TIMEOUT_SECONDS", 0), // 0 = no timeout for streams
+		JobTTLSeconds:                  envInt("VIDEO_JOB_TTL_SECONDS", 3600),
+		JobPollIntervalSeconds:         envInt("VIDEO_POLL_INTERVAL_SECONDS", 5),
+		ModelCapabilities:              modelCapabilities,
+		ModelCapabilitiesStrict:        envBool("MODEL_CAPABILITY_STRICT", false),
+		ModelAliases:                   modelAliases,
+		DefaultModel:                   env("DEFAULT_MODEL", ""),
+		SSEMaxLineBytes:                envInt("SSE_MAX_LINE_BYTES", 32<<20),
+		SSEInterruptedEnd:              env("SSE_INTERRUPTED_END", proxy.StreamEndError),
+		SSEIdleTimeoutSeconds:          envInt("SSE_IDLE_TIMEOUT_SECONDS", 0),
+		MaxResponseBytes:               int64(envInt("MAX_RESPONSE_BYTES", 100<<20)),
+		StreamMaxResponseBytes:         int64(envInt("STREAM_MAX_RESPONSE_BYTES", 1<<30)),
+		SSERequiredKeys:                envListMap("SSE_REQUIRED_KEYS"),
+		SSEKeepAliveSeconds:            envInt("SSE_KEEPALIVE_SECONDS", 15),
+		SSEFlushIntervalMS:             envInt("SSE_FLUSH_INTERVAL_MS", 0),
+		AllowClientLivepeerHeader:      envBool("ALLOW_CLIENT_LIVEPEER_HEADER", false),
+		ExposeLivepeerHeaders:          envBool("EXPOSE_LIVEPEER_HEADERS", false),
+		ForwardHeaders:                 envList("FORWARD_HEADERS"),
+		IdempotencyTTLSeconds:          envInt("IDEMPOTENCY_TTL_SECONDS", 0),
+		IdempotencyMaxEntries:          envInt("IDEMPOTENCY_MAX_ENTRIES", 1000),
+		RaceMaxRequests:                envInt("RACE_MAX_REQUESTS", 0),
+		RaceAllowedClients:             envList("RACE_ALLOWED_CLIENTS"),
+		BodyBuffering:                  env("BODY_BUFFERING", proxy.BodyBufferingAuto),
+		GatewayAuth: proxy.GatewayAuth{
+			Forward:        envBool("FORWARD_AUTHORIZATION", false),
+			Token:          env("GATEWAY_AUTH_TOKEN", ""),
+			TokenFile:      env("GATEWAY_AUTH_TOKEN_FILE", ""),
+			Header:         env("GATEWAY_AUTH_HEADER", ""),
+			Value:          env("GATEWAY_AUTH_VALUE", ""),
+			ValueFile:      env("GATEWAY_AUTH_VALUE_FILE", ""),
+			ReloadInterval: time.Duration(envInt("GATEWAY_AUTH_RELOAD_SECONDS", 60)) * time.Second,
+		},
+		APIKeys:                          envList("API_KEYS"),
+		APIKeysFile:                      env("API_KEYS_FILE", ""),
+		RateLimitRPM:                     envInt("RATE_LIMIT_RPM", 0),
+		RateLimitBurst:                   envInt("RATE_LIMIT_BURST", 0),
+		JWTJWKSURL:                       env("JWT_JWKS_URL", ""),
+		JWTJWKSRefreshSeconds:            envInt("JWT_JWKS_REFRESH_SECONDS", 300),
+		JWTHS256Secret:                   env("JWT_HS256_SECRET", ""),
+		JWTIssuer:                        env("JWT_ISSUER", ""),
+		JWTAudience:                      env("JWT_AUDIENCE", ""),
+		JWTRateLimitClaim:                env("JWT_RATE_LIMIT_CLAIM", "sub"),
+		CORSAllowedOrigins:               envList("CORS_ALLOWED_ORIGINS"),
+		UsageTracking:                    env("USAGE_TRACKING", proxy.UsageOn),
+		UsageTrailers:                    envBool("USAGE_TRAILERS", false),
+		OrchestratorInclude:              envList("ORCHESTRATOR_INCLUDE"),
+		OrchestratorExclude:              envList("ORCHESTRATOR_EXCLUDE"),
+		GatewayRetries:                   envInt("GATEWAY_RETRIES", 0),
+		GatewayRetryBackoffMS:            envInt("GATEWAY_RETRY_BACKOFF_MS", 200),
+		ShadowGatewayURL:                 env("SHADOW_GATEWAY_URL", ""),
+		ShadowSamplePercent:              envFloat("SHADOW_SAMPLE_PERCENT", 0),
+		ShadowMaxInFlight:                envInt("SHADOW_MAX_IN_FLIGHT", 10),
+		BreakerFailures:                  envInt("BREAKER_FAILURES", 5),
+		BreakerWindowSeconds:             envInt("BREAKER_WINDOW_SECONDS", 60),
+		BreakerCooldownSeconds:           envInt("BREAKER_COOLDOWN_SECONDS", 30),
+		BreakerCapabilityFailures:        envIntMap("BREAKER_CAPABILITY_FAILURES"),
+		BreakerCapabilityWindowSeconds:   envIntMap("BREAKER_CAPABILITY_WINDOW_SECONDS"),
+		BreakerCapabilityCooldownSeconds: envIntMap("BREAKER_CAPABILITY_COOLDOWN_SECONDS"),
+		OrchestratorHeaderPattern:        env("ORCHESTRATOR_HEADER_PATTERN", ""),
+		OrchestratorStatsWindowSeconds:   envInt("ORCH_STATS_WINDOW_SECONDS", 900),
+		OrchestratorMetricsMaxHosts:      envInt("ORCH_METRICS_MAX_HOSTS", 50),
+		OrchestratorBlacklistFailures:    envInt("ORCH_BLACKLIST_FAILURES", 0),
+		OrchestratorBlacklistTTLSeconds:  envInt("ORCH_BLACKLIST_TTL_SECONDS", 300),
+		AccessLogFormat:                  env("ACCESS_LOG_FORMAT", defaultAccessLogFormat()),
+		LogBodies:                        envBool("LOG_BODIES", false),
+		LogBodiesMaxBytes:                envInt("LOG_BODIES_MAX_BYTES", 2048),
+		LogBodiesMaxChunks:               envInt("LOG_BODIES_MAX_CHUNKS", 10),
+		TrustedProxies:                   envList("TRUSTED_PROXIES"),
+	}
+	if s.metricsAddr != "" || s.enableMetrics {
+		s.cfg.MetricsRegisterer = prometheus.DefaultRegisterer
+	}
+	return s
+}
+
+// loadRoutes reads the route config file, if any, over the built-in routes
+// and applies the route env vars on top.
+func loadRoutes() ([]proxy.Route, error) {
+	routesConfig := env("PROXY_CONFIG", env("ROUTES_CONFIG", ""))
+	routes, err := proxy.LoadRoutes(routesConfig, defaultRoutes())
+	if err != nil {
+		return nil, err
+	}
+	applyRouteEnv(routes)
+	return routes, nil
+}
+
+// defaultAccessLogFormat is the access log format used when
+// ACCESS_LOG_FORMAT isn't set: common with LOG_FORMAT=clf, json otherwise.
+func defaultAccessLogFormat() string {
+	if _, format := loggingSettings(); strings.EqualFold(format, "clf") {
+		return proxy.AccessLogCommon
+	}
+	return proxy.AccessLogJSON
+}
+
+// option is a setting read through lookup.
+type option struct {
+	env, def string
+	isBool   bool
+}
+
+var (
+	// overrides holds the values of the flags set on the command line,
+	// by env var name.
+	overrides map[string]string
+	// collected records every setting read while collecting is set.
+	collecting bool
+	collected  []option
+)
+
+// collectOptions lists every setting with its default by reading the
+// settings once with the environment ignored.
+func collectOptions() []option {
+	collecting, collected = true, nil
+	defer func() { collecting = false }()
+	loggingSettings()
+	readSettings()
+	return collected
+}
+
+// lookup returns the flag or env var value of setting k, whose default is
+// def. isBool marks on/off settings, which can be given as bare flags.
+func lookup(k, def string, isBool bool) string {
+	if collecting {
+		for _, o := range collected {
+			if o.env == k {
+				return ""
+			}
+		}
+		collected = append(collected, option{env: k, def: def, isBool: isBool})
+		return ""
+	}
+	if v, ok := overrides[k]; ok {
+		return v
+	}
+	return os.Getenv(k)
+}
+
+// optionValue is the flag.Value of a setting.
+type optionValue struct {
+	value  string
+	isBool bool
+}
+
+func (v *optionValue) String() string     { return v.value }
+func (v *optionValue) Set(s string) error { v.value = s; return nil }
+func (v *optionValue) IsBoolFlag() bool   { return v.isBool }
+
+func flagName(env string) string {
+	return strings.ReplaceAll(strings.ToLower(env), "_", "-")
+}
+
+func envName(flag string) string {
+	return strings.ReplaceAll(strings.ToUpper(flag), "-", "_")
+}
+
+// buildVersion describes the binary: its version and, from the build info,
+// the VCS revision and Go version.
+func buildVersion() string {
+	v := version
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return v
+	}
+	if v == "" {
+		v = info.Main.Version
+	}
+	out := []string{v}
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision", "vcs.time", "vcs.modified":
+			out = append(out, s.Key+"="+s.Value)
+		}
+	}
+	return strings.Join(append(out, info.GoVersion), " ")
+}
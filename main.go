@@ -1,1213 +1,494 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
 	"context"
-	"encoding/base64"
+	"crypto/tls"
 	"encoding/json"
-	"io"
-	"log"
-	"net"
+	"errors"
+	"fmt"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
-)
 
-type livepeerHeader struct {
-	Request        string `json:"request"`
-	Capability     string `json:"capability"`
-	TimeoutSeconds int    `json:"timeout_seconds"`
-}
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 
-func main() {
-	addr := env("PROXY_ADDR", ":8090")
-	gatewayURL := env("GATEWAY_URL", "http://gateway:9935")
-	capability := env("CHAT_COMPLETIONS_CAPABILITY", "openai-chat-completions")
-	imageCapability := env("IMAGE_GENERATION_CAPABILITY", "openai-image-generation")
-	embeddingsCapability := env("TEXT_EMBEDDINGS_CAPABILITY", "openai-text-embeddings")
-	rerankCapability := env("RERANK_CAPABILITY", "cohere-rerank")
-	videoGenerationCapability := env("VIDEO_GENERATION_CAPABILITY", "video-generation")
-	transcodeCapability := env("BYOC_TRANSCODE_CAPABILITY", "video-transcode")
-	abrCapability := env("BYOC_ABR_CAPABILITY", "transcode-abr")
-	liveTranscodeCapability := env("BYOC_LIVE_TRANSCODE_CAPABILITY", "transcode-live")
-	timeoutSeconds := envInt("CHAT_COMPLETIONS_TIMEOUT_SECONDS", 120)
-	imageTimeoutSeconds := envInt("IMAGE_GENERATION_TIMEOUT_SECONDS", 120)
-	embeddingsTimeoutSeconds := envInt("TEXT_EMBEDDINGS_TIMEOUT_SECONDS", 30)
-	rerankTimeoutSeconds := envInt("RERANK_TIMEOUT_SECONDS", 30)
-	videoPipelineTimeoutSeconds := envInt("VIDEO_GENERATION_TIMEOUT_SECONDS", 900)
-	transcodeTimeoutSeconds := envInt("TRANSCODE_TIMEOUT_SECONDS", 900)
-	abrTimeoutSeconds := envInt("ABR_TIMEOUT_SECONDS", 1800)
-	liveTranscodeTimeoutSeconds := envInt("LIVE_TRANSCODE_TIMEOUT_SECONDS", 0) // 0 = no timeout for streams
+	"openai_gateway_proxy/proxy"
+)
 
-	target := strings.TrimRight(gatewayURL, "/") + "/process/request/v1/chat/completions"
-	imageTarget := strings.TrimRight(gatewayURL, "/") + "/process/request/v1/images/generations"
-	embeddingsTarget := strings.TrimRight(gatewayURL, "/") + "/process/request/v1/embeddings"
-	rerankTarget := strings.TrimRight(gatewayURL, "/") + "/process/request/v1/rerank"
-	videoGenerationTarget := strings.TrimRight(gatewayURL, "/") + "/process/request/v1/video/generations"
-	transcodeTarget := strings.TrimRight(gatewayURL, "/") + "/process/request/v1/video/transcode"
-	transcodeStatusTarget := strings.TrimRight(gatewayURL, "/") + "/process/request/v1/video/transcode/status"
-	transcodePresetsTarget := strings.TrimRight(gatewayURL, "/") + "/process/request/v1/video/transcode/presets"
-	abrTarget := strings.TrimRight(gatewayURL, "/") + "/process/request/v1/video/transcode/abr"
-	abrStatusTarget := strings.TrimRight(gatewayURL, "/") + "/process/request/v1/video/transcode/abr/status"
-	abrPresetsTarget := strings.TrimRight(gatewayURL, "/") + "/process/request/v1/video/transcode/abr/presets"
+func main() {
+	s := loadConfig(os.Args[1:])
+	setupTracing()
 
-	transport := &http.Transport{
-		Proxy: http.ProxyFromEnvironment,
-		DialContext: (&net.Dialer{
-			Timeout:   10 * time.Second,
-			KeepAlive: 30 * time.Second,
-		}).DialContext,
-		ForceAttemptHTTP2:     false,
-		MaxIdleConns:          200,
-		IdleConnTimeout:       90 * time.Second,
-		TLSHandshakeTimeout:   10 * time.Second,
-		ExpectContinueTimeout: 1 * time.Second,
+	cfg, routes := s.cfg, s.cfg.Routes
+	addr, adminAddr, metricsAddr := s.addr, s.adminAddr, s.metricsAddr
+	if err := cfg.Validate(); err != nil {
+		fatal("invalid config", err)
 	}
-	client := &http.Client{Transport: transport}
-
-	mux := http.NewServeMux()
-	mux.HandleFunc("/v1/chat/completions", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
-
-		// Proxy should be streaming-friendly; optionally use a hard timeout
-		ctx := r.Context()
-		ctx, cancel := context.WithTimeout(ctx, time.Duration(timeoutSeconds)*time.Second)
-		defer cancel()
-
-		const maxBody = 5 << 20 // 5MB
-		bodyBytes, err := io.ReadAll(io.LimitReader(r.Body, maxBody))
-		if err != nil {
-			http.Error(w, "failed to read request body", http.StatusBadRequest)
-			return
-		}
-		_ = r.Body.Close()
-
-		req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(bodyBytes))
-		if err != nil {
-			http.Error(w, "failed to create gateway request", http.StatusBadGateway)
-			return
-		}
-		req.ContentLength = int64(len(bodyBytes))
-
-		// Copy content-type and accept (keep it simple)
-		copyHeader(req.Header, r.Header, []string{"Content-Type", "Accept"})
-
-		// Strip client auth headers (Traefik handles auth/rate limit)
-		req.Header.Del("Authorization")
-
-		// Build Livepeer header
-		lp := map[string]any{
-			"request":         `{"run":"` + capability + `"}`,
-			"parameters":      `{"orchestrators":{"include":[],"exclude":[]}}`,
-			"capability":      capability,
-			"timeout_seconds": timeoutSeconds,
-		}
-
-		b, _ := json.Marshal(lp)
-		req.Header.Set("Livepeer", base64.StdEncoding.EncodeToString(b))
-		decoded, _ := base64.StdEncoding.DecodeString(req.Header.Get("Livepeer"))
-		log.Printf("sending to gateway: url=%s content_len=%d livepeer=%s",
-			target, len(bodyBytes), string(decoded),
-		)
-		resp, err := client.Do(req)
-		if err != nil {
-			http.Error(w, "gateway request failed: "+err.Error(), http.StatusBadGateway)
-			return
-		}
-		defer resp.Body.Close()
-
-		copyAllHeaders(w.Header(), resp.Header)
-
-		// Fix: The Livepeer gateway may pass through an incorrect
-		// Content-Type (text/plain). Override it at the proxy layer as
-		// a safety net — this is what clients actually see.
-		if ct := resp.Header.Get("Content-Type"); strings.HasPrefix(ct, "text/event-stream") {
-			w.Header().Set("Content-Type", "text/event-stream")
-		} else {
-			w.Header().Set("Content-Type", "application/json")
-		}
-
-		// Strip Livepeer-specific headers that aren't part of the OpenAI API
-		w.Header().Del("Livepeer-Balance")
-		w.Header().Del("X-Metadata")
-		w.Header().Del("X-Orchestrator-Url")
-
-		w.WriteHeader(resp.StatusCode)
-
-		// For SSE responses, filter out non-OpenAI events injected by
-		// the Livepeer gateway (e.g. {"balance": ...}). These events
-		// lack the "choices" field and crash OpenAI SDK parsers.
-		if strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
-			streamSSEFiltered(w, resp.Body)
-		} else {
-			streamResponse(w, resp.Body)
-		}
-	})
-
-	// Image generation endpoint — routes to image runner via BYOC
-	mux.HandleFunc("/v1/images/generations", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
-
-		ctx := r.Context()
-		ctx, cancel := context.WithTimeout(ctx, time.Duration(imageTimeoutSeconds)*time.Second)
-		defer cancel()
-
-		const maxBody = 1 << 20 // 1MB
-		bodyBytes, err := io.ReadAll(io.LimitReader(r.Body, maxBody))
-		if err != nil {
-			http.Error(w, "failed to read request body", http.StatusBadRequest)
-			return
-		}
-		_ = r.Body.Close()
-
-		req, err := http.NewRequestWithContext(ctx, http.MethodPost, imageTarget, bytes.NewReader(bodyBytes))
-		if err != nil {
-			http.Error(w, "failed to create gateway request", http.StatusBadGateway)
-			return
-		}
-		req.ContentLength = int64(len(bodyBytes))
-
-		copyHeader(req.Header, r.Header, []string{"Content-Type", "Accept"})
-		req.Header.Del("Authorization")
-
-		// Build Livepeer header for image capability
-		lp := map[string]any{
-			"request":         `{"run":"` + imageCapability + `"}`,
-			"parameters":      `{"orchestrators":{"include":[],"exclude":[]}}`,
-			"capability":      imageCapability,
-			"timeout_seconds": imageTimeoutSeconds,
-		}
-
-		b, _ := json.Marshal(lp)
-		req.Header.Set("Livepeer", base64.StdEncoding.EncodeToString(b))
-		log.Printf("image gen request to gateway: url=%s content_len=%d", imageTarget, len(bodyBytes))
-
-		resp, err := client.Do(req)
-		if err != nil {
-			http.Error(w, "gateway request failed: "+err.Error(), http.StatusBadGateway)
-			return
-		}
-		defer resp.Body.Close()
-
-		copyAllHeaders(w.Header(), resp.Header)
-		// Ensure Content-Type is application/json so OpenAI SDK parses correctly
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(resp.StatusCode)
-
-		// Image generation is not streaming — just copy the full response
-		io.Copy(w, resp.Body)
-	})
-
-	// Embeddings endpoint — routes to embeddings runner via BYOC
-	mux.HandleFunc("/v1/embeddings", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
-
-		ctx := r.Context()
-		ctx, cancel := context.WithTimeout(ctx, time.Duration(embeddingsTimeoutSeconds)*time.Second)
-		defer cancel()
-
-		const maxBody = 1 << 20 // 1MB
-		bodyBytes, err := io.ReadAll(io.LimitReader(r.Body, maxBody))
-		if err != nil {
-			http.Error(w, "failed to read request body", http.StatusBadRequest)
-			return
-		}
-		_ = r.Body.Close()
-
-		req, err := http.NewRequestWithContext(ctx, http.MethodPost, embeddingsTarget, bytes.NewReader(bodyBytes))
-		if err != nil {
-			http.Error(w, "failed to create gateway request", http.StatusBadGateway)
-			return
-		}
-		req.ContentLength = int64(len(bodyBytes))
-
-		copyHeader(req.Header, r.Header, []string{"Content-Type", "Accept"})
-		req.Header.Del("Authorization")
-
-		// Build Livepeer header for embeddings capability
-		lp := map[string]any{
-			"request":         `{"run":"` + embeddingsCapability + `"}`,
-			"parameters":      `{"orchestrators":{"include":[],"exclude":[]}}`,
-			"capability":      embeddingsCapability,
-			"timeout_seconds": embeddingsTimeoutSeconds,
-		}
-
-		b, _ := json.Marshal(lp)
-		req.Header.Set("Livepeer", base64.StdEncoding.EncodeToString(b))
-		log.Printf("embeddings request to gateway: url=%s content_len=%d", embeddingsTarget, len(bodyBytes))
-
-		resp, err := client.Do(req)
-		if err != nil {
-			http.Error(w, "gateway request failed: "+err.Error(), http.StatusBadGateway)
-			return
-		}
-		defer resp.Body.Close()
-
-		copyAllHeaders(w.Header(), resp.Header)
-		// Ensure Content-Type is application/json so OpenAI SDK parses correctly
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(resp.StatusCode)
-
-		// Embeddings are not streaming — just copy the full response
-		io.Copy(w, resp.Body)
-	})
-
-	// Rerank endpoint — routes to rerank runner via BYOC
-	mux.HandleFunc("/v1/rerank", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
-
-		ctx := r.Context()
-		ctx, cancel := context.WithTimeout(ctx, time.Duration(rerankTimeoutSeconds)*time.Second)
-		defer cancel()
-
-		const maxBody = 1 << 20 // 1MB
-		bodyBytes, err := io.ReadAll(io.LimitReader(r.Body, maxBody))
-		if err != nil {
-			http.Error(w, "failed to read request body", http.StatusBadRequest)
-			return
-		}
-		_ = r.Body.Close()
-
-		req, err := http.NewRequestWithContext(ctx, http.MethodPost, rerankTarget, bytes.NewReader(bodyBytes))
-		if err != nil {
-			http.Error(w, "failed to create gateway request", http.StatusBadGateway)
-			return
-		}
-		req.ContentLength = int64(len(bodyBytes))
-
-		copyHeader(req.Header, r.Header, []string{"Content-Type", "Accept"})
-		req.Header.Del("Authorization")
-
-		// Build Livepeer header for rerank capability
-		lp := map[string]any{
-			"request":         `{"run":"` + rerankCapability + `"}`,
-			"parameters":      `{"orchestrators":{"include":[],"exclude":[]}}`,
-			"capability":      rerankCapability,
-			"timeout_seconds": rerankTimeoutSeconds,
-		}
-
-		b, _ := json.Marshal(lp)
-		req.Header.Set("Livepeer", base64.StdEncoding.EncodeToString(b))
-		log.Printf("rerank request to gateway: url=%s content_len=%d", rerankTarget, len(bodyBytes))
-
-		resp, err := client.Do(req)
-		if err != nil {
-			http.Error(w, "gateway request failed: "+err.Error(), http.StatusBadGateway)
-			return
-		}
-		defer resp.Body.Close()
-
-		copyAllHeaders(w.Header(), resp.Header)
-		// Ensure Content-Type is application/json
-		w.Header().Set("Content-Type", "application/json")
-		w.Header().Del("Livepeer-Balance")
-		w.Header().Del("X-Metadata")
-		w.Header().Del("X-Orchestrator-Url")
-		w.WriteHeader(resp.StatusCode)
-
-		// Rerank is not streaming — just copy the full response
-		io.Copy(w, resp.Body)
-	})
-
-	// Video generation endpoint — starts async job, returns job_id
-	mux.HandleFunc("/v1/video/generations", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
-
-		// Use a short timeout for job submission (returns immediately)
-		ctx := r.Context()
-		ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
-		defer cancel()
-
-		const maxBody = 1 << 20 // 1MB
-		bodyBytes, err := io.ReadAll(io.LimitReader(r.Body, maxBody))
-		if err != nil {
-			http.Error(w, "failed to read request body", http.StatusBadRequest)
-			return
-		}
-		_ = r.Body.Close()
-
-		req, err := http.NewRequestWithContext(ctx, http.MethodPost, videoGenerationTarget, bytes.NewReader(bodyBytes))
-		if err != nil {
-			http.Error(w, "failed to create gateway request", http.StatusBadGateway)
-			return
-		}
-		req.ContentLength = int64(len(bodyBytes))
-
-		copyHeader(req.Header, r.Header, []string{"Content-Type", "Accept"})
-		req.Header.Del("Authorization")
-
-		// Build Livepeer header for video pipeline capability
-		lp := map[string]any{
-			"request":         `{"run":"` + videoGenerationCapability + `"}`,
-			"parameters":      `{"orchestrators":{"include":[],"exclude":[]}}`,
-			"capability":      videoGenerationCapability,
-			"timeout_seconds": videoPipelineTimeoutSeconds,
-		}
-
-		b, _ := json.Marshal(lp)
-		req.Header.Set("Livepeer", base64.StdEncoding.EncodeToString(b))
-		log.Printf("video generation request to gateway: url=%s content_len=%d", videoGenerationTarget, len(bodyBytes))
-
-		resp, err := client.Do(req)
-		if err != nil {
-			http.Error(w, "gateway request failed: "+err.Error(), http.StatusBadGateway)
-			return
-		}
-		defer resp.Body.Close()
-
-		copyAllHeaders(w.Header(), resp.Header)
-		w.Header().Set("Content-Type", "application/json")
-		w.Header().Del("Livepeer-Balance")
-		w.Header().Del("X-Metadata")
-		w.Header().Del("X-Orchestrator-Url")
-		w.WriteHeader(resp.StatusCode)
-
-		io.Copy(w, resp.Body)
-	})
-
-	// Video pipeline status endpoint — poll job progress
-	videoPipelineStatusTarget := strings.TrimRight(gatewayURL, "/") + "/process/request/v1/video/generations/status"
-	mux.HandleFunc("/v1/video/generations/status", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
-
-		ctx := r.Context()
-		ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
-		defer cancel()
-
-		const maxBody = 1 << 20
-		bodyBytes, err := io.ReadAll(io.LimitReader(r.Body, maxBody))
-		if err != nil {
-			http.Error(w, "failed to read request body", http.StatusBadRequest)
-			return
-		}
-		_ = r.Body.Close()
-
-		req, err := http.NewRequestWithContext(ctx, http.MethodPost, videoPipelineStatusTarget, bytes.NewReader(bodyBytes))
-		if err != nil {
-			http.Error(w, "failed to create gateway request", http.StatusBadGateway)
-			return
-		}
-		req.ContentLength = int64(len(bodyBytes))
-
-		copyHeader(req.Header, r.Header, []string{"Content-Type", "Accept"})
-		req.Header.Del("Authorization")
-
-		lp := map[string]any{
-			"request":         `{"run":"` + videoGenerationCapability + `"}`,
-			"parameters":      `{"orchestrators":{"include":[],"exclude":[]}}`,
-			"capability":      videoGenerationCapability,
-			"timeout_seconds": 30,
-		}
-
-		b, _ := json.Marshal(lp)
-		req.Header.Set("Livepeer", base64.StdEncoding.EncodeToString(b))
-
-		resp, err := client.Do(req)
-		if err != nil {
-			http.Error(w, "gateway request failed: "+err.Error(), http.StatusBadGateway)
-			return
-		}
-		defer resp.Body.Close()
-
-		copyAllHeaders(w.Header(), resp.Header)
-		w.Header().Set("Content-Type", "application/json")
-		w.Header().Del("Livepeer-Balance")
-		w.Header().Del("X-Metadata")
-		w.Header().Del("X-Orchestrator-Url")
-		w.WriteHeader(resp.StatusCode)
-
-		io.Copy(w, resp.Body)
-	})
-
-	// Video transcode submit endpoint — starts async transcode job
-	mux.HandleFunc("/v1/video/transcode", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
-
-		ctx := r.Context()
-		ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
-		defer cancel()
-
-		const maxBody = 5 << 20 // 5MB
-		bodyBytes, err := io.ReadAll(io.LimitReader(r.Body, maxBody))
-		if err != nil {
-			http.Error(w, "failed to read request body", http.StatusBadRequest)
-			return
-		}
-		_ = r.Body.Close()
-
-		req, err := http.NewRequestWithContext(ctx, http.MethodPost, transcodeTarget, bytes.NewReader(bodyBytes))
-		if err != nil {
-			http.Error(w, "failed to create gateway request", http.StatusBadGateway)
-			return
-		}
-		req.ContentLength = int64(len(bodyBytes))
-
-		copyHeader(req.Header, r.Header, []string{"Content-Type", "Accept"})
-		req.Header.Del("Authorization")
-
-		lp := map[string]any{
-			"request":         `{"run":"` + transcodeCapability + `"}`,
-			"parameters":      `{"orchestrators":{"include":[],"exclude":[]}}`,
-			"capability":      transcodeCapability,
-			"timeout_seconds": transcodeTimeoutSeconds,
-		}
-
-		b, _ := json.Marshal(lp)
-		req.Header.Set("Livepeer", base64.StdEncoding.EncodeToString(b))
-		log.Printf("transcode request to gateway: url=%s content_len=%d", transcodeTarget, len(bodyBytes))
-
-		resp, err := client.Do(req)
-		if err != nil {
-			http.Error(w, "gateway request failed: "+err.Error(), http.StatusBadGateway)
-			return
-		}
-		defer resp.Body.Close()
-
-		copyAllHeaders(w.Header(), resp.Header)
-		w.Header().Set("Content-Type", "application/json")
-		w.Header().Del("Livepeer-Balance")
-		w.Header().Del("X-Metadata")
-		w.Header().Del("X-Orchestrator-Url")
-		w.WriteHeader(resp.StatusCode)
-
-		io.Copy(w, resp.Body)
-	})
-
-	// Video transcode status endpoint — poll job progress
-	mux.HandleFunc("/v1/video/transcode/status", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
-
-		ctx := r.Context()
-		ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
-		defer cancel()
-
-		const maxBody = 1 << 20
-		bodyBytes, err := io.ReadAll(io.LimitReader(r.Body, maxBody))
-		if err != nil {
-			http.Error(w, "failed to read request body", http.StatusBadRequest)
-			return
-		}
-		_ = r.Body.Close()
-
-		req, err := http.NewRequestWithContext(ctx, http.MethodPost, transcodeStatusTarget, bytes.NewReader(bodyBytes))
-		if err != nil {
-			http.Error(w, "failed to create gateway request", http.StatusBadGateway)
-			return
-		}
-		req.ContentLength = int64(len(bodyBytes))
-
-		copyHeader(req.Header, r.Header, []string{"Content-Type", "Accept"})
-		req.Header.Del("Authorization")
-
-		lp := map[string]any{
-			"request":         `{"run":"` + transcodeCapability + `"}`,
-			"parameters":      `{"orchestrators":{"include":[],"exclude":[]}}`,
-			"capability":      transcodeCapability,
-			"timeout_seconds": 30,
-		}
-
-		b, _ := json.Marshal(lp)
-		req.Header.Set("Livepeer", base64.StdEncoding.EncodeToString(b))
-
-		resp, err := client.Do(req)
-		if err != nil {
-			http.Error(w, "gateway request failed: "+err.Error(), http.StatusBadGateway)
-			return
-		}
-		defer resp.Body.Close()
-
-		copyAllHeaders(w.Header(), resp.Header)
-		w.Header().Set("Content-Type", "application/json")
-		w.Header().Del("Livepeer-Balance")
-		w.Header().Del("X-Metadata")
-		w.Header().Del("X-Orchestrator-Url")
-		w.WriteHeader(resp.StatusCode)
-
-		io.Copy(w, resp.Body)
-	})
-
-	// Video transcode presets endpoint — list available presets
-	mux.HandleFunc("/v1/video/transcode/presets", func(w http.ResponseWriter, r *http.Request) {
-		ctx := r.Context()
-		ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
-		defer cancel()
-
-		req, err := http.NewRequestWithContext(ctx, r.Method, transcodePresetsTarget, nil)
-		if err != nil {
-			http.Error(w, "failed to create gateway request", http.StatusBadGateway)
-			return
-		}
-
-		copyHeader(req.Header, r.Header, []string{"Content-Type", "Accept"})
-		req.Header.Del("Authorization")
-
-		lp := map[string]any{
-			"request":         `{"run":"` + transcodeCapability + `"}`,
-			"parameters":      `{"orchestrators":{"include":[],"exclude":[]}}`,
-			"capability":      transcodeCapability,
-			"timeout_seconds": 30,
-		}
-
-		b, _ := json.Marshal(lp)
-		req.Header.Set("Livepeer", base64.StdEncoding.EncodeToString(b))
-
-		resp, err := client.Do(req)
-		if err != nil {
-			http.Error(w, "gateway request failed: "+err.Error(), http.StatusBadGateway)
-			return
-		}
-		defer resp.Body.Close()
-
-		copyAllHeaders(w.Header(), resp.Header)
-		w.Header().Set("Content-Type", "application/json")
-		w.Header().Del("Livepeer-Balance")
-		w.Header().Del("X-Metadata")
-		w.Header().Del("X-Orchestrator-Url")
-		w.WriteHeader(resp.StatusCode)
-
-		io.Copy(w, resp.Body)
-	})
-
-	// ABR transcode submit endpoint — starts async ABR job
-	mux.HandleFunc("/v1/video/transcode/abr", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
-
-		ctx := r.Context()
-		ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
-		defer cancel()
-
-		const maxBody = 5 << 20 // 5MB
-		bodyBytes, err := io.ReadAll(io.LimitReader(r.Body, maxBody))
-		if err != nil {
-			http.Error(w, "failed to read request body", http.StatusBadRequest)
-			return
-		}
-		_ = r.Body.Close()
-
-		req, err := http.NewRequestWithContext(ctx, http.MethodPost, abrTarget, bytes.NewReader(bodyBytes))
-		if err != nil {
-			http.Error(w, "failed to create gateway request", http.StatusBadGateway)
-			return
-		}
-		req.ContentLength = int64(len(bodyBytes))
-
-		copyHeader(req.Header, r.Header, []string{"Content-Type", "Accept"})
-		req.Header.Del("Authorization")
-
-		lp := map[string]any{
-			"request":         `{"run":"` + abrCapability + `"}`,
-			"parameters":      `{"orchestrators":{"include":[],"exclude":[]}}`,
-			"capability":      abrCapability,
-			"timeout_seconds": abrTimeoutSeconds,
-		}
-
-		b, _ := json.Marshal(lp)
-		req.Header.Set("Livepeer", base64.StdEncoding.EncodeToString(b))
-		log.Printf("ABR transcode request to gateway: url=%s content_len=%d", abrTarget, len(bodyBytes))
-
-		resp, err := client.Do(req)
-		if err != nil {
-			http.Error(w, "gateway request failed: "+err.Error(), http.StatusBadGateway)
-			return
-		}
-		defer resp.Body.Close()
-
-		copyAllHeaders(w.Header(), resp.Header)
-		w.Header().Set("Content-Type", "application/json")
-		w.Header().Del("Livepeer-Balance")
-		w.Header().Del("X-Metadata")
-		w.Header().Del("X-Orchestrator-Url")
-		w.WriteHeader(resp.StatusCode)
-
-		io.Copy(w, resp.Body)
-	})
-
-	// ABR transcode status endpoint — poll per-rendition progress
-	mux.HandleFunc("/v1/video/transcode/abr/status", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
-
-		ctx := r.Context()
-		ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
-		defer cancel()
-
-		const maxBody = 1 << 20
-		bodyBytes, err := io.ReadAll(io.LimitReader(r.Body, maxBody))
-		if err != nil {
-			http.Error(w, "failed to read request body", http.StatusBadRequest)
-			return
-		}
-		_ = r.Body.Close()
-
-		req, err := http.NewRequestWithContext(ctx, http.MethodPost, abrStatusTarget, bytes.NewReader(bodyBytes))
-		if err != nil {
-			http.Error(w, "failed to create gateway request", http.StatusBadGateway)
-			return
-		}
-		req.ContentLength = int64(len(bodyBytes))
-
-		copyHeader(req.Header, r.Header, []string{"Content-Type", "Accept"})
-		req.Header.Del("Authorization")
-
-		lp := map[string]any{
-			"request":         `{"run":"` + abrCapability + `"}`,
-			"parameters":      `{"orchestrators":{"include":[],"exclude":[]}}`,
-			"capability":      abrCapability,
-			"timeout_seconds": 30,
-		}
-
-		b, _ := json.Marshal(lp)
-		req.Header.Set("Livepeer", base64.StdEncoding.EncodeToString(b))
-
-		resp, err := client.Do(req)
-		if err != nil {
-			http.Error(w, "gateway request failed: "+err.Error(), http.StatusBadGateway)
-			return
-		}
-		defer resp.Body.Close()
 
-		copyAllHeaders(w.Header(), resp.Header)
-		w.Header().Set("Content-Type", "application/json")
-		w.Header().Del("Livepeer-Balance")
-		w.Header().Del("X-Metadata")
-		w.Header().Del("X-Orchestrator-Url")
-		w.WriteHeader(resp.StatusCode)
-
-		io.Copy(w, resp.Body)
-	})
-
-	// ── Live Transcode (Stream Model) ──────────────────────────────────────
-	// Live transcode uses /process/stream/... (Stream Model) instead of /process/request/...
-	liveStreamStartTarget := strings.TrimRight(gatewayURL, "/") + "/process/stream/start"
-
-	// Live transcode start — starts a live stream session
-	mux.HandleFunc("/v1/video/transcode/live/start", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
-
-		ctx := r.Context()
-		ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
-		defer cancel()
-
-		const maxBody = 1 << 20
-		bodyBytes, err := io.ReadAll(io.LimitReader(r.Body, maxBody))
-		if err != nil {
-			http.Error(w, "failed to read request body", http.StatusBadRequest)
-			return
-		}
-		_ = r.Body.Close()
-
-		req, err := http.NewRequestWithContext(ctx, http.MethodPost, liveStreamStartTarget, bytes.NewReader(bodyBytes))
-		if err != nil {
-			http.Error(w, "failed to create gateway request", http.StatusBadGateway)
-			return
-		}
-		req.ContentLength = int64(len(bodyBytes))
-
-		copyHeader(req.Header, r.Header, []string{"Content-Type", "Accept"})
-		req.Header.Del("Authorization")
-
-		lp := map[string]any{
-			"request":    `{"run":"` + liveTranscodeCapability + `"}`,
-			"parameters": `{"enable_video_ingress":true,"enable_video_egress":true,"orchestrators":{"include":[],"exclude":[]}}`,
-			"capability": liveTranscodeCapability,
-		}
-		if liveTranscodeTimeoutSeconds > 0 {
-			lp["timeout_seconds"] = liveTranscodeTimeoutSeconds
-		}
-
-		b, _ := json.Marshal(lp)
-		req.Header.Set("Livepeer", base64.StdEncoding.EncodeToString(b))
-		log.Printf("live transcode start request to gateway: url=%s content_len=%d", liveStreamStartTarget, len(bodyBytes))
-
-		resp, err := client.Do(req)
-		if err != nil {
-			http.Error(w, "gateway request failed: "+err.Error(), http.StatusBadGateway)
-			return
-		}
-		defer resp.Body.Close()
-
-		copyAllHeaders(w.Header(), resp.Header)
-		w.Header().Set("Content-Type", "application/json")
-		w.Header().Del("Livepeer-Balance")
-		w.Header().Del("X-Metadata")
-		w.Header().Del("X-Orchestrator-Url")
-		w.WriteHeader(resp.StatusCode)
-
-		io.Copy(w, resp.Body)
-	})
-
-	// Live transcode stop — stop a live stream
-	mux.HandleFunc("/v1/video/transcode/live/stop", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
-
-		ctx := r.Context()
-		ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
-		defer cancel()
-
-		const maxBody = 1 << 20
-		bodyBytes, err := io.ReadAll(io.LimitReader(r.Body, maxBody))
-		if err != nil {
-			http.Error(w, "failed to read request body", http.StatusBadRequest)
-			return
-		}
-		_ = r.Body.Close()
-
-		// Extract stream_id from body to build gateway URL
-		var stopReq struct {
-			StreamID string `json:"stream_id"`
-		}
-		json.Unmarshal(bodyBytes, &stopReq)
-		if stopReq.StreamID == "" {
-			http.Error(w, `{"error":"stream_id is required"}`, http.StatusBadRequest)
-			return
-		}
-
-		stopTarget := strings.TrimRight(gatewayURL, "/") + "/process/stream/" + stopReq.StreamID + "/stop"
-
-		req, err := http.NewRequestWithContext(ctx, http.MethodPost, stopTarget, bytes.NewReader(bodyBytes))
-		if err != nil {
-			http.Error(w, "failed to create gateway request", http.StatusBadGateway)
-			return
-		}
-		req.ContentLength = int64(len(bodyBytes))
-
-		copyHeader(req.Header, r.Header, []string{"Content-Type", "Accept"})
-		req.Header.Del("Authorization")
-
-		lp := map[string]any{
-			"request":    `{"run":"` + liveTranscodeCapability + `"}`,
-			"parameters": `{"orchestrators":{"include":[],"exclude":[]}}`,
-			"capability": liveTranscodeCapability,
-		}
-		b, _ := json.Marshal(lp)
-		req.Header.Set("Livepeer", base64.StdEncoding.EncodeToString(b))
-
-		resp, err := client.Do(req)
-		if err != nil {
-			http.Error(w, "gateway request failed: "+err.Error(), http.StatusBadGateway)
-			return
-		}
-		defer resp.Body.Close()
+	for _, g := range cfg.Gateways {
+		slog.Info("gateway", "url", g.URL, "weight", max(g.Weight, 1))
+	}
+	slog.Info("forwarding client headers", "headers", cfg.ForwardedHeaders())
+	for _, rt := range routes {
+		slog.Info("route", "path", rt.Path, "gateway_path", rt.GatewayPath, "capability", rt.Capability, "timeout_seconds", rt.TimeoutSeconds)
+	}
 
-		copyAllHeaders(w.Header(), resp.Header)
-		w.Header().Set("Content-Type", "application/json")
-		w.Header().Del("Livepeer-Balance")
-		w.Header().Del("X-Metadata")
-		w.Header().Del("X-Orchestrator-Url")
-		w.WriteHeader(resp.StatusCode)
+	if s.basePath != "" && !strings.HasPrefix(s.basePath, "/") {
+		fatal("invalid config", fmt.Errorf("BASE_PATH must start with /, not %q", s.basePath))
+	}
 
-		io.Copy(w, resp.Body)
-	})
+	p := proxy.New(cfg)
+	var handler http.Handler = newMux(p, metricsAddr == "" && s.enableMetrics)
+	if s.basePath != "" {
+		slog.Info("serving under base path", "base_path", s.basePath)
+		handler = withBasePath(handler, s.basePath)
+	}
+	if adminAddr != "" {
+		serveAside("admin", adminAddr, p.AdminHandler())
+	} else {
+		slog.Info("admin endpoints disabled, set ADMIN_ADDR to serve them")
+	}
+	if metricsAddr != "" {
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("/metrics", promhttp.Handler())
+		serveAside("metrics", metricsAddr, metricsMux)
+	}
+	if s.healthAddr != "" {
+		healthMux := http.NewServeMux()
+		healthMux.Handle("/healthz", p)
+		healthMux.Handle("/readyz", p)
+		serveAside("health", s.healthAddr, healthMux)
+	}
 
-	// Live transcode update — update stream params mid-stream
-	mux.HandleFunc("/v1/video/transcode/live/update", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	errc := make(chan error, 1)
+	if s.tlsCertFile != "" || s.tlsKeyFile != "" || s.tlsCertDir != "" {
+		switch {
+		case s.tlsCertDir != "" && (s.tlsCertFile != "" || s.tlsKeyFile != ""):
+			fatal("invalid config", errors.New("set either TLS_CERT_DIR or TLS_CERT_FILE and TLS_KEY_FILE"))
+		case s.tlsCertDir == "" && (s.tlsCertFile == "" || s.tlsKeyFile == ""):
+			fatal("invalid config", errors.New("TLS_CERT_FILE and TLS_KEY_FILE must be set together"))
+		}
+		minVersion, ok := tlsVersions[s.tlsMinVersion]
+		if !ok {
+			fatal("invalid config", fmt.Errorf("TLS_MIN_VERSION must be 1.2 or 1.3, not %q", s.tlsMinVersion))
+		}
+		certs, err := newCertReloader(s.tlsCertFile, s.tlsKeyFile, s.tlsCertDir)
+		if err != nil {
+			fatal("failed to load TLS certificate", err)
+		}
+		if s.tlsReloadInterval > 0 {
+			go certs.watch(s.tlsReloadInterval)
+		}
+		// ServeTLS adds HTTP/2 to the negotiated protocols.
+		srv.TLSConfig = &tls.Config{GetCertificate: certs.getCertificate, MinVersion: minVersion}
+		slog.Info("OpenAI proxy listening", "addr", addr, "gateway", cfg.GatewayURL, "tls", true)
+		go func() { errc <- srv.ListenAndServeTLS("", "") }()
+	} else {
+		slog.Info("OpenAI proxy listening", "addr", addr, "gateway", cfg.GatewayURL)
+		go func() { errc <- srv.ListenAndServe() }()
+	}
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for {
+		select {
+		case err := <-errc:
+			fatal("server failed", err)
+		case <-hup:
+			// Reload logs its outcome.
+			_, _ = p.Reload()
+		case sig := <-stop:
+			shutdown(srv, p, sig, s.shutdownDelay, s.shutdownGrace)
 			return
 		}
+	}
+}
 
-		ctx := r.Context()
-		ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+// shutdown fails the health checks, waits delay for load balancers to
+// notice, then stops accepting connections and gives in-flight requests
+// grace to finish. Streams still running after that are ended with an
+// error event and [DONE].
+func shutdown(srv *http.Server, p *proxy.Proxy, sig os.Signal, delay, grace time.Duration) {
+	slog.Info("shutting down", "signal", sig.String(), "delay", delay.String(), "grace", grace.String())
+	p.Drain()
+	time.Sleep(delay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		slog.Warn("grace period over, closing remaining streams", "error", err)
+		p.CloseStreams()
+		// Leave the handlers a moment to write their final events.
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 		defer cancel()
-
-		const maxBody = 1 << 20
-		bodyBytes, err := io.ReadAll(io.LimitReader(r.Body, maxBody))
-		if err != nil {
-			http.Error(w, "failed to read request body", http.StatusBadRequest)
-			return
+		if err := srv.Shutdown(ctx); err != nil {
+			_ = srv.Close()
 		}
-		_ = r.Body.Close()
-
-		var updateReq struct {
-			StreamID string `json:"stream_id"`
-		}
-		json.Unmarshal(bodyBytes, &updateReq)
-		if updateReq.StreamID == "" {
-			http.Error(w, `{"error":"stream_id is required"}`, http.StatusBadRequest)
-			return
-		}
-
-		updateTarget := strings.TrimRight(gatewayURL, "/") + "/process/stream/" + updateReq.StreamID + "/update"
-
-		req, err := http.NewRequestWithContext(ctx, http.MethodPost, updateTarget, bytes.NewReader(bodyBytes))
-		if err != nil {
-			http.Error(w, "failed to create gateway request", http.StatusBadGateway)
-			return
-		}
-		req.ContentLength = int64(len(bodyBytes))
-
-		copyHeader(req.Header, r.Header, []string{"Content-Type", "Accept"})
-		req.Header.Del("Authorization")
-
-		lp := map[string]any{
-			"request":    `{"run":"` + liveTranscodeCapability + `"}`,
-			"parameters": `{"orchestrators":{"include":[],"exclude":[]}}`,
-			"capability": liveTranscodeCapability,
-		}
-		b, _ := json.Marshal(lp)
-		req.Header.Set("Livepeer", base64.StdEncoding.EncodeToString(b))
-
-		resp, err := client.Do(req)
-		if err != nil {
-			http.Error(w, "gateway request failed: "+err.Error(), http.StatusBadGateway)
-			return
-		}
-		defer resp.Body.Close()
-
-		copyAllHeaders(w.Header(), resp.Header)
-		w.Header().Set("Content-Type", "application/json")
-		w.Header().Del("Livepeer-Balance")
-		w.Header().Del("X-Metadata")
-		w.Header().Del("X-Orchestrator-Url")
-		w.WriteHeader(resp.StatusCode)
-
-		io.Copy(w, resp.Body)
-	})
-
-	// Live transcode status — get stream status
-	mux.HandleFunc("/v1/video/transcode/live/status", func(w http.ResponseWriter, r *http.Request) {
-		ctx := r.Context()
-		ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
-		defer cancel()
-
-		const maxBody = 1 << 20
-		bodyBytes, err := io.ReadAll(io.LimitReader(r.Body, maxBody))
-		if err != nil {
-			http.Error(w, "failed to read request body", http.StatusBadRequest)
-			return
-		}
-		_ = r.Body.Close()
-
-		var statusReq struct {
-			StreamID string `json:"stream_id"`
-		}
-		json.Unmarshal(bodyBytes, &statusReq)
-		if statusReq.StreamID == "" {
-			http.Error(w, `{"error":"stream_id is required"}`, http.StatusBadRequest)
-			return
-		}
-
-		statusTarget := strings.TrimRight(gatewayURL, "/") + "/process/stream/" + statusReq.StreamID + "/status"
-
-		req, err := http.NewRequestWithContext(ctx, r.Method, statusTarget, bytes.NewReader(bodyBytes))
-		if err != nil {
-			http.Error(w, "failed to create gateway request", http.StatusBadGateway)
-			return
-		}
-		if len(bodyBytes) > 0 {
-			req.ContentLength = int64(len(bodyBytes))
-		}
-
-		copyHeader(req.Header, r.Header, []string{"Content-Type", "Accept"})
-		req.Header.Del("Authorization")
+	}
+	p.Close()
+	slog.Info("shutdown complete")
+}
 
-		lp := map[string]any{
-			"request":    `{"run":"` + liveTranscodeCapability + `"}`,
-			"parameters": `{"orchestrators":{"include":[],"exclude":[]}}`,
-			"capability": liveTranscodeCapability,
-		}
-		b, _ := json.Marshal(lp)
-		req.Header.Set("Livepeer", base64.StdEncoding.EncodeToString(b))
+// newMux returns the API mux for p, with the metrics endpoint mounted on
+// it when it is not served on its own listener. The unauthenticated admin
+// endpoints are only served on ADMIN_ADDR. It binds no ports, so it can be
+// driven with httptest.
+func newMux(p *proxy.Proxy, metrics bool) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/", p)
+	if metrics {
+		mux.Handle("/metrics", promhttp.Handler())
+	}
+	return mux
+}
 
-		resp, err := client.Do(req)
-		if err != nil {
-			http.Error(w, "gateway request failed: "+err.Error(), http.StatusBadGateway)
+// withBasePath serves requests under basePath as if it weren't there, for
+// ingresses that forward e.g. /ai/v1/... without stripping /ai. Other
+// paths, such as health probes, are served unchanged.
+func withBasePath(h http.Handler, basePath string) http.Handler {
+	strip := http.StripPrefix(basePath, h)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, basePath+"/") {
+			strip.ServeHTTP(w, r)
 			return
 		}
-		defer resp.Body.Close()
-
-		copyAllHeaders(w.Header(), resp.Header)
-		w.Header().Set("Content-Type", "application/json")
-		w.Header().Del("Livepeer-Balance")
-		w.Header().Del("X-Metadata")
-		w.Header().Del("X-Orchestrator-Url")
-		w.WriteHeader(resp.StatusCode)
-
-		io.Copy(w, resp.Body)
+		h.ServeHTTP(w, r)
 	})
+}
 
-	// ABR transcode presets endpoint — list available ABR presets
-	mux.HandleFunc("/v1/video/transcode/abr/presets", func(w http.ResponseWriter, r *http.Request) {
-		ctx := r.Context()
-		ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
-		defer cancel()
-
-		req, err := http.NewRequestWithContext(ctx, r.Method, abrPresetsTarget, nil)
-		if err != nil {
-			http.Error(w, "failed to create gateway request", http.StatusBadGateway)
-			return
-		}
-
-		copyHeader(req.Header, r.Header, []string{"Content-Type", "Accept"})
-		req.Header.Del("Authorization")
-
-		lp := map[string]any{
-			"request":         `{"run":"` + abrCapability + `"}`,
-			"parameters":      `{"orchestrators":{"include":[],"exclude":[]}}`,
-			"capability":      abrCapability,
-			"timeout_seconds": 30,
-		}
-
-		b, _ := json.Marshal(lp)
-		req.Header.Set("Livepeer", base64.StdEncoding.EncodeToString(b))
-
-		resp, err := client.Do(req)
-		if err != nil {
-			http.Error(w, "gateway request failed: "+err.Error(), http.StatusBadGateway)
-			return
-		}
-		defer resp.Body.Close()
-
-		copyAllHeaders(w.Header(), resp.Header)
-		w.Header().Set("Content-Type", "application/json")
-		w.Header().Del("Livepeer-Balance")
-		w.Header().Del("X-Metadata")
-		w.Header().Del("X-Orchestrator-Url")
-		w.WriteHeader(resp.StatusCode)
+// serveAside serves h on its own listener at addr, for endpoints that
+// should not be exposed with the API.
+func serveAside(name, addr string, h http.Handler) {
+	go func() {
+		slog.Info(name+" listening", "addr", addr)
+		srv := &http.Server{Addr: addr, Handler: h, ReadHeaderTimeout: 10 * time.Second}
+		fatal(name+" server failed", srv.ListenAndServe())
+	}()
+}
 
-		io.Copy(w, resp.Body)
-	})
+// setupLogging installs the default slog logger with the given level
+// (debug/info/warn/error) and format (json/text; clf logs as json).
+func setupLogging(levelName, format string) {
+	var level slog.Level
+	levelErr := level.UnmarshalText([]byte(levelName))
+	opts := &slog.HandlerOptions{Level: level}
+
+	var h slog.Handler
+	switch strings.ToLower(format) {
+	case "text":
+		h = slog.NewTextHandler(os.Stderr, opts)
+	default:
+		h = slog.NewJSONHandler(os.Stderr, opts)
+	}
+	slog.SetDefault(slog.New(h))
+	if levelErr != nil {
+		slog.Warn("invalid LOG_LEVEL, using info", "error", levelErr)
+	}
+}
 
-	// Models endpoint — fetches from api.blueclaw.network and reshapes to OpenAI format
-	mux.HandleFunc("/v1/models", func(w http.ResponseWriter, r *http.Request) {
-		ctx := r.Context()
-		ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
-		defer cancel()
+// setupTracing installs an OTLP/HTTP trace exporter when an OTLP endpoint
+// is configured through the standard OTEL_* env vars. Otherwise the global
+// no-op tracer stays in place.
+func setupTracing() {
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return
+	}
+	if envBool("OTEL_SDK_DISABLED", false) || os.Getenv("OTEL_TRACES_EXPORTER") == "none" {
+		return
+	}
+	exporter, err := otlptracehttp.New(context.Background())
+	if err != nil {
+		fatal("failed to create OTLP trace exporter", err)
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(attribute.String("service.name", env("OTEL_SERVICE_NAME", "openai-gateway-proxy"))))
+	if err != nil {
+		res = resource.Default()
+	}
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	))
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	slog.Info("OpenTelemetry tracing enabled")
+}
 
-		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://api.blueclaw.network/v1/models", nil)
-		if err != nil {
-			http.Error(w, "failed to create models request", http.StatusInternalServerError)
-			return
-		}
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
 
-		resp, err := client.Do(req)
-		if err != nil {
-			http.Error(w, "models request failed: "+err.Error(), http.StatusBadGateway)
-			return
-		}
-		defer resp.Body.Close()
+// defaultRoutes returns the built-in route table, configured from the
+// capability and timeout env vars.
+func defaultRoutes() []proxy.Route {
+	capability := env("CHAT_COMPLETIONS_CAPABILITY", "openai-chat-completions")
+	completionsCapability := env("TEXT_COMPLETIONS_CAPABILITY", "openai-text-completions")
+	imageCapability := env("IMAGE_GENERATION_CAPABILITY", "openai-image-generation")
+	embeddingsCapability := env("TEXT_EMBEDDINGS_CAPABILITY", "openai-text-embeddings")
+	rerankCapability := env("RERANK_CAPABILITY", "cohere-rerank")
+	videoGenerationCapability := env("VIDEO_GENERATION_CAPABILITY", "video-generation")
+	transcodeCapability := env("BYOC_TRANSCODE_CAPABILITY", "video-transcode")
+	abrCapability := env("BYOC_ABR_CAPABILITY", "transcode-abr")
+	transcriptionCapability := env("AUDIO_TRANSCRIPTION_CAPABILITY", "openai-audio-transcription")
+	speechCapability := env("TEXT_TO_SPEECH_CAPABILITY", "openai-text-to-speech")
+	timeoutSeconds := envInt("CHAT_COMPLETIONS_TIMEOUT_SECONDS", 120)
+	completionsTimeoutSeconds := envInt("TEXT_COMPLETIONS_TIMEOUT_SECONDS", 120)
+	imageTimeoutSeconds := envInt("IMAGE_GENERATION_TIMEOUT_SECONDS", 120)
+	embeddingsTimeoutSeconds := envInt("TEXT_EMBEDDINGS_TIMEOUT_SECONDS", 30)
+	rerankTimeoutSeconds := envInt("RERANK_TIMEOUT_SECONDS", 30)
+	videoPipelineTimeoutSeconds := envInt("VIDEO_GENERATION_TIMEOUT_SECONDS", 900)
+	transcodeTimeoutSeconds := envInt("TRANSCODE_TIMEOUT_SECONDS", 900)
+	abrTimeoutSeconds := envInt("ABR_TIMEOUT_SECONDS", 1800)
+	transcriptionTimeoutSeconds := envInt("AUDIO_TRANSCRIPTION_TIMEOUT_SECONDS", 300)
+	speechTimeoutSeconds := envInt("TEXT_TO_SPEECH_TIMEOUT_SECONDS", 120)
+	chatConcurrency := envInt("CHAT_MAX_CONCURRENCY", 0)
+	completionsConcurrency := envInt("TEXT_COMPLETIONS_MAX_CONCURRENCY", 0)
+	imageConcurrency := envInt("IMAGE_GENERATION_MAX_CONCURRENCY", 0)
+	embeddingsConcurrency := envInt("TEXT_EMBEDDINGS_MAX_CONCURRENCY", 0)
+	rerankConcurrency := envInt("RERANK_MAX_CONCURRENCY", 0)
+	videoGenerationConcurrency := envInt("VIDEO_GENERATION_MAX_CONCURRENCY", 0)
+	transcodeConcurrency := envInt("TRANSCODE_MAX_CONCURRENCY", 0)
+	abrConcurrency := envInt("ABR_MAX_CONCURRENCY", 0)
+	transcriptionConcurrency := envInt("AUDIO_TRANSCRIPTION_MAX_CONCURRENCY", 0)
+	speechConcurrency := envInt("TEXT_TO_SPEECH_MAX_CONCURRENCY", 0)
+
+	return []proxy.Route{
+		{Path: "/v1/chat/completions", Capability: capability, TimeoutSeconds: timeoutSeconds, MaxBodyBytes: 5 << 20, Mode: proxy.ModeSSE, MaxConcurrency: chatConcurrency, TrackUsage: true, ModelRouting: true},
+		// Legacy completions stream the same way as chat; their chunks
+		// also carry "choices", so the SSE filter applies unchanged.
+		{Path: "/v1/completions", GatewayPath: env("TEXT_COMPLETIONS_GATEWAY_PATH", ""), Capability: completionsCapability, TimeoutSeconds: completionsTimeoutSeconds, MaxBodyBytes: 5 << 20, Mode: proxy.ModeSSE, MaxConcurrency: completionsConcurrency, TrackUsage: true, ModelRouting: true},
+		{Path: "/v1/images/generations", Capability: imageCapability, TimeoutSeconds: imageTimeoutSeconds, MaxBodyBytes: 1 << 20, MaxConcurrency: imageConcurrency, ModelRouting: true, NormalizeImageFormat: envBool("IMAGE_NORMALIZE_RESPONSE_FORMAT", false), ImageSizes: envList("IMAGE_ALLOWED_SIZES"), DefaultImageSize: env("IMAGE_DEFAULT_SIZE", "")},
+		{Path: "/v1/embeddings", Capability: embeddingsCapability, TimeoutSeconds: embeddingsTimeoutSeconds, MaxBodyBytes: 1 << 20, MaxConcurrency: embeddingsConcurrency, NoStream: true, TrackUsage: true, ModelRouting: true, HedgeAfterMS: envInt("EMBEDDINGS_HEDGE_AFTER_MS", 0)},
+		{Path: "/v1/rerank", Capability: rerankCapability, TimeoutSeconds: rerankTimeoutSeconds, MaxBodyBytes: 1 << 20, MaxConcurrency: rerankConcurrency, NoStream: true},
+
+		// Audio uploads are multipart/form-data; the response format
+		// (json, text, srt, vtt) is chosen by the client, so keep the
+		// upstream Content-Type.
+		{Path: "/v1/audio/transcriptions", Capability: transcriptionCapability, TimeoutSeconds: transcriptionTimeoutSeconds, MaxBodyBytes: 25 << 20, Mode: proxy.ModeStream, Multipart: true, MaxConcurrency: transcriptionConcurrency},
+		// Speech comes back as binary audio (audio/mpeg, audio/wav, ...),
+		// streamed through with the gateway's Content-Type.
+		{Path: "/v1/audio/speech", Capability: speechCapability, TimeoutSeconds: speechTimeoutSeconds, MaxBodyBytes: 1 << 20, Mode: proxy.ModeStream, MaxConcurrency: speechConcurrency},
+
+		// Async job submits return a job ID immediately, so the request
+		// itself gets a short deadline while the job keeps the long one.
+		{Path: "/v1/video/generations", Capability: videoGenerationCapability, TimeoutSeconds: videoPipelineTimeoutSeconds, RequestTimeoutSeconds: 30, MaxBodyBytes: 1 << 20, JobStatusPath: "/v1/video/generations/status", MaxConcurrency: videoGenerationConcurrency},
+		{Path: "/v1/video/generations/status", Capability: videoGenerationCapability, TimeoutSeconds: 30, MaxBodyBytes: 1 << 20},
+		{Path: "/v1/video/transcode", Capability: transcodeCapability, TimeoutSeconds: transcodeTimeoutSeconds, RequestTimeoutSeconds: 30, MaxBodyBytes: 5 << 20, MaxConcurrency: transcodeConcurrency},
+		{Path: "/v1/video/transcode/status", Capability: transcodeCapability, TimeoutSeconds: 30, MaxBodyBytes: 1 << 20},
+		{Path: "/v1/video/transcode/presets", Capability: transcodeCapability, TimeoutSeconds: 30, MaxBodyBytes: 1 << 20, Methods: []string{http.MethodGet, http.MethodPost}},
+		{Path: "/v1/video/transcode/abr", Capability: abrCapability, TimeoutSeconds: abrTimeoutSeconds, RequestTimeoutSeconds: 30, MaxBodyBytes: 5 << 20, MaxConcurrency: abrConcurrency},
+		{Path: "/v1/video/transcode/abr/status", Capability: abrCapability, TimeoutSeconds: 30, MaxBodyBytes: 1 << 20},
+		{Path: "/v1/video/transcode/abr/presets", Capability: abrCapability, TimeoutSeconds: 30, MaxBodyBytes: 1 << 20, Methods: []string{http.MethodGet, http.MethodPost}},
+	}
+}
 
-		var blueclawModels []struct {
-			ModelID   string `json:"model_id"`
-			Provider  string `json:"provider"`
-			Active    bool   `json:"active"`
-			CreatedAt string `json:"created_at"`
-		}
-		if err := json.NewDecoder(resp.Body).Decode(&blueclawModels); err != nil {
-			http.Error(w, "failed to decode models response", http.StatusBadGateway)
-			return
-		}
+// routeEnv lists the env vars that configure each built-in route. Env vars
+// that are set explicitly override a config file entry for the same path.
+var routeEnv = []struct {
+	path                                         string
+	capability, timeout, maxConcurrency, maxBody string
+	// prefix names the <prefix>_ORCHESTRATOR_INCLUDE,
+	// <prefix>_ORCHESTRATOR_EXCLUDE and <prefix>_MAX_PRICE overrides.
+	prefix string
+}{
+	{"/v1/chat/completions", "CHAT_COMPLETIONS_CAPABILITY", "CHAT_COMPLETIONS_TIMEOUT_SECONDS", "CHAT_MAX_CONCURRENCY", "CHAT_MAX_BODY_BYTES", "CHAT"},
+	{"/v1/completions", "TEXT_COMPLETIONS_CAPABILITY", "TEXT_COMPLETIONS_TIMEOUT_SECONDS", "TEXT_COMPLETIONS_MAX_CONCURRENCY", "TEXT_COMPLETIONS_MAX_BODY_BYTES", "TEXT_COMPLETIONS"},
+	{"/v1/images/generations", "IMAGE_GENERATION_CAPABILITY", "IMAGE_GENERATION_TIMEOUT_SECONDS", "IMAGE_GENERATION_MAX_CONCURRENCY", "IMAGE_GENERATION_MAX_BODY_BYTES", "IMAGE_GENERATION"},
+	{"/v1/embeddings", "TEXT_EMBEDDINGS_CAPABILITY", "TEXT_EMBEDDINGS_TIMEOUT_SECONDS", "TEXT_EMBEDDINGS_MAX_CONCURRENCY", "TEXT_EMBEDDINGS_MAX_BODY_BYTES", "TEXT_EMBEDDINGS"},
+	{"/v1/rerank", "RERANK_CAPABILITY", "RERANK_TIMEOUT_SECONDS", "RERANK_MAX_CONCURRENCY", "RERANK_MAX_BODY_BYTES", "RERANK"},
+	{"/v1/audio/transcriptions", "AUDIO_TRANSCRIPTION_CAPABILITY", "AUDIO_TRANSCRIPTION_TIMEOUT_SECONDS", "AUDIO_TRANSCRIPTION_MAX_CONCURRENCY", "AUDIO_TRANSCRIPTION_MAX_BODY_BYTES", "AUDIO_TRANSCRIPTION"},
+	{"/v1/audio/speech", "TEXT_TO_SPEECH_CAPABILITY", "TEXT_TO_SPEECH_TIMEOUT_SECONDS", "TEXT_TO_SPEECH_MAX_CONCURRENCY", "TEXT_TO_SPEECH_MAX_BODY_BYTES", "TEXT_TO_SPEECH"},
+	{"/v1/video/generations", "VIDEO_GENERATION_CAPABILITY", "VIDEO_GENERATION_TIMEOUT_SECONDS", "VIDEO_GENERATION_MAX_CONCURRENCY", "VIDEO_GENERATION_MAX_BODY_BYTES", "VIDEO_GENERATION"},
+	{"/v1/video/generations/status", "VIDEO_GENERATION_CAPABILITY", "", "", "", "VIDEO_GENERATION"},
+	{"/v1/video/transcode", "BYOC_TRANSCODE_CAPABILITY", "TRANSCODE_TIMEOUT_SECONDS", "TRANSCODE_MAX_CONCURRENCY", "TRANSCODE_MAX_BODY_BYTES", "TRANSCODE"},
+	{"/v1/video/transcode/status", "BYOC_TRANSCODE_CAPABILITY", "", "", "", "TRANSCODE"},
+	{"/v1/video/transcode/presets", "BYOC_TRANSCODE_CAPABILITY", "", "", "", "TRANSCODE"},
+	{"/v1/video/transcode/abr", "BYOC_ABR_CAPABILITY", "ABR_TIMEOUT_SECONDS", "ABR_MAX_CONCURRENCY", "ABR_MAX_BODY_BYTES", "ABR"},
+	{"/v1/video/transcode/abr/status", "BYOC_ABR_CAPABILITY", "", "", "", "ABR"},
+	{"/v1/video/transcode/abr/presets", "BYOC_ABR_CAPABILITY", "", "", "", "ABR"},
+}
 
-		type openAIModel struct {
-			ID      string `json:"id"`
-			Object  string `json:"object"`
-			Created int64  `json:"created"`
-			OwnedBy string `json:"owned_by"`
-		}
-		data := make([]openAIModel, 0, len(blueclawModels))
-		for _, m := range blueclawModels {
-			if !m.Active {
+// applyRouteEnv applies explicitly set route env vars on top of routes, so
+// they keep working as overrides when a config file is in use. The
+// per-route orchestrator lists are only read here.
+func applyRouteEnv(routes []proxy.Route) {
+	for i := range routes {
+		for _, e := range routeEnv {
+			if e.path != routes[i].Path {
 				continue
 			}
-			var created int64
-			if t, err := time.Parse(time.RFC3339Nano, m.CreatedAt); err == nil {
-				created = t.Unix()
+			if v := env(e.capability, ""); v != "" {
+				routes[i].Capability = v
+			}
+			if e.timeout != "" && env(e.timeout, "") != "" {
+				routes[i].TimeoutSeconds = envInt(e.timeout, routes[i].TimeoutSeconds)
+			}
+			if e.maxConcurrency != "" && env(e.maxConcurrency, "") != "" {
+				routes[i].MaxConcurrency = envInt(e.maxConcurrency, routes[i].MaxConcurrency)
+			}
+			if e.maxBody != "" && env(e.maxBody, "") != "" {
+				routes[i].MaxBodyBytes = int64(envInt(e.maxBody, int(routes[i].MaxBodyBytes)))
+			}
+			if v := envList(e.prefix + "_ORCHESTRATOR_INCLUDE"); v != nil {
+				routes[i].OrchestratorInclude = v
+			}
+			if v := envList(e.prefix + "_ORCHESTRATOR_EXCLUDE"); v != nil {
+				routes[i].OrchestratorExclude = v
+			}
+			if v := env(e.prefix+"_MAX_PRICE", ""); v != "" {
+				routes[i].MaxPrice = v
 			}
-			data = append(data, openAIModel{
-				ID:      m.ModelID,
-				Object:  "model",
-				Created: created,
-				OwnedBy: m.Provider,
-			})
 		}
-
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]any{
-			"object": "list",
-			"data":   data,
-		})
-	})
-
-	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		_, _ = w.Write([]byte("ok"))
-	})
-
-	log.Printf("OpenAI proxy listening on %s, gateway=%s, llm_capability=%s, image_capability=%s, embeddings_capability=%s, rerank_capability=%s, video_generation_capability=%s", addr, gatewayURL, capability, imageCapability, embeddingsCapability, rerankCapability, videoGenerationCapability)
-	srv := &http.Server{
-		Addr:              addr,
-		Handler:           mux,
-		ReadHeaderTimeout: 10 * time.Second,
 	}
-	log.Fatal(srv.ListenAndServe())
 }
 
 func env(k, def string) string {
-	v := os.Getenv(k)
+	v := lookup(k, def, false)
 	if v == "" {
 		return def
 	}
 	return v
 }
 
+// envInt parses a non-negative integer env var. Unparseable or negative
+// values are logged and fall back to def.
 func envInt(k string, def int) int {
-	v := os.Getenv(k)
+	v := strings.TrimSpace(lookup(k, strconv.Itoa(def), false))
 	if v == "" {
 		return def
 	}
-	var n int
-	_, err := fmtSscanf(v, &n)
+	n, err := strconv.Atoi(v)
 	if err != nil {
+		slog.Warn("env var is not a valid integer, using default", "name", k, "value", v, "default", def)
+		return def
+	}
+	if n < 0 {
+		slog.Warn("env var must not be negative, using default", "name", k, "value", n, "default", def)
 		return def
 	}
 	return n
 }
 
-// tiny helper to avoid importing fmt just for Sscanf overhead in this snippet’s spirit
-func fmtSscanf(s string, out *int) (int, error) {
-	n := 0
-	for _, ch := range s {
-		if ch < '0' || ch > '9' {
-			return 0, io.ErrUnexpectedEOF
-		}
-		n = n*10 + int(ch-'0')
+func envFloat(k string, def float64) float64 {
+	v := strings.TrimSpace(lookup(k, strconv.FormatFloat(def, 'f', -1, 64), false))
+	if v == "" {
+		return def
 	}
-	*out = n
-	return 1, nil
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f < 0 {
+		slog.Warn("env var is not a valid non-negative number, using default", "name", k, "value", v, "default", def)
+		return def
+	}
+	return f
 }
 
-func copyHeader(dst http.Header, src http.Header, keys []string) {
-	for _, k := range keys {
-		if v := src.Get(k); v != "" {
-			dst.Set(k, v)
-		}
+func envBool(k string, def bool) bool {
+	switch strings.ToLower(strings.TrimSpace(lookup(k, strconv.FormatBool(def), true))) {
+	case "1", "true", "yes", "on":
+		return true
+	case "0", "false", "no", "off":
+		return false
 	}
+	return def
 }
 
-func copyAllHeaders(dst http.Header, src http.Header) {
-	for k, vv := range src {
-		if strings.EqualFold(k, "Connection") ||
-			strings.EqualFold(k, "Keep-Alive") ||
-			strings.EqualFold(k, "Proxy-Authenticate") ||
-			strings.EqualFold(k, "Proxy-Authorization") ||
-			strings.EqualFold(k, "TE") ||
-			strings.EqualFold(k, "Trailer") ||
-			strings.EqualFold(k, "Transfer-Encoding") ||
-			strings.EqualFold(k, "Upgrade") {
-			continue
-		}
-		for _, v := range vv {
-			dst.Add(k, v)
+// envList parses a comma-separated env var, dropping empty entries.
+func envList(k string) []string {
+	var out []string
+	for _, s := range strings.Split(lookup(k, "", false), ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			out = append(out, s)
 		}
 	}
+	return out
 }
 
-// streamSSEFiltered reads SSE events line-by-line and forwards only valid
-// OpenAI chat completion chunks. The Livepeer gateway injects non-standard
-// SSE events (e.g. `data: {"balance": ...}`) that lack the "choices" field.
-// OpenAI SDK clients try to parse every `data:` line as a completion chunk
-// and crash with "Cannot read properties of undefined (reading '0')" when
-// they encounter these events.
-func streamSSEFiltered(w http.ResponseWriter, body io.Reader) {
-	flusher, _ := w.(http.Flusher)
-	scanner := bufio.NewScanner(body)
-	// Increase buffer for large SSE lines (e.g. long reasoning tokens)
-	scanner.Buffer(make([]byte, 256*1024), 256*1024)
-
-	for scanner.Scan() {
-		line := scanner.Text()
-
-		// Pass through empty lines (SSE event separators)
-		if line == "" {
-			_, _ = w.Write([]byte("\n"))
-			if flusher != nil {
-				flusher.Flush()
-			}
-			continue
+// envJSONMap parses a JSON object of strings, exiting if it is malformed.
+func envJSONMap(k string) map[string]string {
+	out := map[string]string{}
+	if v := lookup(k, "", false); v != "" {
+		if err := json.Unmarshal([]byte(v), &out); err != nil {
+			fatal("invalid "+k, err)
 		}
+	}
+	return out
+}
 
-		// For "data:" lines, check if it's a valid OpenAI chunk
-		if strings.HasPrefix(line, "data: ") {
-			payload := strings.TrimPrefix(line, "data: ")
-
-			// Always pass through [DONE]
-			if payload == "[DONE]" {
-				_, _ = w.Write([]byte(line + "\n"))
-				if flusher != nil {
-					flusher.Flush()
-				}
-				continue
-			}
-
-			// Parse and check for "choices" field — if absent, it's a
-			// Livepeer-injected event (balance, metadata, etc.), skip it
-			var obj map[string]json.RawMessage
-			if err := json.Unmarshal([]byte(payload), &obj); err == nil {
-				if _, hasChoices := obj["choices"]; !hasChoices {
-					log.Printf("filtered non-OpenAI SSE event: %s", payload)
-					continue
-				}
+// envGateways parses a comma-separated list of gateway URLs, each
+// optionally followed by =weight (e.g. "http://gw1:9935=3,http://gw2:9935").
+// A suffix that isn't an integer is part of the URL, so query strings
+// survive; a URL ending in =<digits> needs an explicit weight.
+func envGateways(k string) []proxy.Gateway {
+	var out []proxy.Gateway
+	for _, v := range envList(k) {
+		g := proxy.Gateway{URL: v}
+		if i := strings.LastIndex(v, "="); i > 0 {
+			if weight, err := strconv.Atoi(v[i+1:]); err == nil {
+				g = proxy.Gateway{URL: v[:i], Weight: weight}
 			}
 		}
+		out = append(out, g)
+	}
+	return out
+}
 
-		// Forward the line as-is
-		_, _ = w.Write([]byte(line + "\n"))
-		if flusher != nil {
-			flusher.Flush()
+// envStringMap parses a comma-separated list of key=value pairs
+// (e.g. "video-upscale=1000,speech-to-text=200").
+func envStringMap(k string) map[string]string {
+	out := map[string]string{}
+	for _, kv := range envList(k) {
+		key, val, ok := strings.Cut(kv, "=")
+		if !ok {
+			slog.Warn("ignoring invalid env var entry", "name", k, "entry", kv)
+			continue
 		}
+		out[strings.TrimSpace(key)] = strings.TrimSpace(val)
 	}
+	return out
 }
 
-func streamResponse(w http.ResponseWriter, body io.Reader) {
-	flusher, _ := w.(http.Flusher)
-	buf := make([]byte, 32*1024)
-	for {
-		n, err := body.Read(buf)
-		if n > 0 {
-			_, _ = w.Write(buf[:n])
-			if flusher != nil {
-				flusher.Flush()
-			}
+// envListMap parses a comma-separated list of key=value pairs whose values
+// are |-separated lists (e.g. "my-capability=data|result").
+func envListMap(k string) map[string][]string {
+	out := map[string][]string{}
+	for key, v := range envStringMap(k) {
+		out[key] = strings.Split(v, "|")
+	}
+	return out
+}
+
+// envIntMap parses a comma-separated list of key=int pairs
+// (e.g. "video-upscale=600,speech-to-text=60"). Malformed or negative
+// entries are logged and skipped.
+func envIntMap(k string) map[string]int {
+	out := map[string]int{}
+	for _, kv := range envList(k) {
+		key, val, ok := strings.Cut(kv, "=")
+		if !ok {
+			continue
 		}
-		if err != nil {
-			return
+		n, err := strconv.Atoi(strings.TrimSpace(val))
+		if err != nil || n < 0 {
+			slog.Warn("ignoring invalid env var entry", "name", k, "entry", kv)
+			continue
 		}
+		out[strings.TrimSpace(key)] = n
 	}
+	return out
 }
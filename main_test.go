@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"openai_gateway_proxy/proxy"
+)
+
+func TestChatCompletionsThroughMux(t *testing.T) {
+	type gatewayRequest struct {
+		path          string
+		livepeer      string
+		authorization string
+	}
+	got := make(chan gatewayRequest, 1)
+	gw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got <- gatewayRequest{r.URL.Path, r.Header.Get("Livepeer"), r.Header.Get("Authorization")}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Livepeer-Balance", "1000")
+		w.Header().Set("X-Metadata", "{}")
+		w.Header().Set("X-Orchestrator-Url", "https://orch.example:8935")
+		io.WriteString(w, "data: {\"balance\":\"1000\"}\n\n"+
+			"data: {\"choices\":[{\"delta\":{\"content\":\"hel\"}}]}\n\n"+
+			"data: {\"balance\":\"990\"}\n\n"+
+			"data: {\"choices\":[{\"delta\":{\"content\":\"lo\"}}]}\n\n"+
+			"data: [DONE]\n\n")
+	}))
+	defer gw.Close()
+
+	p := proxy.New(proxy.Config{GatewayURL: gw.URL, Routes: defaultRoutes()})
+	srv := httptest.NewServer(newMux(p, false))
+	defer srv.Close()
+
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/v1/chat/completions",
+		strings.NewReader(`{"model":"m","stream":true,"messages":[{"role":"user","content":"hi"}]}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer sk-client")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d: %s", resp.StatusCode, body)
+	}
+
+	gr := <-got
+	if gr.path != "/process/request/v1/chat/completions" {
+		t.Errorf("gateway path %q", gr.path)
+	}
+	if gr.authorization != "" {
+		t.Errorf("gateway got Authorization %q", gr.authorization)
+	}
+	raw, err := base64.StdEncoding.DecodeString(gr.livepeer)
+	if err != nil {
+		t.Fatalf("Livepeer header %q: %v", gr.livepeer, err)
+	}
+	var header struct {
+		Request    string `json:"request"`
+		Capability string `json:"capability"`
+	}
+	if err := json.Unmarshal(raw, &header); err != nil {
+		t.Fatalf("Livepeer header %s: %v", raw, err)
+	}
+	if header.Capability != "openai-chat-completions" || header.Request != `{"run":"openai-chat-completions"}` {
+		t.Errorf("Livepeer header %s", raw)
+	}
+
+	for _, name := range []string{"Livepeer-Balance", "X-Metadata", "X-Orchestrator-Url"} {
+		if v := resp.Header.Get(name); v != "" {
+			t.Errorf("client got %s: %s", name, v)
+		}
+	}
+	want := "data: {\"choices\":[{\"delta\":{\"content\":\"hel\"}}]}\n\n" +
+		"data: {\"choices\":[{\"delta\":{\"content\":\"lo\"}}]}\n\n" +
+		"data: [DONE]\n\n"
+	if string(body) != want {
+		t.Errorf("body %q, want %q", body, want)
+	}
+}
+
+// livepeerHeaderJSON is the decoded Livepeer header the gateway should get
+// for a route.
+func livepeerHeaderJSON(capability string, timeoutSeconds int) string {
+	return fmt.Sprintf(`{"request":"{\"run\":\"%s\"}","parameters":"{\"orchestrators\":{\"include\":[],\"exclude\":[]}}","capability":"%s","timeout_seconds":%d}`,
+		capability, capability, timeoutSeconds)
+}
+
+func TestRoutesGolden(t *testing.T) {
+	var form bytes.Buffer
+	mw := multipart.NewWriter(&form)
+	mw.WriteField("model", "whisper-1")
+	fw, _ := mw.CreateFormFile("file", "a.wav")
+	fw.Write([]byte("RIFF\x00\x01audio"))
+	mw.Close()
+
+	const (
+		jsonBody = `{"model":"m","input":"hi"}`
+		chunks   = "data: {\"choices\":[{\"delta\":{\"content\":\"a\"}}]}\n\n"
+		sse      = "data: {\"balance\":\"5\"}\n\n" + chunks + "data: [DONE]\n\n"
+		audio    = "ID3\x04\x00\x00\xff\xfbbinary"
+	)
+	for _, tc := range []struct {
+		path, method       string
+		contentType, body  string
+		capability         string
+		timeoutSeconds     int
+		gatewayPath        string
+		gatewayContentType string
+		gatewayBody        string
+		// wantContentType and wantBody are what the client should get.
+		wantContentType, wantBody string
+	}{
+		{"/v1/chat/completions", "POST", "application/json", `{"model":"m","stream":true}`, "openai-chat-completions", 120, "/process/request/v1/chat/completions", "text/event-stream", sse, "text/event-stream", chunks + "data: [DONE]\n\n"},
+		{"/v1/chat/completions", "POST", "application/json", jsonBody, "openai-chat-completions", 120, "/process/request/v1/chat/completions", "application/json", `{"choices":[{"message":{"content":"a"}}]}`, "application/json", `{"choices":[{"message":{"content":"a"}}]}`},
+		{"/v1/completions", "POST", "application/json", `{"model":"m","stream":true}`, "openai-text-completions", 120, "/process/request/v1/completions", "text/event-stream", sse, "text/event-stream", chunks + "data: [DONE]\n\n"},
+		{"/v1/images/generations", "POST", "application/json", `{"prompt":"p"}`, "openai-image-generation", 120, "/process/request/v1/images/generations", "application/json", `{"created":1,"data":[{"url":"https://img/a.png"}]}`, "application/json", `{"created":1,"data":[{"url":"https://img/a.png"}]}`},
+		{"/v1/embeddings", "POST", "application/json", jsonBody, "openai-text-embeddings", 30, "/process/request/v1/embeddings", "application/json", `{"data":[{"embedding":[0.5]}]}`, "application/json", `{"data":[{"embedding":[0.5]}]}`},
+		{"/v1/rerank", "POST", "application/json", `{"query":"q","documents":["d"]}`, "cohere-rerank", 30, "/process/request/v1/rerank", "application/json", `{"results":[{"index":0}]}`, "application/json", `{"results":[{"index":0}]}`},
+		{"/v1/audio/transcriptions", "POST", mw.FormDataContentType(), form.String(), "openai-audio-transcription", 300, "/process/request/v1/audio/transcriptions", "text/plain; charset=utf-8", "hello", "text/plain; charset=utf-8", "hello"},
+		{"/v1/audio/speech", "POST", "application/json", `{"input":"hi","voice":"v"}`, "openai-text-to-speech", 120, "/process/request/v1/audio/speech", "audio/mpeg", audio, "audio/mpeg", audio},
+		{"/v1/video/generations", "POST", "application/json", `{"prompt":"p"}`, "video-generation", 900, "/process/request/v1/video/generations", "application/json", `{"id":"job-1","status":"queued"}`, "application/json", `{"id":"job-1","status":"queued"}`},
+		{"/v1/video/generations/status", "POST", "application/json", `{"id":"job-1"}`, "video-generation", 30, "/process/request/v1/video/generations/status", "application/json", `{"id":"job-1","status":"done"}`, "application/json", `{"id":"job-1","status":"done"}`},
+		{"/v1/video/transcode", "POST", "application/json", `{"input":"s3://a"}`, "video-transcode", 900, "/process/request/v1/video/transcode", "application/json", `{"id":"t-1"}`, "application/json", `{"id":"t-1"}`},
+		{"/v1/video/transcode/status", "POST", "application/json", `{"id":"t-1"}`, "video-transcode", 30, "/process/request/v1/video/transcode/status", "application/json", `{"id":"t-1","progress":1}`, "application/json", `{"id":"t-1","progress":1}`},
+		{"/v1/video/transcode/presets", "GET", "", "", "video-transcode", 30, "/process/request/v1/video/transcode/presets", "application/json", `{"presets":["720p"]}`, "application/json", `{"presets":["720p"]}`},
+		{"/v1/video/transcode/abr", "POST", "application/json", `{"input":"s3://a"}`, "transcode-abr", 1800, "/process/request/v1/video/transcode/abr", "application/json", `{"id":"a-1"}`, "application/json", `{"id":"a-1"}`},
+		{"/v1/video/transcode/abr/status", "POST", "application/json", `{"id":"a-1"}`, "transcode-abr", 30, "/process/request/v1/video/transcode/abr/status", "application/json", `{"id":"a-1","progress":1}`, "application/json", `{"id":"a-1","progress":1}`},
+		{"/v1/video/transcode/abr/presets", "GET", "", "", "transcode-abr", 30, "/process/request/v1/video/transcode/abr/presets", "application/json", `{"presets":["abr"]}`, "application/json", `{"presets":["abr"]}`},
+		{"/v1/byoc/my-cap/run", "POST", "application/json", `{"x":1}`, "my-cap", 120, "/process/request/run", "application/json", `{"y":2}`, "application/json", `{"y":2}`},
+	} {
+		t.Run(tc.method+" "+tc.path, func(t *testing.T) {
+			var gotPath, gotLivepeer, gotContentType, gotBody string
+			gw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				b, _ := io.ReadAll(r.Body)
+				lp, _ := base64.StdEncoding.DecodeString(r.Header.Get("Livepeer"))
+				gotPath, gotLivepeer, gotContentType, gotBody = r.URL.RequestURI(), string(lp), r.Header.Get("Content-Type"), string(b)
+				w.Header().Set("Content-Type", tc.gatewayContentType)
+				w.Header().Set("Livepeer-Balance", "5")
+				io.WriteString(w, tc.gatewayBody)
+			}))
+			defer gw.Close()
+			p := proxy.New(proxy.Config{GatewayURL: gw.URL, Routes: defaultRoutes(), AllowedCapabilities: []string{"my-cap"}})
+			srv := httptest.NewServer(newMux(p, false))
+			defer srv.Close()
+
+			req, _ := http.NewRequest(tc.method, srv.URL+tc.path, strings.NewReader(tc.body))
+			if tc.contentType != "" {
+				req.Header.Set("Content-Type", tc.contentType)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status %d: %s", resp.StatusCode, body)
+			}
+
+			if gotPath != tc.gatewayPath {
+				t.Errorf("gateway path %q, want %q", gotPath, tc.gatewayPath)
+			}
+			if want := livepeerHeaderJSON(tc.capability, tc.timeoutSeconds); gotLivepeer != want {
+				t.Errorf("Livepeer header %s, want %s", gotLivepeer, want)
+			}
+			if gotContentType != tc.contentType {
+				t.Errorf("gateway Content-Type %q, want %q", gotContentType, tc.contentType)
+			}
+			if gotBody != tc.body {
+				t.Errorf("gateway body %q, want %q", gotBody, tc.body)
+			}
+			if ct := resp.Header.Get("Content-Type"); ct != tc.wantContentType {
+				t.Errorf("Content-Type %q, want %q", ct, tc.wantContentType)
+			}
+			if v := resp.Header.Get("Livepeer-Balance"); v != "" {
+				t.Errorf("client got Livepeer-Balance %q", v)
+			}
+			if string(body) != tc.wantBody {
+				t.Errorf("body %q, want %q", body, tc.wantBody)
+			}
+		})
+	}
+}
+
+func TestAdminNotOnMainMux(t *testing.T) {
+	p := proxy.New(proxy.Config{GatewayURL: "http://127.0.0.1:1", Routes: defaultRoutes(), APIKeys: []string{"sk-1"}})
+	srv := httptest.NewServer(newMux(p, false))
+	defer srv.Close()
+	for _, tc := range []struct{ method, path string }{
+		{http.MethodGet, "/admin/orchestrators"},
+		{http.MethodPost, "/admin/reload"},
+	} {
+		req, _ := http.NewRequest(tc.method, srv.URL+tc.path, nil)
+		req.Header.Set("Authorization", "Bearer sk-1")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%s %s on the main listener: status %d, want 404", tc.method, tc.path, resp.StatusCode)
+		}
+	}
+}
+
+func TestEnvGateways(t *testing.T) {
+	for _, tc := range []struct {
+		env  string
+		want []proxy.Gateway
+	}{
+		{"http://gw1:9935", []proxy.Gateway{{URL: "http://gw1:9935"}}},
+		{"http://gw1:9935=3, http://gw2:9935", []proxy.Gateway{{URL: "http://gw1:9935", Weight: 3}, {URL: "http://gw2:9935"}}},
+		{"https://gw.example/lp?token=abc", []proxy.Gateway{{URL: "https://gw.example/lp?token=abc"}}},
+		{"https://gw.example/lp?token=abc=2", []proxy.Gateway{{URL: "https://gw.example/lp?token=abc", Weight: 2}}},
+		{"https://gw.example/lp?shard=7=1", []proxy.Gateway{{URL: "https://gw.example/lp?shard=7", Weight: 1}}},
+	} {
+		t.Run(tc.env, func(t *testing.T) {
+			t.Setenv("TEST_GATEWAY_URLS", tc.env)
+			got := envGateways("TEST_GATEWAY_URLS")
+			if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+				t.Errorf("envGateways = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestShutdownDrainsStreams(t *testing.T) {
+	const chunk = "data: {\"choices\":[{\"delta\":{\"content\":\"a\"}}]}\n\n"
+	for _, tc := range []struct {
+		name string
+		// chunks is how many chunks the gateway sends, 50ms apart, before
+		// [DONE]; 0 streams until the proxy hangs up.
+		chunks  int
+		grace   time.Duration
+		wantEnd string
+	}{
+		{"finishes within grace", 10, 5 * time.Second, strings.Repeat(chunk, 10) + "data: [DONE]\n\n"},
+		{"outlasts grace", 0, 300 * time.Millisecond, `data: {"error":{"message":"The server is shutting down, please retry.","type":"server_error","param":null,"code":"server_shutting_down"}}` + "\n\ndata: [DONE]\n\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			started := make(chan struct{})
+			gw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/event-stream")
+				for i := 0; tc.chunks == 0 || i < tc.chunks; i++ {
+					io.WriteString(w, chunk)
+					w.(http.Flusher).Flush()
+					if i == 0 {
+						close(started)
+					}
+					select {
+					case <-r.Context().Done():
+						return
+					case <-time.After(50 * time.Millisecond):
+					}
+				}
+				io.WriteString(w, "data: [DONE]\n\n")
+			}))
+			defer gw.Close()
+			p := proxy.New(proxy.Config{GatewayURL: gw.URL, Routes: defaultRoutes()})
+			srv := httptest.NewServer(newMux(p, false))
+			defer srv.Close()
+
+			body := make(chan string, 1)
+			go func() {
+				resp, err := http.Post(srv.URL+"/v1/chat/completions", "application/json", strings.NewReader(`{"model":"m","stream":true}`))
+				if err != nil {
+					body <- err.Error()
+					return
+				}
+				defer resp.Body.Close()
+				b, _ := io.ReadAll(resp.Body)
+				body <- string(b)
+			}()
+			<-started
+
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				shutdown(srv.Config, p, syscall.SIGTERM, 200*time.Millisecond, tc.grace)
+			}()
+			time.Sleep(50 * time.Millisecond)
+			if resp, err := http.Get(srv.URL + "/healthz"); err != nil {
+				t.Errorf("healthz while draining: %v", err)
+			} else {
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusServiceUnavailable {
+					t.Errorf("healthz while draining: status %d, want 503", resp.StatusCode)
+				}
+			}
+
+			select {
+			case got := <-body:
+				if !strings.HasPrefix(got, chunk) || !strings.HasSuffix(got, tc.wantEnd) {
+					t.Errorf("stream %q, want it to end with %q", got, tc.wantEnd)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatal("stream didn't end")
+			}
+			<-done
+		})
+	}
+}
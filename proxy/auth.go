@@ -0,0 +1,157 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// apiKey is a client API key, kept as its SHA-256 hash. id, a prefix of
+// the hash, identifies the key in logs and metrics. rpm and burst override
+// the global rate limit when set.
+type apiKey struct {
+	hash       [sha256.Size]byte
+	id         string
+	rpm, burst int
+}
+
+// parseAPIKey parses "key[:rpm[:burst]]".
+func parseAPIKey(s string) (apiKey, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) > 3 || parts[0] == "" {
+		return apiKey{}, errors.New("API key entries must be key[:rpm[:burst]]")
+	}
+	k := apiKey{hash: sha256.Sum256([]byte(parts[0]))}
+	k.id = hex.EncodeToString(k.hash[:4])
+	for i, n := range []*int{&k.rpm, &k.burst} {
+		if len(parts) <= i+1 {
+			break
+		}
+		v, err := strconv.Atoi(parts[i+1])
+		if err != nil || v < 0 {
+			return apiKey{}, fmt.Errorf("API key %s: invalid rate limit %q", k.id, parts[i+1])
+		}
+		*n = v
+	}
+	return k, nil
+}
+
+// apiKeys checks client API keys against Config.APIKeys and the keys in
+// Config.APIKeysFile, which Reload reads again. A nil *apiKeys lets every
+// request through.
+type apiKeys struct {
+	static []string
+	file   string
+	keys   atomic.Pointer[[]apiKey]
+}
+
+func newAPIKeys(static []string, file string) (*apiKeys, error) {
+	if len(static) == 0 && file == "" {
+		return nil, nil
+	}
+	a := &apiKeys{static: static, file: file}
+	keys, err := a.load()
+	if err != nil {
+		return nil, err
+	}
+	a.keys.Store(&keys)
+	return a, nil
+}
+
+// load reads the configured keys. The file has one key[:rpm[:burst]] per
+// line; blank lines and lines starting with # are skipped.
+func (a *apiKeys) load() ([]apiKey, error) {
+	values := append([]string(nil), a.static...)
+	if a.file != "" {
+		data, err := os.ReadFile(a.file)
+		if err != nil {
+			return nil, fmt.Errorf("read API keys file: %w", err)
+		}
+		sc := bufio.NewScanner(bytes.NewReader(data))
+		for sc.Scan() {
+			if line := strings.TrimSpace(sc.Text()); line != "" && !strings.HasPrefix(line, "#") {
+				values = append(values, line)
+			}
+		}
+	}
+	if len(values) == 0 {
+		return nil, fmt.Errorf("API keys file %s has no keys", a.file)
+	}
+	keys := make([]apiKey, len(values))
+	for i, v := range values {
+		k, err := parseAPIKey(v)
+		if err != nil {
+			return nil, err
+		}
+		keys[i] = k
+	}
+	return keys, nil
+}
+
+// match returns the key equal to token. Every key is compared, in
+// constant time, so the timing reveals nothing about which one matched.
+func (a *apiKeys) match(token string) (key apiKey, ok bool) {
+	hash := sha256.Sum256([]byte(token))
+	for _, k := range *a.keys.Load() {
+		if subtle.ConstantTimeCompare(hash[:], k.hash[:]) == 1 {
+			key, ok = k, true
+		}
+	}
+	return key, ok
+}
+
+// withAPIKeys requires a valid "Authorization: Bearer <key>" on /v1/
+// requests. Other paths (health checks, metrics, admin) and requests
+// withJWT accepted are not checked.
+func withAPIKeys(next http.Handler, keys *apiKeys, m *metrics) http.Handler {
+	if keys == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := jwtClaimsFromContext(r.Context()); ok || !strings.HasPrefix(r.URL.Path, "/v1/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || strings.TrimSpace(token) == "" {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeOpenAIError(w, http.StatusUnauthorized,
+				"You didn't provide an API key. Send it in the Authorization header as 'Bearer YOUR_KEY'.",
+				"invalid_request_error", "missing_api_key")
+			return
+		}
+		key, ok := keys.match(strings.TrimSpace(token))
+		if !ok {
+			logger(r.Context()).Warn("invalid API key")
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeOpenAIError(w, http.StatusUnauthorized, "Incorrect API key provided.",
+				"invalid_request_error", "invalid_api_key")
+			return
+		}
+		if info := getRequestInfo(r.Context()); info != nil {
+			info.apiKey = key.id
+		}
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), apiKeyKey{}, key)))
+		m.observeAPIKey(key.id, statusClass(rec.status()))
+	})
+}
+
+type apiKeyKey struct{}
+
+// apiKeyFromContext returns the API key withAPIKeys accepted for the
+// request.
+func apiKeyFromContext(ctx context.Context) (apiKey, bool) {
+	k, ok := ctx.Value(apiKeyKey{}).(apiKey)
+	return k, ok
+}
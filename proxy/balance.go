@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// balanceEntry is the last Livepeer balance seen for a capability.
+type balanceEntry struct {
+	Value     string    `json:"value"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// balanceStore keeps the most recent Livepeer balance reported per
+// capability, from Livepeer-Balance headers and balance SSE events.
+type balanceStore struct {
+	metrics *metrics
+
+	mu       sync.Mutex
+	balances map[string]balanceEntry
+}
+
+func newBalanceStore(m *metrics) *balanceStore {
+	return &balanceStore{metrics: m, balances: map[string]balanceEntry{}}
+}
+
+func (s *balanceStore) record(capability, value string) {
+	value = strings.Trim(strings.TrimSpace(value), `"`)
+	if value == "" {
+		return
+	}
+	s.mu.Lock()
+	s.balances[capability] = balanceEntry{Value: value, UpdatedAt: time.Now().UTC()}
+	s.mu.Unlock()
+	if f, ok := parseBalance(value); ok {
+		s.metrics.observeBalance(capability, f)
+	}
+}
+
+func (s *balanceStore) handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, r)
+		return
+	}
+	s.mu.Lock()
+	balances := make(map[string]balanceEntry, len(s.balances))
+	for k, v := range s.balances {
+		balances[k] = v
+	}
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"balances": balances})
+}
+
+var numberPrefix = regexp.MustCompile(`^[-+]?(\d+\.?\d*|\.\d+)([eE][-+]?\d+)?`)
+
+// parseBalance reads a balance as a number, ignoring anything after the
+// leading number (e.g. a unit suffix).
+func parseBalance(s string) (float64, bool) {
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f, true
+	}
+	m := numberPrefix.FindString(s)
+	if m == "" {
+		return 0, false
+	}
+	f, err := strconv.ParseFloat(m, 64)
+	return f, err == nil
+}
+
+// sseBalance returns the balance carried by a Livepeer SSE event, if any.
+func sseBalance(obj map[string]json.RawMessage) string {
+	raw, ok := obj["balance"]
+	if !ok {
+		return ""
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s
+	}
+	return string(raw)
+}
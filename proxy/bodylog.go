@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// secretPatterns match credentials in logged bodies; the first group is
+// kept and the rest replaced with [REDACTED].
+var secretPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)("[\w-]*(?:api[_-]?key|token|secret|password|authorization|credential)[\w-]*"\s*:\s*)"(?:[^"\\]|\\.)*"?`),
+	regexp.MustCompile(`(?i)(bearer\s+)[\w.~+/=-]+`),
+	regexp.MustCompile(`()\bsk-[\w-]{16,}`),
+}
+
+// redact replaces the secrets secretPatterns find in s.
+func redact(s string) string {
+	for _, re := range secretPatterns {
+		s = re.ReplaceAllString(s, `${1}[REDACTED]`)
+	}
+	return s
+}
+
+// bodyCapture keeps the first max bytes written to it, across at most
+// chunks writes (0 for any number).
+type bodyCapture struct {
+	max, chunks int
+	writes      int
+	buf         []byte
+	total       int64
+}
+
+func (c *bodyCapture) add(p []byte) {
+	c.total += int64(len(p))
+	if c.chunks > 0 && c.writes >= c.chunks {
+		return
+	}
+	c.writes++
+	if room := c.max - len(c.buf); room > 0 {
+		c.buf = append(c.buf, p[:min(room, len(p))]...)
+	}
+}
+
+// String returns the captured body, redacted, with a note of how much was
+// left out. Bodies that aren't text are described instead.
+func (c *bodyCapture) String(contentType string) string {
+	if c.total == 0 {
+		return ""
+	}
+	if !textual(contentType) {
+		return "[" + strconv.FormatInt(c.total, 10) + " bytes of " + contentType + "]"
+	}
+	s := redact(strings.ToValidUTF8(string(c.buf), ""))
+	if omitted := c.total - int64(len(c.buf)); omitted > 0 {
+		s += "… [" + strconv.FormatInt(omitted, 10) + " more bytes]"
+	}
+	return s
+}
+
+// textual reports whether a body of contentType is worth logging as text.
+func textual(contentType string) bool {
+	mt, _, _ := mime.ParseMediaType(contentType)
+	return mt == "" || strings.HasPrefix(mt, "text/") || mt == "application/x-www-form-urlencoded" ||
+		mt == "application/json" || strings.HasSuffix(mt, "+json")
+}
+
+type captureReader struct {
+	io.ReadCloser
+	capture *bodyCapture
+}
+
+func (r *captureReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.capture.add(p[:n])
+	return n, err
+}
+
+type captureWriter struct {
+	http.ResponseWriter
+	capture *bodyCapture
+}
+
+func (w *captureWriter) Write(p []byte) (int, error) {
+	w.capture.add(p)
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *captureWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *captureWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+// withBodyLog logs the first maxBytes of each /v1/ request and response
+// body, redacted, once the response is complete. Streamed responses are
+// cut after maxChunks writes.
+func withBodyLog(next http.Handler, maxBytes, maxChunks int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/v1/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		req := &bodyCapture{max: maxBytes}
+		resp := &bodyCapture{max: maxBytes, chunks: maxChunks}
+		r.Body = &captureReader{ReadCloser: r.Body, capture: req}
+		next.ServeHTTP(&captureWriter{ResponseWriter: w, capture: resp}, r)
+		logger(r.Context()).Info("bodies",
+			"request_body", req.String(r.Header.Get("Content-Type")),
+			"response_body", resp.String(w.Header().Get("Content-Type")))
+	})
+}
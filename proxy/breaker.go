@@ -0,0 +1,211 @@
+package proxy
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Circuit breaker states, also the values of the
+// proxy_circuit_breaker_state metric.
+const (
+	breakerClosed = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+var breakerStateNames = map[int]string{
+	breakerClosed:   "closed",
+	breakerOpen:     "open",
+	breakerHalfOpen: "half_open",
+}
+
+// breaker fails requests for a capability fast once its gateway requests
+// have failed threshold times in a row within window. After cooldown one
+// probe request is let through; its outcome closes or re-opens the
+// circuit.
+type breaker struct {
+	capability string
+	threshold  int
+	window     time.Duration
+	cooldown   time.Duration
+	metrics    *metrics
+
+	mu           sync.Mutex
+	state        int
+	failures     int
+	firstFailure time.Time
+	openedAt     time.Time
+	probing      bool
+}
+
+// allow reports whether a request may be sent. When it returns false,
+// retryAfter is the time left until the next probe. Allowed requests must
+// be followed by record or abandon.
+func (b *breaker) allow() (ok bool, retryAfter time.Duration) {
+	if b == nil {
+		return true, 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if wait := b.cooldown - time.Since(b.openedAt); wait > 0 {
+			return false, wait
+		}
+		b.setState(breakerHalfOpen)
+		b.probing = true
+		return true, 0
+	case breakerHalfOpen:
+		if b.probing {
+			return false, time.Second
+		}
+		b.probing = true
+		return true, 0
+	}
+	return true, 0
+}
+
+// record feeds the outcome of an allowed request into the breaker.
+func (b *breaker) record(failed bool) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerHalfOpen {
+		b.probing = false
+		if failed {
+			b.trip()
+		} else {
+			b.failures = 0
+			b.setState(breakerClosed)
+		}
+		return
+	}
+	if !failed {
+		b.failures = 0
+		return
+	}
+	now := time.Now()
+	if b.failures == 0 || now.Sub(b.firstFailure) > b.window {
+		b.failures, b.firstFailure = 0, now
+	}
+	b.failures++
+	if b.state == breakerClosed && b.failures >= b.threshold {
+		b.trip()
+	}
+}
+
+// abandon releases an allowed request whose outcome says nothing about the
+// gateway, such as one the client cancelled.
+func (b *breaker) abandon() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerHalfOpen {
+		b.probing = false
+	}
+}
+
+func (b *breaker) trip() {
+	b.failures = 0
+	b.openedAt = time.Now()
+	b.setState(breakerOpen)
+}
+
+func (b *breaker) setState(state int) {
+	if b.state == state {
+		return
+	}
+	slog.Warn("circuit breaker state changed", "capability", b.capability,
+		"from", breakerStateNames[b.state], "to", breakerStateNames[state])
+	b.state = state
+	b.metrics.observeBreaker(b.capability, state)
+}
+
+func (b *breaker) stateName() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return breakerStateNames[b.state]
+}
+
+// breakerSettings configure a capability's breaker. A threshold of 0
+// disables it.
+type breakerSettings struct {
+	threshold int
+	window    time.Duration
+	cooldown  time.Duration
+}
+
+// breakers holds a breaker per capability, created on first use. A nil
+// *breakers disables circuit breaking.
+type breakers struct {
+	defaults breakerSettings
+	// settings overrides defaults per capability.
+	settings map[string]breakerSettings
+	metrics  *metrics
+
+	mu sync.Mutex
+	m  map[string]*breaker
+}
+
+func newBreakers(defaults breakerSettings, settings map[string]breakerSettings, m *metrics) *breakers {
+	enabled := defaults.threshold > 0
+	for _, s := range settings {
+		enabled = enabled || s.threshold > 0
+	}
+	if !enabled {
+		return nil
+	}
+	return &breakers{defaults: defaults, settings: settings, metrics: m, m: map[string]*breaker{}}
+}
+
+// get returns capability's breaker, or nil if it has none.
+func (bs *breakers) get(capability string) *breaker {
+	if bs == nil {
+		return nil
+	}
+	settings, ok := bs.settings[capability]
+	if !ok {
+		settings = bs.defaults
+	}
+	if settings.threshold <= 0 {
+		return nil
+	}
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	b, ok := bs.m[capability]
+	if !ok {
+		b = &breaker{
+			capability: capability,
+			threshold:  settings.threshold,
+			window:     settings.window,
+			cooldown:   settings.cooldown,
+			metrics:    bs.metrics,
+		}
+		bs.m[capability] = b
+		bs.metrics.observeBreaker(capability, breakerClosed)
+	}
+	return b
+}
+
+// states returns the state of every capability's breaker.
+func (bs *breakers) states() map[string]string {
+	out := map[string]string{}
+	if bs == nil {
+		return out
+	}
+	bs.mu.Lock()
+	list := make([]*breaker, 0, len(bs.m))
+	for _, b := range bs.m {
+		list = append(list, b)
+	}
+	bs.mu.Unlock()
+	for _, b := range list {
+		out[b.capability] = b.stateName()
+	}
+	return out
+}
@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// byocHandler serves /v1/byoc/{capability}/{path...}: it forwards to
+// /process/request/{path} for any capability in Config.AllowedCapabilities, so
+// new capabilities don't need a dedicated route.
+func byocHandler(p *Proxy, limiters map[string]*limiter) http.HandlerFunc {
+	allowedCapabilities := p.cfg.AllowedCapabilities
+	byocTimeoutSeconds := p.cfg.BYOCTimeoutSeconds
+	byocTimeouts := p.cfg.BYOCCapabilityTimeouts
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeMethodNotAllowed(w, r)
+			return
+		}
+
+		byocCapability := r.PathValue("capability")
+		if !contains(allowedCapabilities, byocCapability) {
+			writeError(w, http.StatusForbidden, "capability_not_allowed", "Capability "+byocCapability+" is not allowed.")
+			return
+		}
+
+		byocTimeout := byocTimeoutSeconds
+		if t, ok := byocTimeouts[byocCapability]; ok {
+			byocTimeout = t
+		}
+
+		path, ok := byocGatewayPath(r.PathValue("path"))
+		if !ok {
+			writeError(w, http.StatusBadRequest, "invalid_path", "The path may not contain . or .. segments.")
+			return
+		}
+
+		opts := p.options()
+		opts.path = path
+		opts.capability = byocCapability
+		opts.timeoutSeconds = byocTimeout
+		opts.maxBody = 5 << 20 // 5MB
+		opts.methods = []string{http.MethodPost}
+		opts.limiter = limiters[byocCapability]
+		// Unknown capabilities may stream or not — keep the upstream
+		// Content-Type instead of assuming JSON.
+		opts.mode = modeRawStream
+		capabilityHandler(opts)(w, r)
+	}
+}
+
+// byocGatewayPath returns the gateway path for the decoded {path...} of a
+// BYOC request. Each segment is escaped again, so an encoded "?" or "#"
+// can't add a query or fragment, and dot segments, which would leave
+// /process/request, are rejected.
+func byocGatewayPath(p string) (string, bool) {
+	segments := strings.Split(p, "/")
+	for i, seg := range segments {
+		if seg == "." || seg == ".." {
+			return "", false
+		}
+		segments[i] = url.PathEscape(seg)
+	}
+	return "/process/request/" + strings.Join(segments, "/"), true
+}
@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBYOCGatewayPath(t *testing.T) {
+	gotPath := make(chan string, 1)
+	gw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath <- r.URL.RequestURI()
+		w.Write([]byte("{}"))
+	}))
+	defer gw.Close()
+	h := NewHandler(Config{GatewayURL: gw.URL, AllowedCapabilities: []string{"cap"}})
+
+	for _, tc := range []struct {
+		path   string
+		status int
+		// gateway is the request URI the gateway should see.
+		gateway string
+	}{
+		{"/v1/byoc/cap/run", http.StatusOK, "/process/request/run"},
+		{"/v1/byoc/cap/a/b/c", http.StatusOK, "/process/request/a/b/c"},
+		{"/v1/byoc/cap/x%3Fq=1", http.StatusOK, "/process/request/x%3Fq=1"},
+		// The mux decodes {path...} whole, so %2F is a separator.
+		{"/v1/byoc/cap/a%2Fb", http.StatusOK, "/process/request/a/b"},
+		{"/v1/byoc/cap/a%20b", http.StatusOK, "/process/request/a%20b"},
+		{"/v1/byoc/cap/..%2f..%2fsecret", http.StatusBadRequest, ""},
+		{"/v1/byoc/cap/%2e%2e/secret", http.StatusBadRequest, ""},
+		{"/v1/byoc/cap/a/.%2fb", http.StatusBadRequest, ""},
+	} {
+		req := httptest.NewRequest(http.MethodPost, tc.path, strings.NewReader("{}"))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tc.status {
+			t.Errorf("%s: status %d, want %d: %s", tc.path, rec.Code, tc.status, rec.Body)
+			continue
+		}
+		select {
+		case got := <-gotPath:
+			if got != tc.gateway {
+				t.Errorf("%s: gateway saw %s, want %s", tc.path, got, tc.gateway)
+			}
+		default:
+			if tc.gateway != "" {
+				t.Errorf("%s: request didn't reach the gateway", tc.path)
+			}
+		}
+	}
+}
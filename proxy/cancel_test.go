@@ -0,0 +1,147 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClientDisconnectClosesGatewayStream(t *testing.T) {
+	for _, tc := range []struct {
+		path, contentType, chunk string
+	}{
+		{"/v1/chat/completions", "text/event-stream", "data: {\"choices\":[{\"delta\":{\"content\":\"a\"}}]}\n\n"},
+		{"/v1/audio/speech", "audio/mpeg", "audio-bytes\n"},
+	} {
+		t.Run(tc.path, func(t *testing.T) {
+			gone := make(chan struct{})
+			gw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tc.contentType)
+				for {
+					if _, err := io.WriteString(w, tc.chunk); err != nil {
+						break
+					}
+					w.(http.Flusher).Flush()
+					select {
+					case <-r.Context().Done():
+						close(gone)
+						return
+					case <-time.After(20 * time.Millisecond):
+					}
+				}
+				close(gone)
+			}))
+			defer gw.Close()
+			p := New(Config{
+				GatewayURL: gw.URL,
+				Routes: []Route{
+					{Path: "/v1/chat/completions", Capability: "chat", Mode: ModeSSE},
+					{Path: "/v1/audio/speech", Capability: "speech", Mode: ModeStream},
+				},
+			})
+			srv := httptest.NewServer(p)
+			defer srv.Close()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			req, _ := http.NewRequestWithContext(ctx, http.MethodPost, srv.URL+tc.path, strings.NewReader(`{"model":"m","stream":true}`))
+			req.Header.Set("Content-Type", "application/json")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if _, err := bufio.NewReader(resp.Body).ReadString('\n'); err != nil {
+				t.Fatalf("reading the first chunk: %v", err)
+			}
+			cancel()
+
+			select {
+			case <-gone:
+			case <-time.After(2 * time.Second):
+				t.Fatal("gateway connection still open 2s after the client left")
+			}
+		})
+	}
+}
+
+// closeRecorder is a gateway response body that blocks until closed.
+type closeRecorder struct {
+	io.Reader
+	closed atomic.Bool
+	done   chan struct{}
+}
+
+func (b *closeRecorder) Read(p []byte) (int, error) {
+	if n, err := b.Reader.Read(p); err != io.EOF {
+		return n, err
+	}
+	<-b.done
+	return 0, io.ErrClosedPipe
+}
+
+func (b *closeRecorder) Close() error {
+	if b.closed.CompareAndSwap(false, true) {
+		close(b.done)
+	}
+	return nil
+}
+
+// roundTripFunc adapts a function to http.RoundTripper.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+func TestClientCancelClosesUpstreamBody(t *testing.T) {
+	for _, tc := range []struct {
+		path, contentType, chunk string
+	}{
+		{"/v1/chat/completions", "text/event-stream", "data: {\"choices\":[{\"delta\":{\"content\":\"a\"}}]}\n\n"},
+		{"/v1/audio/speech", "audio/mpeg", "audio-bytes"},
+	} {
+		t.Run(tc.path, func(t *testing.T) {
+			body := &closeRecorder{Reader: strings.NewReader(tc.chunk), done: make(chan struct{})}
+			p := New(Config{
+				GatewayURL: "http://gateway.invalid",
+				Client: &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+					return &http.Response{
+						StatusCode: http.StatusOK,
+						Header:     http.Header{"Content-Type": {tc.contentType}},
+						Body:       body,
+						Request:    r,
+					}, nil
+				})},
+				Routes: []Route{
+					{Path: "/v1/chat/completions", Capability: "chat", Mode: ModeSSE},
+					{Path: "/v1/audio/speech", Capability: "speech", Mode: ModeStream},
+				},
+			})
+
+			ctx, cancel := context.WithCancel(context.Background())
+			req := httptest.NewRequest(http.MethodPost, tc.path, strings.NewReader(`{"model":"m","stream":true}`)).WithContext(ctx)
+			req.Header.Set("Content-Type", "application/json")
+			served := make(chan struct{})
+			go func() {
+				defer close(served)
+				p.ServeHTTP(httptest.NewRecorder(), req)
+			}()
+			time.Sleep(50 * time.Millisecond)
+			cancel()
+
+			select {
+			case <-served:
+			case <-time.After(2 * time.Second):
+				t.Fatal("handler still running 2s after the client canceled")
+			}
+			if !body.closed.Load() {
+				t.Error("upstream body wasn't closed")
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// parseTrustedProxies parses IPs and CIDR prefixes.
+func parseTrustedProxies(list []string) ([]netip.Prefix, error) {
+	var out []netip.Prefix
+	for _, s := range list {
+		if p, err := netip.ParsePrefix(s); err == nil {
+			out = append(out, p.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy %q: not an IP or CIDR", s)
+		}
+		out = append(out, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return out, nil
+}
+
+func isTrusted(trusted []netip.Prefix, ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, p := range trusted {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// peerIP returns the address of r's direct peer.
+func peerIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// clientIP returns the address of the client that sent r. X-Forwarded-For
+// and X-Real-IP are only consulted when the direct peer is a trusted
+// proxy, and then the right-most X-Forwarded-For address not belonging to
+// a trusted proxy is used, or X-Real-IP without X-Forwarded-For.
+func clientIP(r *http.Request, trusted []netip.Prefix) string {
+	ip := peerIP(r)
+	if !isTrusted(trusted, ip) {
+		return ip
+	}
+	if r.Header.Get("X-Forwarded-For") == "" {
+		if real := strings.TrimSpace(r.Header.Get("X-Real-IP")); real != "" {
+			return real
+		}
+		return ip
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		if !isTrusted(trusted, hop) {
+			return hop
+		}
+		ip = hop
+	}
+	return ip
+}
+
+// setForwarded sets X-Forwarded-For, -Proto and -Host on a gateway request
+// made for r. The proxy appends its peer to X-Forwarded-For; the client's
+// X-Forwarded-* headers are only kept when the peer is a trusted proxy.
+func setForwarded(dst http.Header, r *http.Request, trusted []netip.Prefix) {
+	peer := peerIP(r)
+	proto, host := "http", r.Host
+	if r.TLS != nil {
+		proto = "https"
+	}
+	forwardedFor := peer
+	if isTrusted(trusted, peer) {
+		if prior := strings.Join(r.Header.Values("X-Forwarded-For"), ", "); prior != "" {
+			forwardedFor = prior + ", " + peer
+		}
+		if v := r.Header.Get("X-Forwarded-Proto"); v != "" {
+			proto = v
+		}
+		if v := r.Header.Get("X-Forwarded-Host"); v != "" {
+			host = v
+		}
+	}
+	dst.Set("X-Forwarded-For", forwardedFor)
+	dst.Set("X-Forwarded-Proto", proto)
+	if host != "" {
+		dst.Set("X-Forwarded-Host", host)
+	}
+}
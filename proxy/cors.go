@@ -0,0 +1,46 @@
+package proxy
+
+import (
+	"net/http"
+)
+
+// withCORS answers CORS preflight requests and adds Access-Control-Allow-*
+// headers for browser clients whose Origin is in allowedOrigins ("*" allows
+// any origin). With no origins configured the handler is returned as is.
+func withCORS(next http.Handler, allowedOrigins []string) http.Handler {
+	if len(allowedOrigins) == 0 {
+		return next
+	}
+	allowAny := contains(allowedOrigins, "*")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+
+		allowed := allowAny || contains(allowedOrigins, origin)
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+
+		if !allowed {
+			if preflight {
+				writeError(w, http.StatusForbidden, "origin_not_allowed", "Origin "+origin+" is not allowed.")
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		if preflight {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, "+timeoutHeader+", "+legacyTimeoutHeader+", "+capabilityHeader+", "+livepeerCapabilityHeader+", "+orchestratorIncludeHeader+", "+orchestratorExcludeHeader+", "+debugHeader+", "+idempotencyHeader)
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Gateway error bodies are read up to maxUpstreamErrorBody bytes and
+// quoted up to maxUpstreamErrorMessage bytes.
+const (
+	maxUpstreamErrorBody    = 64 << 10
+	maxUpstreamErrorMessage = 1024
+)
+
+// writeOpenAIError writes an error in the OpenAI API error format, which
+// OpenAI SDKs know how to surface. The request ID, if set on the response
+// already, is added to the message so users can quote it.
+func writeOpenAIError(w http.ResponseWriter, status int, message, errType, code string) {
+	if id := w.Header().Get("X-Request-Id"); id != "" {
+		message += " (request ID " + id + ")"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"error": map[string]any{
+			"message": message,
+			"type":    errType,
+			"param":   nil,
+			"code":    code,
+		},
+	})
+}
+
+// errorType is the OpenAI error type for a proxy-generated error with
+// status.
+func errorType(status int) string {
+	switch {
+	case status == http.StatusServiceUnavailable:
+		return "service_unavailable"
+	case status >= 500:
+		return "api_error"
+	}
+	return "invalid_request_error"
+}
+
+// writeError writes a proxy-generated error typed by its status.
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	writeOpenAIError(w, status, message, errorType(status), code)
+}
+
+// writeMethodNotAllowed answers a request with an unsupported method.
+func writeMethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method "+r.Method+" is not allowed on "+r.URL.Path+".")
+}
+
+// writeNotFound answers requests to paths no route handles, instead of
+// the mux's plain-text 404.
+func writeNotFound(w http.ResponseWriter, r *http.Request) {
+	writeError(w, http.StatusNotFound, "not_found", "Unknown route: "+r.Method+" "+r.URL.Path+".")
+}
+
+// gatewayFailure maps a gateway request that failed without a response
+// to a status and code: 504 timeout when it timed out, 502
+// gateway_unreachable when the connection was refused and 502
+// gateway_error otherwise.
+func gatewayFailure(err error) (status int, code, message string) {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout():
+		return http.StatusGatewayTimeout, "timeout", "The gateway did not respond in time."
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return http.StatusBadGateway, "gateway_unreachable", "The gateway could not be reached."
+	}
+	return http.StatusBadGateway, "gateway_error", "The gateway request failed."
+}
+
+// writeGatewayError answers a request whose gateway request failed with
+// err. The error itself, which may name internal hosts, is only logged.
+func writeGatewayError(w http.ResponseWriter, err error) {
+	status, code, message := gatewayFailure(err)
+	writeError(w, status, code, message)
+}
+
+// translateUpstreamError replaces the body of a gateway error response
+// that isn't an OpenAI error with one wrapping its text, and fixes h, the
+// client response headers, to match. The original body is logged at debug
+// level. Successful, event-stream and compressed responses are left alone.
+func translateUpstreamError(ctx context.Context, h http.Header, resp *http.Response) {
+	if resp.StatusCode < 400 || strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") ||
+		resp.Header.Get("Content-Encoding") != "" {
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxUpstreamErrorBody))
+	if err != nil {
+		logger(ctx).Warn("failed to read gateway error response", "error", err)
+	}
+	logger(ctx).Debug("gateway error response", "status", resp.StatusCode, "body", string(body))
+	out := upstreamErrorBody(resp.StatusCode, body)
+	resp.Body = io.NopCloser(bytes.NewReader(out))
+	h.Set("Content-Type", "application/json")
+	h.Set("Content-Length", strconv.Itoa(len(out)))
+}
+
+// upstreamErrorBody returns body if it is an OpenAI error already, and
+// otherwise an OpenAI error of type upstream_error quoting it: the
+// "error", "message" or "detail" string of a JSON body, or the text.
+func upstreamErrorBody(status int, body []byte) []byte {
+	var message string
+	var v map[string]json.RawMessage
+	if json.Unmarshal(body, &v) == nil {
+		var e struct {
+			Message *string `json:"message"`
+		}
+		if json.Unmarshal(v["error"], &e) == nil && e.Message != nil {
+			return body
+		}
+		for _, k := range []string{"error", "message", "detail"} {
+			if json.Unmarshal(v[k], &message) == nil && message != "" {
+				break
+			}
+		}
+	}
+	if message == "" {
+		message = strings.TrimSpace(string(body))
+	}
+	if message == "" {
+		message = http.StatusText(status)
+	}
+	if len(message) > maxUpstreamErrorMessage {
+		message = strings.ToValidUTF8(message[:maxUpstreamErrorMessage], "") + "…"
+	}
+	code := "upstream_error"
+	if text := http.StatusText(status); text != "" {
+		code = strings.ToLower(strings.NewReplacer(" ", "_", "-", "_", "'", "").Replace(text))
+	}
+	out, _ := json.Marshal(map[string]any{
+		"error": map[string]any{
+			"message": message,
+			"type":    "upstream_error",
+			"param":   nil,
+			"code":    code,
+		},
+	})
+	return append(out, '\n')
+}
@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// openAIError is the body of an OpenAI error response.
+type openAIError struct {
+	Error struct {
+		Message string  `json:"message"`
+		Type    string  `json:"type"`
+		Param   *string `json:"param"`
+		Code    string  `json:"code"`
+	} `json:"error"`
+}
+
+func decodeOpenAIError(t *testing.T, rec *httptest.ResponseRecorder) openAIError {
+	t.Helper()
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type %q, want application/json", ct)
+	}
+	var e openAIError
+	if err := json.Unmarshal(rec.Body.Bytes(), &e); err != nil {
+		t.Fatalf("body %s: %v", rec.Body, err)
+	}
+	return e
+}
+
+// timeoutError is a net.Error that timed out.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestWriteGatewayError(t *testing.T) {
+	// A real refused connection, from a port nothing listens on.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	_, refused := http.Get("http://" + addr)
+	if refused == nil {
+		t.Fatal("request to a closed port succeeded")
+	}
+
+	urlErr := func(err error) error {
+		return &url.Error{Op: "Post", URL: "http://gateway:8935/process/request", Err: err}
+	}
+	for _, tc := range []struct {
+		name   string
+		err    error
+		status int
+		code   string
+	}{
+		{"deadline exceeded", urlErr(context.DeadlineExceeded), http.StatusGatewayTimeout, "timeout"},
+		{"wrapped deadline", urlErr(&net.OpError{Op: "read", Net: "tcp", Err: os.ErrDeadlineExceeded}), http.StatusGatewayTimeout, "timeout"},
+		{"net timeout", urlErr(timeoutError{}), http.StatusGatewayTimeout, "timeout"},
+		{"connection refused", refused, http.StatusBadGateway, "gateway_unreachable"},
+		{"wrapped ECONNREFUSED", urlErr(&net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}), http.StatusBadGateway, "gateway_unreachable"},
+		{"connection reset", urlErr(&net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}), http.StatusBadGateway, "gateway_error"},
+		{"canceled", urlErr(context.Canceled), http.StatusBadGateway, "gateway_error"},
+		{"other", errors.New("boom"), http.StatusBadGateway, "gateway_error"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			rec.Header().Set("X-Request-Id", "req-1")
+			writeGatewayError(rec, tc.err)
+			if rec.Code != tc.status {
+				t.Errorf("status %d, want %d", rec.Code, tc.status)
+			}
+			e := decodeOpenAIError(t, rec)
+			if e.Error.Code != tc.code || e.Error.Type != "api_error" {
+				t.Errorf("type %q code %q, want api_error %q", e.Error.Type, e.Error.Code, tc.code)
+			}
+			if !strings.HasSuffix(e.Error.Message, " (request ID req-1)") {
+				t.Errorf("message %q doesn't end with the request ID", e.Error.Message)
+			}
+			if e.Error.Param != nil {
+				t.Errorf("param %q, want null", *e.Error.Param)
+			}
+		})
+	}
+}
+
+func TestWriteErrorTypes(t *testing.T) {
+	for _, tc := range []struct {
+		status int
+		typ    string
+	}{
+		{http.StatusBadRequest, "invalid_request_error"},
+		{http.StatusUnauthorized, "invalid_request_error"},
+		{http.StatusNotFound, "invalid_request_error"},
+		{http.StatusRequestEntityTooLarge, "invalid_request_error"},
+		{http.StatusTooManyRequests, "invalid_request_error"},
+		{http.StatusInternalServerError, "api_error"},
+		{http.StatusBadGateway, "api_error"},
+		{http.StatusServiceUnavailable, "service_unavailable"},
+		{http.StatusGatewayTimeout, "api_error"},
+	} {
+		rec := httptest.NewRecorder()
+		writeError(rec, tc.status, "some_code", "Something happened.")
+		e := decodeOpenAIError(t, rec)
+		if rec.Code != tc.status || e.Error.Type != tc.typ || e.Error.Code != "some_code" || e.Error.Message != "Something happened." {
+			t.Errorf("status %d: got %d %+v, want type %q", tc.status, rec.Code, e.Error, tc.typ)
+		}
+	}
+}
+
+func TestUpstreamErrorBody(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		status  int
+		body    string
+		message string
+		code    string
+	}{
+		{"text", http.StatusBadGateway, "no orchestrators available\n", "no orchestrators available", "bad_gateway"},
+		{"error string", http.StatusServiceUnavailable, `{"error":"busy"}`, "busy", "service_unavailable"},
+		{"message", http.StatusBadRequest, `{"message":"bad input"}`, "bad input", "bad_request"},
+		{"detail", http.StatusUnprocessableEntity, `{"detail":"invalid model"}`, "invalid model", "unprocessable_entity"},
+		{"empty", http.StatusInternalServerError, "", "Internal Server Error", "internal_server_error"},
+		{"unknown status", 599, "", "", "upstream_error"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var e openAIError
+			if err := json.Unmarshal(upstreamErrorBody(tc.status, []byte(tc.body)), &e); err != nil {
+				t.Fatal(err)
+			}
+			if e.Error.Type != "upstream_error" || e.Error.Code != tc.code || tc.message != "" && e.Error.Message != tc.message {
+				t.Errorf("got %+v, want message %q code %q", e.Error, tc.message, tc.code)
+			}
+		})
+	}
+
+	openAI := `{"error":{"message":"rate limited","type":"requests","code":"rate_limit_exceeded"}}`
+	if got := string(upstreamErrorBody(http.StatusTooManyRequests, []byte(openAI))); got != openAI {
+		t.Errorf("OpenAI error rewritten to %s", got)
+	}
+}
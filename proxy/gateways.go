@@ -0,0 +1,196 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Gateway is one Livepeer gateway requests are spread across.
+type Gateway struct {
+	URL string
+	// Weight is the gateway's share of requests relative to the others.
+	// Defaults to 1.
+	Weight int
+}
+
+// gatewayPool picks the gateway for each request by smooth weighted
+// round-robin, skipping gateways marked down after repeated connection
+// failures unless all of them are.
+type gatewayPool struct {
+	metrics *metrics
+	// threshold consecutive connection failures mark a gateway down for
+	// downFor.
+	threshold int
+	downFor   time.Duration
+
+	mu       sync.Mutex
+	gateways []*gatewayState
+}
+
+type gatewayState struct {
+	url     string
+	weight  int
+	current int
+	// failures counts consecutive connection failures.
+	failures  int
+	downUntil time.Time
+}
+
+func newGatewayPool(gateways []Gateway, threshold int, downFor time.Duration, m *metrics) *gatewayPool {
+	p := &gatewayPool{metrics: m, threshold: threshold, downFor: downFor}
+	for _, g := range gateways {
+		weight := g.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		url := strings.TrimRight(g.URL, "/")
+		p.gateways = append(p.gateways, &gatewayState{url: url, weight: weight})
+		m.observeGatewayUp(url, true)
+	}
+	return p
+}
+
+// urls returns the base URL of every gateway.
+func (p *gatewayPool) urls() []string {
+	out := make([]string, len(p.gateways))
+	for i, g := range p.gateways {
+		out[i] = g.url
+	}
+	return out
+}
+
+// pick returns the base URL of the gateway for the next request.
+func (p *gatewayPool) pick() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	candidates := make([]*gatewayState, 0, len(p.gateways))
+	for _, g := range p.gateways {
+		if now.After(g.downUntil) {
+			candidates = append(candidates, g)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = p.gateways
+	}
+	var best *gatewayState
+	total := 0
+	for _, g := range candidates {
+		g.current += g.weight
+		total += g.weight
+		if best == nil || g.current > best.current {
+			best = g
+		}
+	}
+	best.current -= total
+	return best.url
+}
+
+// fallThrough is called after a request to the gateway from failed with
+// err. If the connection was refused, it sends the request to the other
+// gateways in turn, healthy ones first, until one can be reached, and
+// returns the gateway that answered. A request that never connected
+// reached no gateway, so this is safe for job submissions too.
+func (p *gatewayPool) fallThrough(ctx context.Context, from string, err error, send func(gateway string) (*http.Response, error)) (*http.Response, string, error) {
+	for _, gateway := range p.others(from) {
+		if !isDialError(err) || ctx.Err() != nil {
+			break
+		}
+		logger(ctx).Warn("gateway unreachable, trying next", "gateway", from, "next", gateway, "error", err)
+		var resp *http.Response
+		if resp, err = send(gateway); err == nil {
+			return resp, gateway, nil
+		}
+		from = gateway
+	}
+	return nil, from, err
+}
+
+// others returns every gateway except from, healthy ones first, each
+// group in pool order starting after from.
+func (p *gatewayPool) others(from string) []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	start := 0
+	for i, g := range p.gateways {
+		if g.url == from {
+			start = i + 1
+		}
+	}
+	now := time.Now()
+	var up, down []string
+	for i := range p.gateways {
+		g := p.gateways[(start+i)%len(p.gateways)]
+		switch {
+		case g.url == from:
+		case now.After(g.downUntil):
+			up = append(up, g.url)
+		default:
+			down = append(down, g.url)
+		}
+	}
+	return append(up, down...)
+}
+
+// isDialError reports whether err means the connection to the gateway
+// could not be established, so the request was never sent.
+func isDialError(err error) bool {
+	var op *net.OpError
+	return errors.As(err, &op) && op.Op == "dial"
+}
+
+// roundTripper wraps next to record the outcome of every request to a
+// pooled gateway.
+func (p *gatewayPool) roundTripper(next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		resp, err := next.RoundTrip(req)
+		// Requests the client gave up on say nothing about the gateway.
+		switch {
+		case err == nil:
+			p.record(req.URL.String(), statusClass(resp.StatusCode))
+		case req.Context().Err() == nil:
+			p.record(req.URL.String(), "error")
+		}
+		return resp, err
+	})
+}
+
+// record counts a request to target; class is the response's status
+// class, or "error" if the gateway couldn't be reached.
+func (p *gatewayPool) record(target, class string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, g := range p.gateways {
+		if target != g.url && !strings.HasPrefix(target, g.url+"/") {
+			continue
+		}
+		url := g.url
+		p.metrics.observeGateway(url, class)
+		if class != "error" {
+			g.failures = 0
+			if !g.downUntil.IsZero() {
+				g.downUntil = time.Time{}
+				slog.Info("gateway is back up", "gateway", url)
+				p.metrics.observeGatewayUp(url, true)
+			}
+			return
+		}
+		g.failures++
+		if g.failures >= p.threshold {
+			g.failures = 0
+			g.downUntil = time.Now().Add(p.downFor)
+			slog.Warn("gateway marked down", "gateway", url, "for", p.downFor.String())
+			p.metrics.observeGatewayUp(url, false)
+		}
+		return
+	}
+}
@@ -0,0 +1,640 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"mime"
+	"net/http"
+	"net/netip"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// responseMode selects how a gateway response is written to the client.
+type responseMode int
+
+const (
+	// modeJSON forces Content-Type: application/json and copies the body.
+	// A text/event-stream response is passed through unfiltered and
+	// flushed as it arrives.
+	modeJSON responseMode = iota
+	// modeSSEFiltered filters non-OpenAI events out of text/event-stream
+	// responses; anything else is sent as JSON, flushed as it arrives.
+	modeSSEFiltered
+	// modeRawStream keeps the upstream Content-Type and flushes the body as
+	// it arrives; text/event-stream responses are still filtered.
+	modeRawStream
+)
+
+// handlerOptions describes one capability endpoint served by
+// capabilityHandler.
+type handlerOptions struct {
+	client *http.Client
+	// retries is how often a failed gateway request is resent, waiting
+	// retryBackoff, doubled each time, in between.
+	retries      int
+	retryBackoff time.Duration
+	// gateways picks the gateway for each request; path is appended to
+	// its URL.
+	gateways   *gatewayPool
+	path       string
+	capability string
+	// timeoutSeconds is sent in the Livepeer header and, unless
+	// requestTimeoutSeconds is set, bounds the proxied request.
+	timeoutSeconds        int
+	requestTimeoutSeconds int
+	// minTimeoutSeconds and maxTimeoutSeconds bound the timeout a client
+	// may ask for.
+	minTimeoutSeconds int
+	maxTimeoutSeconds int
+	// clientLivepeerHeader forwards a valid Livepeer header sent by the
+	// client instead of generating one.
+	clientLivepeerHeader bool
+	// bodyTimeout honours, and strips, a top-level "timeout" field in
+	// JSON request bodies.
+	bodyTimeout bool
+	maxBody     int64
+	methods     []string
+	mode        responseMode
+	// maxResponse truncates non-streamed gateway responses, and
+	// maxStreamResponse aborts streamed ones, past that many bytes; 0 is
+	// no limit.
+	maxResponse, maxStreamResponse int64
+
+	exposeLivepeerHeaders bool
+	gatewayAuth           GatewayAuth
+
+	// jobs records async jobs. Submit routes set jobStatusPath so the
+	// job ID in a successful response is registered; status routes set
+	// jobStatus so polls for a known job ID go to the gateway that has
+	// the job, with the recorded capability.
+	jobs          *jobStore
+	jobStatusPath string
+	jobStatus     bool
+
+	// metrics records SSE stream metrics; nil disables them.
+	metrics *metrics
+	// limiter caps in-flight requests for the capability; nil means no
+	// limit.
+	limiter *limiter
+	// streams caps streaming requests across all routes.
+	streams *streamLimiter
+	// balances records Livepeer balances seen in responses.
+	balances *balanceStore
+	// orchestrators records per-orchestrator outcomes.
+	orchestrators *orchestratorStats
+	// orchestratorFilter is sent in the Livepeer header, with currently
+	// blacklisted orchestrators added to its exclude list.
+	orchestratorFilter orchestratorFilter
+	// orchestratorPattern validates the X-Orchestrator-Include/Exclude
+	// request headers; nil ignores them.
+	orchestratorPattern *regexp.Regexp
+	// breakers fail requests fast while a capability's circuit is open.
+	breakers *breakers
+	// sseKeepAlive is the idle time after which filtered streams get a
+	// keep-alive comment; 0 disables them.
+	sseKeepAlive time.Duration
+	// sseFlushInterval batches filtered stream output; 0 flushes each line.
+	sseFlushInterval time.Duration
+	// sseMaxLine is the longest SSE line read from the gateway.
+	sseMaxLine int
+	// sseInterruptedEnd is how filtered streams cut off before [DONE] end.
+	sseInterruptedEnd string
+	// sseIdleTimeout ends filtered streams the gateway stops sending.
+	sseIdleTimeout time.Duration
+	// sseRequiredKeys are the keys filtered SSE data events need, unless
+	// sseCapabilityKeys has an entry for the request's capability.
+	sseRequiredKeys   []string
+	sseCapabilityKeys map[string][]string
+	// allowedCapabilities may be selected per request with the
+	// X-Capability header.
+	allowedCapabilities []string
+	// capabilityTimeouts is the timeout for capabilities chosen per
+	// request rather than by the route.
+	capabilityTimeouts map[string]int
+	// maxPrice is sent as max_price_per_unit unless maxPrices has an entry
+	// for the request's capability; "" sends none.
+	maxPrice  string
+	maxPrices map[string]string
+	// models routes requests by the model in their body; nil uses
+	// capability.
+	models *modelRouter
+	// aliases rewrites the model in request bodies, and back in
+	// responses.
+	aliases *modelAliases
+	// multipart rejects requests that aren't multipart/form-data.
+	multipart bool
+	// validateJSON rejects non-empty request bodies that aren't valid
+	// JSON. Streamed bodies aren't checked; the gateway rejects them.
+	validateJSON bool
+	// noStream rejects JSON bodies with "stream": true.
+	noStream bool
+	// shadow mirrors a sample of requests to a shadow gateway.
+	shadow *shadower
+	// hedgeAfter, when set, sends a second identical request if the
+	// gateway hasn't answered within it, and uses whichever answers first.
+	hedgeAfter time.Duration
+	// raceMax is the most copies of a request X-Proxy-Race may ask for,
+	// by clients whose API key ID or JWT subject is in raceAllowed.
+	raceMax     int
+	raceAllowed []string
+	// bodyBuffering is the BodyBuffering mode deciding whether request
+	// bodies are streamed to the gateway.
+	bodyBuffering string
+	// imageFormat rewrites image responses to the response_format the
+	// client asked for.
+	imageFormat bool
+	// imageSizes, when set, are the image sizes requests may ask for;
+	// defaultImageSize is set on requests without one.
+	imageSizes       []string
+	defaultImageSize string
+	// idempotency replays responses to requests with a repeated
+	// Idempotency-Key.
+	idempotency *idempotencyCache
+	// forwardHeaders are the client headers sent to the gateway.
+	forwardHeaders []string
+	// trustedProxies are the peers whose X-Forwarded-* headers are kept.
+	trustedProxies []netip.Prefix
+	// usageTrailers reports the usage of filtered streams in HTTP
+	// trailers.
+	usageTrailers bool
+	// usage is the usage tracking mode (UsageOff, UsageOn, UsageForce)
+	// for routes that report OpenAI token usage; "" disables it.
+	usage string
+}
+
+// capabilityHeader selects an allowlisted capability for one request
+// instead of the route's; livepeerCapabilityHeader is an alias for it.
+// Neither is forwarded.
+const (
+	capabilityHeader         = "X-Capability"
+	livepeerCapabilityHeader = "X-Livepeer-Capability"
+)
+
+// capabilityHandler returns a handler that forwards the request body to
+// opts.path on one of opts.gateways with the Livepeer header for opts.capability and writes the
+// response back according to opts.mode.
+func capabilityHandler(opts handlerOptions) http.HandlerFunc {
+	return opts.idempotency.wrap(opts.maxBody, opts.mode == modeRawStream, func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		if !contains(opts.methods, r.Method) {
+			writeMethodNotAllowed(w, r)
+			return
+		}
+
+		if !opts.limiter.acquire(r.Context()) {
+			logger(r.Context()).Warn("concurrency limit reached", "capability", opts.capability)
+			w.Header().Set("Retry-After", "1")
+			setRateLimitHeaders(w.Header(), nil, opts.limiter)
+			writeOpenAIError(w, http.StatusTooManyRequests,
+				"Too many concurrent requests for "+opts.capability+", please retry shortly.",
+				"rate_limit_error", "concurrency_limit_exceeded")
+			return
+		}
+		defer opts.limiter.release()
+
+		if opts.multipart {
+			mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if err != nil || mediaType != "multipart/form-data" || params["boundary"] == "" {
+				writeOpenAIError(w, http.StatusBadRequest, "Content-Type must be multipart/form-data with a boundary", "invalid_request_error", "invalid_content_type")
+				return
+			}
+		}
+
+		orchestrators, err := opts.orchestratorFilter.withRequestOrchestrators(r.Header, opts.orchestratorPattern)
+		if err != nil {
+			writeOpenAIError(w, http.StatusBadRequest, err.Error(), "invalid_request_error", "invalid_orchestrator")
+			return
+		}
+
+		streamBody := opts.streamBody(r)
+		var bodyBytes []byte
+		switch {
+		case streamBody && r.ContentLength > opts.maxBody:
+			writeBodyTooLarge(w, r, opts.maxBody)
+			return
+		case !streamBody:
+			var ok bool
+			if bodyBytes, ok = readBody(w, r, opts.maxBody); !ok {
+				return
+			}
+		}
+
+		if opts.validateJSON && len(bodyBytes) > 0 && !json.Valid(bodyBytes) {
+			writeOpenAIError(w, http.StatusBadRequest, "We could not parse the JSON body of your request.", "invalid_request_error", "invalid_json")
+			return
+		}
+
+		streaming := opts.validateJSON && wantsStream(bodyBytes)
+		if streaming {
+			if opts.noStream {
+				writeOpenAIError(w, http.StatusBadRequest,
+					"This endpoint does not support streaming; remove \"stream\": true from the request.",
+					"invalid_request_error", "stream_not_supported")
+				return
+			}
+			if !opts.streams.acquire() {
+				logger(r.Context()).Warn("streaming connection limit reached", "capability", opts.capability)
+				w.Header().Set("Retry-After", "1")
+				writeOpenAIError(w, http.StatusServiceUnavailable,
+					"Too many streaming requests in progress, please retry shortly.",
+					"server_error", "streaming_limit_exceeded")
+				return
+			}
+			defer opts.streams.release()
+		}
+
+		if opts.usage == UsageForce {
+			bodyBytes = forceIncludeUsage(bodyBytes)
+		}
+		var bodyTimeout string
+		if opts.bodyTimeout {
+			bodyBytes, bodyTimeout = stripBodyTimeout(bodyBytes)
+		}
+
+		var rewrite *modelRewrite
+		bodyBytes, rewrite = opts.aliases.apply(bodyBytes)
+		if len(opts.imageSizes) > 0 || opts.defaultImageSize != "" {
+			var size string
+			if bodyBytes, size, err = imageSize(bodyBytes, opts.imageSizes, opts.defaultImageSize); err != nil {
+				writeOpenAIError(w, http.StatusBadRequest,
+					fmt.Sprintf("Invalid size %q. Supported sizes are %s.", size, strings.Join(opts.imageSizes, ", ")),
+					"invalid_request_error", "invalid_size")
+				return
+			}
+		}
+		imageFormat := ""
+		if opts.imageFormat {
+			imageFormat = imageResponseFormat(bodyBytes)
+		}
+
+		gateway, path, capability := "", opts.path, opts.capability
+		pinned := false
+		if opts.models != nil {
+			model := requestModel(bodyBytes)
+			routed, ok := opts.models.route(model)
+			if !ok {
+				writeModelNotFound(w, model)
+				return
+			}
+			if routed != "" {
+				capability = routed
+			}
+		}
+		override := strings.TrimSpace(r.Header.Get(capabilityHeader))
+		if override == "" {
+			override = strings.TrimSpace(r.Header.Get(livepeerCapabilityHeader))
+		}
+		if override != "" {
+			if !contains(opts.allowedCapabilities, override) {
+				logger(r.Context()).Warn("capability override not allowed", "capability", override)
+				writeOpenAIError(w, http.StatusForbidden,
+					"Capability "+override+" is not allowed; it must be listed in ALLOWED_CAPABILITIES.",
+					"permission_error", "capability_not_allowed")
+				return
+			}
+			capability = override
+		}
+		timeoutSeconds := opts.timeoutSeconds
+		if t, ok := opts.capabilityTimeouts[capability]; ok && capability != opts.capability {
+			timeoutSeconds = t
+		}
+		timeoutSeconds = requestTimeout(r.Context(), r.Header, bodyTimeout, timeoutSeconds, opts.minTimeoutSeconds, opts.maxTimeoutSeconds)
+
+		maxPrice := opts.maxPrice
+		if v, ok := opts.maxPrices[capability]; ok {
+			maxPrice = v
+		}
+
+		var clientHeader *clientLivepeerHeader
+		if v := r.Header.Get("Livepeer"); v != "" && opts.clientLivepeerHeader {
+			clientHeader, err = parseClientLivepeerHeader(v)
+			if err == nil && clientHeader.capability != capability && !contains(opts.allowedCapabilities, clientHeader.capability) {
+				err = fmt.Errorf("capability %s is not allowed", clientHeader.capability)
+			}
+			if err != nil {
+				writeOpenAIError(w, http.StatusBadRequest, "Invalid Livepeer header: "+err.Error(), "invalid_request_error", "invalid_livepeer_header")
+				return
+			}
+			if clientHeader.timeoutSeconds == 0 {
+				clientHeader.timeoutSeconds = timeoutSeconds
+			}
+			clientHeader.timeoutSeconds = min(clientHeader.timeoutSeconds, opts.maxTimeoutSeconds)
+			capability, timeoutSeconds = clientHeader.capability, clientHeader.timeoutSeconds
+		}
+		setTimeout(r.Context(), timeoutSeconds)
+
+		deadline := timeoutSeconds
+		if opts.requestTimeoutSeconds > 0 {
+			deadline = opts.requestTimeoutSeconds
+		}
+		ctx := r.Context()
+		ctx, cancel := context.WithTimeout(ctx, time.Duration(deadline)*time.Second)
+		defer cancel()
+
+		if opts.jobStatus && opts.jobs != nil {
+			if job, ok := opts.jobs.get(jobID(bodyBytes)); ok {
+				gateway, path, capability = job.gateway, job.statusPath, job.capability
+				pinned = true
+			}
+		}
+		if gateway == "" {
+			gateway = opts.gateways.pick()
+		}
+		target := gateway + path
+		traceCapability(ctx, capability)
+		setCapability(ctx, capability)
+
+		var body io.Reader = bytes.NewReader(bodyBytes)
+		if streamBody {
+			body = http.MaxBytesReader(w, r.Body, opts.maxBody)
+		}
+		req, err := http.NewRequestWithContext(ctx, r.Method, target, body)
+		if err != nil {
+			logger(ctx).Error("failed to create gateway request", "url", target, "error", err)
+			writeError(w, http.StatusInternalServerError, "internal_error", "Failed to create the gateway request.")
+			return
+		}
+		req.ContentLength = int64(len(bodyBytes))
+		if streamBody {
+			// -1 sends the body chunked.
+			req.ContentLength = r.ContentLength
+		}
+
+		copyHeader(req.Header, r.Header, opts.forwardHeaders)
+		setForwarded(req.Header, r, opts.trustedProxies)
+
+		opts.gatewayAuth.apply(req.Header, r.Header)
+
+		if clientHeader != nil {
+			req.Header.Set("Livepeer", clientHeader.encode())
+		} else {
+			header, err := buildLivepeerHeader(livepeerJob{
+				Parameters: livepeerParameters{
+					Orchestrators:   orchestrators.withExcluded(opts.orchestrators.excluded()),
+					MaxPricePerUnit: json.Number(maxPrice),
+				},
+				Capability:     capability,
+				TimeoutSeconds: timeoutSeconds,
+			})
+			if err != nil {
+				logger(ctx).Error("failed to build Livepeer header", "capability", capability, "error", err)
+				writeError(w, http.StatusInternalServerError, "internal_error", "Failed to create the gateway request.")
+				return
+			}
+			req.Header.Set("Livepeer", header)
+		}
+		if log := logger(ctx); log.Enabled(ctx, slog.LevelDebug) {
+			decoded, _ := base64.StdEncoding.DecodeString(req.Header.Get("Livepeer"))
+			log.Debug("sending to gateway", "url", target, "content_len", req.ContentLength, "streamed_body", streamBody, "livepeer", string(decoded))
+		}
+
+		breaker := opts.breakers.get(capability)
+		if ok, wait := breaker.allow(); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeOpenAIError(w, http.StatusServiceUnavailable,
+				"The "+capability+" capability is temporarily unavailable, please retry shortly.",
+				"api_error", "circuit_open")
+			return
+		}
+
+		race, ok := raceCount(w, r, opts, !streaming && !pinned && opts.mode != modeRawStream && opts.jobStatusPath == "" && !opts.jobStatus)
+		if !ok {
+			return
+		}
+
+		retries := opts.retries
+		if opts.jobStatusPath != "" || streamBody {
+			// A resent submit could start a second job, and a streamed
+			// body can't be sent again.
+			retries = 0
+		}
+		if !pinned && !streamBody {
+			opts.shadow.mirror(req, path, bodyBytes, time.Duration(timeoutSeconds)*time.Second)
+		}
+		gatewayStart := time.Now()
+		var resp *http.Response
+		var attempts int
+		switch {
+		case race > 1:
+			resp, err = doRaced(opts.client, req, bodyBytes, race, opts.metrics)
+		case opts.hedgeAfter > 0 && !pinned && !streamBody:
+			resp, err = doHedged(opts.client, req, bodyBytes, opts.hedgeAfter, opts.metrics)
+		default:
+			resp, attempts, err = doWithRetries(opts.client, req, retries, opts.retryBackoff, opts.metrics)
+		}
+		if err != nil && !pinned && !streamBody {
+			// Only the gateway that took a job knows about it.
+			resp, gateway, err = opts.gateways.fallThrough(ctx, gateway, err, func(gateway string) (*http.Response, error) {
+				next, err := http.NewRequestWithContext(ctx, req.Method, gateway+path, bytes.NewReader(bodyBytes))
+				if err != nil {
+					return nil, err
+				}
+				next.Header = req.Header.Clone()
+				return opts.client.Do(next)
+			})
+			target = gateway + path
+		}
+		upstream := time.Since(gatewayStart)
+		if err != nil {
+			var maxErr *http.MaxBytesError
+			if errors.As(err, &maxErr) {
+				breaker.abandon()
+				writeBodyTooLarge(w, r, opts.maxBody)
+				return
+			}
+			if r.Context().Err() != nil {
+				breaker.abandon()
+			} else {
+				breaker.record(true)
+			}
+			opts.metrics.observeCapability(capability, "error")
+			logger(ctx).Error("gateway request failed", "url", target, "timeout_seconds", timeoutSeconds, "error", err)
+			writeGatewayError(w, err)
+			return
+		}
+		defer resp.Body.Close()
+		// Only the response headers count: a stream that breaks later
+		// doesn't trip the circuit.
+		breaker.record(resp.StatusCode >= 500)
+		opts.metrics.observeCapability(capability, statusClass(resp.StatusCode))
+		setUpstreamStatus(ctx, resp.StatusCode)
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+			if d, ok := retryAfter(resp.Header, time.Now()); ok {
+				logger(ctx).Warn("gateway asked to back off", "status", resp.StatusCode, "retry_after", d.String())
+			}
+		}
+		if maxPrice != "" && clientHeader == nil && resp.StatusCode >= 400 &&
+			!strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+			// Tell a price ceiling nobody meets apart from other errors.
+			head, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+			if priceRejected(head) {
+				logger(ctx).Warn("no orchestrator within max price", "capability", capability, "max_price", maxPrice, "status", resp.StatusCode)
+				writeOpenAIError(w, http.StatusServiceUnavailable,
+					"No orchestrator is available for "+capability+" within the configured max price.",
+					"api_error", "max_price_exceeded")
+				return
+			}
+			resp.Body = io.NopCloser(io.MultiReader(bytes.NewReader(head), resp.Body))
+		}
+		if opts.orchestrators != nil {
+			opts.orchestrators.record(resp.Header.Get("X-Orchestrator-Url"), upstream, resp.StatusCode)
+		}
+
+		if opts.jobStatusPath != "" && opts.jobs != nil && resp.StatusCode/100 == 2 &&
+			!strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+			// Peek at the submit response for the job ID, then hand the
+			// full body on to the client unchanged.
+			head, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+			if id := jobID(head); id != "" {
+				opts.jobs.put(id, jobEntry{capability: capability, gateway: gateway, statusPath: opts.jobStatusPath})
+			}
+			resp.Body = io.NopCloser(io.MultiReader(bytes.NewReader(head), resp.Body))
+		}
+
+		if opts.balances != nil {
+			opts.balances.record(capability, resp.Header.Get("Livepeer-Balance"))
+		}
+
+		copyAllHeaders(w.Header(), resp.Header)
+		scrubLivepeerHeaders(w.Header(), opts.exposeLivepeerHeaders)
+		if resp.StatusCode == http.StatusTooManyRequests {
+			setRateLimitHeaders(w.Header(), resp.Header, opts.limiter)
+		}
+		if r.Header.Get(debugHeader) != "" {
+			setDebugHeaders(w.Header(), upstream, attempts, resp.Header.Get("X-Orchestrator-Url"))
+		}
+		translateUpstreamError(ctx, w.Header(), resp)
+		opts.limitResponse(w, resp)
+		if rewrite != nil && resp.StatusCode/100 == 2 && !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+			// Restore the client's model name in the JSON response.
+			data, err := io.ReadAll(resp.Body)
+			if err != nil {
+				logger(ctx).Warn("failed to read gateway response", "error", err)
+			}
+			data = rewrite.apply(data)
+			resp.Body = io.NopCloser(bytes.NewReader(data))
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		}
+		if imageFormat != "" && resp.StatusCode/100 == 2 && !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+			data, err := io.ReadAll(resp.Body)
+			if err == nil {
+				data, err = normalizeImageFormat(ctx, imageClient, data, imageFormat)
+			}
+			if err != nil {
+				logger(ctx).Error("failed to convert image response", "response_format", imageFormat, "error", err)
+				w.Header().Del("Content-Length")
+				writeOpenAIError(w, http.StatusBadGateway, "The image could not be returned as "+imageFormat+".", "api_error", "bad_gateway")
+				return
+			}
+			resp.Body = io.NopCloser(bytes.NewReader(data))
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		}
+		var captured *captureBody
+		trackUsage := opts.usage == UsageOn || opts.usage == UsageForce
+		if trackUsage && !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+			captured = &captureBody{ReadCloser: resp.Body}
+			resp.Body = captured
+		}
+		sse := sseOptions{rewrite: rewrite, keepAlive: opts.sseKeepAlive, flushInterval: opts.sseFlushInterval, maxLine: opts.sseMaxLine, requiredKeys: opts.sseRequiredKeys, interruptedEnd: opts.sseInterruptedEnd, idleTimeout: opts.sseIdleTimeout}
+		if keys, ok := opts.sseCapabilityKeys[capability]; ok {
+			sse.requiredKeys = keys
+		}
+		trailers := opts.usageTrailers && trackUsage && resp.StatusCode/100 == 2 &&
+			opts.mode != modeJSON && strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream")
+		if trailers {
+			w.Header().Set("Trailer", usageTrailerPrompt+", "+usageTrailerCompletion+", "+usageTrailerTotal)
+		}
+		stats, outcome := writeResponse(w, resp, opts.mode, sse)
+		opts.metrics.observeStream(routeFromContext(r.Context()), outcome)
+		if trailers && stats.usage != nil {
+			w.Header().Set(usageTrailerPrompt, strconv.Itoa(stats.usage.PromptTokens))
+			w.Header().Set(usageTrailerCompletion, strconv.Itoa(stats.usage.CompletionTokens))
+			w.Header().Set(usageTrailerTotal, strconv.Itoa(stats.usage.TotalTokens))
+		}
+		if opts.balances != nil && stats.balance != "" {
+			opts.balances.record(capability, stats.balance)
+		}
+		if trackUsage && resp.StatusCode/100 == 2 {
+			if captured != nil {
+				if model, u, ok := parseUsage(captured.buf.Bytes()); ok {
+					recordUsage(ctx, opts.metrics, capability, model, u)
+				}
+			} else if stats.usage != nil {
+				recordUsage(ctx, opts.metrics, capability, stats.model, *stats.usage)
+			}
+		}
+		opts.metrics.observeSSE(routeFromContext(r.Context()), start, stats)
+		traceSSE(r.Context(), start, stats)
+		setSSEStats(r.Context(), stats)
+	})
+}
+
+// writeResponse writes the gateway response status and body to w. Headers
+// must already be copied. The returned stats are zero unless the body was
+// SSE-filtered; the outcome of streamed bodies is returned too.
+func writeResponse(w http.ResponseWriter, resp *http.Response, mode responseMode, sse sseOptions) (sseStats, string) {
+	isSSE := strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream")
+
+	// The Livepeer gateway may pass through an incorrect Content-Type
+	// (text/plain). Override it at the proxy layer — this is what clients
+	// actually see.
+	switch {
+	case isSSE:
+		w.Header().Set("Content-Type", "text/event-stream")
+	case mode != modeRawStream:
+		w.Header().Set("Content-Type", "application/json")
+	}
+
+	// The SSE filter has to read plaintext events, and re-emits them
+	// uncompressed.
+	filterSSE := isSSE && mode != modeJSON
+	if filterSSE {
+		// Dropped and rewritten events change the length, and without one
+		// the response is chunked and can carry trailers.
+		w.Header().Del("Content-Length")
+	}
+	body := resp.Body
+	if filterSSE && strings.EqualFold(strings.TrimSpace(resp.Header.Get("Content-Encoding")), "gzip") {
+		zr, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			logger(resp.Request.Context()).Warn("failed to decompress gateway event stream", "error", err)
+			w.Header().Del("Content-Encoding")
+			w.Header().Del("Content-Length")
+			writeOpenAIError(w, http.StatusBadGateway, "invalid compressed event stream from gateway", "api_error", "bad_gateway")
+			return sseStats{}, ""
+		}
+		defer zr.Close()
+		body = zr
+		w.Header().Del("Content-Encoding")
+		w.Header().Del("Content-Length")
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	switch {
+	case filterSSE:
+		// Filter out non-OpenAI events injected by the Livepeer gateway
+		// (e.g. {"balance": ...}). These events lack the "choices" field
+		// and crash OpenAI SDK parsers.
+		setStreamed(resp.Request.Context())
+		return streamSSEFiltered(resp.Request.Context(), w, body, sse)
+	case isSSE || mode != modeJSON:
+		// Backends that stream (e.g. chunked embeddings/rerank) are
+		// flushed as they arrive rather than buffered.
+		setStreamed(resp.Request.Context())
+		return sseStats{}, streamResponse(resp.Request.Context(), w, resp.Body)
+	default:
+		io.Copy(w, resp.Body)
+	}
+	return sseStats{}, ""
+}
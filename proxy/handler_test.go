@@ -0,0 +1,48 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSpeechPassesAudioThrough(t *testing.T) {
+	audio := make([]byte, 1<<20)
+	if _, err := rand.Read(audio); err != nil {
+		t.Fatal(err)
+	}
+	// Every byte value, including NUL, CR and LF, must survive.
+	for i := range 256 {
+		audio[i] = byte(i)
+	}
+	for _, contentType := range []string{"audio/mpeg", "audio/wav", "audio/ogg; codecs=opus", "application/octet-stream"} {
+		t.Run(contentType, func(t *testing.T) {
+			gw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", contentType)
+				w.Write(audio)
+			}))
+			defer gw.Close()
+			p := New(Config{
+				GatewayURL: gw.URL,
+				Routes:     []Route{{Path: "/v1/audio/speech", Capability: "speech", Mode: ModeStream}},
+			})
+
+			req := httptest.NewRequest(http.MethodPost, "/v1/audio/speech", strings.NewReader(`{"model":"tts-1","input":"hi","voice":"alloy"}`))
+			req.Header.Set("Content-Type", "application/json")
+			rec := httptest.NewRecorder()
+			p.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", rec.Code, rec.Body)
+			}
+			if ct := rec.Header().Get("Content-Type"); ct != contentType {
+				t.Errorf("Content-Type %q, want %q", ct, contentType)
+			}
+			if !bytes.Equal(rec.Body.Bytes(), audio) {
+				t.Errorf("got %d bytes of audio that differ from the gateway's %d", rec.Body.Len(), len(audio))
+			}
+		})
+	}
+}
@@ -0,0 +1,361 @@
+package proxy
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// defaultForwardHeaders are the client headers always sent to the gateway.
+var defaultForwardHeaders = []string{"Content-Type", "Accept"}
+
+// unforwardableHeaders can't be added with Config.ForwardHeaders: they are
+// hop-by-hop, carry credentials, or are set by the proxy itself.
+var unforwardableHeaders = map[string]bool{
+	"Authorization": true, "Proxy-Authorization": true, "Cookie": true,
+	"Connection": true, "Keep-Alive": true, "Proxy-Connection": true, "Te": true,
+	"Trailer": true, "Transfer-Encoding": true, "Upgrade": true,
+	"Host": true, "Content-Length": true, "Livepeer": true,
+	"X-Forwarded-For": true, "X-Forwarded-Proto": true, "X-Forwarded-Host": true,
+}
+
+// ForwardedHeaders returns the client headers sent to the gateway: the
+// defaults plus cfg.ForwardHeaders, canonicalized and without duplicates.
+func (cfg Config) ForwardedHeaders() []string {
+	out := append([]string(nil), defaultForwardHeaders...)
+	for _, h := range cfg.ForwardHeaders {
+		if h = http.CanonicalHeaderKey(strings.TrimSpace(h)); !contains(out, h) {
+			out = append(out, h)
+		}
+	}
+	return out
+}
+
+// validateForwardHeaders rejects header names that aren't valid or must
+// not be forwarded.
+func validateForwardHeaders(headers []string) error {
+	for _, h := range headers {
+		name := strings.TrimSpace(h)
+		if name == "" || strings.ContainsFunc(name, func(r rune) bool {
+			return r <= ' ' || r >= 0x7f || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, r)
+		}) {
+			return fmt.Errorf("forward header %q is not a valid header name", h)
+		}
+		if unforwardableHeaders[http.CanonicalHeaderKey(name)] {
+			return fmt.Errorf("header %s can't be forwarded", http.CanonicalHeaderKey(name))
+		}
+	}
+	return nil
+}
+
+func copyHeader(dst http.Header, src http.Header, keys []string) {
+	for _, k := range keys {
+		if v := src.Get(k); v != "" {
+			dst.Set(k, v)
+		}
+	}
+}
+
+// copyAllHeaders copies src to dst without hop-by-hop headers. Retry-After
+// is only copied when it is a valid delay, so clients backing off on a 429
+// or 503 never see a value they can't parse.
+func copyAllHeaders(dst http.Header, src http.Header) {
+	for k, vv := range src {
+		if http.CanonicalHeaderKey(k) == "Retry-After" {
+			if _, ok := retryAfter(src, time.Now()); ok {
+				dst.Set(k, strings.TrimSpace(vv[0]))
+			}
+			continue
+		}
+		if strings.EqualFold(k, "Connection") ||
+			strings.EqualFold(k, "Keep-Alive") ||
+			strings.EqualFold(k, "Proxy-Authenticate") ||
+			strings.EqualFold(k, "Proxy-Authorization") ||
+			strings.EqualFold(k, "TE") ||
+			strings.EqualFold(k, "Trailer") ||
+			strings.EqualFold(k, "Transfer-Encoding") ||
+			strings.EqualFold(k, "Upgrade") {
+			continue
+		}
+		for _, v := range vv {
+			dst.Add(k, v)
+		}
+	}
+}
+
+// livepeerResponseHeaders maps the Livepeer-specific gateway response
+// headers to the names they are exposed under when
+// Config.ExposeLivepeerHeaders is set.
+var livepeerResponseHeaders = map[string]string{
+	"Livepeer-Balance":   "X-Livepeer-Balance",
+	"X-Metadata":         "X-Livepeer-Metadata",
+	"X-Orchestrator-Url": "X-Livepeer-Orchestrator-Url",
+}
+
+// scrubLivepeerHeaders removes the Livepeer-specific headers that aren't
+// part of the OpenAI API. With expose set they are renamed into the
+// X-Livepeer-* namespace instead of dropped.
+func scrubLivepeerHeaders(h http.Header, expose bool) {
+	for name, exposed := range livepeerResponseHeaders {
+		if vv := h.Values(name); expose && len(vv) > 0 {
+			h[exposed] = append([]string(nil), vv...)
+		}
+		h.Del(name)
+	}
+}
+
+// retryAfter parses the Retry-After header in h, either delay-seconds or an
+// HTTP date relative to now. A date in the past yields 0.
+func retryAfter(h http.Header, now time.Time) (time.Duration, bool) {
+	v := strings.TrimSpace(h.Get("Retry-After"))
+	if v == "" {
+		return 0, false
+	}
+	if n, err := strconv.Atoi(v); err == nil {
+		if n < 0 {
+			return 0, false
+		}
+		return time.Duration(n) * time.Second, true
+	}
+	t, err := http.ParseTime(v)
+	if err != nil {
+		return 0, false
+	}
+	return max(t.Sub(now), 0), true
+}
+
+// GatewayAuth decides the Authorization header sent to the gateway. By
+// default client credentials are stripped (auth is handled in front of
+// the proxy, e.g. by Traefik).
+type GatewayAuth struct {
+	// Forward keeps the client's Authorization header.
+	Forward bool
+	// Token, or the contents of TokenFile, is sent as a bearer token when
+	// no client header is forwarded.
+	Token     string
+	TokenFile string
+	// Value, or the contents of ValueFile, is sent as-is in Header
+	// (default Authorization) instead of a bearer token.
+	Header    string
+	Value     string
+	ValueFile string
+	// ReloadInterval is how often TokenFile or ValueFile is read again
+	// (default a minute), so a rotated secret is picked up.
+	ReloadInterval time.Duration
+
+	file *secretFile
+}
+
+// load reads TokenFile or ValueFile and starts re-reading it. It is
+// called once, by New.
+func (a *GatewayAuth) load() error {
+	path := cmp.Or(a.TokenFile, a.ValueFile)
+	if path == "" {
+		return nil
+	}
+	f, err := newSecretFile(path, cmp.Or(a.ReloadInterval, time.Minute))
+	if err != nil {
+		return err
+	}
+	a.file = f
+	return nil
+}
+
+// close stops re-reading TokenFile or ValueFile.
+func (a *GatewayAuth) close() {
+	if a.file != nil {
+		a.file.close()
+	}
+}
+
+func (a GatewayAuth) validate() error {
+	set := 0
+	for _, s := range []string{a.Token, a.TokenFile, a.Value, a.ValueFile} {
+		if s != "" {
+			set++
+		}
+	}
+	if set > 1 {
+		return errors.New("set only one of the gateway auth token, token file, value and value file")
+	}
+	if a.Header != "" && unforwardableHeaders[http.CanonicalHeaderKey(a.Header)] && !strings.EqualFold(a.Header, "Authorization") {
+		return fmt.Errorf("gateway auth header %s can't be set", a.Header)
+	}
+	if path := cmp.Or(a.TokenFile, a.ValueFile); path != "" {
+		if _, err := readSecret(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// credential returns the header and value to send to the gateway, or an
+// empty value when there is none.
+func (a GatewayAuth) credential() (header, value string) {
+	header = cmp.Or(http.CanonicalHeaderKey(a.Header), "Authorization")
+	token, raw := a.Token, a.Value
+	if a.file != nil {
+		if a.TokenFile != "" {
+			token = a.file.get()
+		} else {
+			raw = a.file.get()
+		}
+	}
+	if token != "" {
+		return "Authorization", "Bearer " + token
+	}
+	return header, raw
+}
+
+// apply sets the gateway request's Authorization header, and the
+// credential header if it is another one, in dst from the client request
+// headers src.
+func (a GatewayAuth) apply(dst, src http.Header) {
+	dst.Del("Authorization")
+	header, value := a.credential()
+	if v := src.Get("Authorization"); a.Forward && v != "" {
+		dst.Set("Authorization", v)
+		if header == "Authorization" {
+			return
+		}
+	}
+	if value != "" {
+		dst.Set(header, value)
+	}
+}
+
+// secretFile is a secret read from a file and read again every interval.
+// A failed read keeps the previous value. The value is never logged.
+type secretFile struct {
+	path  string
+	value atomic.Pointer[string]
+	stop  chan struct{}
+}
+
+func newSecretFile(path string, interval time.Duration) (*secretFile, error) {
+	v, err := readSecret(path)
+	if err != nil {
+		return nil, err
+	}
+	f := &secretFile{path: path, stop: make(chan struct{})}
+	f.value.Store(&v)
+	go f.watch(interval)
+	return f, nil
+}
+
+// watch reads the file again every interval until close is called.
+func (f *secretFile) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-f.stop:
+			return
+		case <-ticker.C:
+		}
+		v, err := readSecret(f.path)
+		if err != nil {
+			slog.Warn("failed to read secret file, keeping the previous value", "path", f.path, "error", err)
+			continue
+		}
+		if v != f.get() {
+			slog.Info("secret file changed", "path", f.path)
+			f.value.Store(&v)
+		}
+	}
+}
+
+func (f *secretFile) get() string { return *f.value.Load() }
+
+// close stops re-reading the file.
+func (f *secretFile) close() { close(f.stop) }
+
+// readSecret returns the contents of path without surrounding whitespace.
+func readSecret(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("read secret file: %w", err)
+	}
+	v := strings.TrimSpace(string(data))
+	if v == "" {
+		return "", fmt.Errorf("secret file %s is empty", path)
+	}
+	return v, nil
+}
+
+// debugHeader asks for the debug response headers set by setDebugHeaders.
+const debugHeader = "X-Proxy-Debug"
+
+// setDebugHeaders adds the gateway latency, retry count and orchestrator to
+// h, including the orchestrator URL that scrubLivepeerHeaders removes.
+func setDebugHeaders(h http.Header, upstream time.Duration, retries int, orchestrator string) {
+	h.Set("X-Proxy-Upstream-Ms", strconv.FormatInt(upstream.Milliseconds(), 10))
+	h.Set("X-Proxy-Retries", strconv.Itoa(retries))
+	if orchestrator != "" {
+		h.Set("X-Proxy-Orchestrator-Url", orchestrator)
+	}
+}
+
+// Upstream rate-limit headers mapped onto OpenAI's, by OpenAI name. The
+// first one present wins.
+var rateLimitSources = map[string][]string{
+	"X-Ratelimit-Limit-Requests":     {"Livepeer-Ratelimit-Limit", "X-Ratelimit-Limit", "Ratelimit-Limit"},
+	"X-Ratelimit-Remaining-Requests": {"Livepeer-Ratelimit-Remaining", "X-Ratelimit-Remaining", "Ratelimit-Remaining"},
+	"X-Ratelimit-Reset-Requests":     {"Livepeer-Ratelimit-Reset", "X-Ratelimit-Reset", "Ratelimit-Reset"},
+}
+
+// setRateLimitHeaders sets OpenAI's x-ratelimit-*-requests headers on a
+// 429 response so client backoff logic can read them. Values come from
+// equivalent upstream headers when present, otherwise from l's state;
+// the reset falls back to Retry-After.
+func setRateLimitHeaders(h, upstream http.Header, l *limiter) {
+	for name, sources := range rateLimitSources {
+		if h.Get(name) != "" {
+			continue
+		}
+		for _, src := range sources {
+			if v := strings.TrimSpace(upstream.Get(src)); v != "" {
+				if name == "X-Ratelimit-Reset-Requests" {
+					v = rateLimitReset(v, time.Now())
+				}
+				h.Set(name, v)
+				break
+			}
+		}
+	}
+	if l != nil {
+		if h.Get("X-Ratelimit-Limit-Requests") == "" {
+			h.Set("X-Ratelimit-Limit-Requests", strconv.Itoa(cap(l.sem)))
+		}
+		if h.Get("X-Ratelimit-Remaining-Requests") == "" {
+			h.Set("X-Ratelimit-Remaining-Requests", strconv.Itoa(cap(l.sem)-len(l.sem)))
+		}
+	}
+	if h.Get("X-Ratelimit-Reset-Requests") == "" {
+		if d, ok := retryAfter(h, time.Now()); ok {
+			h.Set("X-Ratelimit-Reset-Requests", d.String())
+		}
+	}
+}
+
+// rateLimitReset turns a reset value in seconds, or a Unix time, into the
+// duration format OpenAI uses (e.g. "1s", "6m0s"). Other values are kept.
+func rateLimitReset(v string, now time.Time) string {
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return v
+	}
+	d := time.Duration(n) * time.Second
+	// Values this large are timestamps, not delays.
+	if n > 1e9 {
+		d = max(time.Unix(n, 0).Sub(now), 0).Truncate(time.Second)
+	}
+	return d.String()
+}
@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSecretFileReloadsUntilClosed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	write := func(v string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(v+"\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("one")
+	f, err := newSecretFile(path, 5*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := f.get(); got != "one" {
+		t.Fatalf("get = %q, want one", got)
+	}
+
+	write("two")
+	for deadline := time.Now().Add(2 * time.Second); f.get() != "two"; time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("rotated secret not picked up, still %q", f.get())
+		}
+	}
+
+	f.close()
+	time.Sleep(20 * time.Millisecond) // let a tick already under way finish
+	write("three")
+	time.Sleep(50 * time.Millisecond)
+	if got := f.get(); got != "two" {
+		t.Fatalf("get = %q after close, want two", got)
+	}
+}
+
+func TestProxyClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(path, []byte("secret"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	p := New(Config{
+		GatewayURL:     "http://127.0.0.1:1",
+		GatewayAuth:    GatewayAuth{TokenFile: path},
+		JWTHS256Secret: "s3cret",
+		JobTTLSeconds:  60,
+	})
+	p.Close()
+	p.Close()
+	select {
+	case <-p.cfg.GatewayAuth.file.stop:
+	default:
+		t.Error("secret file still being re-read")
+	}
+	select {
+	case <-p.jobs.stop:
+	default:
+		t.Error("job store cleanup still running")
+	}
+}
@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"time"
+)
+
+// hedgeResult is the outcome of request i (0 original, 1 hedge) of a
+// hedged pair.
+type hedgeResult struct {
+	i    int
+	resp *http.Response
+	err  error
+}
+
+// doHedged sends req and, if the gateway hasn't answered after the
+// given delay, an identical second request. The first response wins; the
+// other request is canceled and its response body closed. req must be
+// idempotent, and body is its buffered body.
+func doHedged(client *http.Client, req *http.Request, body []byte, after time.Duration, m *metrics) (*http.Response, error) {
+	ctx := req.Context()
+	results := make(chan hedgeResult, 2)
+	var cancels [2]context.CancelFunc
+	send := func(i int) {
+		rctx, cancel := context.WithCancel(ctx)
+		cancels[i] = cancel
+		r := req.Clone(rctx)
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		go func() {
+			resp, err := client.Do(r)
+			results <- hedgeResult{i: i, resp: resp, err: err}
+		}()
+	}
+	send(0)
+
+	timer := time.NewTimer(after)
+	defer timer.Stop()
+	pending, hedged := 1, false
+	var res hedgeResult
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			logger(ctx).Debug("hedging gateway request", "after", after.String())
+			pending, hedged = pending+1, true
+			send(1)
+			continue
+		case res = <-results:
+		}
+		pending--
+		if res.err != nil {
+			cancels[res.i]()
+			if !hedged {
+				return nil, res.err
+			}
+			continue
+		}
+		if hedged {
+			winner := "original"
+			if res.i == 1 {
+				winner = "hedge"
+			}
+			m.observeHedge(routeFromContext(ctx), winner)
+		}
+		if pending > 0 {
+			cancels[1-res.i]()
+			go discardHedge(results)
+		}
+		res.resp.Body = &cancelOnClose{ReadCloser: res.resp.Body, cancel: cancels[res.i]}
+		return res.resp, nil
+	}
+	m.observeHedge(routeFromContext(ctx), "none")
+	return nil, res.err
+}
+
+// discardHedge closes the response of the canceled request of a hedged
+// pair if it arrives anyway.
+func discardHedge(results <-chan hedgeResult) {
+	if r := <-results; r.resp != nil {
+		r.resp.Body.Close()
+	}
+}
+
+// cancelOnClose cancels the request's context once its body is closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
@@ -0,0 +1,214 @@
+package proxy
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// idempotencyHeader names a request so retries of it get the first
+// response back instead of running again.
+const idempotencyHeader = "Idempotency-Key"
+
+// maxIdempotentResponse caps the size of a cached response body; larger
+// responses aren't cached.
+const maxIdempotentResponse = 4 << 20
+
+// idempotencyCache keeps the successful non-streaming responses of
+// requests with an Idempotency-Key for ttl, evicting the least recently
+// used beyond max entries. A nil *idempotencyCache caches nothing.
+type idempotencyCache struct {
+	ttl time.Duration
+	max int
+
+	mu      sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+	// pending holds the keys of requests still running, with their body
+	// hash.
+	pending map[string][sha256.Size]byte
+}
+
+type idempotentResponse struct {
+	key      string
+	bodyHash [sha256.Size]byte
+	status   int
+	header   http.Header
+	body     []byte
+	expires  time.Time
+}
+
+func newIdempotencyCache(ttl time.Duration, max int) *idempotencyCache {
+	if ttl <= 0 {
+		return nil
+	}
+	if max <= 0 {
+		max = 1000
+	}
+	return &idempotencyCache{
+		ttl:     ttl,
+		max:     max,
+		lru:     list.New(),
+		entries: map[string]*list.Element{},
+		pending: map[string][sha256.Size]byte{},
+	}
+}
+
+// begin looks key up. It returns the cached response if there is one, or
+// claims the key for a new request (ok true) unless another request with
+// it is still running. mismatch reports a key reused with a different body.
+func (c *idempotencyCache) begin(key string, bodyHash [sha256.Size]byte, now time.Time) (cached *idempotentResponse, ok, mismatch bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, found := c.entries[key]; found {
+		resp := el.Value.(*idempotentResponse)
+		if now.Before(resp.expires) {
+			c.lru.MoveToFront(el)
+			return resp, false, resp.bodyHash != bodyHash
+		}
+		c.lru.Remove(el)
+		delete(c.entries, key)
+	}
+	if hash, running := c.pending[key]; running {
+		return nil, false, hash != bodyHash
+	}
+	c.pending[key] = bodyHash
+	return nil, true, false
+}
+
+// end releases key, caching resp if it isn't nil.
+func (c *idempotencyCache) end(key string, resp *idempotentResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.pending, key)
+	if resp == nil {
+		return
+	}
+	c.entries[key] = c.lru.PushFront(resp)
+	for c.lru.Len() > c.max {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*idempotentResponse).key)
+	}
+}
+
+// wrap serves repeats of a request with an Idempotency-Key from the cache.
+// Keys are scoped to the route and the client's API key or JWT subject.
+// Routes that stream their responses (rawStream) aren't cached.
+func (c *idempotencyCache) wrap(maxBody int64, rawStream bool, next http.HandlerFunc) http.HandlerFunc {
+	if c == nil || rawStream {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		idempotencyKey := strings.TrimSpace(r.Header.Get(idempotencyHeader))
+		if idempotencyKey == "" || r.Method != http.MethodPost {
+			next(w, r)
+			return
+		}
+		body, ok := readBody(w, r, maxBody)
+		if !ok {
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		if wantsStream(body) {
+			next(w, r)
+			return
+		}
+
+		apiKey, _ := apiKeyFromContext(r.Context())
+		claims, _ := jwtClaimsFromContext(r.Context())
+		key := apiKey.id + "\x00" + claims.subject + "\x00" + r.URL.Path + "\x00" + idempotencyKey
+		bodyHash := sha256.Sum256(body)
+		cached, ok, mismatch := c.begin(key, bodyHash, time.Now())
+		switch {
+		case mismatch:
+			writeOpenAIError(w, http.StatusUnprocessableEntity,
+				"This Idempotency-Key was already used with a different request body.",
+				"invalid_request_error", "idempotency_key_mismatch")
+			return
+		case cached != nil:
+			logger(r.Context()).Debug("replaying idempotent response", "idempotency_key", idempotencyKey)
+			for k, vv := range cached.header {
+				if k != "X-Request-Id" {
+					w.Header()[k] = vv
+				}
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(cached.status)
+			_, _ = w.Write(cached.body)
+			return
+		case !ok:
+			w.Header().Set("Retry-After", "1")
+			writeOpenAIError(w, http.StatusConflict,
+				"A request with this Idempotency-Key is still in progress.",
+				"invalid_request_error", "idempotency_key_in_use")
+			return
+		}
+
+		rec := &idempotencyRecorder{ResponseWriter: w}
+		var resp *idempotentResponse
+		defer func() { c.end(key, resp) }()
+		next(rec, r)
+		if rec.cacheable() {
+			resp = &idempotentResponse{
+				key:      key,
+				bodyHash: bodyHash,
+				status:   rec.status,
+				header:   w.Header().Clone(),
+				body:     rec.buf.Bytes(),
+				expires:  time.Now().Add(c.ttl),
+			}
+		}
+	}
+}
+
+// idempotencyRecorder keeps a copy of a response for the cache.
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	status int
+	buf    bytes.Buffer
+	// uncacheable is set once the response is too large.
+	uncacheable bool
+}
+
+func (r *idempotencyRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *idempotencyRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	if !r.uncacheable {
+		if r.buf.Len()+len(b) > maxIdempotentResponse {
+			r.uncacheable = true
+			r.buf = bytes.Buffer{}
+		} else {
+			r.buf.Write(b)
+		}
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// Flush passes flushes on: JSON bodies are flushed as they arrive too, and
+// stay cacheable.
+func (r *idempotencyRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *idempotencyRecorder) Unwrap() http.ResponseWriter { return r.ResponseWriter }
+
+func (r *idempotencyRecorder) cacheable() bool {
+	return !r.uncacheable && r.status/100 == 2 &&
+		!strings.HasPrefix(r.Header().Get("Content-Type"), "text/event-stream")
+}
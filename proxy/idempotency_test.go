@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyCachesFlushedJSON(t *testing.T) {
+	var calls atomic.Int32
+	gw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"choices":[{"message":{"content":"hi"}}]}`))
+	}))
+	defer gw.Close()
+	p := New(Config{
+		GatewayURL:            gw.URL,
+		IdempotencyTTLSeconds: 60,
+		Routes:                []Route{{Path: "/v1/chat/completions", Capability: "chat", Mode: ModeSSE}},
+	})
+
+	send := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"model":"m"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(idempotencyHeader, "k1")
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		return rec
+	}
+	first, second := send(), send()
+	if first.Code != http.StatusOK || second.Code != http.StatusOK {
+		t.Fatalf("statuses %d, %d", first.Code, second.Code)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("gateway called %d times, want 1", n)
+	}
+	if second.Header().Get("Idempotent-Replayed") != "true" {
+		t.Error("second response wasn't replayed")
+	}
+	if first.Body.String() != second.Body.String() {
+		t.Errorf("replayed body %q, want %q", second.Body, first.Body)
+	}
+}
+
+func TestIdempotencyScopedToJWTSubject(t *testing.T) {
+	var calls atomic.Int32
+	gw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"choices":[{"message":{"content":"hi"}}]}`))
+	}))
+	defer gw.Close()
+	p := New(Config{
+		GatewayURL:            gw.URL,
+		IdempotencyTTLSeconds: 60,
+		JWTHS256Secret:        "s3cret",
+		Routes:                []Route{{Path: "/v1/chat/completions", Capability: "chat", Mode: ModeSSE}},
+	})
+
+	send := func(subject string) *httptest.ResponseRecorder {
+		token := signJWT(t, map[string]any{"alg": "HS256"},
+			map[string]any{"sub": subject, "exp": time.Now().Add(time.Hour).Unix()}, hs256("s3cret"))
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"model":"m"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set(idempotencyHeader, "k1")
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		return rec
+	}
+	alice, bob := send("alice"), send("bob")
+	if alice.Code != http.StatusOK || bob.Code != http.StatusOK {
+		t.Fatalf("statuses %d, %d: %s", alice.Code, bob.Code, bob.Body)
+	}
+	if n := calls.Load(); n != 2 {
+		t.Errorf("gateway called %d times, want 2", n)
+	}
+	if bob.Header().Get("Idempotent-Replayed") != "" {
+		t.Error("bob got alice's response")
+	}
+	if send("alice").Header().Get("Idempotent-Replayed") != "true" {
+		t.Error("alice's retry wasn't replayed")
+	}
+}
@@ -0,0 +1,147 @@
+package proxy
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// maxImageFetch caps the size of an image downloaded to turn a URL into
+// b64_json.
+const maxImageFetch = 32 << 20
+
+// imageClient downloads images. Image URLs can point anywhere, so it
+// doesn't share the gateway client's credentials, TLS certificate or
+// metrics.
+var imageClient = &http.Client{}
+
+// imageResponseFormat returns the "response_format" ("url" or "b64_json")
+// of an image request body, or "" if the client didn't ask for one.
+func imageResponseFormat(body []byte) string {
+	var v struct {
+		ResponseFormat string `json:"response_format"`
+	}
+	if json.Unmarshal(body, &v) != nil {
+		return ""
+	}
+	switch v.ResponseFormat {
+	case "url", "b64_json":
+		return v.ResponseFormat
+	}
+	return ""
+}
+
+// errImageSize is returned by imageSize for sizes that aren't allowed.
+var errImageSize = errors.New("unsupported image size")
+
+// imageSize checks the "size" of an image request body against allowed,
+// if any, setting it to def when the client didn't give one. Sizes are
+// normalized to lower case without spaces ("1024 X 1024" is "1024x1024").
+// Bodies that aren't JSON objects are returned unchanged.
+func imageSize(body []byte, allowed []string, def string) ([]byte, string, error) {
+	var v struct {
+		Size *string `json:"size"`
+	}
+	if json.Unmarshal(body, &v) != nil {
+		return body, "", nil
+	}
+	if v.Size == nil || *v.Size == "" {
+		if def == "" {
+			return body, "", nil
+		}
+		return setField(body, "size", def), def, nil
+	}
+	size := strings.ToLower(strings.ReplaceAll(*v.Size, " ", ""))
+	if len(allowed) > 0 && !contains(allowed, size) {
+		return body, size, errImageSize
+	}
+	if size != *v.Size {
+		body = setField(body, "size", size)
+	}
+	return body, size, nil
+}
+
+// normalizeImageFormat rewrites the "data" entries of an image response
+// to format: b64_json images become data URLs, and URLs, including data
+// URLs, are decoded or downloaded into b64_json. Other fields are kept.
+// The body is returned unchanged if it isn't an image response.
+func normalizeImageFormat(ctx context.Context, client *http.Client, body []byte, format string) ([]byte, error) {
+	var resp map[string]json.RawMessage
+	if json.Unmarshal(body, &resp) != nil {
+		return body, nil
+	}
+	var images []map[string]json.RawMessage
+	if json.Unmarshal(resp["data"], &images) != nil {
+		return body, nil
+	}
+	changed := false
+	for _, img := range images {
+		var url, b64 string
+		_ = json.Unmarshal(img["url"], &url)
+		_ = json.Unmarshal(img["b64_json"], &b64)
+		switch {
+		case format == "url" && url == "" && b64 != "":
+			raw, err := base64.StdEncoding.DecodeString(b64)
+			if err != nil {
+				return nil, fmt.Errorf("decode b64_json: %w", err)
+			}
+			img["url"], _ = json.Marshal("data:" + http.DetectContentType(raw) + ";base64," + b64)
+			delete(img, "b64_json")
+		case format == "b64_json" && b64 == "" && url != "":
+			data, err := imageData(ctx, client, url)
+			if err != nil {
+				return nil, err
+			}
+			img["b64_json"], _ = json.Marshal(data)
+			delete(img, "url")
+		default:
+			continue
+		}
+		changed = true
+	}
+	if !changed {
+		return body, nil
+	}
+	resp["data"], _ = json.Marshal(images)
+	return json.Marshal(resp)
+}
+
+// imageData returns the base64 content of an image URL, decoding data
+// URLs in place and downloading http(s) ones.
+func imageData(ctx context.Context, client *http.Client, url string) (string, error) {
+	if rest, ok := strings.CutPrefix(url, "data:"); ok {
+		meta, data, ok := strings.Cut(rest, ",")
+		if !ok || !strings.HasSuffix(meta, ";base64") {
+			return "", errors.New("unsupported data URL")
+		}
+		return data, nil
+	}
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return "", errors.New("unsupported image URL")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return "", fmt.Errorf("fetch image: status %d", resp.StatusCode)
+	}
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, maxImageFetch+1))
+	if err != nil {
+		return "", err
+	}
+	if len(raw) > maxImageFetch {
+		return "", errors.New("image too large")
+	}
+	return base64.StdEncoding.EncodeToString(raw), nil
+}
@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// recordingTransport records the hosts it sends requests to.
+type recordingTransport struct {
+	mu    sync.Mutex
+	hosts []string
+}
+
+func (t *recordingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	t.hosts = append(t.hosts, r.URL.Host)
+	t.mu.Unlock()
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func TestImageDownloadSkipsGatewayClient(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\nfake")
+	images := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(png)
+	}))
+	defer images.Close()
+	gw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"created":1,"data":[{"url":"` + images.URL + `/a.png"}]}`))
+	}))
+	defer gw.Close()
+	transport := &recordingTransport{}
+	p := New(Config{
+		GatewayURL: gw.URL,
+		Client:     &http.Client{Transport: transport},
+		Routes:     []Route{{Path: "/v1/images/generations", Capability: "image", NormalizeImageFormat: true}},
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/images/generations", strings.NewReader(`{"prompt":"p","response_format":"b64_json"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var resp struct {
+		Data []struct {
+			B64JSON string `json:"b64_json"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || len(resp.Data) != 1 {
+		t.Fatalf("response %s: %v", rec.Body, err)
+	}
+	if want := base64.StdEncoding.EncodeToString(png); resp.Data[0].B64JSON != want {
+		t.Errorf("b64_json %q, want %q", resp.Data[0].B64JSON, want)
+	}
+	imageHost := strings.TrimPrefix(images.URL, "http://")
+	for _, host := range transport.hosts {
+		if host == imageHost {
+			t.Error("image was downloaded with the gateway client")
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"runtime"
+	"time"
+)
+
+// gatewayInfo is a gateway as reported by /debug/info.
+type gatewayInfo struct {
+	URL    string `json:"url"`
+	Weight int    `json:"weight"`
+}
+
+// infoHandler serves /debug/info: the build, uptime, gateways and current
+// route table. Credentials in gateway URLs are redacted and auth tokens
+// are never included.
+func (p *Proxy) infoHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, r)
+		return
+	}
+	t := p.routes.Load()
+	gateways := make([]gatewayInfo, len(p.cfg.Gateways))
+	for i, g := range p.cfg.Gateways {
+		gateways[i] = gatewayInfo{URL: redactURL(g.URL), Weight: max(g.Weight, 1)}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"version":           p.cfg.Version,
+		"go_version":        runtime.Version(),
+		"started_at":        p.started.UTC(),
+		"uptime_seconds":    int(time.Since(p.started).Seconds()),
+		"config_generation": t.generation,
+		"gateway_url":       redactURL(p.cfg.GatewayURL),
+		"gateways":          gateways,
+		"routes":            t.routes,
+	})
+}
+
+// redactURL masks the password of a URL's userinfo.
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return ""
+	}
+	return u.Redacted()
+}
@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// jobEntry is what the proxy remembers about an async job submitted through
+// it, so the client can poll with just the job ID.
+type jobEntry struct {
+	capability string
+	// gateway is the base URL of the gateway that has the job, and
+	// statusPath the path to poll there.
+	gateway    string
+	statusPath string
+	expires    time.Time
+}
+
+// jobStore is an in-memory registry of async jobs keyed by job ID. Entries
+// expire after ttl and are swept by a background goroutine.
+type jobStore struct {
+	ttl time.Duration
+
+	mu   sync.Mutex
+	jobs map[string]jobEntry
+	stop chan struct{}
+}
+
+// newJobStore returns a jobStore and starts its cleanup goroutine. A zero
+// ttl returns nil, which disables the registry.
+func newJobStore(ttl time.Duration) *jobStore {
+	if ttl <= 0 {
+		return nil
+	}
+	s := &jobStore{ttl: ttl, jobs: map[string]jobEntry{}, stop: make(chan struct{})}
+	go s.cleanup(time.Minute)
+	return s
+}
+
+func (s *jobStore) put(jobID string, e jobEntry) {
+	e.expires = time.Now().Add(s.ttl)
+	s.mu.Lock()
+	s.jobs[jobID] = e
+	s.mu.Unlock()
+}
+
+func (s *jobStore) get(jobID string) (jobEntry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.jobs[jobID]
+	if !ok || time.Now().After(e.expires) {
+		return jobEntry{}, false
+	}
+	return e, true
+}
+
+func (s *jobStore) cleanup(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case now := <-ticker.C:
+			s.sweep(now)
+		}
+	}
+}
+
+// close stops the cleanup goroutine.
+func (s *jobStore) close() {
+	if s != nil {
+		close(s.stop)
+	}
+}
+
+// sweep drops the jobs expired at now.
+func (s *jobStore) sweep(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, e := range s.jobs {
+		if now.After(e.expires) {
+			delete(s.jobs, id)
+		}
+	}
+}
+
+// jobID extracts the "job_id" field from a JSON body, or "" if absent.
+func jobID(body []byte) string {
+	var v struct {
+		JobID string `json:"job_id"`
+	}
+	_ = json.Unmarshal(body, &v)
+	return v.JobID
+}
@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJobStore(t *testing.T) {
+	if newJobStore(0) != nil {
+		t.Fatal("a zero TTL should disable the store")
+	}
+	s := &jobStore{ttl: time.Hour, jobs: map[string]jobEntry{}}
+	s.put("j1", jobEntry{capability: "video", gateway: "http://gw-a", statusPath: "/status"})
+	e, ok := s.get("j1")
+	if !ok || e.capability != "video" || e.gateway != "http://gw-a" || e.statusPath != "/status" {
+		t.Fatalf("get(j1) = %+v, %v", e, ok)
+	}
+	if _, ok := s.get("j2"); ok {
+		t.Fatal("get(j2) found an unknown job")
+	}
+	if _, ok := s.get(""); ok {
+		t.Fatal("get found an empty job ID")
+	}
+
+	s.mu.Lock()
+	s.jobs["old"] = jobEntry{gateway: "http://gw-b", expires: time.Now().Add(-time.Second)}
+	s.mu.Unlock()
+	if _, ok := s.get("old"); ok {
+		t.Fatal("get returned an expired job")
+	}
+	s.sweep(time.Now())
+	s.mu.Lock()
+	_, oldKept := s.jobs["old"]
+	_, j1Kept := s.jobs["j1"]
+	s.mu.Unlock()
+	if oldKept || !j1Kept {
+		t.Fatalf("after sweep: old kept %v, j1 kept %v; want false, true", oldKept, j1Kept)
+	}
+	s.sweep(time.Now().Add(2 * time.Hour))
+	if _, ok := s.get("j1"); ok {
+		t.Fatal("j1 survived a sweep after its TTL")
+	}
+}
+
+func TestJobStatusPollGoesToSubmitGateway(t *testing.T) {
+	type call struct {
+		gateway, path, capability string
+	}
+	calls := make(chan call, 10)
+	gateway := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, h, _, _ := decodeLivepeerHeader(t, r.Header.Get("Livepeer"))
+			calls <- call{name, r.URL.Path, h.Capability}
+			w.Header().Set("Content-Type", "application/json")
+			if strings.HasSuffix(r.URL.Path, "/status") {
+				w.Write([]byte(`{"status":"running"}`))
+				return
+			}
+			w.Write([]byte(`{"job_id":"j1"}`))
+		}))
+	}
+	a, b := gateway("a"), gateway("b")
+	defer a.Close()
+	defer b.Close()
+	p := New(Config{
+		Gateways:            []Gateway{{URL: a.URL}, {URL: b.URL}},
+		JobTTLSeconds:       60,
+		AllowedCapabilities: []string{"video-b"},
+		Routes: []Route{
+			{Path: "/v1/video/generations", Capability: "video", JobStatusPath: "/v1/video/generations/status"},
+			{Path: "/v1/video/generations/status", Capability: "video", GatewayPath: "/jobs/status"},
+		},
+	})
+	post := func(path, body string, header http.Header) call {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status %d: %s", path, rec.Code, rec.Body)
+		}
+		return <-calls
+	}
+
+	submit := post("/v1/video/generations", `{"prompt":"p"}`, http.Header{"X-Capability": {"video-b"}})
+	if submit.gateway != "a" || submit.capability != "video-b" {
+		t.Fatalf("submit went to %+v", submit)
+	}
+	// Round-robin would send the next request to b; the poll follows the job.
+	if poll := post("/v1/video/generations/status", `{"job_id":"j1"}`, nil); poll != (call{"a", "/jobs/status", "video-b"}) {
+		t.Errorf("poll for j1 went to %+v, want gateway a with capability video-b", poll)
+	}
+	if poll := post("/v1/video/generations/status", `{"job_id":"unknown"}`, nil); poll != (call{"b", "/jobs/status", "video"}) {
+		t.Errorf("poll for an unknown job went to %+v, want gateway b with capability video", poll)
+	}
+}
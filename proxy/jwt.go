@@ -0,0 +1,432 @@
+package proxy
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// jwtLeeway is the clock skew allowed when checking exp and nbf.
+const jwtLeeway = time.Minute
+
+// jwksMinRefresh is how often a token with an unknown kid may trigger a
+// JWKS fetch ahead of the regular refresh.
+const jwksMinRefresh = 30 * time.Second
+
+// jwtClaims is the identity of a request authenticated with a JWT.
+// subject is the "sub" claim; client is the value of the rate limit claim.
+type jwtClaims struct {
+	subject string
+	client  string
+}
+
+type jwtClaimsKey struct{}
+
+// jwtClaimsFromContext returns the claims withJWT accepted for the request.
+func jwtClaimsFromContext(ctx context.Context) (jwtClaims, bool) {
+	c, ok := ctx.Value(jwtClaimsKey{}).(jwtClaims)
+	return c, ok
+}
+
+// jwtVerifier checks bearer JWTs signed with an HS256 secret or a key from
+// a JWKS. A nil *jwtVerifier accepts no tokens.
+type jwtVerifier struct {
+	secret    []byte
+	issuer    string
+	audience  string
+	limitWith string
+	jwks      *jwks
+}
+
+// jwksClient fetches key sets. The JWKS is usually served by a public
+// identity provider, so it doesn't share the gateway client's TLS
+// settings or client certificate.
+var jwksClient = &http.Client{Timeout: 10 * time.Second}
+
+func newJWTVerifier(cfg Config, m *metrics) *jwtVerifier {
+	if cfg.JWTJWKSURL == "" && cfg.JWTHS256Secret == "" {
+		return nil
+	}
+	v := &jwtVerifier{
+		secret:    []byte(cfg.JWTHS256Secret),
+		issuer:    cfg.JWTIssuer,
+		audience:  cfg.JWTAudience,
+		limitWith: cfg.JWTRateLimitClaim,
+	}
+	if cfg.JWTJWKSURL != "" {
+		v.jwks = newJWKS(cfg.JWTJWKSURL, time.Duration(cfg.JWTJWKSRefreshSeconds)*time.Second, jwksClient, m)
+	}
+	return v
+}
+
+// close stops refreshing the JWKS.
+func (v *jwtVerifier) close() {
+	if v != nil && v.jwks != nil {
+		v.jwks.close()
+	}
+}
+
+// verify checks token's signature and its exp, nbf, iss and aud claims.
+func (v *jwtVerifier) verify(token string, now time.Time) (jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return jwtClaims{}, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return jwtClaims{}, fmt.Errorf("malformed header: %w", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return jwtClaims{}, errors.New("malformed signature")
+	}
+	if err := v.checkSignature(header.Alg, header.Kid, parts[0]+"."+parts[1], sig); err != nil {
+		return jwtClaims{}, err
+	}
+	var claims map[string]any
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return jwtClaims{}, fmt.Errorf("malformed claims: %w", err)
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return jwtClaims{}, errors.New("token has no expiry")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(jwtLeeway)) {
+		return jwtClaims{}, errors.New("token is expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return jwtClaims{}, errors.New("token is not valid yet")
+	}
+	if v.issuer != "" && claims["iss"] != v.issuer {
+		return jwtClaims{}, errors.New("token has the wrong issuer")
+	}
+	if v.audience != "" && !hasAudience(claims["aud"], v.audience) {
+		return jwtClaims{}, errors.New("token has the wrong audience")
+	}
+	c := jwtClaims{subject: claimString(claims["sub"])}
+	if v.limitWith != "" {
+		c.client = claimString(claims[v.limitWith])
+	}
+	return c, nil
+}
+
+// checkSignature verifies sig over signed. Only HS256 (with a secret) and
+// the RS and ES algorithms (with a JWKS) are accepted.
+func (v *jwtVerifier) checkSignature(alg, kid, signed string, sig []byte) error {
+	if alg == "HS256" {
+		if len(v.secret) == 0 {
+			return errors.New("unexpected signing algorithm HS256")
+		}
+		mac := hmac.New(sha256.New, v.secret)
+		mac.Write([]byte(signed))
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	}
+	hash, ok := map[string]crypto.Hash{
+		"RS256": crypto.SHA256, "RS384": crypto.SHA384, "RS512": crypto.SHA512,
+		"ES256": crypto.SHA256, "ES384": crypto.SHA384, "ES512": crypto.SHA512,
+	}[alg]
+	if !ok || v.jwks == nil {
+		return fmt.Errorf("unexpected signing algorithm %q", alg)
+	}
+	key := v.jwks.key(kid)
+	if key == nil {
+		return fmt.Errorf("unknown key ID %q", kid)
+	}
+	var digest []byte
+	switch hash {
+	case crypto.SHA256:
+		d := sha256.Sum256([]byte(signed))
+		digest = d[:]
+	case crypto.SHA384:
+		d := sha512.Sum384([]byte(signed))
+		digest = d[:]
+	default:
+		d := sha512.Sum512([]byte(signed))
+		digest = d[:]
+	}
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if alg[0] == 'R' && rsa.VerifyPKCS1v15(key, hash, digest, sig) == nil {
+			return nil
+		}
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if alg[0] == 'E' && len(sig) == 2*size {
+			r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+			if ecdsa.Verify(key, digest, r, s) {
+				return nil
+			}
+		}
+	}
+	return errors.New("invalid signature")
+}
+
+func decodeJWTPart(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// hasAudience reports whether aud, a string or a list of strings,
+// includes want.
+func hasAudience(aud any, want string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == want
+	case []any:
+		for _, a := range aud {
+			if a == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// claimString returns a string or numeric claim as a string.
+func claimString(v any) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return ""
+}
+
+// looksLikeJWT reports whether token has the three dot-separated parts of
+// a JWT, so it isn't checked as an API key.
+func looksLikeJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// withJWT requires a valid bearer JWT on /v1/ requests. With API keys
+// also configured, tokens that aren't JWTs are left to withAPIKeys.
+func withJWT(next http.Handler, v *jwtVerifier, keys *apiKeys, m *metrics) http.Handler {
+	if v == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/v1/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		token = strings.TrimSpace(token)
+		if keys != nil && !looksLikeJWT(token) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !found || token == "" {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeOpenAIError(w, http.StatusUnauthorized,
+				"You didn't provide a token. Send it in the Authorization header as 'Bearer YOUR_TOKEN'.",
+				"invalid_request_error", "missing_api_key")
+			return
+		}
+		claims, err := v.verify(token, time.Now())
+		if err != nil {
+			logger(r.Context()).Warn("invalid JWT", "error", err)
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			writeOpenAIError(w, http.StatusUnauthorized, "Invalid token: "+err.Error()+".",
+				"invalid_request_error", "invalid_token")
+			return
+		}
+		if info := getRequestInfo(r.Context()); info != nil {
+			info.subject = claims.subject
+		}
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), jwtClaimsKey{}, claims)))
+		m.observeJWT(statusClass(rec.status()))
+	})
+}
+
+// jwks is a JSON Web Key Set fetched from url and refreshed in the
+// background. A failed fetch keeps the last good set.
+type jwks struct {
+	url    string
+	client *http.Client
+	keys   atomic.Pointer[map[string]crypto.PublicKey]
+
+	mu      sync.Mutex
+	fetched time.Time
+
+	metrics *metrics
+	stop    chan struct{}
+}
+
+// newJWKS fetches the key set and starts refreshing it every interval
+// (default 5 minutes). A failed first fetch is logged; tokens are rejected
+// until a fetch succeeds.
+func newJWKS(url string, interval time.Duration, client *http.Client, m *metrics) *jwks {
+	if interval <= 0 {
+		interval = 5 * time.Minute
+	}
+	k := &jwks{url: url, client: client, metrics: m, stop: make(chan struct{})}
+	k.keys.Store(&map[string]crypto.PublicKey{})
+	k.refresh()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-k.stop:
+				return
+			case <-ticker.C:
+				k.refresh()
+			}
+		}
+	}()
+	return k
+}
+
+// close stops the background refreshes.
+func (k *jwks) close() { close(k.stop) }
+
+// key returns the key with the given ID, fetching the set again if it
+// isn't there and the last fetch is older than jwksMinRefresh.
+func (k *jwks) key(kid string) crypto.PublicKey {
+	if key, ok := (*k.keys.Load())[kid]; ok {
+		return key
+	}
+	k.mu.Lock()
+	stale := time.Since(k.fetched) >= jwksMinRefresh
+	k.mu.Unlock()
+	if stale {
+		k.refresh()
+	}
+	return (*k.keys.Load())[kid]
+}
+
+func (k *jwks) refresh() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.fetched = time.Now()
+	keys, err := k.fetch()
+	if err != nil {
+		slog.Warn("JWKS refresh failed, keeping the previous keys", "url", k.url, "error", err)
+		k.metrics.observeJWKSRefresh("error")
+		return
+	}
+	k.keys.Store(&keys)
+	k.metrics.observeJWKSRefresh("ok")
+}
+
+func (k *jwks) fetch() (map[string]crypto.PublicKey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, k.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&set); err != nil {
+		return nil, err
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, j := range set.Keys {
+		if j.Use != "" && j.Use != "sig" {
+			continue
+		}
+		key, err := j.publicKey()
+		if err != nil {
+			slog.Warn("skipping JWKS key", "kid", j.Kid, "error", err)
+			continue
+		}
+		keys[j.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no usable keys")
+	}
+	return keys, nil
+}
+
+// jwk is an RSA or EC public key in a JWKS.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (j jwk) publicKey() (crypto.PublicKey, error) {
+	num := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil || len(b) == 0 {
+			return nil, errors.New("invalid key parameter")
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+	switch j.Kty {
+	case "RSA":
+		n, err := num(j.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := num(j.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		curve, ok := map[string]elliptic.Curve{
+			"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521(),
+		}[j.Crv]
+		if !ok {
+			return nil, fmt.Errorf("unsupported curve %q", j.Crv)
+		}
+		x, err := num(j.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := num(j.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", j.Kty)
+}
@@ -0,0 +1,240 @@
+package proxy
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var b64 = base64.RawURLEncoding
+
+// signJWT returns header.claims signed by sign, which gets the signing
+// input.
+func signJWT(t *testing.T, header, claims map[string]any, sign func(signed []byte) []byte) string {
+	t.Helper()
+	h, err := json.Marshal(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := b64.EncodeToString(h) + "." + b64.EncodeToString(c)
+	return signed + "." + b64.EncodeToString(sign([]byte(signed)))
+}
+
+func hs256(secret string) func([]byte) []byte {
+	return func(signed []byte) []byte {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(signed)
+		return mac.Sum(nil)
+	}
+}
+
+func rs256(t *testing.T, key *rsa.PrivateKey) func([]byte) []byte {
+	return func(signed []byte) []byte {
+		d := sha256.Sum256(signed)
+		sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, d[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sig
+	}
+}
+
+func es256(t *testing.T, key *ecdsa.PrivateKey) func([]byte) []byte {
+	return func(signed []byte) []byte {
+		d := sha256.Sum256(signed)
+		r, s, err := ecdsa.Sign(rand.Reader, key, d[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+}
+
+// jwksServer serves a JWKS with rsaKey as "rsa-1" and ecKey as "ec-1"
+// until fail is set.
+func jwksServer(t *testing.T, rsaKey *rsa.PrivateKey, ecKey *ecdsa.PrivateKey, fail *atomic.Bool) *httptest.Server {
+	t.Helper()
+	set := map[string]any{"keys": []map[string]string{
+		{
+			"kty": "RSA", "kid": "rsa-1", "use": "sig",
+			"n": b64.EncodeToString(rsaKey.N.Bytes()),
+			"e": b64.EncodeToString(big.NewInt(int64(rsaKey.E)).Bytes()),
+		},
+		{
+			"kty": "EC", "kid": "ec-1", "crv": "P-256",
+			"x": b64.EncodeToString(ecKey.X.FillBytes(make([]byte, 32))),
+			"y": b64.EncodeToString(ecKey.Y.FillBytes(make([]byte, 32))),
+		},
+	}}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail.Load() {
+			http.Error(w, "down", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(set)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestJWTVerify(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherRSA, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fail atomic.Bool
+	srv := jwksServer(t, rsaKey, ecKey, &fail)
+
+	now := time.Unix(1_700_000_000, 0)
+	hsOnly := &jwtVerifier{secret: []byte("s3cret")}
+	withJWKS := &jwtVerifier{jwks: newJWKS(srv.URL, time.Hour, srv.Client(), nil)}
+	scoped := &jwtVerifier{secret: []byte("s3cret"), issuer: "https://issuer", audience: "proxy"}
+
+	claims := func(extra map[string]any) map[string]any {
+		c := map[string]any{"sub": "user-1", "exp": now.Add(time.Hour).Unix()}
+		for k, v := range extra {
+			c[k] = v
+		}
+		return c
+	}
+	hs := map[string]any{"alg": "HS256", "typ": "JWT"}
+	none := func([]byte) []byte { return nil }
+
+	for _, tc := range []struct {
+		name     string
+		verifier *jwtVerifier
+		token    string
+		wantErr  string
+	}{
+		{"HS256 valid", hsOnly, signJWT(t, hs, claims(nil), hs256("s3cret")), ""},
+		{"HS256 bad signature", hsOnly, signJWT(t, hs, claims(nil), hs256("wrong")), "invalid signature"},
+		{"HS256 without a secret", withJWKS, signJWT(t, hs, claims(nil), hs256("")), "unexpected signing algorithm"},
+		{"alg none", hsOnly, signJWT(t, map[string]any{"alg": "none"}, claims(nil), none), "unexpected signing algorithm"},
+		{"alg None", hsOnly, signJWT(t, map[string]any{"alg": "None"}, claims(nil), none), "unexpected signing algorithm"},
+		{"alg HS512", hsOnly, signJWT(t, map[string]any{"alg": "HS512"}, claims(nil), hs256("s3cret")), "unexpected signing algorithm"},
+		{"RS256 without a JWKS", hsOnly, signJWT(t, map[string]any{"alg": "RS256", "kid": "rsa-1"}, claims(nil), rs256(t, rsaKey)), "unexpected signing algorithm"},
+		{"RS256 valid", withJWKS, signJWT(t, map[string]any{"alg": "RS256", "kid": "rsa-1"}, claims(nil), rs256(t, rsaKey)), ""},
+		{"RS256 wrong key", withJWKS, signJWT(t, map[string]any{"alg": "RS256", "kid": "rsa-1"}, claims(nil), rs256(t, otherRSA)), "invalid signature"},
+		{"RS256 unknown kid", withJWKS, signJWT(t, map[string]any{"alg": "RS256", "kid": "rsa-2"}, claims(nil), rs256(t, rsaKey)), "unknown key ID"},
+		{"ES256 valid", withJWKS, signJWT(t, map[string]any{"alg": "ES256", "kid": "ec-1"}, claims(nil), es256(t, ecKey)), ""},
+		{"ES256 unknown kid", withJWKS, signJWT(t, map[string]any{"alg": "ES256", "kid": "ec-2"}, claims(nil), es256(t, ecKey)), "unknown key ID"},
+		{"ES256 on an RSA key", withJWKS, signJWT(t, map[string]any{"alg": "ES256", "kid": "rsa-1"}, claims(nil), es256(t, ecKey)), "invalid signature"},
+		{"no exp", hsOnly, signJWT(t, hs, map[string]any{"sub": "user-1"}, hs256("s3cret")), "no expiry"},
+		{"expired within leeway", hsOnly, signJWT(t, hs, claims(map[string]any{"exp": now.Add(-30 * time.Second).Unix()}), hs256("s3cret")), ""},
+		{"expired", hsOnly, signJWT(t, hs, claims(map[string]any{"exp": now.Add(-2 * time.Minute).Unix()}), hs256("s3cret")), "expired"},
+		{"nbf within leeway", hsOnly, signJWT(t, hs, claims(map[string]any{"nbf": now.Add(30 * time.Second).Unix()}), hs256("s3cret")), ""},
+		{"nbf in the future", hsOnly, signJWT(t, hs, claims(map[string]any{"nbf": now.Add(2 * time.Minute).Unix()}), hs256("s3cret")), "not valid yet"},
+		{"iss and aud string", scoped, signJWT(t, hs, claims(map[string]any{"iss": "https://issuer", "aud": "proxy"}), hs256("s3cret")), ""},
+		{"aud array", scoped, signJWT(t, hs, claims(map[string]any{"iss": "https://issuer", "aud": []string{"other", "proxy"}}), hs256("s3cret")), ""},
+		{"wrong iss", scoped, signJWT(t, hs, claims(map[string]any{"iss": "https://evil", "aud": "proxy"}), hs256("s3cret")), "wrong issuer"},
+		{"missing iss", scoped, signJWT(t, hs, claims(map[string]any{"aud": "proxy"}), hs256("s3cret")), "wrong issuer"},
+		{"wrong aud string", scoped, signJWT(t, hs, claims(map[string]any{"iss": "https://issuer", "aud": "other"}), hs256("s3cret")), "wrong audience"},
+		{"wrong aud array", scoped, signJWT(t, hs, claims(map[string]any{"iss": "https://issuer", "aud": []string{"a", "b"}}), hs256("s3cret")), "wrong audience"},
+		{"malformed", hsOnly, "not.a-token", "malformed"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c, err := tc.verifier.verify(tc.token, now)
+			switch {
+			case tc.wantErr == "" && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case tc.wantErr == "" && c.subject != "user-1":
+				t.Fatalf("subject %q, want user-1", c.subject)
+			case tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)):
+				t.Fatalf("error %v, want one containing %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestJWKSKeepsKeysAfterFailedRefresh(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fail atomic.Bool
+	srv := jwksServer(t, rsaKey, ecKey, &fail)
+	v := &jwtVerifier{jwks: newJWKS(srv.URL, time.Hour, srv.Client(), nil)}
+	now := time.Now()
+	token := signJWT(t, map[string]any{"alg": "RS256", "kid": "rsa-1"},
+		map[string]any{"sub": "user-1", "exp": now.Add(time.Hour).Unix()}, rs256(t, rsaKey))
+	if _, err := v.verify(token, now); err != nil {
+		t.Fatalf("before the failed refresh: %v", err)
+	}
+
+	fail.Store(true)
+	v.jwks.refresh()
+	if _, err := v.verify(token, now); err != nil {
+		t.Fatalf("after the failed refresh: %v", err)
+	}
+}
+
+func TestJWKSSkipsGatewayClient(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fail atomic.Bool
+	keys := jwksServer(t, rsaKey, ecKey, &fail)
+	gw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"choices":[]}`))
+	}))
+	defer gw.Close()
+	transport := &recordingTransport{}
+	p := New(Config{
+		GatewayURL: gw.URL,
+		Client:     &http.Client{Transport: transport},
+		JWTJWKSURL: keys.URL,
+		Routes:     []Route{{Path: "/v1/chat/completions", Capability: "llm"}},
+	})
+
+	token := signJWT(t, map[string]any{"alg": "RS256", "kid": "rsa-1"},
+		map[string]any{"sub": "user-1", "exp": time.Now().Add(time.Hour).Unix()}, rs256(t, rsaKey))
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"model":"m"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	keysHost := strings.TrimPrefix(keys.URL, "http://")
+	for _, host := range transport.hosts {
+		if host == keysHost {
+			t.Error("JWKS was fetched with the gateway client")
+		}
+	}
+}
@@ -0,0 +1,281 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Concurrency limit modes.
+const (
+	// ConcurrencyReject answers 429 as soon as a capability is at its limit.
+	ConcurrencyReject = "reject"
+	// ConcurrencyBlock waits up to Config.ConcurrencyQueueTimeoutSeconds for
+	// a slot before answering 429.
+	ConcurrencyBlock = "block"
+)
+
+// limiter caps the number of in-flight gateway requests for a capability.
+// A nil *limiter never limits.
+type limiter struct {
+	capability   string
+	sem          chan struct{}
+	queueTimeout time.Duration
+	metrics      *metrics
+}
+
+func newLimiter(capability string, max int, mode string, queueTimeout time.Duration, m *metrics) *limiter {
+	if max <= 0 {
+		return nil
+	}
+	if mode != ConcurrencyBlock {
+		queueTimeout = 0
+	}
+	return &limiter{capability: capability, sem: make(chan struct{}, max), queueTimeout: queueTimeout, metrics: m}
+}
+
+// acquire takes a slot, waiting up to the queue timeout if the limiter
+// blocks. It reports false if no slot became available; otherwise the
+// caller must release.
+func (l *limiter) acquire(ctx context.Context) bool {
+	if l == nil {
+		return true
+	}
+	select {
+	case l.sem <- struct{}{}:
+		l.metrics.observeConcurrency(l.capability, 1, 0)
+		return true
+	default:
+	}
+	if l.queueTimeout <= 0 {
+		return false
+	}
+	l.metrics.observeConcurrency(l.capability, 0, 1)
+	defer l.metrics.observeConcurrency(l.capability, 0, -1)
+	timer := time.NewTimer(l.queueTimeout)
+	defer timer.Stop()
+	select {
+	case l.sem <- struct{}{}:
+		l.metrics.observeConcurrency(l.capability, 1, 0)
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (l *limiter) release() {
+	if l != nil {
+		<-l.sem
+		l.metrics.observeConcurrency(l.capability, -1, 0)
+	}
+}
+
+// newLimiters returns a limiter per capability. Routes sharing a capability
+// share its limit; if they disagree the highest limit wins.
+func newLimiters(cfg Config, routes []Route, prev map[string]*limiter, m *metrics) map[string]*limiter {
+	max := map[string]int{}
+	for capability, n := range cfg.BYOCCapabilityConcurrency {
+		max[capability] = n
+	}
+	for _, rt := range routes {
+		if rt.MaxConcurrency > max[rt.Capability] {
+			max[rt.Capability] = rt.MaxConcurrency
+		}
+	}
+	queueTimeout := time.Duration(cfg.ConcurrencyQueueTimeoutSeconds) * time.Second
+	limiters := map[string]*limiter{}
+	for capability, n := range max {
+		// Keep unchanged limiters so requests in flight across a reload
+		// still count against them.
+		if l := prev[capability]; l != nil && cap(l.sem) == n {
+			limiters[capability] = l
+			continue
+		}
+		if l := newLimiter(capability, n, cfg.ConcurrencyMode, queueTimeout, m); l != nil {
+			limiters[capability] = l
+		}
+	}
+	return limiters
+}
+
+// streamLimiter counts the streaming requests in flight across all routes
+// and caps them at max, 0 meaning no cap. Streams hold their connection
+// for much longer than other requests, so they get a limit of their own.
+type streamLimiter struct {
+	max     int64
+	n       atomic.Int64
+	metrics *metrics
+}
+
+func newStreamLimiter(max int, m *metrics) *streamLimiter {
+	return &streamLimiter{max: int64(max), metrics: m}
+}
+
+// limited reports whether streams are capped.
+func (l *streamLimiter) limited() bool {
+	return l != nil && l.max > 0
+}
+
+// acquire counts a stream, reporting false without counting it if the cap
+// is reached. The caller must release after a true result.
+func (l *streamLimiter) acquire() bool {
+	n := l.n.Add(1)
+	if l.max > 0 && n > l.max {
+		l.n.Add(-1)
+		return false
+	}
+	l.metrics.observeStreams(n)
+	return true
+}
+
+func (l *streamLimiter) release() {
+	l.metrics.observeStreams(l.n.Add(-1))
+}
+
+// wantsStream reports whether a JSON request body asks for a streamed
+// response. Bodies without "stream" aren't parsed.
+func wantsStream(body []byte) bool {
+	if !bytes.Contains(body, []byte(`"stream"`)) {
+		return false
+	}
+	var v struct {
+		Stream bool `json:"stream"`
+	}
+	return json.Unmarshal(body, &v) == nil && v.Stream
+}
+
+// readBody reads r's body, answering 413 request_too_large if it is longer
+// than max bytes and 400 invalid_body if it can't be read. It reports
+// whether the body was read.
+func readBody(w http.ResponseWriter, r *http.Request, max int64) ([]byte, bool) {
+	defer r.Body.Close()
+	var (
+		body     []byte
+		err      error
+		maxErr   *http.MaxBytesError
+		tooLarge = r.ContentLength > max
+	)
+	if !tooLarge {
+		body, err = io.ReadAll(http.MaxBytesReader(w, r.Body, max))
+		tooLarge = errors.As(err, &maxErr)
+	}
+	switch {
+	case tooLarge:
+		writeBodyTooLarge(w, r, max)
+		return nil, false
+	case err != nil:
+		logger(r.Context()).Warn("failed to read request body", "error", err)
+		writeError(w, http.StatusBadRequest, "invalid_body", "Failed to read the request body.")
+		return nil, false
+	}
+	return body, true
+}
+
+// writeBodyTooLarge answers a request whose body is over max bytes.
+func writeBodyTooLarge(w http.ResponseWriter, r *http.Request, max int64) {
+	logger(r.Context()).Warn("request body too large", "content_length", r.ContentLength, "max_body_bytes", max)
+	writeError(w, http.StatusRequestEntityTooLarge, "request_too_large",
+		"The request body exceeds the limit of "+strconv.FormatInt(max, 10)+" bytes for this endpoint.")
+}
+
+// errResponseTooLarge ends a streamed gateway response over the limit.
+var errResponseTooLarge = errors.New("gateway response too large")
+
+// responseLimit bounds a gateway response body to max bytes. Past it, a
+// truncating limit ends the body early, as if it were complete; otherwise
+// reads fail with errResponseTooLarge. Either is logged.
+type responseLimit struct {
+	io.ReadCloser
+	ctx      context.Context
+	max, n   int64
+	truncate bool
+}
+
+func (l *responseLimit) Read(p []byte) (int, error) {
+	if l.n > l.max {
+		return 0, l.exceeded()
+	}
+	// Read up to one byte past the limit to tell a body of exactly max
+	// bytes from a longer one.
+	if rest := l.max - l.n + 1; int64(len(p)) > rest {
+		p = p[:rest]
+	}
+	n, err := l.ReadCloser.Read(p)
+	l.n += int64(n)
+	if l.n > l.max {
+		logger(l.ctx).Warn("gateway response exceeds limit", "max_response_bytes", l.max, "truncated", l.truncate)
+		return n - 1, l.exceeded()
+	}
+	return n, err
+}
+
+func (l *responseLimit) exceeded() error {
+	if l.truncate {
+		return io.EOF
+	}
+	return errResponseTooLarge
+}
+
+// limitResponse bounds resp's body, before anything reads it, and drops
+// w's Content-Length if the body is known to be truncated. Streamed
+// responses (SSE, or any on raw stream routes) are aborted past
+// opts.maxStreamResponse, others truncated at opts.maxResponse. A limit of
+// 0 leaves the body alone.
+func (opts handlerOptions) limitResponse(w http.ResponseWriter, resp *http.Response) {
+	streamed := opts.mode == modeRawStream || strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream")
+	max := opts.maxResponse
+	if streamed {
+		max = opts.maxStreamResponse
+	}
+	if max <= 0 {
+		return
+	}
+	if !streamed && resp.ContentLength > max {
+		w.Header().Del("Content-Length")
+	}
+	resp.Body = &responseLimit{ReadCloser: resp.Body, ctx: resp.Request.Context(), max: max, truncate: !streamed}
+}
+
+// Request body buffering modes.
+const (
+	// BodyBufferingAuto streams large bodies the proxy doesn't need to
+	// read when the request won't be resent.
+	BodyBufferingAuto = "auto"
+	// BodyBufferingAlways reads every body into memory before forwarding.
+	BodyBufferingAlways = "always"
+	// BodyBufferingNever streams every body the proxy doesn't need to
+	// read, giving up retries for those requests.
+	BodyBufferingNever = "never"
+)
+
+// minStreamedBody is the smallest body BodyBufferingAuto streams; smaller
+// ones are cheap to buffer.
+const minStreamedBody = 256 << 10
+
+// streamBody reports whether r's body can go to the gateway as it arrives
+// instead of being buffered: the route must not rewrite it or need its
+// "stream" field, and nothing may need to send it again. JSON bodies
+// that are streamed skip the validateJSON check.
+func (opts handlerOptions) streamBody(r *http.Request) bool {
+	needsStreamField := opts.validateJSON && (opts.noStream || opts.streams.limited())
+	if opts.bodyBuffering == BodyBufferingAlways || needsStreamField || opts.models != nil ||
+		opts.aliases != nil || opts.bodyTimeout || opts.usage == UsageForce || opts.jobStatus ||
+		opts.imageFormat || len(opts.imageSizes) > 0 || opts.defaultImageSize != "" ||
+		r.Header.Get(raceHeader) != "" {
+		return false
+	}
+	if opts.bodyBuffering == BodyBufferingNever {
+		return true
+	}
+	return (r.ContentLength < 0 || r.ContentLength >= minStreamedBody) &&
+		(opts.retries == 0 || opts.jobStatusPath != "") && opts.hedgeAfter == 0 && opts.shadow == nil && len(opts.gateways.urls()) < 2
+}
@@ -0,0 +1,190 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRequestBodyLimit(t *testing.T) {
+	const max = 1000
+	var reached, complete atomic.Int32
+	var got atomic.Value
+	gw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached.Add(1)
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			return
+		}
+		complete.Add(1)
+		got.Store(string(b))
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"data":[]}`))
+	}))
+	defer gw.Close()
+
+	// body returns a JSON body of exactly n bytes.
+	body := func(n int) string {
+		return `{"input":"` + strings.Repeat("a", n-len(`{"input":""}`)) + `"}`
+	}
+	for _, buffering := range []string{BodyBufferingAlways, BodyBufferingNever} {
+		p := New(Config{
+			GatewayURL:    gw.URL,
+			BodyBuffering: buffering,
+			// A raw body can be streamed to the gateway.
+			Routes: []Route{{Path: "/v1/embeddings", Capability: "embeddings", MaxBodyBytes: max, RawBody: true}},
+		})
+		for _, tc := range []struct {
+			name  string
+			size  int
+			known bool
+		}{
+			{"just under", max - 1, true},
+			{"at the limit", max, true},
+			{"just over", max + 1, true},
+			{"just under, chunked", max - 1, false},
+			{"just over, chunked", max + 1, false},
+		} {
+			t.Run(buffering+"/"+tc.name, func(t *testing.T) {
+				reached.Store(0)
+				complete.Store(0)
+				b := body(tc.size)
+				req := httptest.NewRequest(http.MethodPost, "/v1/embeddings", strings.NewReader(b))
+				req.Header.Set("Content-Type", "application/json")
+				if !tc.known {
+					req.ContentLength = -1
+				}
+				rec := httptest.NewRecorder()
+				p.ServeHTTP(rec, req)
+
+				if tc.size <= max {
+					if rec.Code != http.StatusOK {
+						t.Fatalf("status %d: %s", rec.Code, rec.Body)
+					}
+					if complete.Load() != 1 || got.Load() != b {
+						t.Error("gateway didn't get the body unchanged")
+					}
+					return
+				}
+				if rec.Code != http.StatusRequestEntityTooLarge {
+					t.Fatalf("status %d, want 413: %s", rec.Code, rec.Body)
+				}
+				if !strings.Contains(rec.Body.String(), `"code":"request_too_large"`) {
+					t.Errorf("body %s, want a request_too_large error", rec.Body)
+				}
+				if n := complete.Load(); n != 0 {
+					t.Errorf("gateway got %d complete bodies, want 0", n)
+				}
+				// Only a body streamed without a length can be cut off
+				// after it has started going out.
+				if streamed := buffering == BodyBufferingNever && !tc.known; !streamed && reached.Load() != 0 {
+					t.Error("over-limit request reached the gateway")
+				}
+			})
+		}
+	}
+}
+
+func TestStreamedRequestBodyArrivesIncrementally(t *testing.T) {
+	for _, tc := range []struct {
+		path  string
+		parts []string
+	}{
+		{"/v1/embeddings", []string{`{"input":"`, strings.Repeat("a", 64<<10), `"}`}},
+		{"/v1/chat/completions", []string{`{"model":"m","messages":[{"role":"user","content":"`, strings.Repeat("a", 512<<10), strings.Repeat("b", 512<<10), `"}]}`}},
+	} {
+		for _, buffering := range []string{BodyBufferingAuto, BodyBufferingNever} {
+			t.Run(tc.path+"/"+buffering, func(t *testing.T) {
+				received := make(chan int, 16)
+				gw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					buf := make([]byte, 32<<10)
+					total := 0
+					for {
+						n, err := r.Body.Read(buf)
+						total += n
+						if n > 0 {
+							received <- total
+						}
+						if err != nil {
+							break
+						}
+					}
+					w.Header().Set("Content-Type", "application/json")
+					w.Write([]byte(`{"data":[]}`))
+				}))
+				defer gw.Close()
+				p := New(Config{
+					GatewayURL:    gw.URL,
+					BodyBuffering: buffering,
+					Routes: []Route{
+						{Path: "/v1/embeddings", Capability: "embeddings", MaxBodyBytes: 1 << 20, RawBody: true},
+						{Path: "/v1/chat/completions", Capability: "llm", MaxBodyBytes: 4 << 20, Mode: ModeSSE},
+					},
+				})
+				srv := httptest.NewServer(p)
+				defer srv.Close()
+
+				pr, pw := io.Pipe()
+				defer pw.CloseWithError(io.ErrUnexpectedEOF)
+				result := make(chan error, 1)
+				go func() {
+					resp, err := http.Post(srv.URL+tc.path, "application/json", pr)
+					if err == nil {
+						resp.Body.Close()
+					}
+					result <- err
+				}()
+
+				// Each part must reach the gateway before the next is sent.
+				sent := 0
+				for _, part := range tc.parts {
+					if _, err := io.WriteString(pw, part); err != nil {
+						t.Fatal(err)
+					}
+					sent += len(part)
+					for got := 0; got < sent; {
+						select {
+						case got = <-received:
+						case <-time.After(2 * time.Second):
+							t.Fatalf("gateway had %d of the %d bytes sent so far", got, sent)
+						}
+					}
+				}
+				pw.Close()
+				if err := <-result; err != nil {
+					t.Fatal(err)
+				}
+			})
+		}
+	}
+}
+
+func TestStreamBody(t *testing.T) {
+	chunked := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	chunked.ContentLength = -1
+	for _, tc := range []struct {
+		name string
+		opts handlerOptions
+		want bool
+	}{
+		{"JSON", handlerOptions{bodyBuffering: BodyBufferingNever, validateJSON: true}, true},
+		{"JSON, auto", handlerOptions{bodyBuffering: BodyBufferingAuto, validateJSON: true}, true},
+		{"JSON, always", handlerOptions{bodyBuffering: BodyBufferingAlways, validateJSON: true}, false},
+		{"JSON, no stream", handlerOptions{bodyBuffering: BodyBufferingNever, validateJSON: true, noStream: true}, false},
+		{"JSON, stream cap", handlerOptions{bodyBuffering: BodyBufferingNever, validateJSON: true, streams: newStreamLimiter(10, nil)}, false},
+		{"raw, stream cap", handlerOptions{bodyBuffering: BodyBufferingNever, streams: newStreamLimiter(10, nil)}, true},
+		{"forced usage", handlerOptions{bodyBuffering: BodyBufferingNever, validateJSON: true, usage: UsageForce}, false},
+		{"auto with retries", handlerOptions{bodyBuffering: BodyBufferingAuto, retries: 2}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.opts.gateways = &gatewayPool{}
+			if got := tc.opts.streamBody(chunked); got != tc.want {
+				t.Errorf("streamBody = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,296 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxLiveBody is the largest request body the live transcode routes accept.
+const maxLiveBody = 1 << 20
+
+// registerLiveTranscode adds the live transcode routes to mux. Live
+// transcode uses the gateway's Stream Model (/process/stream/...) instead of
+// /process/request/..., so these routes don't fit the Route table.
+func registerLiveTranscode(mux *http.ServeMux, client *http.Client, cfg Config) {
+	gatewayURL := cfg.GatewayURL
+	liveTranscodeCapability := cfg.LiveTranscodeCapability
+	liveTranscodeTimeoutSeconds := cfg.LiveTranscodeTimeoutSeconds
+	forwardHeaders := cfg.ForwardedHeaders()
+	trusted, _ := parseTrustedProxies(cfg.TrustedProxies)
+	orchestrators := orchestratorFilter{Include: cfg.OrchestratorInclude, Exclude: cfg.OrchestratorExclude}
+
+	liveMaxPrice := cfg.MaxPrice
+	if v, ok := cfg.CapabilityMaxPrices[liveTranscodeCapability]; ok {
+		liveMaxPrice = v
+	}
+
+	// controlJob is the Livepeer job for requests about an existing stream.
+	controlJob := livepeerJob{
+		Parameters: livepeerParameters{Orchestrators: orchestrators},
+		Capability: liveTranscodeCapability,
+	}
+
+	liveStreamStartTarget := strings.TrimRight(gatewayURL, "/") + "/process/stream/start"
+
+	// Live transcode start — starts a live stream session
+	mux.HandleFunc("/v1/video/transcode/live/start", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeMethodNotAllowed(w, r)
+			return
+		}
+
+		ctx := r.Context()
+		ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		defer cancel()
+
+		bodyBytes, ok := readBody(w, r, maxLiveBody)
+		if !ok {
+			return
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, liveStreamStartTarget, bytes.NewReader(bodyBytes))
+		if err != nil {
+			logger(ctx).Error("failed to create gateway request", "error", err)
+			writeError(w, http.StatusInternalServerError, "internal_error", "Failed to create the gateway request.")
+			return
+		}
+		req.ContentLength = int64(len(bodyBytes))
+
+		copyHeader(req.Header, r.Header, forwardHeaders)
+		setForwarded(req.Header, r, trusted)
+		cfg.GatewayAuth.apply(req.Header, r.Header)
+
+		header, err := buildLivepeerHeader(livepeerJob{
+			Parameters: livepeerParameters{
+				EnableVideoIngress: true,
+				EnableVideoEgress:  true,
+				Orchestrators:      orchestrators,
+				MaxPricePerUnit:    json.Number(liveMaxPrice),
+			},
+			Capability:     liveTranscodeCapability,
+			TimeoutSeconds: liveTranscodeTimeoutSeconds,
+		})
+		if err != nil {
+			logger(ctx).Error("failed to build Livepeer header", "error", err)
+			writeError(w, http.StatusInternalServerError, "internal_error", "Failed to create the gateway request.")
+			return
+		}
+		req.Header.Set("Livepeer", header)
+		logger(ctx).Debug("live transcode start request to gateway", "url", liveStreamStartTarget, "content_len", len(bodyBytes))
+
+		resp, err := client.Do(req)
+		if err != nil {
+			logger(ctx).Error("gateway request failed", "url", req.URL.String(), "error", err)
+			writeGatewayError(w, err)
+			return
+		}
+		defer resp.Body.Close()
+		setUpstreamStatus(ctx, resp.StatusCode)
+
+		copyAllHeaders(w.Header(), resp.Header)
+		translateUpstreamError(ctx, w.Header(), resp)
+		w.Header().Set("Content-Type", "application/json")
+		scrubLivepeerHeaders(w.Header(), cfg.ExposeLivepeerHeaders)
+		w.WriteHeader(resp.StatusCode)
+
+		io.Copy(w, resp.Body)
+	})
+
+	// Live transcode stop — stop a live stream
+	mux.HandleFunc("/v1/video/transcode/live/stop", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeMethodNotAllowed(w, r)
+			return
+		}
+
+		ctx := r.Context()
+		ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		defer cancel()
+
+		bodyBytes, ok := readBody(w, r, maxLiveBody)
+		if !ok {
+			return
+		}
+
+		// Extract stream_id from body to build gateway URL
+		var stopReq struct {
+			StreamID string `json:"stream_id"`
+		}
+		json.Unmarshal(bodyBytes, &stopReq)
+		if stopReq.StreamID == "" {
+			writeError(w, http.StatusBadRequest, "missing_stream_id", "stream_id is required.")
+			return
+		}
+
+		stopTarget := strings.TrimRight(gatewayURL, "/") + "/process/stream/" + stopReq.StreamID + "/stop"
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, stopTarget, bytes.NewReader(bodyBytes))
+		if err != nil {
+			logger(ctx).Error("failed to create gateway request", "error", err)
+			writeError(w, http.StatusInternalServerError, "internal_error", "Failed to create the gateway request.")
+			return
+		}
+		req.ContentLength = int64(len(bodyBytes))
+
+		copyHeader(req.Header, r.Header, forwardHeaders)
+		setForwarded(req.Header, r, trusted)
+		cfg.GatewayAuth.apply(req.Header, r.Header)
+
+		header, err := buildLivepeerHeader(controlJob)
+		if err != nil {
+			logger(ctx).Error("failed to build Livepeer header", "error", err)
+			writeError(w, http.StatusInternalServerError, "internal_error", "Failed to create the gateway request.")
+			return
+		}
+		req.Header.Set("Livepeer", header)
+
+		resp, err := client.Do(req)
+		if err != nil {
+			logger(ctx).Error("gateway request failed", "url", req.URL.String(), "error", err)
+			writeGatewayError(w, err)
+			return
+		}
+		defer resp.Body.Close()
+		setUpstreamStatus(ctx, resp.StatusCode)
+
+		copyAllHeaders(w.Header(), resp.Header)
+		translateUpstreamError(ctx, w.Header(), resp)
+		w.Header().Set("Content-Type", "application/json")
+		scrubLivepeerHeaders(w.Header(), cfg.ExposeLivepeerHeaders)
+		w.WriteHeader(resp.StatusCode)
+
+		io.Copy(w, resp.Body)
+	})
+
+	// Live transcode update — update stream params mid-stream
+	mux.HandleFunc("/v1/video/transcode/live/update", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeMethodNotAllowed(w, r)
+			return
+		}
+
+		ctx := r.Context()
+		ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		defer cancel()
+
+		bodyBytes, ok := readBody(w, r, maxLiveBody)
+		if !ok {
+			return
+		}
+
+		var updateReq struct {
+			StreamID string `json:"stream_id"`
+		}
+		json.Unmarshal(bodyBytes, &updateReq)
+		if updateReq.StreamID == "" {
+			writeError(w, http.StatusBadRequest, "missing_stream_id", "stream_id is required.")
+			return
+		}
+
+		updateTarget := strings.TrimRight(gatewayURL, "/") + "/process/stream/" + updateReq.StreamID + "/update"
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, updateTarget, bytes.NewReader(bodyBytes))
+		if err != nil {
+			logger(ctx).Error("failed to create gateway request", "error", err)
+			writeError(w, http.StatusInternalServerError, "internal_error", "Failed to create the gateway request.")
+			return
+		}
+		req.ContentLength = int64(len(bodyBytes))
+
+		copyHeader(req.Header, r.Header, forwardHeaders)
+		setForwarded(req.Header, r, trusted)
+		cfg.GatewayAuth.apply(req.Header, r.Header)
+
+		header, err := buildLivepeerHeader(controlJob)
+		if err != nil {
+			logger(ctx).Error("failed to build Livepeer header", "error", err)
+			writeError(w, http.StatusInternalServerError, "internal_error", "Failed to create the gateway request.")
+			return
+		}
+		req.Header.Set("Livepeer", header)
+
+		resp, err := client.Do(req)
+		if err != nil {
+			logger(ctx).Error("gateway request failed", "url", req.URL.String(), "error", err)
+			writeGatewayError(w, err)
+			return
+		}
+		defer resp.Body.Close()
+		setUpstreamStatus(ctx, resp.StatusCode)
+
+		copyAllHeaders(w.Header(), resp.Header)
+		translateUpstreamError(ctx, w.Header(), resp)
+		w.Header().Set("Content-Type", "application/json")
+		scrubLivepeerHeaders(w.Header(), cfg.ExposeLivepeerHeaders)
+		w.WriteHeader(resp.StatusCode)
+
+		io.Copy(w, resp.Body)
+	})
+
+	// Live transcode status — get stream status
+	mux.HandleFunc("/v1/video/transcode/live/status", func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		defer cancel()
+
+		bodyBytes, ok := readBody(w, r, maxLiveBody)
+		if !ok {
+			return
+		}
+
+		var statusReq struct {
+			StreamID string `json:"stream_id"`
+		}
+		json.Unmarshal(bodyBytes, &statusReq)
+		if statusReq.StreamID == "" {
+			writeError(w, http.StatusBadRequest, "missing_stream_id", "stream_id is required.")
+			return
+		}
+
+		statusTarget := strings.TrimRight(gatewayURL, "/") + "/process/stream/" + statusReq.StreamID + "/status"
+
+		req, err := http.NewRequestWithContext(ctx, r.Method, statusTarget, bytes.NewReader(bodyBytes))
+		if err != nil {
+			logger(ctx).Error("failed to create gateway request", "error", err)
+			writeError(w, http.StatusInternalServerError, "internal_error", "Failed to create the gateway request.")
+			return
+		}
+		if len(bodyBytes) > 0 {
+			req.ContentLength = int64(len(bodyBytes))
+		}
+
+		copyHeader(req.Header, r.Header, forwardHeaders)
+		setForwarded(req.Header, r, trusted)
+		cfg.GatewayAuth.apply(req.Header, r.Header)
+
+		header, err := buildLivepeerHeader(controlJob)
+		if err != nil {
+			logger(ctx).Error("failed to build Livepeer header", "error", err)
+			writeError(w, http.StatusInternalServerError, "internal_error", "Failed to create the gateway request.")
+			return
+		}
+		req.Header.Set("Livepeer", header)
+
+		resp, err := client.Do(req)
+		if err != nil {
+			logger(ctx).Error("gateway request failed", "url", req.URL.String(), "error", err)
+			writeGatewayError(w, err)
+			return
+		}
+		defer resp.Body.Close()
+		setUpstreamStatus(ctx, resp.StatusCode)
+
+		copyAllHeaders(w.Header(), resp.Header)
+		translateUpstreamError(ctx, w.Header(), resp)
+		w.Header().Set("Content-Type", "application/json")
+		scrubLivepeerHeaders(w.Header(), cfg.ExposeLivepeerHeaders)
+		w.WriteHeader(resp.StatusCode)
+
+		io.Copy(w, resp.Body)
+	})
+}
@@ -0,0 +1,226 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// livepeerHeader is the JSON carried base64-encoded in the Livepeer request
+// header. Request and Parameters are themselves JSON documents; livepeerJob
+// is the typed form the proxy builds it from.
+type livepeerHeader struct {
+	Request        string `json:"request"`
+	Parameters     string `json:"parameters"`
+	Capability     string `json:"capability"`
+	TimeoutSeconds int    `json:"timeout_seconds,omitempty"`
+}
+
+// livepeerParameters is the parameters document of the Livepeer header.
+type livepeerParameters struct {
+	EnableVideoIngress bool               `json:"enable_video_ingress,omitempty"`
+	EnableVideoEgress  bool               `json:"enable_video_egress,omitempty"`
+	Orchestrators      orchestratorFilter `json:"orchestrators"`
+	// MaxPricePerUnit is the most an orchestrator may charge per unit of
+	// work, in wei; empty leaves pricing to the gateway.
+	MaxPricePerUnit json.Number `json:"max_price_per_unit,omitempty"`
+}
+
+// validMaxPrice reports whether s is usable as MaxPricePerUnit.
+func validMaxPrice(s string) bool {
+	f, err := strconv.ParseFloat(s, 64)
+	return err == nil && f >= 0 && json.Valid([]byte(s))
+}
+
+// priceRejected reports whether a gateway error body says that no
+// orchestrator was available within the max price.
+func priceRejected(body []byte) bool {
+	body = bytes.ToLower(body)
+	for _, phrase := range []string{"max price", "maxprice", "price too high", "price exceeds", "exceeds price"} {
+		if bytes.Contains(body, []byte(phrase)) {
+			return true
+		}
+	}
+	return false
+}
+
+// orchestratorFilter is the parameters.orchestrators object of the
+// Livepeer header.
+type orchestratorFilter struct {
+	Include []string `json:"include"`
+	Exclude []string `json:"exclude"`
+}
+
+// withExcluded returns f with extra appended to its exclude list, skipping
+// addresses already listed.
+func (f orchestratorFilter) withExcluded(extra []string) orchestratorFilter {
+	if len(extra) == 0 {
+		return f
+	}
+	exclude := append([]string(nil), f.Exclude...)
+	for _, orch := range extra {
+		if !contains(exclude, orch) {
+			exclude = append(exclude, orch)
+		}
+	}
+	f.Exclude = exclude
+	return f
+}
+
+// Request headers that steer a single request's orchestrator selection when
+// Config.OrchestratorHeaderPattern is set. They are never forwarded.
+const (
+	orchestratorIncludeHeader = "X-Orchestrator-Include"
+	orchestratorExcludeHeader = "X-Orchestrator-Exclude"
+)
+
+// withRequestOrchestrators merges the orchestrator headers of h into f.
+// Every address must match pattern; a nil pattern ignores the headers.
+func (f orchestratorFilter) withRequestOrchestrators(h http.Header, pattern *regexp.Regexp) (orchestratorFilter, error) {
+	if pattern == nil {
+		return f, nil
+	}
+	include, err := orchestratorHeader(h, orchestratorIncludeHeader, pattern)
+	if err != nil {
+		return f, err
+	}
+	exclude, err := orchestratorHeader(h, orchestratorExcludeHeader, pattern)
+	if err != nil {
+		return f, err
+	}
+	if len(include) > 0 {
+		merged := append([]string(nil), f.Include...)
+		for _, orch := range include {
+			if !contains(merged, orch) {
+				merged = append(merged, orch)
+			}
+		}
+		f.Include = merged
+	}
+	return f.withExcluded(exclude), nil
+}
+
+func orchestratorHeader(h http.Header, name string, pattern *regexp.Regexp) ([]string, error) {
+	var out []string
+	for _, v := range h.Values(name) {
+		for _, orch := range strings.Split(v, ",") {
+			orch = strings.TrimSpace(orch)
+			if orch == "" {
+				continue
+			}
+			if !pattern.MatchString(orch) {
+				return nil, fmt.Errorf("%s: %q is not an allowed orchestrator address", name, orch)
+			}
+			out = append(out, orch)
+		}
+	}
+	return out, nil
+}
+
+// livepeerJob describes a gateway job, encoded into the Livepeer header by
+// buildLivepeerHeader.
+type livepeerJob struct {
+	// Request defaults to running Capability.
+	Request    livepeerRequest
+	Parameters livepeerParameters
+	Capability string
+	// TimeoutSeconds of 0 leaves timeout_seconds out.
+	TimeoutSeconds int
+}
+
+// livepeerRequest is the request document of the Livepeer header.
+type livepeerRequest struct {
+	Run string `json:"run"`
+}
+
+// buildLivepeerHeader returns the base64-encoded Livepeer header for job.
+func buildLivepeerHeader(job livepeerJob) (string, error) {
+	if job.Capability == "" {
+		return "", errors.New("livepeer job: missing capability")
+	}
+	if job.Request.Run == "" {
+		job.Request.Run = job.Capability
+	}
+	// The gateway expects empty lists rather than null.
+	params := job.Parameters
+	if params.Orchestrators.Include == nil {
+		params.Orchestrators.Include = []string{}
+	}
+	if params.Orchestrators.Exclude == nil {
+		params.Orchestrators.Exclude = []string{}
+	}
+	request, err := json.Marshal(job.Request)
+	if err != nil {
+		return "", fmt.Errorf("livepeer job request: %w", err)
+	}
+	parameters, err := json.Marshal(params)
+	if err != nil {
+		return "", fmt.Errorf("livepeer job parameters: %w", err)
+	}
+	b, err := json.Marshal(livepeerHeader{
+		Request:        string(request),
+		Parameters:     string(parameters),
+		Capability:     job.Capability,
+		TimeoutSeconds: job.TimeoutSeconds,
+	})
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// clientLivepeerHeader is a Livepeer header supplied by the client, checked
+// by parseClientLivepeerHeader.
+type clientLivepeerHeader struct {
+	fields         map[string]json.RawMessage
+	capability     string
+	timeoutSeconds int
+}
+
+// parseClientLivepeerHeader decodes a client's Livepeer header and checks
+// that it has the shape the gateway expects. Fields the proxy doesn't know
+// are kept.
+func parseClientLivepeerHeader(v string) (*clientLivepeerHeader, error) {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(v))
+	if err != nil {
+		return nil, errors.New("not valid base64")
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil || fields == nil {
+		return nil, errors.New("not a JSON object")
+	}
+	var lp livepeerHeader
+	if err := json.Unmarshal(b, &lp); err != nil {
+		return nil, fmt.Errorf("unexpected field type: %v", err)
+	}
+	if lp.Capability == "" {
+		return nil, errors.New("capability is required")
+	}
+	var request map[string]any
+	if err := json.Unmarshal([]byte(lp.Request), &request); err != nil || request == nil {
+		return nil, errors.New("request must be a JSON object encoded as a string")
+	}
+	if lp.Parameters != "" {
+		var params map[string]any
+		if err := json.Unmarshal([]byte(lp.Parameters), &params); err != nil || params == nil {
+			return nil, errors.New("parameters must be a JSON object encoded as a string")
+		}
+	}
+	if lp.TimeoutSeconds < 0 {
+		return nil, errors.New("timeout_seconds must not be negative")
+	}
+	return &clientLivepeerHeader{fields: fields, capability: lp.Capability, timeoutSeconds: lp.TimeoutSeconds}, nil
+}
+
+// encode returns the header with timeoutSeconds applied, base64-encoded.
+func (h *clientLivepeerHeader) encode() string {
+	h.fields["timeout_seconds"], _ = json.Marshal(h.timeoutSeconds)
+	b, _ := json.Marshal(h.fields)
+	return base64.StdEncoding.EncodeToString(b)
+}
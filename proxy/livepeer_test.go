@@ -0,0 +1,181 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// decodeLivepeerHeader returns the decoded JSON of a Livepeer header and
+// its request and parameters documents.
+func decodeLivepeerHeader(t *testing.T, header string) (raw string, h livepeerHeader, req livepeerRequest, params livepeerParameters) {
+	t.Helper()
+	b, err := base64.StdEncoding.DecodeString(header)
+	if err != nil {
+		t.Fatalf("header %q isn't base64: %v", header, err)
+	}
+	if err := json.Unmarshal(b, &h); err != nil {
+		t.Fatalf("header %s: %v", b, err)
+	}
+	if err := json.Unmarshal([]byte(h.Request), &req); err != nil {
+		t.Fatalf("request %s: %v", h.Request, err)
+	}
+	if err := json.Unmarshal([]byte(h.Parameters), &params); err != nil {
+		t.Fatalf("parameters %s: %v", h.Parameters, err)
+	}
+	return string(b), h, req, params
+}
+
+func TestBuildLivepeerHeader(t *testing.T) {
+	const params = `"parameters":"{\"orchestrators\":{\"include\":[],\"exclude\":[]}}"`
+	for _, tc := range []struct {
+		capability string
+		want       string
+	}{
+		{"llm", `{"request":"{\"run\":\"llm\"}",` + params + `,"capability":"llm","timeout_seconds":30}`},
+		{`my "quoted" cap`, `{"request":"{\"run\":\"my \\\"quoted\\\" cap\"}",` + params + `,"capability":"my \"quoted\" cap","timeout_seconds":30}`},
+		{`back\slash`, `{"request":"{\"run\":\"back\\\\slash\"}",` + params + `,"capability":"back\\slash","timeout_seconds":30}`},
+		{"модель-翻译-🚀", `{"request":"{\"run\":\"модель-翻译-🚀\"}",` + params + `,"capability":"модель-翻译-🚀","timeout_seconds":30}`},
+		{"a<b>&c", `{"request":"{\"run\":\"a\\u003cb\\u003e\\u0026c\"}",` + params + `,"capability":"a\u003cb\u003e\u0026c","timeout_seconds":30}`},
+	} {
+		header, err := buildLivepeerHeader(livepeerJob{Capability: tc.capability, TimeoutSeconds: 30})
+		if err != nil {
+			t.Errorf("%q: %v", tc.capability, err)
+			continue
+		}
+		if want := base64.StdEncoding.EncodeToString([]byte(tc.want)); header != want {
+			t.Errorf("%q: header %s, want %s", tc.capability, header, want)
+		}
+		raw, h, req, _ := decodeLivepeerHeader(t, header)
+		if raw != tc.want {
+			t.Errorf("%q: decoded %s, want %s", tc.capability, raw, tc.want)
+		}
+		if h.Capability != tc.capability || req.Run != tc.capability {
+			t.Errorf("%q: capability %q and run %q don't round-trip", tc.capability, h.Capability, req.Run)
+		}
+	}
+
+	if _, err := buildLivepeerHeader(livepeerJob{TimeoutSeconds: 30}); err == nil {
+		t.Error("empty capability: no error")
+	}
+}
+
+func TestOrchestratorFilterHeader(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		filter orchestratorFilter
+		want   string
+	}{
+		{"none", orchestratorFilter{}, `{"orchestrators":{"include":[],"exclude":[]}}`},
+		{"include", orchestratorFilter{Include: []string{"https://o1:8935", "https://o2:8935"}}, `{"orchestrators":{"include":["https://o1:8935","https://o2:8935"],"exclude":[]}}`},
+		{"exclude", orchestratorFilter{Exclude: []string{"https://bad:8935"}}, `{"orchestrators":{"include":[],"exclude":["https://bad:8935"]}}`},
+		{"both", orchestratorFilter{Include: []string{"https://o1:8935"}, Exclude: []string{"https://o2:8935"}}, `{"orchestrators":{"include":["https://o1:8935"],"exclude":["https://o2:8935"]}}`},
+		{"awkward addresses", orchestratorFilter{Include: []string{`https://o"1`, `a,b`, `c\d`, `]}`}}, `{"orchestrators":{"include":["https://o\"1","a,b","c\\d","]}"],"exclude":[]}}`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			header, err := buildLivepeerHeader(livepeerJob{Capability: "llm", Parameters: livepeerParameters{Orchestrators: tc.filter}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, h, _, params := decodeLivepeerHeader(t, header)
+			if h.Parameters != tc.want {
+				t.Errorf("parameters %s, want %s", h.Parameters, tc.want)
+			}
+			if len(params.Orchestrators.Include) != len(tc.filter.Include) || len(params.Orchestrators.Exclude) != len(tc.filter.Exclude) {
+				t.Errorf("orchestrators %+v don't round-trip", params.Orchestrators)
+			}
+			for i, orch := range tc.filter.Include {
+				if params.Orchestrators.Include[i] != orch {
+					t.Errorf("include[%d] %q, want %q", i, params.Orchestrators.Include[i], orch)
+				}
+			}
+		})
+	}
+}
+
+func TestOrchestratorFilterMerge(t *testing.T) {
+	base := orchestratorFilter{Include: []string{"https://o1:8935"}, Exclude: []string{"https://bad:8935"}}
+	h := http.Header{}
+	h.Add(orchestratorIncludeHeader, "https://o2:8935, https://o1:8935")
+	h.Add(orchestratorExcludeHeader, "https://bad:8935,https://worse:8935")
+	pattern := regexp.MustCompile(`^https://[a-z0-9.-]+:\d+$`)
+
+	f, err := base.withRequestOrchestrators(h, pattern)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, err := buildLivepeerHeader(livepeerJob{Capability: "llm", Parameters: livepeerParameters{Orchestrators: f}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, lh, _, _ := decodeLivepeerHeader(t, header)
+	want := `{"orchestrators":{"include":["https://o1:8935","https://o2:8935"],"exclude":["https://bad:8935","https://worse:8935"]}}`
+	if lh.Parameters != want {
+		t.Errorf("parameters %s, want %s", lh.Parameters, want)
+	}
+	if len(base.Include) != 1 || len(base.Exclude) != 1 {
+		t.Errorf("base filter changed: %+v", base)
+	}
+
+	h.Set(orchestratorIncludeHeader, `https://o"1:8935`)
+	if _, err := base.withRequestOrchestrators(h, pattern); err == nil {
+		t.Error("address not matching the pattern: no error")
+	}
+	if f, err := base.withRequestOrchestrators(h, nil); err != nil || len(f.Include) != 1 {
+		t.Errorf("nil pattern: %+v, %v; want the headers ignored", f, err)
+	}
+}
+
+func TestMaxPriceHeader(t *testing.T) {
+	const noPrice = `{"request":"{\"run\":\"llm\"}","parameters":"{\"orchestrators\":{\"include\":[],\"exclude\":[]}}","capability":"llm","timeout_seconds":30}`
+	withPrice := func(price string) string {
+		return `{"request":"{\"run\":\"llm\"}","parameters":"{\"orchestrators\":{\"include\":[],\"exclude\":[]},\"max_price_per_unit\":` + price + `}","capability":"llm","timeout_seconds":30}`
+	}
+	for _, tc := range []struct {
+		name string
+		cfg  Config
+		rt   Route
+		want string
+	}{
+		{"no price", Config{}, Route{}, noPrice},
+		{"default price", Config{MaxPrice: "1000"}, Route{}, withPrice("1000")},
+		{"fractional price", Config{MaxPrice: "0.25"}, Route{}, withPrice("0.25")},
+		{"large price", Config{MaxPrice: "123456789012345678901234567890"}, Route{}, withPrice("123456789012345678901234567890")},
+		{"route price", Config{MaxPrice: "1000"}, Route{MaxPrice: "500"}, withPrice("500")},
+		{"capability price", Config{MaxPrice: "1000", CapabilityMaxPrices: map[string]string{"llm": "700"}}, Route{MaxPrice: "500"}, withPrice("700")},
+		{"other capability's price", Config{CapabilityMaxPrices: map[string]string{"image": "700"}}, Route{}, noPrice},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := make(chan string, 1)
+			gw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got <- r.Header.Get("Livepeer")
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(`{"choices":[]}`))
+			}))
+			defer gw.Close()
+			cfg := tc.cfg
+			cfg.GatewayURL = gw.URL
+			rt := tc.rt
+			rt.Path, rt.Capability, rt.TimeoutSeconds = "/v1/chat/completions", "llm", 30
+			cfg.Routes = []Route{rt}
+			if err := cfg.Validate(); err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"model":"m"}`))
+			req.Header.Set("Content-Type", "application/json")
+			rec := httptest.NewRecorder()
+			New(cfg).ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", rec.Code, rec.Body)
+			}
+			if raw, _, _, _ := decodeLivepeerHeader(t, <-got); raw != tc.want {
+				t.Errorf("header %s, want %s", raw, tc.want)
+			}
+		})
+	}
+}
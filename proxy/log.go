@@ -0,0 +1,244 @@
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// requestInfo carries per-request details that handlers fill in for the
+// request log.
+type requestInfo struct {
+	id             string
+	capability     string
+	timeoutSeconds int
+	upstreamStatus int
+	// streamed is set when the response body was flushed as it arrived.
+	streamed                  bool
+	sseForwarded, sseFiltered int
+	// model and usage are set when the response reported token usage.
+	model string
+	usage *tokenUsage
+	// apiKey is the ID of the client's API key, when keys are required.
+	apiKey string
+	// subject is the "sub" claim of the client's JWT.
+	subject string
+}
+
+type requestInfoKey struct{}
+
+func getRequestInfo(ctx context.Context) *requestInfo {
+	info, _ := ctx.Value(requestInfoKey{}).(*requestInfo)
+	return info
+}
+
+// setUpstreamStatus records the gateway's status code for the request log
+// and trace.
+func setUpstreamStatus(ctx context.Context, code int) {
+	if info := getRequestInfo(ctx); info != nil {
+		info.upstreamStatus = code
+	}
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Int("livepeer.upstream_status_code", code))
+}
+
+// setCapability records the capability a request was forwarded under for
+// the access log.
+func setCapability(ctx context.Context, capability string) {
+	if info := getRequestInfo(ctx); info != nil {
+		info.capability = capability
+	}
+}
+
+// setTimeout records the effective timeout of a request for the access
+// log.
+func setTimeout(ctx context.Context, seconds int) {
+	if info := getRequestInfo(ctx); info != nil {
+		info.timeoutSeconds = seconds
+	}
+}
+
+// setStreamed marks the response as streamed for the access log.
+func setStreamed(ctx context.Context) {
+	if info := getRequestInfo(ctx); info != nil {
+		info.streamed = true
+	}
+}
+
+// setSSEStats records SSE event counts for the access log.
+func setSSEStats(ctx context.Context, stats sseStats) {
+	if info := getRequestInfo(ctx); info != nil {
+		info.sseForwarded, info.sseFiltered = stats.forwarded, stats.filtered
+	}
+}
+
+// logger returns the default logger tagged with the request ID in ctx.
+func logger(ctx context.Context) *slog.Logger {
+	if info := getRequestInfo(ctx); info != nil {
+		return slog.Default().With("request_id", info.id)
+	}
+	return slog.Default()
+}
+
+// Access log formats.
+const (
+	// AccessLogJSON logs each request as a structured slog record.
+	AccessLogJSON = "json"
+	// AccessLogCombined writes NCSA combined log lines, followed by the
+	// upstream status, request bytes, duration in milliseconds, whether
+	// the response was streamed and the forwarded/filtered SSE event
+	// counts.
+	AccessLogCombined = "combined"
+	// AccessLogCommon writes Common Log Format lines followed by the
+	// duration in milliseconds, for log pipelines that expect plain CLF.
+	AccessLogCommon = "common"
+	// AccessLogOff disables the access log.
+	AccessLogOff = "off"
+)
+
+// withRequestLog assigns each request an ID (the client's X-Request-Id if
+// present), echoes it in the response and writes one access log entry per
+// request once the response, including any stream, is complete.
+func withRequestLog(next http.Handler, format string, out io.Writer, trusted []netip.Prefix) http.Handler {
+	if out == nil {
+		out = os.Stdout
+	}
+	var mu sync.Mutex
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		info := &requestInfo{id: r.Header.Get("X-Request-Id")}
+		if info.id == "" {
+			info.id = newRequestID()
+		}
+		w.Header().Set("X-Request-Id", info.id)
+
+		body := &countingReader{r: r.Body}
+		r.Body = body
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info)))
+
+		if r.URL.Path == "/healthz" || r.URL.Path == "/readyz" {
+			return
+		}
+		duration := time.Since(start)
+		switch format {
+		case AccessLogOff:
+		case AccessLogCombined, AccessLogCommon:
+			var line string
+			if format == AccessLogCommon {
+				line = commonLogLine(r, clientIP(r, trusted), start, rec, duration)
+			} else {
+				line = combinedLogLine(r, clientIP(r, trusted), start, rec, body.n, duration, info)
+			}
+			mu.Lock()
+			_, _ = io.WriteString(out, line)
+			mu.Unlock()
+		default:
+			attrs := []slog.Attr{
+				slog.String("request_id", info.id),
+				slog.String("remote_addr", clientIP(r, trusted)),
+				slog.String("method", r.Method),
+				slog.String("path", r.URL.Path),
+				slog.Int("status", rec.status()),
+				slog.Float64("duration_ms", float64(duration.Microseconds())/1000),
+				slog.Int64("bytes_in", body.n),
+				slog.Int64("bytes_out", rec.bytes),
+				slog.Bool("streamed", info.streamed),
+			}
+			if info.apiKey != "" {
+				attrs = append(attrs, slog.String("api_key", info.apiKey))
+			}
+			if info.subject != "" {
+				attrs = append(attrs, slog.String("subject", info.subject))
+			}
+			if info.capability != "" {
+				attrs = append(attrs, slog.String("capability", info.capability))
+			}
+			if info.timeoutSeconds != 0 {
+				attrs = append(attrs, slog.Int("timeout_seconds", info.timeoutSeconds))
+			}
+			if info.upstreamStatus != 0 {
+				attrs = append(attrs, slog.Int("upstream_status", info.upstreamStatus))
+			}
+			if info.sseForwarded != 0 || info.sseFiltered != 0 {
+				attrs = append(attrs,
+					slog.Int("sse_events_forwarded", info.sseForwarded),
+					slog.Int("sse_events_filtered", info.sseFiltered),
+				)
+			}
+			if info.usage != nil {
+				attrs = append(attrs,
+					slog.String("model", info.model),
+					slog.Int("prompt_tokens", info.usage.PromptTokens),
+					slog.Int("completion_tokens", info.usage.CompletionTokens),
+					slog.Int("total_tokens", info.usage.TotalTokens),
+				)
+			}
+			slog.LogAttrs(r.Context(), slog.LevelInfo, "request", attrs...)
+		}
+	})
+}
+
+func combinedLogLine(r *http.Request, remote string, start time.Time, rec *statusRecorder, bytesIn int64, duration time.Duration, info *requestInfo) string {
+	upstream := "-"
+	if info.upstreamStatus != 0 {
+		upstream = strconv.Itoa(info.upstreamStatus)
+	}
+	return fmt.Sprintf("%s - - [%s] %q %d %d %q %q %s %d %.3f %t %d %d %s\n",
+		remote,
+		start.Format("02/Jan/2006:15:04:05 -0700"),
+		r.Method+" "+r.URL.RequestURI()+" "+r.Proto,
+		rec.status(), rec.bytes,
+		orDash(r.Referer()), orDash(r.UserAgent()),
+		upstream, bytesIn, float64(duration.Microseconds())/1000, info.streamed,
+		info.sseForwarded, info.sseFiltered, info.id,
+	)
+}
+
+func commonLogLine(r *http.Request, remote string, start time.Time, rec *statusRecorder, duration time.Duration) string {
+	return fmt.Sprintf("%s - - [%s] %q %d %d %.3f\n",
+		remote,
+		start.Format("02/Jan/2006:15:04:05 -0700"),
+		r.Method+" "+r.URL.RequestURI()+" "+r.Proto,
+		rec.status(), rec.bytes, float64(duration.Microseconds())/1000,
+	)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingReader) Close() error { return c.r.Close() }
@@ -0,0 +1,475 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metrics holds the proxy's Prometheus collectors. Labels come from the
+// configuration, the gateway and small fixed sets, never from per-client
+// values such as addresses or JWT subjects. A nil *metrics disables
+// instrumentation.
+type metrics struct {
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	gatewayDuration *prometheus.HistogramVec
+	sseFirstEvent   *prometheus.HistogramVec
+	responseBytes   *prometheus.CounterVec
+	inFlight        *prometheus.GaugeVec
+	sseFiltered     *prometheus.CounterVec
+	tokens          *prometheus.CounterVec
+	balance         *prometheus.GaugeVec
+	blacklisted     prometheus.Counter
+	orchestrators   *prometheus.CounterVec
+	breakerState    *prometheus.GaugeVec
+	capabilities    *prometheus.CounterVec
+	retries         *prometheus.CounterVec
+	gateways        *prometheus.CounterVec
+	gatewayUp       *prometheus.GaugeVec
+	hedges          *prometheus.CounterVec
+	races           *prometheus.CounterVec
+	shadowDuration  *prometheus.HistogramVec
+	shadowDropped   *prometheus.CounterVec
+	limitInFlight   *prometheus.GaugeVec
+	limitQueued     *prometheus.GaugeVec
+	generation      prometheus.Gauge
+	streams         prometheus.Gauge
+	streamOutcomes  *prometheus.CounterVec
+	apiKeys         *prometheus.CounterVec
+	jwtRequests     *prometheus.CounterVec
+	jwksRefreshes   *prometheus.CounterVec
+	panics          prometheus.Counter
+}
+
+// newMetrics registers the proxy collectors with reg. Collectors that are
+// already registered (e.g. by an earlier NewHandler call) are reused. A nil
+// reg returns nil.
+func newMetrics(reg prometheus.Registerer) *metrics {
+	if reg == nil {
+		return nil
+	}
+	return &metrics{
+		requests: register(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "proxy_requests_total",
+			Help: "Requests handled by the proxy.",
+		}, []string{"route", "method", "status_class"})),
+		requestDuration: register(reg, prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "proxy_request_duration_seconds",
+			Help:    "End-to-end request duration, including streaming the response.",
+			Buckets: []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120, 300, 900},
+		}, []string{"route", "method"})),
+		gatewayDuration: register(reg, prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "proxy_gateway_request_duration_seconds",
+			Help:    "Time until the gateway returned response headers.",
+			Buckets: []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120, 300, 900},
+		}, []string{"route", "status_class"})),
+		sseFirstEvent: register(reg, prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "proxy_sse_time_to_first_event_seconds",
+			Help:    "Time from request start until the first SSE event was forwarded.",
+			Buckets: []float64{.05, .1, .25, .5, 1, 2, 5, 10, 30, 60},
+		}, []string{"route"})),
+		responseBytes: register(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "proxy_response_bytes_total",
+			Help: "Response body bytes written to clients.",
+		}, []string{"route"})),
+		inFlight: register(reg, prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "proxy_in_flight_requests",
+			Help: "Requests currently being handled.",
+		}, []string{"route"})),
+		sseFiltered: register(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "proxy_sse_filtered_events_total",
+			Help: "Livepeer SSE events withheld from clients.",
+		}, []string{"route"})),
+		tokens: register(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "proxy_tokens_total",
+			Help: "Tokens reported in response usage objects.",
+		}, []string{"capability", "model", "type"})),
+		balance: register(reg, prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "proxy_livepeer_balance",
+			Help: "Most recent Livepeer balance reported by the gateway.",
+		}, []string{"capability"})),
+		blacklisted: register(reg, prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "proxy_orchestrator_blacklist_additions_total",
+			Help: "Orchestrators blacklisted after repeated failures.",
+		})),
+		orchestrators: register(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "proxy_orchestrator_responses_total",
+			Help: "Gateway responses per orchestrator host (from X-Orchestrator-Url), by status class.",
+		}, []string{"orchestrator", "status_class"})),
+		breakerState: register(reg, prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "proxy_circuit_breaker_state",
+			Help: "Circuit breaker state per capability: 0 closed, 1 open, 2 half-open.",
+		}, []string{"capability"})),
+		capabilities: register(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "proxy_capability_requests_total",
+			Help: "Gateway requests per Livepeer capability, by upstream status class.",
+		}, []string{"capability", "status_class"})),
+		retries: register(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "proxy_gateway_retries_total",
+			Help: "Gateway requests resent after a connection error or 502/503/504.",
+		}, []string{"route"})),
+		hedges: register(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "proxy_gateway_hedges_total",
+			Help: "Hedge requests sent after a slow gateway response, by which request answered first.",
+		}, []string{"route", "winner"})),
+		races: register(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "proxy_gateway_races_total",
+			Help: "Requests sent to the gateway several times at once (X-Proxy-Race), by whether any copy succeeded.",
+		}, []string{"route", "result"})),
+		shadowDuration: register(reg, prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "proxy_shadow_request_duration_seconds",
+			Help:    "Time until the shadow gateway answered a mirrored request, by status class.",
+			Buckets: []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120, 300, 900},
+		}, []string{"route", "status_class"})),
+		shadowDropped: register(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "proxy_shadow_dropped_total",
+			Help: "Sampled requests not mirrored because too many shadow requests were in flight.",
+		}, []string{"route"})),
+		gateways: register(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "proxy_gateway_requests_total",
+			Help: "Requests per gateway, by status class (error when it couldn't be reached).",
+		}, []string{"gateway", "status_class"})),
+		gatewayUp: register(reg, prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "proxy_gateway_up",
+			Help: "Whether a gateway is in rotation (1) or marked down (0).",
+		}, []string{"gateway"})),
+		limitInFlight: register(reg, prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "proxy_concurrency_in_flight",
+			Help: "Requests holding a concurrency slot, per limited capability.",
+		}, []string{"capability"})),
+		limitQueued: register(reg, prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "proxy_concurrency_queued",
+			Help: "Requests waiting for a concurrency slot, per limited capability.",
+		}, []string{"capability"})),
+		streams: register(reg, prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "proxy_streaming_connections",
+			Help: "Streaming requests currently in flight.",
+		})),
+		streamOutcomes: register(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "proxy_streams_total",
+			Help: "Streamed responses by how they ended: completed, client_aborted, interrupted or idle_timeout.",
+		}, []string{"route", "outcome"})),
+		apiKeys: register(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "proxy_api_key_requests_total",
+			Help: "Authenticated requests per API key ID (a SHA-256 prefix of the key), by status class.",
+		}, []string{"api_key", "status_class"})),
+		jwtRequests: register(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "proxy_jwt_requests_total",
+			Help: "Requests authenticated with a JWT, by status class.",
+		}, []string{"status_class"})),
+		panics: register(reg, prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "proxy_panics_total",
+			Help: "Requests whose handler panicked.",
+		})),
+		jwksRefreshes: register(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "proxy_jwks_refreshes_total",
+			Help: "JWKS fetches by result (ok or error).",
+		}, []string{"result"})),
+		generation: register(reg, prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "proxy_config_generation",
+			Help: "Route table generation: 1 at startup, incremented by each successful reload.",
+		})),
+	}
+}
+
+func register[C prometheus.Collector](reg prometheus.Registerer, c C) C {
+	if err := reg.Register(c); err != nil {
+		var are prometheus.AlreadyRegisteredError
+		if errors.As(err, &are) {
+			if existing, ok := are.ExistingCollector.(C); ok {
+				return existing
+			}
+		}
+		panic(err)
+	}
+	return c
+}
+
+type routeKey struct{}
+
+// routeFromContext returns the route pattern set by instrument, for
+// labelling gateway requests.
+func routeFromContext(ctx context.Context) string {
+	if route, ok := ctx.Value(routeKey{}).(string); ok {
+		return route
+	}
+	return "other"
+}
+
+// instrument wraps mux to record request metrics labelled with the pattern
+// of the matched route. /healthz is not recorded.
+func (m *metrics) instrument(mux *http.ServeMux) http.Handler {
+	if m == nil {
+		return mux
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, route := mux.Handler(r)
+		switch route {
+		case "/healthz", "/readyz":
+			mux.ServeHTTP(w, r)
+			return
+		case "", "/":
+			route = "unmatched"
+		}
+
+		start := time.Now()
+		inFlight := m.inFlight.WithLabelValues(route)
+		inFlight.Inc()
+		defer inFlight.Dec()
+
+		rec := &statusRecorder{ResponseWriter: w}
+		mux.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), routeKey{}, route)))
+
+		m.requests.WithLabelValues(route, r.Method, statusClass(rec.status())).Inc()
+		m.requestDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+		m.responseBytes.WithLabelValues(route).Add(float64(rec.bytes))
+	})
+}
+
+// observeSSE records the outcome of a filtered SSE stream that started at
+// start.
+func (m *metrics) observeSSE(route string, start time.Time, stats sseStats) {
+	if m == nil || stats == (sseStats{}) {
+		return
+	}
+	if !stats.firstEvent.IsZero() {
+		m.sseFirstEvent.WithLabelValues(route).Observe(stats.firstEvent.Sub(start).Seconds())
+	}
+	m.sseFiltered.WithLabelValues(route).Add(float64(stats.filtered))
+}
+
+// observeUsage adds reported token usage to the token counters.
+func (m *metrics) observeUsage(capability, model string, u tokenUsage) {
+	if m == nil {
+		return
+	}
+	if model == "" {
+		model = "unknown"
+	}
+	m.tokens.WithLabelValues(capability, model, "prompt").Add(float64(u.PromptTokens))
+	m.tokens.WithLabelValues(capability, model, "completion").Add(float64(u.CompletionTokens))
+}
+
+func (m *metrics) observeBalance(capability string, balance float64) {
+	if m != nil {
+		m.balance.WithLabelValues(capability).Set(balance)
+	}
+}
+
+func (m *metrics) observeBlacklisted() {
+	if m != nil {
+		m.blacklisted.Inc()
+	}
+}
+
+// observeOrchestrator counts a gateway response served by the orchestrator
+// host.
+func (m *metrics) observeOrchestrator(host, class string) {
+	if m != nil {
+		m.orchestrators.WithLabelValues(host, class).Inc()
+	}
+}
+
+// observeCapability counts a gateway request for capability; class is
+// the upstream status class or "error".
+func (m *metrics) observeCapability(capability, class string) {
+	if m != nil {
+		m.capabilities.WithLabelValues(capability, class).Inc()
+	}
+}
+
+func (m *metrics) observeRetry(route string) {
+	if m != nil {
+		m.retries.WithLabelValues(route).Inc()
+	}
+}
+
+func (m *metrics) observeHedge(route, winner string) {
+	if m != nil {
+		m.hedges.WithLabelValues(route, winner).Inc()
+	}
+}
+
+func (m *metrics) observeRace(route, result string) {
+	if m != nil {
+		m.races.WithLabelValues(route, result).Inc()
+	}
+}
+
+func (m *metrics) observeShadow(route, class string, d time.Duration) {
+	if m != nil {
+		m.shadowDuration.WithLabelValues(route, class).Observe(d.Seconds())
+	}
+}
+
+func (m *metrics) observeShadowDropped(route string) {
+	if m != nil {
+		m.shadowDropped.WithLabelValues(route).Inc()
+	}
+}
+
+func (m *metrics) observeGateway(gateway, class string) {
+	if m != nil {
+		m.gateways.WithLabelValues(gateway, class).Inc()
+	}
+}
+
+func (m *metrics) observeGatewayUp(gateway string, up bool) {
+	if m == nil {
+		return
+	}
+	v := 0.0
+	if up {
+		v = 1
+	}
+	m.gatewayUp.WithLabelValues(gateway).Set(v)
+}
+
+// observeConcurrency adjusts a capability's in-flight and queued gauges.
+func (m *metrics) observeConcurrency(capability string, inFlight, queued float64) {
+	if m == nil {
+		return
+	}
+	if inFlight != 0 {
+		m.limitInFlight.WithLabelValues(capability).Add(inFlight)
+	}
+	if queued != 0 {
+		m.limitQueued.WithLabelValues(capability).Add(queued)
+	}
+}
+
+// observeStream counts a streamed response that ended with outcome; ""
+// (not streamed) is ignored.
+func (m *metrics) observeStream(route, outcome string) {
+	if m != nil && outcome != "" {
+		m.streamOutcomes.WithLabelValues(route, outcome).Inc()
+	}
+}
+
+// observeStreams records the number of streaming requests in flight.
+func (m *metrics) observeStreams(n int64) {
+	if m == nil {
+		return
+	}
+	m.streams.Set(float64(n))
+}
+
+// observeAPIKey counts a request made with the API key id.
+func (m *metrics) observeAPIKey(id, class string) {
+	if m == nil {
+		return
+	}
+	m.apiKeys.WithLabelValues(id, class).Inc()
+}
+
+// observeJWT counts a request authenticated with a JWT. Subjects aren't
+// labels: any number of them can hold valid tokens.
+func (m *metrics) observeJWT(class string) {
+	if m == nil {
+		return
+	}
+	m.jwtRequests.WithLabelValues(class).Inc()
+}
+
+func (m *metrics) observePanic() {
+	if m == nil {
+		return
+	}
+	m.panics.Inc()
+}
+
+func (m *metrics) observeJWKSRefresh(result string) {
+	if m == nil {
+		return
+	}
+	m.jwksRefreshes.WithLabelValues(result).Inc()
+}
+
+// observeConfigGeneration records the route table generation in use.
+func (m *metrics) observeConfigGeneration(generation uint64) {
+	if m == nil {
+		return
+	}
+	m.generation.Set(float64(generation))
+}
+
+func (m *metrics) observeBreaker(capability string, state int) {
+	if m != nil {
+		m.breakerState.WithLabelValues(capability).Set(float64(state))
+	}
+}
+
+// roundTripper wraps next to time gateway requests separately from the
+// end-to-end request.
+func (m *metrics) roundTripper(next http.RoundTripper) http.RoundTripper {
+	if m == nil {
+		return next
+	}
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		start := time.Now()
+		resp, err := next.RoundTrip(req)
+		class := "error"
+		if err == nil {
+			class = statusClass(resp.StatusCode)
+		}
+		m.gatewayDuration.WithLabelValues(routeFromContext(req.Context()), class).Observe(time.Since(start).Seconds())
+		return resp, err
+	})
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+func statusClass(code int) string {
+	if code < 100 || code > 599 {
+		return "other"
+	}
+	return strconv.Itoa(code/100) + "xx"
+}
+
+// statusRecorder captures the status code and body size written through it.
+type statusRecorder struct {
+	http.ResponseWriter
+	code  int
+	bytes int64
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.code == 0 {
+		r.code = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.code == 0 {
+		r.code = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter { return r.ResponseWriter }
+
+func (r *statusRecorder) status() int {
+	if r.code == 0 {
+		return http.StatusOK
+	}
+	return r.code
+}
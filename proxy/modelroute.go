@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// modelRouter picks the capability for a request from the model named in
+// its JSON body, so several runners can serve one OpenAI endpoint.
+type modelRouter struct {
+	// capabilities maps model names to capabilities; "*" matches any
+	// model not listed.
+	capabilities map[string]string
+	// strict rejects models that aren't listed by name instead of using
+	// the "*" entry or the route's capability.
+	strict bool
+}
+
+// newModelRouter returns nil, which leaves routing to the route, when
+// capabilities is empty.
+func newModelRouter(capabilities map[string]string, strict bool) *modelRouter {
+	if len(capabilities) == 0 {
+		return nil
+	}
+	return &modelRouter{capabilities: capabilities, strict: strict}
+}
+
+// route returns the capability for model, or "" to keep the route's. ok is
+// false when strict routing doesn't know the model.
+func (m *modelRouter) route(model string) (capability string, ok bool) {
+	if c, found := m.capabilities[model]; found && model != "" {
+		return c, true
+	}
+	if m.strict {
+		return "", false
+	}
+	return m.capabilities["*"], true
+}
+
+// requestModel returns the model field of a JSON request body.
+func requestModel(body []byte) string {
+	var req struct {
+		Model string `json:"model"`
+	}
+	_ = json.Unmarshal(body, &req)
+	return req.Model
+}
+
+func writeModelNotFound(w http.ResponseWriter, model string) {
+	writeOpenAIError(w, http.StatusNotFound,
+		"The model `"+model+"` does not exist or you do not have access to it.",
+		"invalid_request_error", "model_not_found")
+}
+
+// modelAliases rewrites the model requested by clients to the model served
+// by the workers, e.g. gpt-4o-mini to a self-hosted model.
+type modelAliases struct {
+	aliases map[string]string
+	// defaultModel is set on JSON requests without a model, before
+	// aliasing.
+	defaultModel string
+}
+
+// newModelAliases returns nil, which leaves request bodies alone, when
+// there is nothing to rewrite.
+func newModelAliases(aliases map[string]string, defaultModel string) *modelAliases {
+	if len(aliases) == 0 && defaultModel == "" {
+		return nil
+	}
+	return &modelAliases{aliases: aliases, defaultModel: defaultModel}
+}
+
+// apply rewrites the model of a JSON request body. The returned rewrite
+// maps the model back in responses; it is nil when the model wasn't
+// aliased.
+func (a *modelAliases) apply(body []byte) ([]byte, *modelRewrite) {
+	if a == nil {
+		return body, nil
+	}
+	model := requestModel(body)
+	if model == "" && a.defaultModel != "" {
+		model = a.defaultModel
+		body = setModel(body, model)
+	}
+	alias, ok := a.aliases[model]
+	if !ok || alias == model {
+		return body, nil
+	}
+	return setModel(body, alias), &modelRewrite{from: alias, to: model}
+}
+
+// modelRewrite restores the client's model name in responses. A nil
+// *modelRewrite leaves them unchanged.
+type modelRewrite struct {
+	from, to string
+}
+
+// apply rewrites the top-level model field of a JSON document if it names
+// the aliased model.
+func (rw *modelRewrite) apply(doc []byte) []byte {
+	if rw == nil || requestModel(doc) != rw.from {
+		return doc
+	}
+	return setModel(doc, rw.to)
+}
+
+// setModel sets the model field of a JSON object, leaving anything else
+// unchanged.
+func setModel(doc []byte, model string) []byte {
+	return setField(doc, "model", model)
+}
+
+// setField sets a top-level string field of a JSON object.
+func setField(doc []byte, key, value string) []byte {
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(doc, &obj); err != nil || obj == nil {
+		return doc
+	}
+	obj[key], _ = json.Marshal(value)
+	out, err := json.Marshal(obj)
+	if err != nil {
+		return doc
+	}
+	return out
+}
@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// DefaultModelsURL is the model catalogue served on /v1/models when
+// Config.ModelsURL is empty.
+const DefaultModelsURL = "https://api.blueclaw.network/v1/models"
+
+// modelsHandler fetches the model catalogue from modelsURL and reshapes it
+// to the OpenAI /v1/models format.
+func modelsHandler(client *http.Client, modelsURL string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, modelsURL, nil)
+		if err != nil {
+			logger(ctx).Error("failed to create models request", "error", err)
+			writeError(w, http.StatusInternalServerError, "internal_error", "Failed to create the models request.")
+			return
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			logger(ctx).Error("models request failed", "url", modelsURL, "error", err)
+			writeError(w, http.StatusBadGateway, "models_unavailable", "The model catalogue could not be fetched.")
+			return
+		}
+		defer resp.Body.Close()
+		setUpstreamStatus(ctx, resp.StatusCode)
+
+		var blueclawModels []struct {
+			ModelID   string `json:"model_id"`
+			Provider  string `json:"provider"`
+			Active    bool   `json:"active"`
+			CreatedAt string `json:"created_at"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&blueclawModels); err != nil {
+			logger(ctx).Error("failed to decode models response", "error", err)
+			writeError(w, http.StatusBadGateway, "models_unavailable", "The model catalogue could not be read.")
+			return
+		}
+
+		type openAIModel struct {
+			ID      string `json:"id"`
+			Object  string `json:"object"`
+			Created int64  `json:"created"`
+			OwnedBy string `json:"owned_by"`
+		}
+		data := make([]openAIModel, 0, len(blueclawModels))
+		for _, m := range blueclawModels {
+			if !m.Active {
+				continue
+			}
+			var created int64
+			if t, err := time.Parse(time.RFC3339Nano, m.CreatedAt); err == nil {
+				created = t.Unix()
+			}
+			data = append(data, openAIModel{
+				ID:      m.ModelID,
+				Object:  "model",
+				Created: created,
+				OwnedBy: m.Provider,
+			})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"object": "list",
+			"data":   data,
+		})
+	}
+}
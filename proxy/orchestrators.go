@@ -0,0 +1,247 @@
+package proxy
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxOrchestratorSamples bounds the samples kept per orchestrator within
+// the window.
+const maxOrchestratorSamples = 10000
+
+type orchestratorSample struct {
+	at      time.Time
+	latency time.Duration
+	failed  bool
+}
+
+// orchestratorStats keeps recent request outcomes per orchestrator, keyed
+// by the X-Orchestrator-Url the gateway reports. Samples older than window
+// are dropped, so orchestrators that stop serving age out.
+type orchestratorStats struct {
+	window    time.Duration
+	blacklist *blacklist
+	metrics   *metrics
+	// maxHosts bounds the orchestrator label of
+	// proxy_orchestrator_responses_total; later hosts count as "other".
+	maxHosts int
+
+	mu      sync.Mutex
+	samples map[string][]orchestratorSample
+	hosts   map[string]bool
+}
+
+func newOrchestratorStats(window time.Duration, bl *blacklist, m *metrics, maxHosts int) *orchestratorStats {
+	return &orchestratorStats{
+		window: window, blacklist: bl, metrics: m, maxHosts: maxHosts,
+		samples: map[string][]orchestratorSample{}, hosts: map[string]bool{},
+	}
+}
+
+// record adds the outcome, status, of a request served by orch. latency is
+// the time until the gateway returned response headers.
+func (s *orchestratorStats) record(orch string, latency time.Duration, status int) {
+	if orch == "" {
+		return
+	}
+	failed := status >= 500
+	s.blacklist.record(orch, failed)
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.metrics.observeOrchestrator(s.hostLabel(orch), statusClass(status))
+	samples := append(s.prune(s.samples[orch], now), orchestratorSample{at: now, latency: latency, failed: failed})
+	if len(samples) > maxOrchestratorSamples {
+		samples = samples[len(samples)-maxOrchestratorSamples:]
+	}
+	s.samples[orch] = samples
+}
+
+// hostLabel returns the metric label for orch: its host, or "other" once
+// maxHosts hosts have been seen. s.mu must be held.
+func (s *orchestratorStats) hostLabel(orch string) string {
+	host := orch
+	if u, err := url.Parse(orch); err == nil && u.Host != "" {
+		host = u.Host
+	}
+	if !s.hosts[host] {
+		if len(s.hosts) >= s.maxHosts {
+			return "other"
+		}
+		s.hosts[host] = true
+	}
+	return host
+}
+
+// prune drops samples that fell out of the window. Samples are in time
+// order.
+func (s *orchestratorStats) prune(samples []orchestratorSample, now time.Time) []orchestratorSample {
+	cutoff := now.Add(-s.window)
+	i := sort.Search(len(samples), func(i int) bool { return samples[i].at.After(cutoff) })
+	return samples[i:]
+}
+
+type orchestratorSummary struct {
+	URL      string    `json:"url"`
+	Requests int       `json:"requests"`
+	Errors   int       `json:"errors"`
+	P50Ms    float64   `json:"p50_ms"`
+	P95Ms    float64   `json:"p95_ms"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+func (s *orchestratorStats) snapshot() []orchestratorSummary {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := []orchestratorSummary{}
+	for orch, samples := range s.samples {
+		samples = s.prune(samples, now)
+		if len(samples) == 0 {
+			delete(s.samples, orch)
+			continue
+		}
+		s.samples[orch] = samples
+
+		latencies := make([]time.Duration, len(samples))
+		sum := orchestratorSummary{URL: orch, Requests: len(samples), LastSeen: samples[len(samples)-1].at.UTC()}
+		for i, smp := range samples {
+			latencies[i] = smp.latency
+			if smp.failed {
+				sum.Errors++
+			}
+		}
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		sum.P50Ms = percentileMs(latencies, 0.50)
+		sum.P95Ms = percentileMs(latencies, 0.95)
+		out = append(out, sum)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].URL < out[j].URL })
+	return out
+}
+
+// percentileMs returns the nearest-rank percentile of sorted in
+// milliseconds.
+func percentileMs(sorted []time.Duration, p float64) float64 {
+	i := int(p*float64(len(sorted)) + 0.5)
+	if i > 0 {
+		i--
+	}
+	return float64(sorted[i].Microseconds()) / 1000
+}
+
+func (s *orchestratorStats) handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"window_seconds": int(s.window.Seconds()),
+		"orchestrators":  s.snapshot(),
+		"blacklist":      s.blacklist.snapshot(),
+	})
+}
+
+// blacklist excludes orchestrators from Livepeer jobs for ttl once they
+// fail threshold times in a row.
+type blacklist struct {
+	threshold int
+	ttl       time.Duration
+	metrics   *metrics
+
+	mu       sync.Mutex
+	failures map[string]int
+	until    map[string]time.Time
+}
+
+// newBlacklist returns nil, which never excludes anything, when threshold
+// or ttl is not positive.
+func newBlacklist(threshold int, ttl time.Duration, m *metrics) *blacklist {
+	if threshold <= 0 || ttl <= 0 {
+		return nil
+	}
+	return &blacklist{
+		threshold: threshold,
+		ttl:       ttl,
+		metrics:   m,
+		failures:  map[string]int{},
+		until:     map[string]time.Time{},
+	}
+}
+
+func (b *blacklist) record(orch string, failed bool) {
+	if b == nil || orch == "" {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !failed {
+		delete(b.failures, orch)
+		return
+	}
+	b.failures[orch]++
+	if b.failures[orch] < b.threshold {
+		return
+	}
+	delete(b.failures, orch)
+	b.until[orch] = time.Now().Add(b.ttl)
+	b.metrics.observeBlacklisted()
+	slog.Warn("orchestrator blacklisted", "orchestrator", orch, "failures", b.threshold, "ttl", b.ttl.String())
+}
+
+// excluded returns the orchestrators currently blacklisted, sorted.
+func (b *blacklist) excluded() []string {
+	if b == nil {
+		return nil
+	}
+	now := time.Now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var out []string
+	for orch, until := range b.until {
+		if now.After(until) {
+			delete(b.until, orch)
+			continue
+		}
+		out = append(out, orch)
+	}
+	sort.Strings(out)
+	return out
+}
+
+type blacklistEntry struct {
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func (b *blacklist) snapshot() []blacklistEntry {
+	out := []blacklistEntry{}
+	if b == nil {
+		return out
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	for orch, until := range b.until {
+		if now.Before(until) {
+			out = append(out, blacklistEntry{URL: orch, ExpiresAt: until.UTC()})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].URL < out[j].URL })
+	return out
+}
+
+// excluded returns the orchestrators to exclude from new jobs.
+func (s *orchestratorStats) excluded() []string {
+	if s == nil {
+		return nil
+	}
+	return s.blacklist.excluded()
+}
@@ -0,0 +1,711 @@
+// Package proxy exposes OpenAI-compatible (and related) endpoints in front
+// of a Livepeer Gateway. Each request is forwarded to the gateway with the
+// Livepeer BYOC capability header it needs, and Livepeer-specific response
+// headers and SSE events are scrubbed before they reach the client.
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/http2"
+)
+
+// Config configures the handler returned by NewHandler.
+type Config struct {
+	// GatewayURL is the base URL of the Livepeer Gateway.
+	GatewayURL string
+	// Gateways spreads requests across several gateways by weight instead.
+	// Live transcoding still uses GatewayURL, or the first of them.
+	Gateways []Gateway
+	// GatewayHealthPath is requested on each gateway by /readyz; empty
+	// only opens a TCP connection. Probes time out after
+	// GatewayHealthTimeoutSeconds (default 2) and their result is reused
+	// for GatewayHealthIntervalSeconds (default 5).
+	GatewayHealthPath            string
+	GatewayHealthTimeoutSeconds  int
+	GatewayHealthIntervalSeconds int
+	// GatewayFailureThreshold consecutive connection failures mark a
+	// gateway down for GatewayDownSeconds. Default 3 and 30.
+	GatewayFailureThreshold int
+	GatewayDownSeconds      int
+	// Client sends requests to the gateway. Defaults to
+	// NewClient(ClientConfig).
+	Client       *http.Client
+	ClientConfig ClientConfig
+
+	// Routes are the /process/request routes to serve.
+	Routes []Route
+	// LoadRoutes, when set, reads the routes again for Proxy.Reload.
+	LoadRoutes func() ([]Route, error)
+	// Version is the build version reported by /debug/info.
+	Version string
+
+	// AllowedCapabilities are the capabilities reachable through
+	// /v1/byoc/{capability}/{path...}. Empty disables that route.
+	AllowedCapabilities []string
+	// BYOCTimeoutSeconds is the default timeout for /v1/byoc/... requests;
+	// BYOCCapabilityTimeouts overrides it per capability.
+	BYOCTimeoutSeconds     int
+	BYOCCapabilityTimeouts map[string]int
+	// BYOCCapabilityConcurrency caps in-flight requests per capability for
+	// capabilities without a Route.MaxConcurrency.
+	BYOCCapabilityConcurrency map[string]int
+
+	// MaxPrice is the default max price per unit, in wei, sent in the
+	// Livepeer header; Route.MaxPrice overrides it per route and
+	// CapabilityMaxPrices per capability. Empty sends no ceiling.
+	MaxPrice            string
+	CapabilityMaxPrices map[string]string
+
+	// ConcurrencyMode is ConcurrencyReject (default) or ConcurrencyBlock.
+	ConcurrencyMode string
+	// ConcurrencyQueueTimeoutSeconds is how long ConcurrencyBlock waits
+	// for a slot.
+	ConcurrencyQueueTimeoutSeconds int
+	// MaxStreamingConnections caps requests asking for "stream": true
+	// across all routes; 0 means no limit.
+	MaxStreamingConnections int
+
+	// MinTimeoutSeconds and MaxTimeoutSeconds clamp the timeout clients
+	// may ask for with the X-Timeout-Seconds header or a "timeout" body
+	// field. MaxTimeoutSeconds defaults to 1800.
+	MinTimeoutSeconds int
+	MaxTimeoutSeconds int
+
+	LiveTranscodeCapability string
+	// LiveTranscodeTimeoutSeconds is sent with live stream starts; 0 means
+	// no timeout.
+	LiveTranscodeTimeoutSeconds int
+
+	// ModelsURL is the model catalogue served on /v1/models. Defaults to
+	// DefaultModelsURL.
+	ModelsURL string
+
+	// JobTTLSeconds is how long async job IDs returned by routes with a
+	// JobStatusPath are remembered. 0 disables the job registry.
+	JobTTLSeconds int
+	// JobPollIntervalSeconds is how often the <submit path>/sync routes
+	// poll a job's status. Defaults to 5.
+	JobPollIntervalSeconds int
+
+	// ModelCapabilities maps the model of requests on routes with
+	// ModelRouting to a capability; "*" matches unlisted models. Mapped
+	// capabilities take their timeout from BYOCCapabilityTimeouts when
+	// listed there. With ModelCapabilitiesStrict, unlisted models get a
+	// 404 instead of falling back to "*" or the route's capability.
+	ModelCapabilities       map[string]string
+	ModelCapabilitiesStrict bool
+	// ModelAliases rewrites the model of requests on routes with
+	// ModelRouting (before ModelCapabilities is consulted), and restores
+	// the requested name in JSON responses and streamed chunks.
+	// DefaultModel is set on such requests that name no model.
+	ModelAliases map[string]string
+	DefaultModel string
+
+	// SSEKeepAliveSeconds is how long a filtered SSE stream may go without
+	// forwarding anything before a keep-alive comment is sent, so idle
+	// timeouts in load balancers don't cut slow streams. 0 disables it.
+	SSEKeepAliveSeconds int
+	// SSEFlushIntervalMS, when positive, coalesces filtered SSE output and
+	// flushes it at most this often instead of after every line. [DONE]
+	// and error events are always flushed at once. Defaults to 0.
+	SSEFlushIntervalMS int
+	// SSEMaxLineBytes is the longest line, and event, accepted in a
+	// filtered SSE stream. A longer one ends the stream with an error
+	// chunk and [DONE]. Defaults to 32 MiB, enough for large tool call
+	// arguments and base64 payloads.
+	SSEMaxLineBytes int
+	// SSEInterruptedEnd is how a filtered stream the gateway breaks off,
+	// or closes, before [DONE] is ended for the client: StreamEndError
+	// (default) sends an error chunk with finish_reason "error" and
+	// [DONE], StreamEndDone only [DONE].
+	SSEInterruptedEnd string
+	// SSEIdleTimeoutSeconds, when positive, ends a filtered stream with an
+	// error chunk and [DONE] once the gateway has sent no bytes for that
+	// long, closing the gateway connection. The request timeout still
+	// bounds the whole stream.
+	SSEIdleTimeoutSeconds int
+	// MaxResponseBytes truncates a non-streamed gateway response body past
+	// that many bytes, so a misbehaving orchestrator can't exhaust memory
+	// where the proxy reads the body. StreamMaxResponseBytes aborts a
+	// streamed one past that many; filtered SSE streams end with an error
+	// chunk and [DONE]. 0 is no limit.
+	MaxResponseBytes       int64
+	StreamMaxResponseBytes int64
+	// SSERequiredKeys overrides, per capability, the JSON keys of which a
+	// filtered SSE data event needs one to be forwarded (see
+	// Route.SSERequiredKeys).
+	SSERequiredKeys map[string][]string
+
+	// AllowClientLivepeerHeader forwards a Livepeer header sent by the
+	// client, after validating it, instead of generating one. Its
+	// capability must be the route's or in AllowedCapabilities, and its
+	// timeout_seconds is capped at MaxTimeoutSeconds.
+	AllowClientLivepeerHeader bool
+
+	// ExposeLivepeerHeaders keeps the Livepeer response headers, renamed
+	// into the X-Livepeer-* namespace, instead of stripping them.
+	ExposeLivepeerHeaders bool
+	// IdempotencyTTLSeconds, when set, caches successful non-streaming
+	// responses to requests with an Idempotency-Key header for that long,
+	// replaying them to requests repeating the key. At most
+	// IdempotencyMaxEntries (default 1000) are kept.
+	IdempotencyTTLSeconds int
+	IdempotencyMaxEntries int
+	// RaceMaxRequests, when above 1, lets clients whose API key ID or JWT
+	// subject is in RaceAllowedClients ("*" for any) send a non-streaming
+	// request to the gateway up to that many times at once with an
+	// X-Proxy-Race header, getting the first successful response.
+	RaceMaxRequests    int
+	RaceAllowedClients []string
+	// BodyBuffering is BodyBufferingAuto (default), BodyBufferingAlways or
+	// BodyBufferingNever. Bodies of routes that read them, such as the
+	// JSON routes, are always buffered.
+	BodyBuffering string
+	// ForwardHeaders are client headers sent to the gateway in addition to
+	// Content-Type and Accept. Credentials and hop-by-hop headers can't be
+	// added.
+	ForwardHeaders []string
+	// GatewayAuth controls the Authorization header, or other credential
+	// header, sent to the gateway; the zero value strips client
+	// credentials.
+	GatewayAuth GatewayAuth
+	// APIKeys and the keys in APIKeysFile (one per line, read again by
+	// Reload) are accepted as "Authorization: Bearer" credentials on /v1/
+	// routes. With neither set no key is required.
+	APIKeys     []string
+	APIKeysFile string
+	// RateLimitRPM limits /v1/ requests per minute for each API key, or
+	// each client IP without keys, allowing bursts of RateLimitBurst
+	// (default RateLimitRPM). Keys may set their own limits as
+	// key:rpm:burst. 0 disables the global limit.
+	RateLimitRPM   int
+	RateLimitBurst int
+	// JWTJWKSURL or JWTHS256Secret require a bearer JWT on /v1/ routes,
+	// signed with a key from the JWKS (refreshed every
+	// JWTJWKSRefreshSeconds, default 300) or with the secret. exp is
+	// required; iss and aud must match JWTIssuer and JWTAudience when set.
+	// With API keys too, bearer tokens that aren't JWTs are checked as
+	// keys. The JWTRateLimitClaim claim identifies the client to the rate
+	// limiter instead of its IP.
+	JWTJWKSURL            string
+	JWTJWKSRefreshSeconds int
+	JWTHS256Secret        string
+	JWTIssuer             string
+	JWTAudience           string
+	JWTRateLimitClaim     string
+
+	// CORSAllowedOrigins enables CORS for these origins ("*" for any).
+	CORSAllowedOrigins []string
+
+	// UsageTracking is UsageOn (default), UsageOff or UsageForce. It
+	// applies to routes with TrackUsage.
+	UsageTracking string
+	// UsageTrailers sends the usage reported at the end of a filtered
+	// stream in X-Usage-*-Tokens HTTP trailers, announced up front in the
+	// Trailer header.
+	UsageTrailers bool
+
+	// OrchestratorStatsWindowSeconds is how far back the per-orchestrator
+	// statistics on /admin/orchestrators look. Defaults to 900.
+	OrchestratorStatsWindowSeconds int
+	// OrchestratorMetricsMaxHosts is how many orchestrator hosts get their
+	// own label in proxy_orchestrator_responses_total; responses from any
+	// others are counted as "other". Defaults to 50.
+	OrchestratorMetricsMaxHosts int
+	// OrchestratorInclude and OrchestratorExclude are the orchestrator
+	// addresses sent in the include/exclude lists of the Livepeer header,
+	// unless a route sets its own.
+	OrchestratorInclude []string
+	OrchestratorExclude []string
+	// BreakerFailures is how many gateway failures (errors and 5xx
+	// responses) for a capability within BreakerWindowSeconds open its
+	// circuit, failing its requests with a 503 for BreakerCooldownSeconds
+	// before a probe request is let through. 0 disables circuit breaking.
+	BreakerFailures        int
+	BreakerWindowSeconds   int
+	BreakerCooldownSeconds int
+	// BreakerCapabilityFailures, BreakerCapabilityWindowSeconds and
+	// BreakerCapabilityCooldownSeconds override the breaker settings per
+	// capability.
+	BreakerCapabilityFailures        map[string]int
+	BreakerCapabilityWindowSeconds   map[string]int
+	BreakerCapabilityCooldownSeconds map[string]int
+	// GatewayRetries is how often a gateway request that failed to connect
+	// or got a 502, 503 or 504 is resent, waiting GatewayRetryBackoffMS,
+	// doubled each time, or the gateway's Retry-After in between. Async
+	// job submissions are never resent.
+	GatewayRetries        int
+	GatewayRetryBackoffMS int
+
+	// ShadowGatewayURL, when set, receives a copy of ShadowSamplePercent
+	// percent of gateway requests, streaming ones made non-streaming. The
+	// shadow responses are discarded and only measured; at most
+	// ShadowMaxInFlight (default 10) shadow requests run at once.
+	ShadowGatewayURL    string
+	ShadowSamplePercent float64
+	ShadowMaxInFlight   int
+
+	// OrchestratorHeaderPattern, when set, lets clients add orchestrators
+	// to the include/exclude lists of one request with the
+	// X-Orchestrator-Include and X-Orchestrator-Exclude headers. Every
+	// address must match the regular expression.
+	OrchestratorHeaderPattern string
+	// OrchestratorBlacklistFailures is how many consecutive 5xx responses
+	// from an orchestrator add it to the exclude list of subsequent jobs
+	// for OrchestratorBlacklistTTLSeconds. 0 disables blacklisting.
+	OrchestratorBlacklistFailures   int
+	OrchestratorBlacklistTTLSeconds int
+
+	// AccessLogFormat is AccessLogJSON (default), AccessLogCombined,
+	// AccessLogCommon or AccessLogOff. Combined and common lines go to
+	// AccessLogOutput, default stdout.
+	AccessLogFormat string
+	AccessLogOutput io.Writer
+	// LogBodies logs the first LogBodiesMaxBytes (default 2048) of each
+	// /v1/ request and response body, with credentials redacted. Streamed
+	// responses are cut after LogBodiesMaxChunks writes (default 10).
+	LogBodies          bool
+	LogBodiesMaxBytes  int
+	LogBodiesMaxChunks int
+	// TrustedProxies are the IPs or CIDRs whose X-Forwarded-For is
+	// believed when logging the client address.
+	TrustedProxies []string
+
+	// MetricsRegisterer receives the proxy's Prometheus metrics. Nil
+	// disables metrics.
+	MetricsRegisterer prometheus.Registerer
+}
+
+// Validate reports whether cfg can be served.
+func (cfg Config) Validate() error {
+	if cfg.GatewayURL == "" && len(cfg.Gateways) == 0 {
+		return errors.New("gateway URL is required")
+	}
+	for _, g := range cfg.Gateways {
+		if g.URL == "" || g.Weight < 0 {
+			return fmt.Errorf("invalid gateway %q with weight %d", g.URL, g.Weight)
+		}
+	}
+	if cfg.ShadowSamplePercent < 0 || cfg.ShadowSamplePercent > 100 {
+		return fmt.Errorf("shadow sample percent %v is not between 0 and 100", cfg.ShadowSamplePercent)
+	}
+	switch cfg.AccessLogFormat {
+	case "", AccessLogJSON, AccessLogCombined, AccessLogCommon, AccessLogOff:
+	default:
+		return fmt.Errorf("unknown access log format %q", cfg.AccessLogFormat)
+	}
+	if _, err := parseTrustedProxies(cfg.TrustedProxies); err != nil {
+		return err
+	}
+	if err := validateForwardHeaders(cfg.ForwardHeaders); err != nil {
+		return err
+	}
+	if err := cfg.GatewayAuth.validate(); err != nil {
+		return err
+	}
+	if _, err := newAPIKeys(cfg.APIKeys, cfg.APIKeysFile); err != nil {
+		return err
+	}
+	if cfg.JWTJWKSURL != "" && cfg.JWTHS256Secret != "" {
+		return errors.New("set only one of the JWKS URL and the HS256 secret")
+	}
+	if _, err := regexp.Compile(cfg.OrchestratorHeaderPattern); err != nil {
+		return fmt.Errorf("orchestrator header pattern: %w", err)
+	}
+	for model, capability := range cfg.ModelCapabilities {
+		if capability == "" {
+			return fmt.Errorf("model %q: missing capability", model)
+		}
+	}
+	if cfg.MaxPrice != "" && !validMaxPrice(cfg.MaxPrice) {
+		return fmt.Errorf("invalid max price %q", cfg.MaxPrice)
+	}
+	for capability, price := range cfg.CapabilityMaxPrices {
+		if !validMaxPrice(price) {
+			return fmt.Errorf("capability %s: invalid max price %q", capability, price)
+		}
+	}
+	switch cfg.UsageTracking {
+	case "", UsageOn, UsageOff, UsageForce:
+	default:
+		return fmt.Errorf("unknown usage tracking mode %q", cfg.UsageTracking)
+	}
+	switch cfg.SSEInterruptedEnd {
+	case "", StreamEndError, StreamEndDone:
+	default:
+		return fmt.Errorf("unknown SSE interrupted end %q", cfg.SSEInterruptedEnd)
+	}
+	switch cfg.BodyBuffering {
+	case "", BodyBufferingAuto, BodyBufferingAlways, BodyBufferingNever:
+	default:
+		return fmt.Errorf("unknown body buffering mode %q", cfg.BodyBuffering)
+	}
+	switch cfg.ConcurrencyMode {
+	case "", ConcurrencyReject, ConcurrencyBlock:
+	default:
+		return fmt.Errorf("unknown concurrency mode %q", cfg.ConcurrencyMode)
+	}
+	return validateRoutes(cfg.Routes)
+}
+
+// Proxy serves the configured routes. Its admin handler exposes runtime
+// state such as per-orchestrator statistics.
+type Proxy struct {
+	cfg           Config
+	client        *http.Client
+	metrics       *metrics
+	gateways      *gatewayPool
+	jobs          *jobStore
+	balances      *balanceStore
+	orchestrators *orchestratorStats
+	// orchestratorPattern validates the per-request orchestrator headers;
+	// nil ignores them.
+	orchestratorPattern *regexp.Regexp
+	models              *modelRouter
+	aliases             *modelAliases
+	breakers            *breakers
+	shadow              *shadower
+	probe               *gatewayProbe
+	streams             *streamLimiter
+	apiKeys             *apiKeys
+	trusted             []netip.Prefix
+	idempotency         *idempotencyCache
+	started             time.Time
+	// draining is set by Drain; closed is canceled by CloseStreams.
+	draining     atomic.Bool
+	closed       context.Context
+	closeStreams context.CancelCauseFunc
+
+	// routes is the route table new requests are served with; Reload
+	// swaps it.
+	routes   atomic.Pointer[routeTable]
+	reloadMu sync.Mutex
+
+	jwt       *jwtVerifier
+	closeOnce sync.Once
+
+	handler http.Handler
+	admin   *http.ServeMux
+}
+
+// NewHandler returns an http.Handler serving every configured route. cfg
+// should have passed Validate.
+func NewHandler(cfg Config) http.Handler {
+	return New(cfg)
+}
+
+// New returns a Proxy serving every configured route. cfg should have
+// passed Validate.
+func New(cfg Config) *Proxy {
+	client := cfg.Client
+	if client == nil {
+		client = NewClient(cfg.ClientConfig)
+	}
+	m := newMetrics(cfg.MetricsRegisterer)
+	if len(cfg.Gateways) == 0 {
+		cfg.Gateways = []Gateway{{URL: cfg.GatewayURL}}
+	} else if cfg.GatewayURL == "" {
+		cfg.GatewayURL = cfg.Gateways[0].URL
+	}
+	if cfg.GatewayHealthTimeoutSeconds <= 0 {
+		cfg.GatewayHealthTimeoutSeconds = 2
+	}
+	if cfg.GatewayHealthIntervalSeconds <= 0 {
+		cfg.GatewayHealthIntervalSeconds = 5
+	}
+	if cfg.GatewayFailureThreshold <= 0 {
+		cfg.GatewayFailureThreshold = 3
+	}
+	if cfg.GatewayDownSeconds <= 0 {
+		cfg.GatewayDownSeconds = 30
+	}
+	gateways := newGatewayPool(cfg.Gateways, cfg.GatewayFailureThreshold, time.Duration(cfg.GatewayDownSeconds)*time.Second, m)
+	// Shadow requests and readiness probes bypass the gateway metrics.
+	base := client
+	shadow := newShadower(cfg.ShadowGatewayURL, cfg.ShadowSamplePercent, cfg.ShadowMaxInFlight, base, m)
+	instrumented := *client
+	instrumented.Transport = tracingRoundTripper(m.roundTripper(gateways.roundTripper(client.Transport)))
+	client = &instrumented
+	if cfg.BYOCTimeoutSeconds == 0 {
+		cfg.BYOCTimeoutSeconds = 120
+	}
+	if cfg.MaxTimeoutSeconds == 0 {
+		cfg.MaxTimeoutSeconds = 1800
+	}
+	if cfg.SSEMaxLineBytes == 0 {
+		cfg.SSEMaxLineBytes = 32 << 20
+	}
+	if cfg.LiveTranscodeCapability == "" {
+		cfg.LiveTranscodeCapability = "transcode-live"
+	}
+	if cfg.ModelsURL == "" {
+		cfg.ModelsURL = DefaultModelsURL
+	}
+	if cfg.JobPollIntervalSeconds <= 0 {
+		cfg.JobPollIntervalSeconds = 5
+	}
+	if cfg.OrchestratorStatsWindowSeconds == 0 {
+		cfg.OrchestratorStatsWindowSeconds = 900
+	}
+	if cfg.OrchestratorMetricsMaxHosts == 0 {
+		cfg.OrchestratorMetricsMaxHosts = 50
+	}
+	if cfg.LogBodiesMaxBytes <= 0 {
+		cfg.LogBodiesMaxBytes = 2048
+	}
+	if cfg.LogBodiesMaxChunks <= 0 {
+		cfg.LogBodiesMaxChunks = 10
+	}
+
+	routes := applyDefaults(cfg.Routes)
+	if err := cfg.GatewayAuth.load(); err != nil {
+		slog.Error("failed to load gateway auth", "error", err)
+	}
+	apiKeys, _ := newAPIKeys(cfg.APIKeys, cfg.APIKeysFile)
+	trusted, _ := parseTrustedProxies(cfg.TrustedProxies)
+	var orchestratorPattern *regexp.Regexp
+	if cfg.OrchestratorHeaderPattern != "" {
+		orchestratorPattern, _ = regexp.Compile(cfg.OrchestratorHeaderPattern)
+	}
+	p := &Proxy{
+		cfg:                 cfg,
+		client:              client,
+		metrics:             m,
+		gateways:            gateways,
+		jobs:                newJobStore(time.Duration(cfg.JobTTLSeconds) * time.Second),
+		balances:            newBalanceStore(m),
+		orchestratorPattern: orchestratorPattern,
+		breakers:            newBreakers(breakerConfig(cfg), breakerOverrides(cfg), m),
+		shadow:              shadow,
+		streams:             newStreamLimiter(cfg.MaxStreamingConnections, m),
+		apiKeys:             apiKeys,
+		idempotency:         newIdempotencyCache(time.Duration(cfg.IdempotencyTTLSeconds)*time.Second, cfg.IdempotencyMaxEntries),
+		models:              newModelRouter(cfg.ModelCapabilities, cfg.ModelCapabilitiesStrict),
+		aliases:             newModelAliases(cfg.ModelAliases, cfg.DefaultModel),
+		orchestrators: newOrchestratorStats(
+			time.Duration(cfg.OrchestratorStatsWindowSeconds)*time.Second,
+			newBlacklist(cfg.OrchestratorBlacklistFailures, time.Duration(cfg.OrchestratorBlacklistTTLSeconds)*time.Second, m),
+			m, cfg.OrchestratorMetricsMaxHosts,
+		),
+		trusted: trusted,
+		started: time.Now(),
+		admin:   http.NewServeMux(),
+	}
+	p.closed, p.closeStreams = context.WithCancelCause(context.Background())
+	p.probe = &gatewayProbe{
+		gateways: gateways.urls(),
+		path:     cfg.GatewayHealthPath,
+		timeout:  time.Duration(cfg.GatewayHealthTimeoutSeconds) * time.Second,
+		interval: time.Duration(cfg.GatewayHealthIntervalSeconds) * time.Second,
+		client:   base,
+		auth:     cfg.GatewayAuth,
+	}
+	p.routes.Store(p.newRouteTable(routes, nil))
+	m.observeConfigGeneration(1)
+
+	p.admin.HandleFunc("/admin/orchestrators", p.orchestrators.handler)
+	p.admin.HandleFunc("/admin/reload", p.reloadHandler)
+	p.admin.HandleFunc("/", writeNotFound)
+
+	tables := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p.routes.Load().handler.ServeHTTP(w, r)
+	})
+	limited := withRateLimit(tables, newRateLimiter(cfg.RateLimitRPM, cfg.RateLimitBurst, apiKeys), trusted)
+	p.jwt = newJWTVerifier(cfg, m)
+	authed := withJWT(withAPIKeys(limited, apiKeys, m), p.jwt, apiKeys, m)
+	handler := withCORS(authed, cfg.CORSAllowedOrigins)
+	if cfg.LogBodies {
+		handler = withBodyLog(handler, cfg.LogBodiesMaxBytes, cfg.LogBodiesMaxChunks)
+	}
+	p.handler = withRequestLog(withRecover(p.withShutdown(handler), m), cfg.AccessLogFormat, cfg.AccessLogOutput, trusted)
+	return p
+}
+
+func breakerConfig(cfg Config) breakerSettings {
+	return breakerSettings{
+		threshold: cfg.BreakerFailures,
+		window:    time.Duration(cfg.BreakerWindowSeconds) * time.Second,
+		cooldown:  time.Duration(cfg.BreakerCooldownSeconds) * time.Second,
+	}
+}
+
+// breakerOverrides merges the per-capability breaker settings, filling in
+// the defaults for those that aren't overridden.
+func breakerOverrides(cfg Config) map[string]breakerSettings {
+	out := map[string]breakerSettings{}
+	get := func(capability string) breakerSettings {
+		if s, ok := out[capability]; ok {
+			return s
+		}
+		return breakerConfig(cfg)
+	}
+	for capability, n := range cfg.BreakerCapabilityFailures {
+		s := get(capability)
+		s.threshold = n
+		out[capability] = s
+	}
+	for capability, n := range cfg.BreakerCapabilityWindowSeconds {
+		s := get(capability)
+		s.window = time.Duration(n) * time.Second
+		out[capability] = s
+	}
+	for capability, n := range cfg.BreakerCapabilityCooldownSeconds {
+		s := get(capability)
+		s.cooldown = time.Duration(n) * time.Second
+		out[capability] = s
+	}
+	return out
+}
+
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.handler.ServeHTTP(w, r)
+}
+
+// Close stops the proxy's background goroutines: re-reading the gateway
+// credential file, refreshing the JWKS and expiring job IDs. Requests
+// still in flight are not affected.
+func (p *Proxy) Close() {
+	p.closeOnce.Do(func() {
+		p.cfg.GatewayAuth.close()
+		p.jwt.close()
+		p.jobs.close()
+	})
+}
+
+// AdminHandler serves the /admin/ endpoints. It is not part of the main
+// handler so it can be bound to a separate, private listener.
+func (p *Proxy) AdminHandler() http.Handler {
+	return p.admin
+}
+
+// options returns the handlerOptions shared by every capability route.
+func (p *Proxy) options() handlerOptions {
+	return handlerOptions{
+		client:                p.client,
+		gateways:              p.gateways,
+		retries:               p.cfg.GatewayRetries,
+		retryBackoff:          time.Duration(p.cfg.GatewayRetryBackoffMS) * time.Millisecond,
+		minTimeoutSeconds:     p.cfg.MinTimeoutSeconds,
+		clientLivepeerHeader:  p.cfg.AllowClientLivepeerHeader,
+		maxTimeoutSeconds:     p.cfg.MaxTimeoutSeconds,
+		exposeLivepeerHeaders: p.cfg.ExposeLivepeerHeaders,
+		gatewayAuth:           p.cfg.GatewayAuth,
+		jobs:                  p.jobs,
+		metrics:               p.metrics,
+		balances:              p.balances,
+		orchestrators:         p.orchestrators,
+		orchestratorFilter:    orchestratorFilter{Include: p.cfg.OrchestratorInclude, Exclude: p.cfg.OrchestratorExclude},
+		orchestratorPattern:   p.orchestratorPattern,
+		breakers:              p.breakers,
+		shadow:                p.shadow,
+		streams:               p.streams,
+		usageTrailers:         p.cfg.UsageTrailers,
+		forwardHeaders:        p.cfg.ForwardedHeaders(),
+		trustedProxies:        p.trusted,
+		idempotency:           p.idempotency,
+		raceMax:               p.cfg.RaceMaxRequests,
+		raceAllowed:           p.cfg.RaceAllowedClients,
+		bodyBuffering:         p.cfg.BodyBuffering,
+		allowedCapabilities:   p.cfg.AllowedCapabilities,
+		sseKeepAlive:          time.Duration(p.cfg.SSEKeepAliveSeconds) * time.Second,
+		sseFlushInterval:      time.Duration(p.cfg.SSEFlushIntervalMS) * time.Millisecond,
+		sseMaxLine:            p.cfg.SSEMaxLineBytes,
+		sseInterruptedEnd:     p.cfg.SSEInterruptedEnd,
+		sseIdleTimeout:        time.Duration(p.cfg.SSEIdleTimeoutSeconds) * time.Second,
+		maxResponse:           p.cfg.MaxResponseBytes,
+		maxStreamResponse:     p.cfg.StreamMaxResponseBytes,
+		sseCapabilityKeys:     p.cfg.SSERequiredKeys,
+		capabilityTimeouts:    p.cfg.BYOCCapabilityTimeouts,
+		maxPrice:              p.cfg.MaxPrice,
+		maxPrices:             p.cfg.CapabilityMaxPrices,
+	}
+}
+
+// ClientConfig tunes the client built by NewClient.
+type ClientConfig struct {
+	// HTTP2 negotiates HTTP/2 with https gateways so requests are
+	// multiplexed over fewer connections. Plain http gateways keep using
+	// HTTP/1.1.
+	HTTP2 bool
+	// MaxIdleConns and MaxIdleConnsPerHost bound the idle connections kept
+	// for reuse; they default to 200 and 100. MaxConnsPerHost caps all
+	// connections to one gateway, 0 meaning no limit; requests over the
+	// cap wait for a free connection.
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	MaxConnsPerHost     int
+	// TLS configures connections to https gateways, e.g. from
+	// GatewayTLS.Load. Nil uses the defaults.
+	TLS *tls.Config
+	// DialTimeoutSeconds bounds connecting to a gateway; it defaults to
+	// 10. ResponseHeaderTimeoutSeconds, when set, bounds the wait for the
+	// response headers once the request is sent. Both apply on top of
+	// the request's own timeout, so the shorter one wins.
+	DialTimeoutSeconds           int
+	ResponseHeaderTimeoutSeconds int
+}
+
+// NewClient returns the HTTP client used for gateway requests when
+// Config.Client is nil.
+func NewClient(cc ClientConfig) *http.Client {
+	if cc.MaxIdleConns <= 0 {
+		cc.MaxIdleConns = 200
+	}
+	if cc.MaxIdleConnsPerHost <= 0 {
+		cc.MaxIdleConnsPerHost = 100
+	}
+	if cc.DialTimeoutSeconds <= 0 {
+		cc.DialTimeoutSeconds = 10
+	}
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   time.Duration(cc.DialTimeoutSeconds) * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     cc.HTTP2,
+		MaxIdleConns:          cc.MaxIdleConns,
+		MaxIdleConnsPerHost:   cc.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       cc.MaxConnsPerHost,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		TLSClientConfig:       cc.TLS,
+		ResponseHeaderTimeout: time.Duration(cc.ResponseHeaderTimeoutSeconds) * time.Second,
+	}
+	if cc.HTTP2 {
+		// A multiplexed connection carries many streams, so ping it when
+		// idle to notice a dead gateway instead of stalling every stream.
+		if h2, err := http2.ConfigureTransports(transport); err == nil {
+			h2.ReadIdleTimeout = 30 * time.Second
+			h2.PingTimeout = 15 * time.Second
+		}
+	}
+	slog.Info("gateway transport", "http2", cc.HTTP2, "max_idle_conns", cc.MaxIdleConns,
+		"max_idle_conns_per_host", cc.MaxIdleConnsPerHost, "max_conns_per_host", cc.MaxConnsPerHost,
+		"dial_timeout_seconds", cc.DialTimeoutSeconds, "response_header_timeout_seconds", cc.ResponseHeaderTimeoutSeconds)
+	return &http.Client{Transport: transport}
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
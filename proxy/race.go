@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// raceHeader asks for a request to be sent to the gateway several times at
+// once, which may pick different orchestrators, keeping the first
+// successful response. It isn't forwarded.
+const raceHeader = "X-Proxy-Race"
+
+// raceCount returns how many copies of the request to send: 1 without an
+// X-Proxy-Race header. Requests that may not race are answered with an
+// error and reported as not ok.
+func raceCount(w http.ResponseWriter, r *http.Request, opts handlerOptions, eligible bool) (int, bool) {
+	v := strings.TrimSpace(r.Header.Get(raceHeader))
+	if v == "" {
+		return 1, true
+	}
+	if opts.raceMax < 2 || !allowedRacer(r.Context(), opts.raceAllowed) {
+		writeOpenAIError(w, http.StatusForbidden, "You are not allowed to use "+raceHeader+".",
+			"invalid_request_error", "race_not_allowed")
+		return 0, false
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 || n > opts.raceMax {
+		writeOpenAIError(w, http.StatusBadRequest,
+			raceHeader+" must be a number from 1 to "+strconv.Itoa(opts.raceMax)+".",
+			"invalid_request_error", "invalid_race")
+		return 0, false
+	}
+	if n > 1 && !eligible {
+		writeOpenAIError(w, http.StatusBadRequest,
+			raceHeader+" is only supported for non-streaming requests that don't start a job.",
+			"invalid_request_error", "race_not_supported")
+		return 0, false
+	}
+	return n, true
+}
+
+// allowedRacer reports whether the request's API key ID or JWT subject is
+// in allowed, or allowed has "*".
+func allowedRacer(ctx context.Context, allowed []string) bool {
+	if contains(allowed, "*") {
+		return true
+	}
+	if claims, ok := jwtClaimsFromContext(ctx); ok {
+		return claims.subject != "" && contains(allowed, claims.subject)
+	}
+	key, ok := apiKeyFromContext(ctx)
+	return ok && contains(allowed, key.id)
+}
+
+// doRaced sends n copies of req at once and returns the first 2xx
+// response, canceling the other requests and closing their responses. If
+// none succeeds, the last response or error to arrive is returned. body is
+// req's buffered body.
+func doRaced(client *http.Client, req *http.Request, body []byte, n int, m *metrics) (*http.Response, error) {
+	ctx := req.Context()
+	results := make(chan hedgeResult, n)
+	cancels := make([]context.CancelFunc, n)
+	for i := range cancels {
+		rctx, cancel := context.WithCancel(ctx)
+		cancels[i] = cancel
+		r := req.Clone(rctx)
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		go func() {
+			resp, err := client.Do(r)
+			results <- hedgeResult{i: i, resp: resp, err: err}
+		}()
+	}
+
+	var last hedgeResult
+	for pending := n; pending > 0; pending-- {
+		res := <-results
+		if res.err == nil && res.resp.StatusCode < 300 {
+			logger(ctx).Debug("gateway race won", "copy", res.i, "copies", n)
+			m.observeRace(routeFromContext(ctx), "success")
+			for i, cancel := range cancels {
+				if i != res.i {
+					cancel()
+				}
+			}
+			if last.resp != nil {
+				last.resp.Body.Close()
+			}
+			go func() {
+				for range pending - 1 {
+					discardHedge(results)
+				}
+			}()
+			res.resp.Body = &cancelOnClose{ReadCloser: res.resp.Body, cancel: cancels[res.i]}
+			return res.resp, nil
+		}
+		if last.resp != nil {
+			last.resp.Body.Close()
+		}
+		if last.resp != nil || last.err != nil {
+			cancels[last.i]()
+		}
+		last = res
+	}
+	m.observeRace(routeFromContext(ctx), "failure")
+	if last.err != nil {
+		cancels[last.i]()
+		return nil, last.err
+	}
+	last.resp.Body = &cancelOnClose{ReadCloser: last.resp.Body, cancel: cancels[last.i]}
+	return last.resp, nil
+}
@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"math"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket per client: per API key or JWT claim when
+// requests are authenticated, otherwise per client IP. Buckets refill at rpm per minute up
+// to burst. A nil *rateLimiter doesn't limit.
+type rateLimiter struct {
+	rpm, burst int
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	// full is when the bucket will have refilled completely; idle buckets
+	// are dropped after it.
+	full time.Time
+}
+
+// newRateLimiter returns a limiter allowing rpm requests per minute with
+// bursts of burst (default rpm). With API keys, keys with their own
+// limit are limited even when rpm is 0.
+func newRateLimiter(rpm, burst int, keys *apiKeys) *rateLimiter {
+	if rpm <= 0 && keys == nil {
+		return nil
+	}
+	return &rateLimiter{rpm: rpm, burst: burst, buckets: map[string]*bucket{}}
+}
+
+// allow takes a token from client's bucket. It reports how many tokens
+// are left and, when none was available, how long until one is.
+func (l *rateLimiter) allow(client string, rpm, burst int, now time.Time) (ok bool, remaining int, wait time.Duration) {
+	if burst <= 0 {
+		burst = rpm
+	}
+	rate := float64(rpm) / 60
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+	b := l.buckets[client]
+	if b == nil {
+		b = &bucket{tokens: float64(burst), last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		ok = true
+	} else {
+		wait = time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	}
+	b.full = now.Add(time.Duration((float64(burst) - b.tokens) / rate * float64(time.Second)))
+	return ok, int(b.tokens), wait
+}
+
+// sweep drops the buckets that have refilled, at most once a minute.
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < time.Minute {
+		return
+	}
+	l.swept = now
+	for client, b := range l.buckets {
+		if !now.Before(b.full) {
+			delete(l.buckets, client)
+		}
+	}
+}
+
+// withRateLimit answers 429 to /v1/ requests over their client's rate
+// limit, before the body is read.
+func withRateLimit(next http.Handler, l *rateLimiter, trusted []netip.Prefix) http.Handler {
+	if l == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/v1/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		client, rpm, burst := "ip:"+clientIP(r, trusted), l.rpm, l.burst
+		if key, ok := apiKeyFromContext(r.Context()); ok {
+			client = "key:" + key.id
+			if key.rpm > 0 {
+				rpm, burst = key.rpm, key.burst
+			}
+		} else if claims, ok := jwtClaimsFromContext(r.Context()); ok && claims.client != "" {
+			client = "jwt:" + claims.client
+		}
+		if rpm <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ok, remaining, wait := l.allow(client, rpm, burst, time.Now())
+		if !ok {
+			logger(r.Context()).Warn("rate limit exceeded", "client", client)
+			h := w.Header()
+			h.Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			h.Set("X-RateLimit-Limit", strconv.Itoa(rpm))
+			h.Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+			h.Set("X-Ratelimit-Limit-Requests", strconv.Itoa(rpm))
+			h.Set("X-Ratelimit-Remaining-Requests", strconv.Itoa(remaining))
+			h.Set("X-Ratelimit-Reset-Requests", wait.Round(time.Millisecond).String())
+			writeOpenAIError(w, http.StatusTooManyRequests,
+				"Rate limit reached: "+strconv.Itoa(rpm)+" requests per minute. Please retry after "+h.Get("Retry-After")+"s.",
+				"requests", "rate_limit_exceeded")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// gatewayProbe checks that the gateways can be reached, caching the result
+// for interval so readiness probes don't hammer them.
+type gatewayProbe struct {
+	gateways []string
+	// path is requested with GET on each gateway; empty only dials it.
+	path     string
+	timeout  time.Duration
+	interval time.Duration
+	client   *http.Client
+	auth     GatewayAuth
+
+	mu      sync.Mutex
+	checked time.Time
+	status  []gatewayStatus
+}
+
+type gatewayStatus struct {
+	URL       string    `json:"url"`
+	Reachable bool      `json:"reachable"`
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// check returns the status of every gateway, probing them again if the
+// last result is older than the interval.
+func (g *gatewayProbe) check(ctx context.Context) []gatewayStatus {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if time.Since(g.checked) < g.interval {
+		return g.status
+	}
+	status := make([]gatewayStatus, len(g.gateways))
+	var wg sync.WaitGroup
+	for i, gw := range g.gateways {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, g.timeout)
+			defer cancel()
+			status[i] = gatewayStatus{URL: gw, Reachable: true, CheckedAt: time.Now().UTC()}
+			if err := g.probe(ctx, gw); err != nil {
+				status[i].Reachable, status[i].Error = false, err.Error()
+			}
+		}()
+	}
+	wg.Wait()
+	g.checked, g.status = time.Now(), status
+	return status
+}
+
+// probe GETs the health path on gateway, or dials it if there is none. Any
+// response below 500 counts as reachable.
+func (g *gatewayProbe) probe(ctx context.Context, gateway string) error {
+	if g.path == "" {
+		u, err := url.Parse(gateway)
+		if err != nil {
+			return err
+		}
+		host := u.Host
+		if u.Port() == "" {
+			port := "80"
+			if u.Scheme == "https" {
+				port = "443"
+			}
+			host = net.JoinHostPort(u.Hostname(), port)
+		}
+		conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", host)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, gateway+g.path, nil)
+	if err != nil {
+		return err
+	}
+	g.auth.apply(req.Header, nil)
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// readyHandler serves /readyz: ready means at least one gateway can be
+// reached. The body lists the gateways' status and the capabilities whose
+// circuit isn't closed.
+func (p *Proxy) readyHandler(w http.ResponseWriter, r *http.Request) {
+	tripped := map[string]string{}
+	for capability, state := range p.breakers.states() {
+		if state != breakerStateNames[breakerClosed] {
+			tripped[capability] = state
+		}
+	}
+	gateways := p.probe.check(r.Context())
+	reachable := false
+	for _, g := range gateways {
+		reachable = reachable || g.Reachable
+	}
+	status, code := "ok", http.StatusOK
+	switch {
+	case !reachable:
+		status, code = "unavailable", http.StatusServiceUnavailable
+	case len(tripped) > 0:
+		status = "degraded"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"status":   status,
+		"gateways": gateways,
+		"breakers": tripped,
+	})
+}
@@ -0,0 +1,35 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/debug"
+)
+
+// withRecover turns a panic in next into a 500 with an OpenAI error body,
+// logging it with its stack, so one bad request can't take the process
+// down or leave its client without a response. If the response had
+// already started the connection is dropped instead.
+func withRecover(next http.Handler, m *metrics) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+			logger(r.Context()).Error("handler panicked", "method", r.Method, "path", r.URL.Path,
+				"panic", fmt.Sprint(v), "stack", string(debug.Stack()))
+			m.observePanic()
+			if rec.code != 0 {
+				panic(http.ErrAbortHandler)
+			}
+			writeOpenAIError(w, http.StatusInternalServerError,
+				"The server had an error while processing your request.", "server_error", "internal_error")
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// routeTable is a generation of the routes. Requests keep the table they
+// started with, so a reload only affects new requests.
+type routeTable struct {
+	generation uint64
+	routes     []Route
+	limiters   map[string]*limiter
+	handler    http.Handler
+}
+
+// newRouteTable builds the mux serving routes. Limiters of prev whose
+// limit is unchanged are carried over.
+func (p *Proxy) newRouteTable(routes []Route, prev *routeTable) *routeTable {
+	t := &routeTable{generation: 1, routes: routes}
+	var prevLimiters map[string]*limiter
+	if prev != nil {
+		t.generation = prev.generation + 1
+		prevLimiters = prev.limiters
+	}
+	t.limiters = newLimiters(p.cfg, routes, prevLimiters, p.metrics)
+
+	gatewayPaths := map[string]string{}
+	statusPaths := map[string]bool{}
+	byPath := map[string]Route{}
+	for _, rt := range routes {
+		gatewayPaths[rt.Path] = rt.GatewayPath
+		byPath[rt.Path] = rt
+		if rt.JobStatusPath != "" {
+			statusPaths[rt.JobStatusPath] = true
+		}
+	}
+
+	mux := http.NewServeMux()
+	for _, rt := range routes {
+		opts := routeOptions(p, rt, t.limiters)
+		if rt.JobStatusPath != "" {
+			opts.jobStatusPath = gatewayPaths[rt.JobStatusPath]
+		}
+		opts.jobStatus = statusPaths[rt.Path]
+		mux.HandleFunc(rt.Path, capabilityHandler(opts))
+		if rt.JobStatusPath != "" {
+			status := routeOptions(p, byPath[rt.JobStatusPath], t.limiters)
+			mux.HandleFunc(rt.Path+"/sync", syncJobHandler(opts, status, time.Duration(p.cfg.JobPollIntervalSeconds)*time.Second))
+		}
+	}
+	registerLiveTranscode(mux, p.client, p.cfg)
+	mux.HandleFunc(byocPrefix+"{capability}/{path...}", byocHandler(p, t.limiters))
+	mux.HandleFunc("/v1/balance", p.balances.handler)
+	mux.HandleFunc("/v1/models", modelsHandler(p.client, p.cfg.ModelsURL))
+	mux.HandleFunc("/healthz", p.drainingHandler(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ok"))
+	}))
+	mux.HandleFunc("/readyz", p.drainingHandler(p.readyHandler))
+	mux.HandleFunc("/debug/info", p.infoHandler)
+	if !hasRoute(routes, "/") {
+		mux.HandleFunc("/", writeNotFound)
+	}
+
+	t.handler = withTracing(mux, p.metrics.instrument(mux))
+	return t
+}
+
+// Reload reads the routes again with Config.LoadRoutes and the API keys
+// file and, if they are valid, serves new requests with them. Requests in
+// flight finish with the routes they started with. On error the current
+// routes and keys stay in place.
+func (p *Proxy) Reload() (generation uint64, err error) {
+	p.reloadMu.Lock()
+	defer p.reloadMu.Unlock()
+	current := p.routes.Load()
+	defer func() {
+		if err != nil {
+			slog.Error("route reload failed, keeping current routes", "error", err, "config_generation", current.generation)
+		}
+	}()
+	if p.cfg.LoadRoutes == nil && (p.apiKeys == nil || p.apiKeys.file == "") {
+		return current.generation, errors.New("reloading is not configured")
+	}
+	routes := current.routes
+	if p.cfg.LoadRoutes != nil {
+		if routes, err = p.cfg.LoadRoutes(); err != nil {
+			return current.generation, err
+		}
+		if err = validateRoutes(routes); err != nil {
+			return current.generation, err
+		}
+		routes = applyDefaults(routes)
+	}
+	var keys []apiKey
+	if p.apiKeys != nil && p.apiKeys.file != "" {
+		if keys, err = p.apiKeys.load(); err != nil {
+			return current.generation, err
+		}
+		p.apiKeys.keys.Store(&keys)
+	}
+	t := p.newRouteTable(routes, current)
+	p.routes.Store(t)
+	p.metrics.observeConfigGeneration(t.generation)
+	slog.Info("routes reloaded", "config_generation", t.generation, "routes", len(t.routes))
+	return t.generation, nil
+}
+
+// reloadHandler serves POST /admin/reload.
+func (p *Proxy) reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, r)
+		return
+	}
+	generation, err := p.Reload()
+	body := map[string]any{"config_generation": generation}
+	code := http.StatusOK
+	if err != nil {
+		body["error"] = err.Error()
+		code = http.StatusUnprocessableEntity
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestReloadRejectsUnservableRoutes(t *testing.T) {
+	gw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"choices":[]}`))
+	}))
+	defer gw.Close()
+
+	chat := Route{Path: "/v1/chat/completions", Capability: "llm"}
+	var next []Route
+	p := New(Config{
+		GatewayURL: gw.URL,
+		Routes:     []Route{chat},
+		LoadRoutes: func() ([]Route, error) { return next, nil },
+	})
+
+	for _, tc := range []struct {
+		name    string
+		route   Route
+		wantErr string
+	}{
+		{"reserved path", Route{Path: "/v1/balance", Capability: "llm"}, "served by the proxy"},
+		{"healthz", Route{Path: "/healthz", Capability: "llm"}, "served by the proxy"},
+		{"malformed pattern", Route{Path: "/v1/{x", Capability: "llm"}, "bad wildcard"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			next = []Route{chat, tc.route}
+			generation, err := p.Reload()
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("error %v, want one containing %q", err, tc.wantErr)
+			}
+			if generation != 1 {
+				t.Fatalf("generation %d, want 1", generation)
+			}
+
+			rec := httptest.NewRecorder()
+			p.AdminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/admin/reload", nil))
+			var body struct {
+				Generation uint64 `json:"config_generation"`
+				Error      string `json:"error"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if rec.Code != http.StatusUnprocessableEntity || body.Generation != 1 || !strings.Contains(body.Error, tc.wantErr) {
+				t.Fatalf("POST /admin/reload: %d %s", rec.Code, rec.Body)
+			}
+
+			for path, want := range map[string]int{"/v1/chat/completions": http.StatusOK, "/healthz": http.StatusOK, "/v1/balance": http.StatusOK} {
+				req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(`{"model":"m"}`))
+				if path != "/v1/chat/completions" {
+					req.Method = http.MethodGet
+				}
+				req.Header.Set("Content-Type", "application/json")
+				rec := httptest.NewRecorder()
+				p.ServeHTTP(rec, req)
+				if rec.Code != want {
+					t.Errorf("%s after the failed reload: %d %s", path, rec.Code, rec.Body)
+				}
+			}
+		})
+	}
+
+	next = []Route{chat, {Path: "/v1/embeddings", Capability: "embed"}}
+	if generation, err := p.Reload(); err != nil || generation != 2 {
+		t.Fatalf("valid reload: generation %d, %v", generation, err)
+	}
+}
@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"time"
+)
+
+// maxRetryWait is the longest Retry-After the proxy waits out itself;
+// longer ones are passed on to the client.
+const maxRetryWait = 10 * time.Second
+
+// doWithRetries sends req, retrying connection errors and 502/503/504
+// responses up to retries times. Nothing has been written to the client at
+// that point, and req's body is buffered, so it can be sent again. Waits
+// double from backoff, or follow the gateway's Retry-After.
+func doWithRetries(client *http.Client, req *http.Request, retries int, backoff time.Duration, m *metrics) (*http.Response, int, error) {
+	ctx := req.Context()
+	for attempt := 0; ; attempt++ {
+		resp, err := client.Do(req)
+		if attempt >= retries || ctx.Err() != nil {
+			return resp, attempt, err
+		}
+		wait := backoff << attempt
+		if err == nil {
+			switch resp.StatusCode {
+			case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			default:
+				return resp, attempt, nil
+			}
+			if d, ok := retryAfter(resp.Header, time.Now()); ok {
+				if d > maxRetryWait {
+					return resp, attempt, nil
+				}
+				wait = d
+			}
+			logger(ctx).Warn("retrying gateway request", "attempt", attempt+1, "status", resp.StatusCode, "wait", wait.String())
+			_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+		} else {
+			logger(ctx).Warn("retrying gateway request", "attempt", attempt+1, "error", err, "wait", wait.String())
+		}
+		m.observeRetry(routeFromContext(ctx))
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, attempt, ctx.Err()
+		case <-timer.C:
+		}
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, attempt, err
+		}
+		req = req.Clone(ctx)
+		req.Body = body
+	}
+}
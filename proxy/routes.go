@@ -0,0 +1,337 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Route describes a client-facing endpoint that is forwarded to a gateway
+// /process/request path under a fixed BYOC capability.
+type Route struct {
+	// Path is the client-facing path registered on the mux.
+	Path string `json:"path" yaml:"path"`
+	// GatewayPath is appended to Config.GatewayURL. Defaults to
+	// /process/request + Path.
+	GatewayPath string `json:"gateway_path" yaml:"gateway_path"`
+	Capability  string `json:"capability" yaml:"capability"`
+	// TimeoutSeconds is sent to the gateway as timeout_seconds and, unless
+	// RequestTimeoutSeconds is set, also bounds the proxied request.
+	TimeoutSeconds int `json:"timeout_seconds" yaml:"timeout_seconds"`
+	// RequestTimeoutSeconds bounds the proxied request when it differs from
+	// the job timeout (e.g. async submits that return a job ID right away).
+	RequestTimeoutSeconds int   `json:"request_timeout_seconds,omitempty" yaml:"request_timeout_seconds,omitempty"`
+	MaxBodyBytes          int64 `json:"max_body_bytes" yaml:"max_body_bytes"`
+	// MaxResponseBytes overrides Config.MaxResponseBytes for the route.
+	MaxResponseBytes int64 `json:"max_response_bytes,omitempty" yaml:"max_response_bytes,omitempty"`
+	// Mode is how responses are written: ModeJSON (default), ModeSSE or
+	// ModeStream.
+	Mode string `json:"mode,omitempty" yaml:"mode,omitempty"`
+	// SSEFilter is shorthand for Mode: ModeSSE.
+	SSEFilter bool     `json:"sse_filter,omitempty" yaml:"sse_filter,omitempty"`
+	Methods   []string `json:"methods,omitempty" yaml:"methods,omitempty"`
+	// SSERequiredKeys are the JSON keys of which a filtered SSE data event
+	// needs at least one to be forwarded. Defaults to "choices".
+	SSERequiredKeys []string `json:"sse_required_keys,omitempty" yaml:"sse_required_keys,omitempty"`
+	// JobStatusPath marks an async submit route: job IDs it returns are
+	// remembered so polls to the route at JobStatusPath only need
+	// {"job_id": "..."}.
+	JobStatusPath string `json:"job_status_path,omitempty" yaml:"job_status_path,omitempty"`
+	// MaxConcurrency caps in-flight requests for the route's capability
+	// (shared with other routes for the same capability). 0 means no limit.
+	MaxConcurrency int `json:"max_concurrency,omitempty" yaml:"max_concurrency,omitempty"`
+	// Multipart requires multipart/form-data request bodies (file
+	// uploads); the boundary is passed through untouched.
+	Multipart bool `json:"multipart,omitempty" yaml:"multipart,omitempty"`
+	// RawBody forwards request bodies without checking that they are
+	// JSON. Multipart routes are never checked.
+	RawBody bool `json:"raw_body,omitempty" yaml:"raw_body,omitempty"`
+	// NoStream rejects JSON requests with "stream": true with a 400, for
+	// endpoints that can't stream, instead of answering them with JSON
+	// the client's stream parser waits on.
+	NoStream bool `json:"no_stream,omitempty" yaml:"no_stream,omitempty"`
+	// TrackUsage records the token usage reported in OpenAI-style
+	// responses, per Config.UsageTracking.
+	TrackUsage bool `json:"track_usage,omitempty" yaml:"track_usage,omitempty"`
+	// HedgeAfterMS, when set, sends a second identical request if the
+	// gateway hasn't answered within it, and returns whichever answers
+	// first. Only for idempotent routes.
+	HedgeAfterMS int `json:"hedge_after_ms,omitempty" yaml:"hedge_after_ms,omitempty"`
+	// NormalizeImageFormat converts the images in responses between url
+	// and b64_json to match the request's response_format.
+	NormalizeImageFormat bool `json:"normalize_image_format,omitempty" yaml:"normalize_image_format,omitempty"`
+	// ImageSizes, when set, are the only "size" values image requests may
+	// ask for; others are rejected with a 400. DefaultImageSize is sent
+	// for requests without a size.
+	ImageSizes       []string `json:"image_sizes,omitempty" yaml:"image_sizes,omitempty"`
+	DefaultImageSize string   `json:"default_image_size,omitempty" yaml:"default_image_size,omitempty"`
+	// ModelRouting marks routes whose JSON body names an OpenAI model: it
+	// is rewritten per Config.ModelAliases and then picks the capability
+	// via Config.ModelCapabilities. A top-level "timeout" field in such
+	// bodies is taken as the request timeout and not forwarded.
+	ModelRouting bool `json:"model_routing,omitempty" yaml:"model_routing,omitempty"`
+	// OrchestratorInclude and OrchestratorExclude replace
+	// Config.OrchestratorInclude and Config.OrchestratorExclude for the
+	// route when set.
+	OrchestratorInclude []string `json:"orchestrator_include,omitempty" yaml:"orchestrator_include,omitempty"`
+	OrchestratorExclude []string `json:"orchestrator_exclude,omitempty" yaml:"orchestrator_exclude,omitempty"`
+	// MaxPrice replaces Config.MaxPrice for the route when set.
+	MaxPrice string `json:"max_price,omitempty" yaml:"max_price,omitempty"`
+}
+
+// Route response modes.
+const (
+	// ModeJSON returns JSON; a text/event-stream response is passed
+	// through unfiltered.
+	ModeJSON = "json"
+	// ModeSSE filters non-OpenAI events (e.g. Livepeer balance updates)
+	// out of text/event-stream responses.
+	ModeSSE = "sse"
+	// ModeStream keeps the upstream Content-Type and flushes the body as
+	// it arrives, for binary or unknown response formats.
+	ModeStream = "stream"
+)
+
+var routeModes = map[string]responseMode{
+	ModeJSON:   modeJSON,
+	ModeSSE:    modeSSEFiltered,
+	ModeStream: modeRawStream,
+}
+
+type routesFile struct {
+	Routes []Route `json:"routes" yaml:"routes"`
+}
+
+// LoadRoutes merges the routes declared in the JSON or YAML (.yaml/.yml)
+// file at path over the defaults: a file entry with the same Path replaces
+// the default, new paths are appended. An empty path returns the defaults.
+// Optional fields are filled in on the returned routes.
+func LoadRoutes(path string, defaults []Route) ([]Route, error) {
+	if path == "" {
+		return applyDefaults(defaults), nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read routes config: %w", err)
+	}
+	var file routesFile
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		err = dec.Decode(&file)
+	default:
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&file)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse routes config %s: %w", path, err)
+	}
+
+	seen := map[string]bool{}
+	for i, rt := range file.Routes {
+		if rt.Path == "" {
+			return nil, fmt.Errorf("routes config %s: entry %d has no path", path, i)
+		}
+		if seen[rt.Path] {
+			return nil, fmt.Errorf("routes config %s: duplicate path %s", path, rt.Path)
+		}
+		seen[rt.Path] = true
+	}
+
+	routes := make([]Route, 0, len(defaults)+len(file.Routes))
+	for _, rt := range defaults {
+		if !seen[rt.Path] {
+			routes = append(routes, rt)
+		}
+	}
+	routes = append(routes, file.Routes...)
+	return applyDefaults(routes), nil
+}
+
+func applyDefaults(routes []Route) []Route {
+	out := make([]Route, len(routes))
+	for i, rt := range routes {
+		out[i] = rt.withDefaults()
+	}
+	return out
+}
+
+// reservedPaths are served by the proxy itself and can't be routes.
+var reservedPaths = []string{
+	"/healthz",
+	"/readyz",
+	"/v1/models",
+	"/v1/balance",
+	"/debug/info",
+	"/v1/video/transcode/live/start",
+	"/v1/video/transcode/live/stop",
+	"/v1/video/transcode/live/update",
+	"/v1/video/transcode/live/status",
+}
+
+// byocPrefix is where byocHandler serves every capability.
+const byocPrefix = "/v1/byoc/"
+
+// validateRoutes rejects route tables that can't be served.
+func validateRoutes(routes []Route) error {
+	seen := map[string]bool{}
+	mux := http.NewServeMux()
+	for _, path := range reservedPaths {
+		mux.Handle(path, http.NotFoundHandler())
+	}
+	for _, rt := range routes {
+		if !strings.HasPrefix(rt.Path, "/") {
+			return fmt.Errorf("route %q: path must start with /", rt.Path)
+		}
+		if seen[rt.Path] {
+			return fmt.Errorf("route %s: duplicate path", rt.Path)
+		}
+		seen[rt.Path] = true
+		if contains(reservedPaths, rt.Path) || strings.HasPrefix(rt.Path, byocPrefix) {
+			return fmt.Errorf("route %s: path is served by the proxy", rt.Path)
+		}
+		if err := checkPattern(mux, rt.Path); err != nil {
+			return fmt.Errorf("route %s: %v", rt.Path, err)
+		}
+		if rt.JobStatusPath != "" {
+			if hasRoute(routes, rt.Path+"/sync") {
+				return fmt.Errorf("route %s/sync: path is served by the proxy", rt.Path)
+			}
+			if err := checkPattern(mux, rt.Path+"/sync"); err != nil {
+				return fmt.Errorf("route %s: %v", rt.Path, err)
+			}
+		}
+		if rt.JobStatusPath != "" && !hasRoute(routes, rt.JobStatusPath) {
+			return fmt.Errorf("route %s: job_status_path %s is not a route", rt.Path, rt.JobStatusPath)
+		}
+		if rt.Capability == "" {
+			return fmt.Errorf("route %s: missing capability", rt.Path)
+		}
+		if _, ok := routeModes[rt.withDefaults().Mode]; !ok {
+			return fmt.Errorf("route %s: unknown mode %q", rt.Path, rt.Mode)
+		}
+		if rt.TimeoutSeconds < 0 || rt.RequestTimeoutSeconds < 0 {
+			return fmt.Errorf("route %s: timeouts must be positive", rt.Path)
+		}
+		if rt.MaxBodyBytes < 0 {
+			return fmt.Errorf("route %s: max_body_bytes must be positive", rt.Path)
+		}
+		if rt.MaxResponseBytes < 0 {
+			return fmt.Errorf("route %s: max_response_bytes must not be negative", rt.Path)
+		}
+		if rt.MaxConcurrency < 0 {
+			return fmt.Errorf("route %s: max_concurrency must not be negative", rt.Path)
+		}
+		if rt.DefaultImageSize != "" && len(rt.ImageSizes) > 0 && !contains(rt.ImageSizes, rt.DefaultImageSize) {
+			return fmt.Errorf("route %s: default_image_size %s is not in image_sizes", rt.Path, rt.DefaultImageSize)
+		}
+		if rt.MaxPrice != "" && !validMaxPrice(rt.MaxPrice) {
+			return fmt.Errorf("route %s: invalid max_price %q", rt.Path, rt.MaxPrice)
+		}
+	}
+	return nil
+}
+
+// checkPattern registers pattern on mux, returning the error ServeMux
+// panics with for malformed or conflicting patterns.
+func checkPattern(mux *http.ServeMux, pattern string) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	mux.Handle(pattern, http.NotFoundHandler())
+	return nil
+}
+
+// withDefaults fills in the optional fields of rt.
+func (rt Route) withDefaults() Route {
+	if rt.GatewayPath == "" {
+		rt.GatewayPath = "/process/request" + rt.Path
+	}
+	if rt.TimeoutSeconds == 0 {
+		rt.TimeoutSeconds = 120
+	}
+	if rt.MaxBodyBytes == 0 {
+		rt.MaxBodyBytes = 1 << 20
+	}
+	if rt.Mode == "" {
+		rt.Mode = ModeJSON
+		if rt.SSEFilter {
+			rt.Mode = ModeSSE
+		}
+	}
+	if len(rt.Methods) == 0 {
+		rt.Methods = []string{http.MethodPost}
+	}
+	return rt
+}
+
+// routeOptions returns the handlerOptions serving rt against the gateway,
+// limited by the capability's entry in limiters.
+func routeOptions(p *Proxy, rt Route, limiters map[string]*limiter) handlerOptions {
+	opts := p.options()
+	opts.path = rt.GatewayPath
+	opts.capability = rt.Capability
+	opts.timeoutSeconds = rt.TimeoutSeconds
+	opts.requestTimeoutSeconds = rt.RequestTimeoutSeconds
+	opts.maxBody = rt.MaxBodyBytes
+	if rt.MaxResponseBytes > 0 {
+		opts.maxResponse = rt.MaxResponseBytes
+	}
+	opts.methods = rt.Methods
+	opts.mode = routeModes[rt.Mode]
+	opts.usage = routeUsage(p.cfg, rt)
+	opts.multipart = rt.Multipart
+	opts.sseRequiredKeys = rt.SSERequiredKeys
+	opts.validateJSON = !rt.Multipart && !rt.RawBody
+	opts.noStream = rt.NoStream
+	opts.imageFormat = rt.NormalizeImageFormat
+	opts.imageSizes = rt.ImageSizes
+	opts.defaultImageSize = rt.DefaultImageSize
+	opts.hedgeAfter = time.Duration(rt.HedgeAfterMS) * time.Millisecond
+	opts.limiter = limiters[rt.Capability]
+	if rt.ModelRouting {
+		opts.models = p.models
+		opts.aliases = p.aliases
+		opts.bodyTimeout = true
+	}
+	if rt.OrchestratorInclude != nil {
+		opts.orchestratorFilter.Include = rt.OrchestratorInclude
+	}
+	if rt.OrchestratorExclude != nil {
+		opts.orchestratorFilter.Exclude = rt.OrchestratorExclude
+	}
+	if rt.MaxPrice != "" {
+		opts.maxPrice = rt.MaxPrice
+	}
+	return opts
+}
+
+func routeUsage(cfg Config, rt Route) string {
+	if !rt.TrackUsage || cfg.UsageTracking == UsageOff {
+		return ""
+	}
+	if cfg.UsageTracking == "" {
+		return UsageOn
+	}
+	return cfg.UsageTracking
+}
+
+func hasRoute(routes []Route, path string) bool {
+	for _, rt := range routes {
+		if rt.Path == path {
+			return true
+		}
+	}
+	return false
+}
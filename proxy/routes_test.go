@@ -0,0 +1,46 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateRoutes(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		routes  []Route
+		wantErr string
+	}{
+		{"valid", []Route{{Path: "/v1/chat/completions", Capability: "llm"}}, ""},
+		{"wildcard", []Route{{Path: "/v1/files/{id}", Capability: "files"}}, ""},
+		{"catch-all", []Route{{Path: "/", Capability: "llm"}}, ""},
+		{"no leading slash", []Route{{Path: "v1/x", Capability: "llm"}}, "must start with /"},
+		{"duplicate", []Route{{Path: "/v1/x", Capability: "a"}, {Path: "/v1/x", Capability: "b"}}, "duplicate path"},
+		{"healthz", []Route{{Path: "/healthz", Capability: "llm"}}, "served by the proxy"},
+		{"readyz", []Route{{Path: "/readyz", Capability: "llm"}}, "served by the proxy"},
+		{"models", []Route{{Path: "/v1/models", Capability: "llm"}}, "served by the proxy"},
+		{"balance", []Route{{Path: "/v1/balance", Capability: "llm"}}, "served by the proxy"},
+		{"debug info", []Route{{Path: "/debug/info", Capability: "llm"}}, "served by the proxy"},
+		{"live transcode", []Route{{Path: "/v1/video/transcode/live/start", Capability: "llm"}}, "served by the proxy"},
+		{"byoc", []Route{{Path: "/v1/byoc/cap/run", Capability: "llm"}}, "served by the proxy"},
+		{"sync of a submit route", []Route{
+			{Path: "/v1/jobs", Capability: "video", JobStatusPath: "/v1/jobs/status"},
+			{Path: "/v1/jobs/status", Capability: "video"},
+			{Path: "/v1/jobs/sync", Capability: "video"},
+		}, "/v1/jobs/sync: path is served by the proxy"},
+		{"unclosed wildcard", []Route{{Path: "/v1/{x", Capability: "llm"}}, "bad wildcard"},
+		{"duplicate wildcard", []Route{{Path: "/v1/{x}/{x}", Capability: "llm"}}, "duplicate wildcard"},
+		{"conflicting patterns", []Route{{Path: "/v1/{a}/x", Capability: "a"}, {Path: "/v1/y/{b}", Capability: "b"}}, "conflicts"},
+		{"missing capability", []Route{{Path: "/v1/x"}}, "missing capability"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validateRoutes(tc.routes)
+			switch {
+			case tc.wantErr == "" && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)):
+				t.Fatalf("error %v, want one containing %q", err, tc.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// shadower mirrors a sample of gateway requests to a shadow gateway. The
+// responses are discarded; only their status and latency are recorded. A
+// nil *shadower mirrors nothing.
+type shadower struct {
+	url     string
+	percent float64
+	client  *http.Client
+	// sem caps the shadow requests in flight; requests sampled while it is
+	// full are dropped.
+	sem     chan struct{}
+	metrics *metrics
+}
+
+func newShadower(url string, percent float64, maxInFlight int, client *http.Client, m *metrics) *shadower {
+	if url == "" || percent <= 0 {
+		return nil
+	}
+	if maxInFlight <= 0 {
+		maxInFlight = 10
+	}
+	return &shadower{
+		url:     strings.TrimRight(url, "/"),
+		percent: percent,
+		client:  client,
+		sem:     make(chan struct{}, maxInFlight),
+		metrics: m,
+	}
+}
+
+// mirror sends a copy of req, with body as its body, to path on the shadow
+// gateway in the background if the request is sampled. Streaming requests
+// are sent with "stream" removed, so the shadow answers in one piece.
+func (s *shadower) mirror(req *http.Request, path string, body []byte, timeout time.Duration) {
+	if s == nil || rand.Float64()*100 >= s.percent {
+		return
+	}
+	route := routeFromContext(req.Context())
+	select {
+	case s.sem <- struct{}{}:
+	default:
+		s.metrics.observeShadowDropped(route)
+		return
+	}
+	body = withoutStream(body)
+	header := req.Header.Clone()
+	method := req.Method
+	log := logger(req.Context())
+	go func() {
+		defer func() { <-s.sem }()
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		sreq, err := http.NewRequestWithContext(ctx, method, s.url+path, bytes.NewReader(body))
+		if err != nil {
+			return
+		}
+		sreq.Header = header
+		start := time.Now()
+		resp, err := s.client.Do(sreq)
+		class := "error"
+		if err == nil {
+			class = statusClass(resp.StatusCode)
+			_, _ = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		} else {
+			log.Debug("shadow request failed", "url", s.url+path, "error", err)
+		}
+		s.metrics.observeShadow(route, class, time.Since(start))
+	}()
+}
+
+// withoutStream drops "stream" and "stream_options" from a JSON request
+// body that asks for a stream. Other bodies are returned unchanged.
+func withoutStream(body []byte) []byte {
+	var v map[string]json.RawMessage
+	if json.Unmarshal(body, &v) != nil || string(v["stream"]) != "true" {
+		return body
+	}
+	delete(v, "stream")
+	delete(v, "stream_options")
+	out, err := json.Marshal(v)
+	if err != nil {
+		return body
+	}
+	return out
+}
@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// errShuttingDown is the cause of requests ended by CloseStreams.
+var errShuttingDown = errors.New("proxy is shutting down")
+
+// shutdownChunk ends an SSE stream cut short by shutdown.
+const shutdownChunk = `{"error":{"message":"The server is shutting down, please retry.","type":"server_error","param":null,"code":"server_shutting_down"}}`
+
+// Drain makes /healthz and /readyz answer 503 so load balancers stop
+// routing new requests here. Requests are still served.
+func (p *Proxy) Drain() {
+	p.draining.Store(true)
+}
+
+// CloseStreams ends every in-flight request once the shutdown grace period
+// is over. Filtered SSE streams get an error event and [DONE] first.
+func (p *Proxy) CloseStreams() {
+	p.closeStreams(errShuttingDown)
+}
+
+// withShutdown cancels each request's context when CloseStreams is
+// called.
+func (p *Proxy) withShutdown(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithCancelCause(r.Context())
+		defer cancel(nil)
+		stop := context.AfterFunc(p.closed, func() { cancel(context.Cause(p.closed)) })
+		defer stop()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// drainingHandler answers 503 while the proxy is draining and next
+// otherwise.
+func (p *Proxy) drainingHandler(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if p.draining.Load() {
+			writeError(w, http.StatusServiceUnavailable, "server_shutting_down", "The server is shutting down.")
+			return
+		}
+		next(w, r)
+	}
+}
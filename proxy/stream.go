@@ -0,0 +1,573 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// streamSSEFiltered reads SSE events line-by-line and forwards only valid
+// OpenAI chat completion chunks. The Livepeer gateway injects non-standard
+// SSE events (e.g. `data: {"balance": ...}`) that lack the "choices" field.
+// OpenAI SDK clients try to parse every `data:` line as a completion chunk
+// and crash with "Cannot read properties of undefined (reading '0')" when
+// they encounter these events. Other streaming capabilities can require
+// different keys via opts.requiredKeys. It also returns how the stream
+// ended (see streamOutcome).
+func streamSSEFiltered(ctx context.Context, w http.ResponseWriter, body io.Reader, opts sseOptions) (sseStats, string) {
+	var stats sseStats
+	var sawDone bool
+	requiredKeys := opts.requiredKeys
+	if len(requiredKeys) == 0 {
+		requiredKeys = defaultSSERequiredKeys
+	}
+	sw := &sseWriter{w: w, lastWrite: time.Now(), coalesce: opts.flushInterval > 0}
+	sw.flusher, _ = w.(http.Flusher)
+	if sw.coalesce {
+		done := make(chan struct{})
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sw.flushEvery(done, opts.flushInterval)
+		}()
+		defer wg.Wait()
+		defer close(done)
+		// Whatever is still buffered goes out when the stream ends.
+		defer sw.flush()
+	}
+	// Lines are read into a buffer that grows as needed (e.g. for long
+	// reasoning tokens), up to opts.maxLine, on a goroutine so the loop
+	// below can send keep-alives while the gateway is quiet. They are
+	// collected into events, which end at a blank line.
+	// The same ticker checks for opts.idleTimeout, measured from the last
+	// bytes received rather than the last whole line.
+	activity := &activityReader{r: body}
+	activity.touch()
+	lines := make(chan sseLine)
+	stop := make(chan struct{})
+	defer close(stop)
+	go readSSELines(bufio.NewReader(activity), opts.maxLine, lines, stop)
+	var tick <-chan time.Time
+	if opts.keepAlive > 0 || opts.idleTimeout > 0 {
+		interval := time.Second
+		for _, d := range []time.Duration{opts.keepAlive, opts.idleTimeout} {
+			if d > 0 {
+				interval = min(interval, d)
+			}
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	var event []string
+	var eventBytes int
+	var readErr error
+read:
+	for !sw.failed() {
+		var line string
+		var err error
+		select {
+		case <-ctx.Done():
+			// Stop pumping as soon as the client is gone; the caller
+			// closes the gateway body, which frees the orchestrator.
+			readErr = ctx.Err()
+			break read
+		case <-tick:
+			if opts.idleTimeout > 0 && activity.idle() >= opts.idleTimeout {
+				readErr = errSSEIdleTimeout
+				break read
+			}
+			// Only whole events are written, so this never splits one.
+			if opts.keepAlive > 0 {
+				sw.keepAlive(opts.keepAlive)
+			}
+			continue
+		case l := <-lines:
+			line, err = l.line, l.err
+		}
+		eof := err == io.EOF
+		if eof && len(event) > 0 {
+			// The last event wasn't followed by a blank line; end it here.
+			// The reader has stopped, so nothing more will arrive.
+			line, err = "", nil
+		}
+		if err != nil {
+			readErr = err
+			break
+		}
+		if line != "" {
+			eventBytes += len(line)
+			if opts.maxLine > 0 && eventBytes > opts.maxLine {
+				readErr = errSSELineTooLong
+				break
+			}
+			event = append(event, line)
+			continue
+		}
+		if len(event) == 0 {
+			continue
+		}
+
+		out, done := filterSSEEvent(ctx, event, requiredKeys, opts.rewrite, &stats)
+		if out != nil {
+			sw.writeEvent(out)
+		}
+		if done {
+			sawDone = true
+			sw.flush()
+		}
+		event, eventBytes = event[:0], 0
+		if eof {
+			readErr = io.EOF
+			break
+		}
+	}
+
+	// A read error (as opposed to EOF) means the gateway connection broke
+	// or timed out mid-stream; a cancelled context means the client left.
+	// Without [DONE] OpenAI SDKs wait for more chunks, so end the stream
+	// with an error chunk they can surface.
+	switch {
+	case errors.Is(readErr, errSSELineTooLong):
+		logger(ctx).Error("SSE line from gateway exceeds limit, ending stream", "max_line_bytes", opts.maxLine)
+		sw.writeError(lineTooLongChunk)
+	case errors.Is(readErr, errResponseTooLarge):
+		sw.writeError(responseTooLargeChunk)
+	case readErr == errSSEIdleTimeout:
+		// The caller closes the gateway body, freeing the orchestrator.
+		logger(ctx).Warn("SSE stream from gateway idle, ending stream", "idle_timeout", opts.idleTimeout.String())
+		sw.writeError(idleTimeoutChunk)
+		return stats, streamIdleTimeout
+	case !sawDone && errors.Is(context.Cause(ctx), errShuttingDown):
+		logger(ctx).Warn("ending SSE stream for shutdown")
+		sw.writeError(shutdownChunk)
+	case sawDone:
+		return stats, streamCompleted
+	case sw.failed() || errors.Is(ctx.Err(), context.Canceled):
+		return stats, clientAborted(ctx, sw.err)
+	default:
+		// The gateway also closing the stream cleanly without [DONE]
+		// leaves SDK clients waiting.
+		if readErr == io.EOF {
+			logger(ctx).Warn("SSE stream from gateway ended without [DONE]")
+		} else {
+			logger(ctx).Warn("SSE stream from gateway interrupted", "error", readErr)
+		}
+		if opts.interruptedEnd == StreamEndDone {
+			sw.writeEvent([]string{"data: [DONE]"})
+			sw.flush()
+		} else {
+			sw.writeError(streamErrorChunk)
+		}
+	}
+	return stats, streamInterrupted
+}
+
+// filterSSEEvent returns what to forward of the event made of lines, or
+// nil to drop it, and reports whether it is the [DONE] event. Data spread
+// over several lines is joined, as the SSE spec has it, before the event
+// is checked for the required keys (or the configured ones) — without
+// them it's a Livepeer-injected event (balance, metadata, etc.).
+func filterSSEEvent(ctx context.Context, lines, requiredKeys []string, rewrite *modelRewrite, stats *sseStats) ([]string, bool) {
+	var data []string
+	for _, line := range lines {
+		if value, ok := sseData(line); ok {
+			data = append(data, value)
+		}
+	}
+	if data == nil {
+		// Comments and events without data pass through.
+		return lines, false
+	}
+	payload := strings.Join(data, "\n")
+	if payload == "[DONE]" {
+		stats.forward()
+		return lines, true
+	}
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(payload), &obj); err != nil {
+		if json.Valid([]byte(payload)) {
+			// A bare string, number or array would crash SDK parsers
+			// expecting chunk objects.
+			logger(ctx).Debug("filtered SSE event that isn't a JSON object", "payload", payload)
+			stats.filtered++
+			return nil, false
+		}
+		stats.forward()
+		return lines, false
+	}
+	if _, ok := obj["error"]; ok {
+		// Errors the gateway reports mid-stream are passed on, in the
+		// OpenAI error format if they aren't already.
+		logger(ctx).Warn("gateway sent an error event", "payload", payload)
+		return withSSEData(lines, bytes.TrimSpace(upstreamErrorBody(http.StatusBadGateway, []byte(payload)))), false
+	}
+	if !hasAnyKey(obj, requiredKeys) {
+		logger(ctx).Debug("filtered non-OpenAI SSE event", "payload", payload)
+		stats.filtered++
+		if b := sseBalance(obj); b != "" {
+			stats.balance = b
+		}
+		return nil, false
+	}
+	if model, u, ok := parseUsage([]byte(payload)); ok {
+		stats.model, stats.usage = model, &u
+	}
+	stats.forward()
+	if rewrite != nil {
+		return withSSEData(lines, rewrite.apply([]byte(payload))), false
+	}
+	return lines, false
+}
+
+// withSSEData returns lines with their data lines replaced by data, one
+// line of it per data line, written like the first data line.
+func withSSEData(lines []string, data []byte) []string {
+	out := make([]string, 0, len(lines))
+	replaced := false
+	for _, line := range lines {
+		value, ok := sseData(line)
+		if !ok {
+			out = append(out, line)
+			continue
+		}
+		if !replaced {
+			prefix := line[:len(line)-len(value)]
+			for _, part := range strings.Split(string(data), "\n") {
+				out = append(out, prefix+part)
+			}
+			replaced = true
+		}
+	}
+	return out
+}
+
+// defaultSSERequiredKeys are the keys a data event must have to be
+// forwarded when none are configured.
+var defaultSSERequiredKeys = []string{"choices"}
+
+func hasAnyKey(obj map[string]json.RawMessage, keys []string) bool {
+	for _, k := range keys {
+		if _, ok := obj[k]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// sseData returns the value of a "data:" line, without the one space
+// that may follow the colon.
+func sseData(line string) (string, bool) {
+	value, ok := strings.CutPrefix(line, "data:")
+	return strings.TrimPrefix(value, " "), ok
+}
+
+// errSSELineTooLong is returned by readSSELine for lines over the limit.
+var errSSELineTooLong = errors.New("SSE line too long")
+
+// errSSEIdleTimeout ends a filtered stream the gateway stopped sending.
+var errSSEIdleTimeout = errors.New("SSE stream idle")
+
+// activityReader records when bytes were last read from r.
+type activityReader struct {
+	r    io.Reader
+	last atomic.Int64
+}
+
+func (a *activityReader) Read(p []byte) (int, error) {
+	n, err := a.r.Read(p)
+	if n > 0 {
+		a.touch()
+	}
+	return n, err
+}
+
+func (a *activityReader) touch() { a.last.Store(time.Now().UnixNano()) }
+
+// idle returns how long ago bytes were last read.
+func (a *activityReader) idle() time.Duration {
+	return time.Since(time.Unix(0, a.last.Load()))
+}
+
+// readSSELine returns the next line from r without its line ending. A
+// final line without one is returned before io.EOF. Lines longer than max
+// bytes fail with errSSELineTooLong.
+func readSSELine(r *bufio.Reader, max int) (string, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if max > 0 && len(line)+len(chunk) > max+2 {
+			return "", errSSELineTooLong
+		}
+		line = append(line, chunk...)
+		switch {
+		case err == bufio.ErrBufferFull:
+			continue
+		case err == io.EOF && len(line) > 0:
+		case err != nil:
+			return "", err
+		}
+		line = bytes.TrimSuffix(line, []byte("\n"))
+		line = bytes.TrimSuffix(line, []byte("\r"))
+		if max > 0 && len(line) > max {
+			return "", errSSELineTooLong
+		}
+		return string(line), nil
+	}
+}
+
+// sseLine is a line, or the error ending the stream, from readSSELines.
+type sseLine struct {
+	line string
+	err  error
+}
+
+// readSSELines sends the lines read from r to lines until a read fails,
+// ending with that error, or stop is closed.
+func readSSELines(r *bufio.Reader, max int, lines chan<- sseLine, stop <-chan struct{}) {
+	for {
+		line, err := readSSELine(r, max)
+		select {
+		case lines <- sseLine{line, err}:
+		case <-stop:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// sseOptions tunes streamSSEFiltered.
+type sseOptions struct {
+	// rewrite restores the client's model name in forwarded chunks.
+	rewrite *modelRewrite
+	// keepAlive is the idle time after which a comment is sent to keep
+	// intermediaries from closing the connection; 0 disables it.
+	keepAlive time.Duration
+	// flushInterval, when set, batches forwarded events and flushes them
+	// at most this often (or once sseFlushBytes are pending) instead of
+	// after every event.
+	flushInterval time.Duration
+	// maxLine is the longest line, and event, accepted from the gateway,
+	// in bytes.
+	maxLine int
+	// requiredKeys are the JSON keys of which a data event needs at least
+	// one to be forwarded; empty means defaultSSERequiredKeys.
+	requiredKeys []string
+	// interruptedEnd is StreamEndError or StreamEndDone.
+	interruptedEnd string
+	// idleTimeout ends the stream when the gateway sends nothing for that
+	// long; 0 disables it.
+	idleTimeout time.Duration
+}
+
+// sseWriter serialises writes to a filtered stream with the flushes of
+// flushEvery, which runs on another goroutine.
+type sseWriter struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+
+	mu        sync.Mutex
+	lastWrite time.Time
+	// coalesce defers flushes to flushEvery; pending counts the bytes
+	// written since the last flush.
+	coalesce bool
+	pending  int
+	// err is the first error writing to the client, after which nothing
+	// more is written.
+	err error
+}
+
+// sseFlushBytes is how much a coalescing stream buffers before flushing
+// without waiting for the interval.
+const sseFlushBytes = 16 << 10
+
+// writeEvent writes the lines of an event and the blank line ending it.
+func (sw *sseWriter) writeEvent(lines []string) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	if sw.err != nil {
+		return
+	}
+	var b strings.Builder
+	for _, line := range lines {
+		b.WriteString(line)
+		b.WriteByte('\n')
+	}
+	b.WriteByte('\n')
+	n, err := io.WriteString(sw.w, b.String())
+	sw.err = err
+	sw.pending += n
+	if !sw.coalesce || sw.pending >= sseFlushBytes {
+		sw.flushLocked()
+	}
+	sw.lastWrite = time.Now()
+}
+
+// writeError ends the stream with an OpenAI error chunk and [DONE].
+func (sw *sseWriter) writeError(chunk string) {
+	sw.writeEvent([]string{"data: " + chunk})
+	sw.writeEvent([]string{"data: [DONE]"})
+	sw.flush()
+}
+
+// failed reports whether a write to the client failed.
+func (sw *sseWriter) failed() bool {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	return sw.err != nil
+}
+
+func (sw *sseWriter) flush() {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	sw.flushLocked()
+}
+
+func (sw *sseWriter) flushLocked() {
+	if sw.pending == 0 {
+		return
+	}
+	if sw.flusher != nil {
+		sw.flusher.Flush()
+	}
+	sw.pending = 0
+}
+
+// flushEvery flushes buffered lines every interval until done is closed.
+func (sw *sseWriter) flushEvery(done <-chan struct{}, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			sw.flush()
+		}
+	}
+}
+
+// keepAlive writes a comment if nothing was forwarded for interval.
+func (sw *sseWriter) keepAlive(interval time.Duration) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	if sw.err == nil && time.Since(sw.lastWrite) >= interval {
+		n, err := io.WriteString(sw.w, ": keep-alive\n\n")
+		sw.err = err
+		sw.pending += n
+		sw.flushLocked()
+		sw.lastWrite = time.Now()
+	}
+}
+
+// Ways to end a filtered stream the gateway broke off before [DONE].
+const (
+	// StreamEndError sends streamErrorChunk, then [DONE].
+	StreamEndError = "error"
+	// StreamEndDone only sends [DONE], for clients that treat any error
+	// chunk as fatal and would rather keep the partial output.
+	StreamEndDone = "done"
+)
+
+// streamErrorChunk is sent when the upstream stream breaks before [DONE].
+// Its finish_reason lets clients that only read choices tell the output
+// is incomplete.
+const streamErrorChunk = `{"choices":[{"index":0,"delta":{},"finish_reason":"error"}],"error":{"message":"The upstream stream was interrupted before completion.","type":"server_error","param":null,"code":"stream_interrupted"}}`
+
+// idleTimeoutChunk is sent when the gateway sends nothing for the idle
+// timeout.
+const idleTimeoutChunk = `{"choices":[{"index":0,"delta":{},"finish_reason":"error"}],"error":{"message":"The upstream stream stalled and was ended.","type":"server_error","param":null,"code":"stream_idle_timeout"}}`
+
+// responseTooLargeChunk is sent when a stream from the gateway exceeds the
+// streamed response limit.
+const responseTooLargeChunk = `{"error":{"message":"The upstream stream exceeded the size the proxy accepts.","type":"server_error","param":null,"code":"response_too_large"}}`
+
+// lineTooLongChunk is sent when a line from the gateway exceeds the limit.
+const lineTooLongChunk = `{"error":{"message":"The upstream stream sent an event larger than the proxy accepts.","type":"server_error","param":null,"code":"stream_line_too_long"}}`
+
+// sseStats summarises a filtered SSE stream.
+type sseStats struct {
+	// forwarded and filtered count data events sent to and withheld from
+	// the client.
+	forwarded, filtered int
+	// firstEvent is when the first data event was forwarded.
+	firstEvent time.Time
+	// usage is the last usage object seen in the stream, if any.
+	model string
+	usage *tokenUsage
+	// balance is the last Livepeer balance event filtered out.
+	balance string
+}
+
+func (s *sseStats) forward() {
+	if s.forwarded == 0 {
+		s.firstEvent = time.Now()
+	}
+	s.forwarded++
+}
+
+// Stream outcomes, as counted by proxy_streams_total.
+const (
+	streamCompleted = "completed"
+	// streamClientAborted streams stopped because the client went away;
+	// the caller closing the gateway body cancels the gateway's work.
+	streamClientAborted = "client_aborted"
+	streamInterrupted   = "interrupted"
+	// streamIdleTimeout filtered streams were ended after the gateway
+	// sent nothing for the idle timeout.
+	streamIdleTimeout = "idle_timeout"
+)
+
+// streamResponse copies body to w, flushing as it arrives, and returns how
+// the stream ended. It stops at the first failed write or once ctx is
+// done, closing body then if it's an io.Closer so a blocked read returns.
+func streamResponse(ctx context.Context, w http.ResponseWriter, body io.Reader) string {
+	if c, ok := body.(io.Closer); ok {
+		stop := context.AfterFunc(ctx, func() { c.Close() })
+		defer stop()
+	}
+	flusher, _ := w.(http.Flusher)
+	buf := make([]byte, 32*1024)
+	var readErr error
+	for readErr == nil && ctx.Err() == nil {
+		var n int
+		n, readErr = body.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				return clientAborted(ctx, err)
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+	switch {
+	case readErr == io.EOF:
+		return streamCompleted
+	case errors.Is(ctx.Err(), context.Canceled) && !errors.Is(context.Cause(ctx), errShuttingDown):
+		return clientAborted(ctx, nil)
+	}
+	logger(ctx).Warn("stream from gateway interrupted", "error", readErr, "cause", context.Cause(ctx))
+	return streamInterrupted
+}
+
+// clientAborted logs that a stream stopped because the client left, seen
+// as writeErr or as the request's context being canceled.
+func clientAborted(ctx context.Context, writeErr error) string {
+	if writeErr == nil {
+		writeErr = context.Cause(ctx)
+	}
+	logger(ctx).Debug("client went away, closing gateway stream", "error", writeErr)
+	return streamClientAborted
+}
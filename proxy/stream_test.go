@@ -0,0 +1,405 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// filterStream runs body through streamSSEFiltered and returns what the
+// client received and how the stream ended.
+func filterStream(t *testing.T, body string, opts sseOptions) (string, sseStats, string) {
+	t.Helper()
+	return filterStreamReader(t, strings.NewReader(body), opts)
+}
+
+// filterStreamReader is filterStream reading from body.
+func filterStreamReader(t *testing.T, body io.Reader, opts sseOptions) (string, sseStats, string) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rec := httptest.NewRecorder()
+	start := time.Now()
+	stats, outcome := streamSSEFiltered(ctx, rec, body, opts)
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("stream took %v to end", d)
+	}
+	return rec.Body.String(), stats, outcome
+}
+
+func TestStreamSSEFilteredEOFWithoutBlankLine(t *testing.T) {
+	for _, body := range []string{
+		"data: {\"choices\":[{\"delta\":{\"content\":\"a\"}}]}\n\ndata: [DONE]",
+		"data: {\"choices\":[{\"delta\":{\"content\":\"a\"}}]}\n\ndata: [DONE]\n",
+		"data: {\"choices\":[{\"delta\":{\"content\":\"a\"}}]}\r\n\r\ndata: [DONE]\r\n",
+	} {
+		// Keep-alives keep the ticker running, as in production.
+		out, _, outcome := filterStream(t, body, sseOptions{keepAlive: 50 * time.Millisecond})
+		want := "data: {\"choices\":[{\"delta\":{\"content\":\"a\"}}]}\n\ndata: [DONE]\n\n"
+		if out != want {
+			t.Errorf("body %q: got %q, want %q", body, out, want)
+		}
+		if outcome != streamCompleted {
+			t.Errorf("body %q: outcome %q, want %q", body, outcome, streamCompleted)
+		}
+	}
+}
+
+func TestStreamFlushesOverHTTP2(t *testing.T) {
+	const chunk = "data: {\"choices\":[{\"delta\":{\"content\":\"a\"}}]}\n\n"
+	proto := make(chan string, 1)
+	release := make(chan struct{})
+	gw := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proto <- r.Proto
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, chunk)
+		w.(http.Flusher).Flush()
+		// The rest of the stream waits until the client has the first
+		// chunk, so buffering anywhere on the way stalls the test.
+		select {
+		case <-release:
+		case <-time.After(5 * time.Second):
+		}
+		io.WriteString(w, "data: [DONE]\n\n")
+	}))
+	gw.EnableHTTP2 = true
+	gw.StartTLS()
+	defer gw.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(gw.Certificate())
+	p := New(Config{
+		GatewayURL:   gw.URL,
+		ClientConfig: ClientConfig{HTTP2: true, TLS: &tls.Config{RootCAs: roots}},
+		Routes:       []Route{{Path: "/v1/chat/completions", Capability: "chat", Mode: ModeSSE}},
+	})
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+
+	// The first chunk has to arrive while the gateway still holds the
+	// stream open.
+	first := make(chan string, 1)
+	bodies := make(chan io.ReadCloser, 1)
+	var body *bufio.Reader
+	go func() {
+		resp, err := http.Post(srv.URL+"/v1/chat/completions", "application/json", strings.NewReader(`{"model":"m","stream":true}`))
+		if err != nil {
+			first <- err.Error()
+			return
+		}
+		bodies <- resp.Body
+		body = bufio.NewReader(resp.Body)
+		var event string
+		for !strings.HasSuffix(event, "\n\n") {
+			line, err := body.ReadString('\n')
+			event += line
+			if err != nil {
+				break
+			}
+		}
+		first <- event
+	}()
+	select {
+	case event := <-first:
+		if event != chunk {
+			t.Fatalf("first event %q, want %q", event, chunk)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("first chunk not flushed within 2s")
+	}
+	defer (<-bodies).Close()
+	if got := <-proto; got != "HTTP/2.0" {
+		t.Errorf("gateway request over %s, want HTTP/2.0", got)
+	}
+	close(release)
+	if rest, _ := io.ReadAll(body); string(rest) != "data: [DONE]\n\n" {
+		t.Errorf("rest of the stream %q", rest)
+	}
+}
+
+// countingFlusher counts the flushes reaching a ResponseWriter.
+type countingFlusher struct {
+	http.ResponseWriter
+	flushes int
+}
+
+func (c *countingFlusher) Flush() {
+	c.flushes++
+	c.ResponseWriter.(http.Flusher).Flush()
+}
+
+// BenchmarkSSEFlushing streams 1000 chunks to a client over a real
+// connection, flushing each one or coalescing them.
+func BenchmarkSSEFlushing(b *testing.B) {
+	const chunks = 1000
+	body := strings.Repeat("data: {\"choices\":[{\"delta\":{\"content\":\"token\"}}]}\n\n", chunks) + "data: [DONE]\n\n"
+	for _, bc := range []struct {
+		name          string
+		flushInterval time.Duration
+	}{
+		{"immediate", 0},
+		{"coalesced_20ms", 20 * time.Millisecond},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			var flushes atomic.Int64
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				cw := &countingFlusher{ResponseWriter: w}
+				w.Header().Set("Content-Type", "text/event-stream")
+				streamSSEFiltered(r.Context(), cw, strings.NewReader(body), sseOptions{flushInterval: bc.flushInterval})
+				flushes.Add(int64(cw.flushes))
+			}))
+			defer srv.Close()
+			client := srv.Client()
+			b.SetBytes(int64(len(body)))
+			b.ResetTimer()
+			for range b.N {
+				resp, err := client.Get(srv.URL)
+				if err != nil {
+					b.Fatal(err)
+				}
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(flushes.Load())/float64(b.N), "flushes/op")
+		})
+	}
+}
+
+func TestStreamSSEFilteredMixedEvents(t *testing.T) {
+	body := "data: {\"choices\":[{\"delta\":{\"content\":\"a\"}}]}\n\n" +
+		"data: {\"balance\":\"990\"}\n\n" +
+		"data: {\"error\":\"model overloaded\"}\n\n" +
+		"data: {\"error\":{\"message\":\"bad\",\"type\":\"server_error\"}}\n\n" +
+		"data: {\"choices\":[{\"delta\":{},\"finish_reason\":\"stop\"}]}\n\n" +
+		"data: [DONE]\n\n"
+	out, stats, outcome := filterStream(t, body, sseOptions{})
+	want := "data: {\"choices\":[{\"delta\":{\"content\":\"a\"}}]}\n\n" +
+		// Errors are kept, in the OpenAI format.
+		"data: {\"error\":{\"code\":\"bad_gateway\",\"message\":\"model overloaded\",\"param\":null,\"type\":\"upstream_error\"}}\n\n" +
+		"data: {\"error\":{\"message\":\"bad\",\"type\":\"server_error\"}}\n\n" +
+		"data: {\"choices\":[{\"delta\":{},\"finish_reason\":\"stop\"}]}\n\n" +
+		"data: [DONE]\n\n"
+	if out != want {
+		t.Errorf("got %q, want %q", out, want)
+	}
+	if outcome != streamCompleted {
+		t.Errorf("outcome %q, want %q", outcome, streamCompleted)
+	}
+	if stats.filtered != 1 || stats.balance != "990" {
+		t.Errorf("filtered %d with balance %q, want 1 with 990", stats.filtered, stats.balance)
+	}
+}
+
+func TestSSEData(t *testing.T) {
+	for _, tc := range []struct {
+		line, want string
+		ok         bool
+	}{
+		{"data: [DONE]", "[DONE]", true},
+		{"data:[DONE]", "[DONE]", true},
+		{"data:  x", " x", true},
+		{"data:", "", true},
+		{": data: x", "", false},
+		{"event: data", "", false},
+		{"Data: x", "", false},
+	} {
+		got, ok := sseData(tc.line)
+		if ok != tc.ok || ok && got != tc.want {
+			t.Errorf("sseData(%q) = %q, %v, want %q, %v", tc.line, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestReadSSELine(t *testing.T) {
+	in := "data: a\r\ndata:b\n\r\n\nlast"
+	r := bufio.NewReaderSize(strings.NewReader(in), 16)
+	var got []string
+	for {
+		line, err := readSSELine(r, 0)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, line)
+	}
+	want := []string{"data: a", "data:b", "", "", "last"}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	long := strings.Repeat("x", 40)
+	r = bufio.NewReaderSize(strings.NewReader(long+"\r\n"), 16)
+	if line, err := readSSELine(r, 40); line != long || err != nil {
+		t.Errorf("line at the limit: %q, %v", line, err)
+	}
+	r = bufio.NewReaderSize(strings.NewReader(long+"x\n"), 16)
+	if _, err := readSSELine(r, 40); err != errSSELineTooLong {
+		t.Errorf("line over the limit: %v, want errSSELineTooLong", err)
+	}
+}
+
+func TestStreamSSEFilteredLineEndings(t *testing.T) {
+	const chunk = `{"choices":[{"delta":{"content":"a"}}]}`
+	for _, body := range []string{
+		"data: " + chunk + "\n\ndata: [DONE]\n\n",
+		"data: " + chunk + "\r\n\r\ndata: [DONE]\r\n\r\n",
+		"data:" + chunk + "\n\ndata:[DONE]\n\n",
+		"data:" + chunk + "\r\n\r\ndata:[DONE]\r\n\r\n",
+		"data: " + chunk + "\r\n\ndata:[DONE]\n\r\n",
+		"data: {\"balance\":\"5\"}\r\n\r\ndata:" + chunk + "\n\ndata: [DONE]\r\n\r\n",
+	} {
+		out, _, outcome := filterStream(t, body, sseOptions{})
+		if outcome != streamCompleted {
+			t.Errorf("body %q: outcome %q, want %q", body, outcome, streamCompleted)
+		}
+		if !strings.Contains(out, chunk) || !strings.HasSuffix(out, "[DONE]\n\n") || strings.Contains(out, "balance") || strings.Contains(out, "\r") {
+			t.Errorf("body %q: got %q", body, out)
+		}
+	}
+}
+
+func TestFilterSSEEvent(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		lines    []string
+		want     []string
+		wantDone bool
+	}{
+		{"chunk", []string{`data: {"choices":[]}`}, []string{`data: {"choices":[]}`}, false},
+		{"multi-line chunk", []string{`data: {"choices":`, `data: []}`}, []string{`data: {"choices":`, `data: []}`}, false},
+		{"multi-line balance", []string{`data: {"balance":`, `data: "5"}`}, nil, false},
+		{"comment", []string{": keep-alive"}, []string{": keep-alive"}, false},
+		{"comment and chunk", []string{": note", `data: {"choices":[]}`}, []string{": note", `data: {"choices":[]}`}, false},
+		{"comment and balance", []string{": note", `data: {"balance":"5"}`}, nil, false},
+		{"event and id fields", []string{"event: message", `data: {"choices":[]}`, "id: 7"}, []string{"event: message", `data: {"choices":[]}`, "id: 7"}, false},
+		{"interleaved fields", []string{"id: 7", `data: {"choices":`, "event: message", `data: []}`}, []string{"id: 7", `data: {"choices":`, "event: message", `data: []}`}, false},
+		{"event and id on balance", []string{"event: balance", "id: 8", `data: {"balance":"5"}`}, nil, false},
+		{"event without data", []string{"event: ping"}, []string{"event: ping"}, false},
+		{"done with event field", []string{"event: done", "data: [DONE]"}, []string{"event: done", "data: [DONE]"}, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var stats sseStats
+			got, done := filterSSEEvent(context.Background(), tc.lines, defaultSSERequiredKeys, nil, &stats)
+			if strings.Join(got, "\n") != strings.Join(tc.want, "\n") || (got == nil) != (tc.want == nil) {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+			if done != tc.wantDone {
+				t.Errorf("done %v, want %v", done, tc.wantDone)
+			}
+		})
+	}
+}
+
+func TestStreamSSEFilteredToolCalls(t *testing.T) {
+	toolCalls := []string{
+		`data: {"choices":[{"index":0,"delta":{"role":"assistant","content":null,"tool_calls":[{"index":0,"id":"call_1","type":"function","function":{"name":"get_weather","arguments":""}}]}}]}`,
+		`data: {"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"{\"city\":"}}]}}]}`,
+		`data: {"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"\"Paris\"}"}}]}}]}`,
+		`data: {"choices":[{"index":0,"delta":{},"finish_reason":"tool_calls"}]}`,
+	}
+	var body, want strings.Builder
+	for i, chunk := range toolCalls {
+		body.WriteString(chunk + "\n\n")
+		want.WriteString(chunk + "\n\n")
+		// Stray scalar events between the chunks are dropped.
+		body.WriteString([]string{`data: "keep-alive"`, "data: 42", "data: [1,2]", "data: null"}[i] + "\n\n")
+	}
+	body.WriteString("data: [DONE]\n\n")
+	want.WriteString("data: [DONE]\n\n")
+
+	out, stats, outcome := filterStream(t, body.String(), sseOptions{})
+	if out != want.String() {
+		t.Errorf("got %q, want %q", out, want.String())
+	}
+	if outcome != streamCompleted {
+		t.Errorf("outcome %q, want %q", outcome, streamCompleted)
+	}
+	if stats.filtered != 4 {
+		t.Errorf("filtered %d events, want 4", stats.filtered)
+	}
+}
+
+func TestStreamSSEFilteredLongLine(t *testing.T) {
+	chunk := `data: {"choices":[{"delta":{"tool_calls":[{"index":0,"function":{"arguments":"` + strings.Repeat("A", 1<<20) + `"}}]}}]}`
+	body := chunk + "\n\ndata: [DONE]\n\n"
+
+	out, _, outcome := filterStream(t, body, sseOptions{maxLine: 32 << 20})
+	if out != body {
+		t.Errorf("1 MB chunk: got %d bytes ending %q, want it unchanged", len(out), out[max(0, len(out)-40):])
+	}
+	if outcome != streamCompleted {
+		t.Errorf("1 MB chunk: outcome %q, want %q", outcome, streamCompleted)
+	}
+
+	out, _, outcome = filterStream(t, body, sseOptions{maxLine: 512 << 10})
+	if want := "data: " + lineTooLongChunk + "\n\ndata: [DONE]\n\n"; out != want {
+		t.Errorf("over the limit: got %q, want %q", out, want)
+	}
+	if outcome != streamInterrupted {
+		t.Errorf("over the limit: outcome %q, want %q", outcome, streamInterrupted)
+	}
+}
+
+func TestStreamSSEFilteredInterrupted(t *testing.T) {
+	const chunk = "data: {\"choices\":[{\"delta\":{\"content\":\"a\"}}]}\n\n"
+	broken := func() io.Reader {
+		return io.MultiReader(strings.NewReader(chunk), iotest.ErrReader(errors.New("connection reset by peer")))
+	}
+	for _, tc := range []struct {
+		name string
+		body io.Reader
+		end  string
+		want string
+	}{
+		{"EOF without [DONE]", strings.NewReader(chunk), "", chunk + "data: " + streamErrorChunk + "\n\ndata: [DONE]\n\n"},
+		{"EOF without [DONE], done end", strings.NewReader(chunk), StreamEndDone, chunk + "data: [DONE]\n\n"},
+		{"read error", broken(), "", chunk + "data: " + streamErrorChunk + "\n\ndata: [DONE]\n\n"},
+		{"read error, done end", broken(), StreamEndDone, chunk + "data: [DONE]\n\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			out, _, outcome := filterStreamReader(t, tc.body, sseOptions{interruptedEnd: tc.end})
+			if out != tc.want {
+				t.Errorf("got %q, want %q", out, tc.want)
+			}
+			if outcome != streamInterrupted {
+				t.Errorf("outcome %q, want %q", outcome, streamInterrupted)
+			}
+		})
+	}
+}
+
+func TestChatStreamGatewayAborts(t *testing.T) {
+	const chunk = "data: {\"choices\":[{\"delta\":{\"content\":\"a\"}}]}\n\n"
+	gw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, chunk)
+		w.(http.Flusher).Flush()
+		// Drop the connection without ending the chunked body.
+		panic(http.ErrAbortHandler)
+	}))
+	defer gw.Close()
+	p := New(Config{
+		GatewayURL: gw.URL,
+		Routes:     []Route{{Path: "/v1/chat/completions", Capability: "chat", Mode: ModeSSE}},
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"model":"m","stream":true}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+	if want := chunk + "data: " + streamErrorChunk + "\n\ndata: [DONE]\n\n"; rec.Body.String() != want {
+		t.Errorf("got %q, want %q", rec.Body, want)
+	}
+}
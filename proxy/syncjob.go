@@ -0,0 +1,214 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// terminalJobStates are the job statuses at which polling stops.
+var terminalJobStates = []string{
+	"completed", "complete", "succeeded", "success", "done", "finished",
+	"failed", "error", "cancelled", "canceled",
+}
+
+// syncJobHandler serves <submit path>/sync: it submits the job like the
+// submit route, then polls the status route every interval until the job
+// reaches a terminal state or the submit route's timeout elapses, and
+// answers with the final status. Clients that accept text/event-stream get
+// every status as an SSE event instead.
+func syncJobHandler(submit, status handlerOptions, interval time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeMethodNotAllowed(w, r)
+			return
+		}
+		if !submit.limiter.acquire(r.Context()) {
+			w.Header().Set("Retry-After", "1")
+			setRateLimitHeaders(w.Header(), nil, submit.limiter)
+			writeOpenAIError(w, http.StatusTooManyRequests,
+				"Too many concurrent requests for "+submit.capability+", please retry shortly.",
+				"rate_limit_error", "concurrency_limit_exceeded")
+			return
+		}
+		defer submit.limiter.release()
+
+		body, ok := readBody(w, r, submit.maxBody)
+		if !ok {
+			return
+		}
+		if !json.Valid(body) {
+			writeOpenAIError(w, http.StatusBadRequest, "We could not parse the JSON body of your request.", "invalid_request_error", "invalid_json")
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), time.Duration(submit.timeoutSeconds)*time.Second)
+		defer cancel()
+		setCapability(ctx, submit.capability)
+		setTimeout(ctx, submit.timeoutSeconds)
+
+		gateway := submit.gateways.pick()
+		resp, err := submit.gatewayPost(ctx, r, gateway+submit.path, body)
+		if err != nil {
+			resp, gateway, err = submit.gateways.fallThrough(ctx, gateway, err, func(gateway string) (*http.Response, error) {
+				return submit.gatewayPost(ctx, r, gateway+submit.path, body)
+			})
+		}
+		if err != nil {
+			logger(ctx).Error("gateway request failed", "url", gateway+submit.path, "error", err)
+			writeGatewayError(w, err)
+			return
+		}
+		submitted, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		setUpstreamStatus(ctx, resp.StatusCode)
+		if resp.StatusCode/100 != 2 {
+			writeJobStatus(w, resp, submitted, submit.exposeLivepeerHeaders)
+			return
+		}
+		id := jobID(submitted)
+		if id == "" {
+			logger(ctx).Error("gateway submit response has no job_id")
+			writeOpenAIError(w, http.StatusBadGateway, "The gateway did not return a job ID.", "api_error", "bad_gateway")
+			return
+		}
+		if submit.jobs != nil {
+			submit.jobs.put(id, jobEntry{capability: submit.capability, gateway: gateway, statusPath: status.path})
+		}
+
+		sse := strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+		var flusher http.Flusher
+		if sse {
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Header().Set("Cache-Control", "no-cache")
+			w.WriteHeader(http.StatusOK)
+			flusher, _ = w.(http.Flusher)
+			setStreamed(ctx)
+			writeJobEvent(w, flusher, submitted)
+		}
+
+		poll, _ := json.Marshal(map[string]string{"job_id": id})
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				if errors.Is(r.Context().Err(), context.Canceled) {
+					return
+				}
+				logger(ctx).Warn("job did not finish in time", "job_id", id, "timeout_seconds", submit.timeoutSeconds)
+				if sse {
+					writeJobEvent(w, flusher, []byte(jobTimeoutChunk))
+					return
+				}
+				writeOpenAIError(w, http.StatusGatewayTimeout, "The job did not finish in time.", "api_error", "job_timeout")
+				return
+			case <-ticker.C:
+			}
+
+			resp, err := status.gatewayPost(ctx, r, gateway+status.path, poll)
+			if err != nil {
+				if ctx.Err() == nil {
+					logger(ctx).Warn("job status request failed", "job_id", id, "error", err)
+				}
+				continue
+			}
+			data, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			switch {
+			case resp.StatusCode/100 == 2:
+			case resp.StatusCode == http.StatusNotFound || resp.StatusCode >= 500:
+				logger(ctx).Warn("job status request failed", "job_id", id, "status", resp.StatusCode)
+				continue
+			default:
+				if sse {
+					writeJobEvent(w, flusher, data)
+				} else {
+					writeJobStatus(w, resp, data, status.exposeLivepeerHeaders)
+				}
+				return
+			}
+			done := contains(terminalJobStates, strings.ToLower(jobState(data)))
+			if sse {
+				writeJobEvent(w, flusher, data)
+				if done {
+					return
+				}
+				continue
+			}
+			if done {
+				writeJobStatus(w, resp, data, status.exposeLivepeerHeaders)
+				return
+			}
+		}
+	}
+}
+
+// gatewayPost sends a JSON body to target with the Livepeer header for
+// opts.capability.
+func (opts handlerOptions) gatewayPost(ctx context.Context, r *http.Request, target string, body []byte) (*http.Response, error) {
+	header, err := buildLivepeerHeader(livepeerJob{
+		Parameters: livepeerParameters{
+			Orchestrators:   opts.orchestratorFilter.withExcluded(opts.orchestrators.excluded()),
+			MaxPricePerUnit: json.Number(opts.maxPrice),
+		},
+		Capability:     opts.capability,
+		TimeoutSeconds: opts.timeoutSeconds,
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	opts.gatewayAuth.apply(req.Header, r.Header)
+	req.Header.Set("Livepeer", header)
+	return opts.client.Do(req)
+}
+
+// writeJobStatus writes a buffered gateway response as JSON.
+func writeJobStatus(w http.ResponseWriter, resp *http.Response, body []byte, exposeLivepeerHeaders bool) {
+	copyAllHeaders(w.Header(), resp.Header)
+	scrubLivepeerHeaders(w.Header(), exposeLivepeerHeaders)
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(resp.StatusCode)
+	_, _ = w.Write(body)
+}
+
+// writeJobEvent writes body, compacted onto one line, as an SSE event.
+func writeJobEvent(w io.Writer, flusher http.Flusher, body []byte) {
+	var buf bytes.Buffer
+	if json.Compact(&buf, body) != nil {
+		buf.Reset()
+		buf.WriteString(strings.ReplaceAll(string(body), "\n", " "))
+	}
+	_, _ = io.WriteString(w, "data: "+buf.String()+"\n\n")
+	if flusher != nil {
+		flusher.Flush()
+	}
+}
+
+// jobState returns the "status" (or "state") field of a job status
+// response.
+func jobState(body []byte) string {
+	var v struct {
+		Status string `json:"status"`
+		State  string `json:"state"`
+	}
+	_ = json.Unmarshal(body, &v)
+	if v.Status != "" {
+		return v.Status
+	}
+	return v.State
+}
+
+// jobTimeoutChunk ends a sync job stream whose job didn't finish in time.
+const jobTimeoutChunk = `{"error":{"message":"The job did not finish in time.","type":"api_error","param":null,"code":"job_timeout"}}`
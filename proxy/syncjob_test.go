@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// jobGateway accepts submits with job_id j1 and answers status polls
+// with statuses in turn, repeating the last one. A status of "400", "404"
+// or "503" answers with that code instead.
+type jobGateway struct {
+	mu       sync.Mutex
+	statuses []string
+	polls    int
+}
+
+func (g *jobGateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !strings.HasSuffix(r.URL.Path, "/status") {
+		w.Write([]byte(`{"job_id":"j1","status":"queued"}`))
+		return
+	}
+	g.mu.Lock()
+	status := g.statuses[min(g.polls, len(g.statuses)-1)]
+	g.polls++
+	g.mu.Unlock()
+	switch status {
+	case "404":
+		http.Error(w, `{"error":"not found"}`, http.StatusNotFound)
+	case "503":
+		http.Error(w, `{"error":"unavailable"}`, http.StatusServiceUnavailable)
+	case "400":
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":{"message":"bad job"}}`))
+	default:
+		w.Write([]byte(`{"job_id":"j1",` + "\n" + `"status":"` + status + `"}`))
+	}
+}
+
+func TestSyncJob(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		statuses   []string
+		accept     string
+		timeout    int
+		wantStatus int
+		wantBody   string
+		wantPolls  int
+	}{
+		{"pending then completed", []string{"running", "running", "completed"}, "", 30,
+			http.StatusOK, "{\"job_id\":\"j1\",\n\"status\":\"completed\"}", 3},
+		{"not found and 5xx are retried", []string{"404", "503", "succeeded"}, "", 30,
+			http.StatusOK, "{\"job_id\":\"j1\",\n\"status\":\"succeeded\"}", 3},
+		{"failed job", []string{"failed"}, "", 30,
+			http.StatusOK, "{\"job_id\":\"j1\",\n\"status\":\"failed\"}", 1},
+		{"other errors end the wait", []string{"running", "400"}, "", 30,
+			http.StatusBadRequest, `{"error":{"message":"bad job"}}`, 2},
+		{"timeout", []string{"running"}, "", 1,
+			http.StatusGatewayTimeout, `"code":"job_timeout"`, -1},
+		{"event stream", []string{"running", "404", "completed"}, "text/event-stream", 30, http.StatusOK,
+			"data: {\"job_id\":\"j1\",\"status\":\"queued\"}\n\n" +
+				"data: {\"job_id\":\"j1\",\"status\":\"running\"}\n\n" +
+				"data: {\"job_id\":\"j1\",\"status\":\"completed\"}\n\n", 3},
+		{"event stream timeout", []string{"running"}, "text/event-stream", 1, http.StatusOK,
+			"data: " + jobTimeoutChunk + "\n\n", -1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			gw := &jobGateway{statuses: tc.statuses}
+			srv := httptest.NewServer(gw)
+			defer srv.Close()
+			p := New(Config{
+				GatewayURL: srv.URL,
+				Routes: []Route{
+					{Path: "/v1/video/generations", Capability: "video", TimeoutSeconds: tc.timeout, JobStatusPath: "/v1/video/generations/status"},
+					{Path: "/v1/video/generations/status", Capability: "video"},
+				},
+			})
+			table := p.routes.Load()
+			submit := routeOptions(p, table.routes[0], table.limiters)
+			status := routeOptions(p, table.routes[1], table.limiters)
+			handler := syncJobHandler(submit, status, 10*time.Millisecond)
+
+			req := httptest.NewRequest(http.MethodPost, "/v1/video/generations/sync", strings.NewReader(`{"prompt":"p"}`))
+			req.Header.Set("Content-Type", "application/json")
+			if tc.accept != "" {
+				req.Header.Set("Accept", tc.accept)
+			}
+			rec := httptest.NewRecorder()
+			start := time.Now()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tc.wantStatus {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tc.wantStatus, rec.Body)
+			}
+			body := rec.Body.String()
+			if tc.wantPolls < 0 {
+				if !strings.Contains(body, tc.wantBody) {
+					t.Errorf("body %q, want it to contain %q", body, tc.wantBody)
+				}
+				if elapsed := time.Since(start); elapsed < time.Second || elapsed > 5*time.Second {
+					t.Errorf("timed out after %v, want about 1s", elapsed)
+				}
+				return
+			}
+			if body != tc.wantBody {
+				t.Errorf("body %q, want %q", body, tc.wantBody)
+			}
+			gw.mu.Lock()
+			polls := gw.polls
+			gw.mu.Unlock()
+			if polls != tc.wantPolls {
+				t.Errorf("%d polls, want %d", polls, tc.wantPolls)
+			}
+			if tc.accept != "" && rec.Header().Get("Content-Type") != "text/event-stream" {
+				t.Errorf("Content-Type %q, want text/event-stream", rec.Header().Get("Content-Type"))
+			}
+		})
+	}
+}
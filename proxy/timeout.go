@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Request headers that override the route timeout for one request. The
+// X-Proxy- name is kept for clients written against earlier releases.
+const (
+	timeoutHeader       = "X-Timeout-Seconds"
+	legacyTimeoutHeader = "X-Proxy-Timeout-Seconds"
+)
+
+// requestTimeout returns the timeout a client asked for in the timeout
+// headers or, failing that, in bodyTimeout (a stripped body field),
+// clamped to [min, max]. Without a usable value it returns def.
+func requestTimeout(ctx context.Context, h http.Header, bodyTimeout string, def, min, max int) int {
+	v := h.Get(timeoutHeader)
+	if v == "" {
+		v = h.Get(legacyTimeoutHeader)
+	}
+	if v == "" {
+		v = bodyTimeout
+	}
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(v))
+	if err != nil || n <= 0 {
+		logger(ctx).Warn("ignoring invalid request timeout", "value", v, "default", def)
+		return def
+	}
+	if max > 0 && n > max {
+		n = max
+	}
+	if n < min {
+		n = min
+	}
+	return n
+}
+
+// stripBodyTimeout removes a top-level "timeout" field (a number or a
+// numeric string) from a JSON request body so it isn't forwarded, and
+// returns its value.
+func stripBodyTimeout(body []byte) ([]byte, string) {
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(body, &obj); err != nil {
+		return body, ""
+	}
+	raw, ok := obj["timeout"]
+	if !ok {
+		return body, ""
+	}
+	delete(obj, "timeout")
+	out, err := json.Marshal(obj)
+	if err != nil {
+		return body, ""
+	}
+	v := strings.Trim(string(raw), `"`)
+	if v == "" {
+		// Present but empty still counts as "no timeout given".
+		return out, ""
+	}
+	return out, v
+}
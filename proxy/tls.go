@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// GatewayTLS locates the certificate material for https gateways.
+type GatewayTLS struct {
+	// CertFile and KeyFile are a PEM client certificate and key presented
+	// to gateways that require mutual TLS.
+	CertFile, KeyFile string
+	// CAFile is a PEM bundle of root CAs trusted instead of the system
+	// roots, for gateways with privately issued certificates.
+	CAFile string
+	// InsecureSkipVerify accepts any gateway certificate. For lab setups
+	// only.
+	InsecureSkipVerify bool
+}
+
+// Load returns the tls.Config for g, or nil if g sets nothing.
+func (g GatewayTLS) Load() (*tls.Config, error) {
+	if g == (GatewayTLS{}) {
+		return nil, nil
+	}
+	cfg := &tls.Config{InsecureSkipVerify: g.InsecureSkipVerify}
+	if g.CertFile != "" || g.KeyFile != "" {
+		if g.CertFile == "" || g.KeyFile == "" {
+			return nil, errors.New("gateway client certificate and key must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(g.CertFile, g.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load gateway client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if g.CAFile != "" {
+		pem, err := os.ReadFile(g.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read gateway CA file: %w", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("gateway CA file %s contains no PEM certificates", g.CAFile)
+		}
+	}
+	return cfg, nil
+}
@@ -0,0 +1,164 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate and key issued by a test CA.
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func issueCert(t *testing.T, template *x509.Certificate, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	parentCert, signer := template, key
+	if parent != nil {
+		parentCert, signer = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parentCert, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+// writePEM writes c's certificate and key to dir as name.crt and
+// name.key.
+func (c *testCert) writePEM(t *testing.T, dir, name string) (certFile, keyFile string) {
+	t.Helper()
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestGatewayMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := issueCert(t, &x509.Certificate{
+		Subject: pkix.Name{CommonName: "test CA"}, IsCA: true, BasicConstraintsValid: true,
+		KeyUsage: x509.KeyUsageCertSign,
+	}, nil)
+	server := issueCert(t, &x509.Certificate{
+		Subject: pkix.Name{CommonName: "gateway"}, IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}, KeyUsage: x509.KeyUsageDigitalSignature,
+	}, ca)
+	client := issueCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "proxy"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}, KeyUsage: x509.KeyUsageDigitalSignature,
+	}, ca)
+	caFile, _ := ca.writePEM(t, dir, "ca")
+	certFile, keyFile := client.writePEM(t, dir, "client")
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	peer := make(chan string, 1)
+	gw := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peer <- r.TLS.PeerCertificates[0].Subject.CommonName
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"data":[]}`))
+	}))
+	gw.TLS = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{server.der}, PrivateKey: server.key}},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	}
+	gw.StartTLS()
+	defer gw.Close()
+
+	for _, tc := range []struct {
+		name    string
+		g       GatewayTLS
+		wantErr bool
+	}{
+		{"client certificate", GatewayTLS{CertFile: certFile, KeyFile: keyFile, CAFile: caFile}, false},
+		{"no client certificate", GatewayTLS{CAFile: caFile}, true},
+		{"untrusted gateway", GatewayTLS{CertFile: certFile, KeyFile: keyFile}, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, err := tc.g.Load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			p := New(Config{
+				GatewayURL:   gw.URL,
+				ClientConfig: ClientConfig{TLS: cfg},
+				Routes:       []Route{{Path: "/v1/embeddings", Capability: "embeddings"}},
+			})
+			req := httptest.NewRequest(http.MethodPost, "/v1/embeddings", strings.NewReader(`{"input":"a"}`))
+			req.Header.Set("Content-Type", "application/json")
+			rec := httptest.NewRecorder()
+			p.ServeHTTP(rec, req)
+
+			if tc.wantErr {
+				if rec.Code != http.StatusBadGateway {
+					t.Errorf("status %d, want 502: %s", rec.Code, rec.Body)
+				}
+				return
+			}
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", rec.Code, rec.Body)
+			}
+			if cn := <-peer; cn != "proxy" {
+				t.Errorf("gateway saw client certificate %q, want proxy", cn)
+			}
+		})
+	}
+}
+
+func TestGatewayTLSLoadErrors(t *testing.T) {
+	dir := t.TempDir()
+	notPEM := filepath.Join(dir, "not.pem")
+	if err := os.WriteFile(notPEM, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if cfg, err := (GatewayTLS{}).Load(); cfg != nil || err != nil {
+		t.Errorf("empty: %v, %v; want nil, nil", cfg, err)
+	}
+	for _, g := range []GatewayTLS{
+		{CertFile: notPEM},
+		{KeyFile: notPEM},
+		{CertFile: notPEM, KeyFile: notPEM},
+		{CAFile: notPEM},
+		{CAFile: filepath.Join(dir, "missing.pem")},
+	} {
+		if _, err := g.Load(); err == nil {
+			t.Errorf("%+v: no error", g)
+		}
+	}
+}
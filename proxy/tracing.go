@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer uses the global OpenTelemetry provider, which is a no-op unless
+// the program installs one.
+var tracer = otel.Tracer("openai_gateway_proxy/proxy")
+
+// withTracing starts a server span per request, named after the mux
+// pattern the request matches and continuing any incoming W3C trace.
+func withTracing(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, route := mux.Handler(r)
+		if route == "/healthz" || route == "/readyz" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", r.Method),
+				attribute.String("http.route", route),
+				attribute.String("url.path", r.URL.Path),
+			),
+		)
+		defer span.End()
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		span.SetAttributes(attribute.Int("http.response.status_code", rec.status()))
+		if rec.status() >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(rec.status()))
+		}
+	})
+}
+
+// tracingRoundTripper wraps next with a client span per gateway request
+// and injects the trace context into the outgoing headers.
+func tracingRoundTripper(next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		ctx, span := tracer.Start(req.Context(), "gateway "+req.Method,
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(
+				attribute.String("http.request.method", req.Method),
+				attribute.String("url.full", req.URL.String()),
+			),
+		)
+		defer span.End()
+
+		req = req.Clone(ctx)
+		otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+		resp, err := next.RoundTrip(req)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			return resp, err
+		}
+		span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+		if resp.StatusCode >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(resp.StatusCode))
+		}
+		return resp, nil
+	})
+}
+
+// traceCapability records the capability a request was forwarded under on
+// the server span.
+func traceCapability(ctx context.Context, capability string) {
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("livepeer.capability", capability))
+}
+
+// traceSSE adds span events for the first forwarded SSE event and the end
+// of the stream.
+func traceSSE(ctx context.Context, start time.Time, stats sseStats) {
+	span := trace.SpanFromContext(ctx)
+	if !span.IsRecording() || stats == (sseStats{}) {
+		return
+	}
+	if !stats.firstEvent.IsZero() {
+		span.AddEvent("sse.first_event", trace.WithTimestamp(stats.firstEvent), trace.WithAttributes(
+			attribute.Float64("sse.time_to_first_event_ms", float64(stats.firstEvent.Sub(start).Microseconds())/1000),
+		))
+	}
+	span.AddEvent("sse.stream_end", trace.WithAttributes(
+		attribute.Float64("sse.duration_ms", float64(time.Since(start).Microseconds())/1000),
+		attribute.Int("sse.events_forwarded", stats.forwarded),
+		attribute.Int("sse.events_filtered", stats.filtered),
+	))
+}
@@ -0,0 +1,116 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+)
+
+// Usage tracking modes.
+const (
+	// UsageOff disables usage tracking.
+	UsageOff = "off"
+	// UsageOn records usage the backend reports (default).
+	UsageOn = "on"
+	// UsageForce also sets stream_options.include_usage on streaming
+	// requests so streamed responses always end with a usage chunk.
+	UsageForce = "force"
+)
+
+// Trailers carrying the usage of a filtered stream, with
+// Config.UsageTrailers.
+const (
+	usageTrailerPrompt     = "X-Usage-Prompt-Tokens"
+	usageTrailerCompletion = "X-Usage-Completion-Tokens"
+	usageTrailerTotal      = "X-Usage-Total-Tokens"
+)
+
+// maxUsageCapture bounds how much of a non-streaming response is kept for
+// usage parsing.
+const maxUsageCapture = 4 << 20
+
+// tokenUsage is the OpenAI usage object.
+type tokenUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// parseUsage extracts the model and usage from an OpenAI response body or
+// stream chunk. Missing, null or malformed usage objects report false.
+func parseUsage(data []byte) (string, tokenUsage, bool) {
+	var v struct {
+		Model string          `json:"model"`
+		Usage json.RawMessage `json:"usage"`
+	}
+	if err := json.Unmarshal(data, &v); err != nil || len(v.Usage) == 0 || string(v.Usage) == "null" {
+		return "", tokenUsage{}, false
+	}
+	var u tokenUsage
+	if err := json.Unmarshal(v.Usage, &u); err != nil {
+		return "", tokenUsage{}, false
+	}
+	if u.PromptTokens < 0 || u.CompletionTokens < 0 || u.TotalTokens < 0 {
+		return "", tokenUsage{}, false
+	}
+	if u.TotalTokens == 0 {
+		u.TotalTokens = u.PromptTokens + u.CompletionTokens
+	}
+	return v.Model, u, true
+}
+
+// forceIncludeUsage sets stream_options.include_usage on a streaming JSON
+// request body. Other bodies are returned unchanged.
+func forceIncludeUsage(body []byte) []byte {
+	var req map[string]json.RawMessage
+	if err := json.Unmarshal(body, &req); err != nil {
+		return body
+	}
+	var stream bool
+	if err := json.Unmarshal(req["stream"], &stream); err != nil || !stream {
+		return body
+	}
+	opts := map[string]json.RawMessage{}
+	if raw, ok := req["stream_options"]; ok {
+		if err := json.Unmarshal(raw, &opts); err != nil || opts == nil {
+			opts = map[string]json.RawMessage{}
+		}
+	}
+	opts["include_usage"] = json.RawMessage("true")
+	req["stream_options"], _ = json.Marshal(opts)
+	out, err := json.Marshal(req)
+	if err != nil {
+		return body
+	}
+	return out
+}
+
+// recordUsage logs usage and adds it to the request's access log entry and
+// token metrics.
+func recordUsage(ctx context.Context, m *metrics, capability, model string, u tokenUsage) {
+	if info := getRequestInfo(ctx); info != nil {
+		info.model, info.usage = model, &u
+	}
+	m.observeUsage(capability, model, u)
+	logger(ctx).Debug("token usage", slog.String("capability", capability), slog.String("model", model),
+		slog.Int("prompt_tokens", u.PromptTokens),
+		slog.Int("completion_tokens", u.CompletionTokens),
+		slog.Int("total_tokens", u.TotalTokens),
+	)
+}
+
+// captureBody tees up to maxUsageCapture bytes of rc into buf as it is read.
+type captureBody struct {
+	io.ReadCloser
+	buf bytes.Buffer
+}
+
+func (c *captureBody) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	if room := maxUsageCapture - c.buf.Len(); room > 0 {
+		c.buf.Write(p[:min(n, room)])
+	}
+	return n, err
+}
@@ -0,0 +1,211 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// counterValue returns the value of the counter name with labels in reg.
+func counterValue(t *testing.T, reg *prometheus.Registry, name string, labels map[string]string) float64 {
+	t.Helper()
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range families {
+		if f.GetName() != name {
+			continue
+		}
+	metrics:
+		for _, m := range f.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if labels[l.GetName()] != l.GetValue() {
+					continue metrics
+				}
+			}
+			return m.GetCounter().GetValue()
+		}
+	}
+	return 0
+}
+
+func TestParseUsage(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		data      string
+		wantModel string
+		want      tokenUsage
+		wantOK    bool
+	}{
+		{"valid", `{"model":"m","usage":{"prompt_tokens":3,"completion_tokens":4,"total_tokens":7}}`, "m", tokenUsage{3, 4, 7}, true},
+		{"total derived", `{"model":"m","usage":{"prompt_tokens":3,"completion_tokens":4}}`, "m", tokenUsage{3, 4, 7}, true},
+		{"embeddings", `{"model":"e","usage":{"prompt_tokens":5,"total_tokens":5}}`, "e", tokenUsage{5, 0, 5}, true},
+		{"no model", `{"usage":{"prompt_tokens":1,"completion_tokens":1}}`, "", tokenUsage{1, 1, 2}, true},
+		{"missing usage", `{"model":"m","choices":[]}`, "", tokenUsage{}, false},
+		{"null usage", `{"model":"m","usage":null}`, "", tokenUsage{}, false},
+		{"string usage", `{"model":"m","usage":"lots"}`, "", tokenUsage{}, false},
+		{"string count", `{"model":"m","usage":{"prompt_tokens":"3"}}`, "", tokenUsage{}, false},
+		{"negative count", `{"model":"m","usage":{"prompt_tokens":-1,"completion_tokens":4}}`, "", tokenUsage{}, false},
+		{"fractional count", `{"model":"m","usage":{"prompt_tokens":1.5,"completion_tokens":4}}`, "", tokenUsage{}, false},
+		{"not JSON", `data: {"usage":{}}`, "", tokenUsage{}, false},
+		{"array", `[{"usage":{"prompt_tokens":1}}]`, "", tokenUsage{}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			model, u, ok := parseUsage([]byte(tc.data))
+			if model != tc.wantModel || u != tc.want || ok != tc.wantOK {
+				t.Fatalf("parseUsage = %q, %+v, %v; want %q, %+v, %v", model, u, ok, tc.wantModel, tc.want, tc.wantOK)
+			}
+		})
+	}
+}
+
+func TestForceIncludeUsage(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		body string
+		want string // "" means unchanged
+	}{
+		{"streaming", `{"model":"m","stream":true}`, `{"model":"m","stream":true,"stream_options":{"include_usage":true}}`},
+		{"existing stream_options", `{"stream":true,"stream_options":{"continuous_usage_stats":true}}`, `{"stream":true,"stream_options":{"continuous_usage_stats":true,"include_usage":true}}`},
+		{"include_usage false", `{"stream":true,"stream_options":{"include_usage":false}}`, `{"stream":true,"stream_options":{"include_usage":true}}`},
+		{"null stream_options", `{"stream":true,"stream_options":null}`, `{"stream":true,"stream_options":{"include_usage":true}}`},
+		{"not streaming", `{"model":"m","stream":false}`, ""},
+		{"no stream field", `{"model":"m"}`, ""},
+		{"stream as a string", `{"stream":"true"}`, ""},
+		{"array body", `[{"stream":true}]`, ""},
+		{"scalar body", `true`, ""},
+		{"not JSON", `stream=true`, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := forceIncludeUsage([]byte(tc.body))
+			if tc.want == "" {
+				if string(got) != tc.body {
+					t.Fatalf("body changed to %s", got)
+				}
+				return
+			}
+			var gotV, wantV any
+			if err := json.Unmarshal(got, &gotV); err != nil {
+				t.Fatalf("invalid JSON %s: %v", got, err)
+			}
+			json.Unmarshal([]byte(tc.want), &wantV)
+			if !reflect.DeepEqual(gotV, wantV) {
+				t.Fatalf("body %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestUsageCountsTokens(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		mode        string
+		contentType string
+		response    string
+	}{
+		{"json", ModeJSON, "application/json",
+			`{"model":"m","choices":[],"usage":{"prompt_tokens":3,"completion_tokens":4,"total_tokens":7}}`},
+		{"sse", ModeSSE, "text/event-stream",
+			"data: {\"model\":\"m\",\"choices\":[{\"delta\":{\"content\":\"hi\"}}]}\n\n" +
+				"data: {\"model\":\"m\",\"choices\":[],\"usage\":{\"prompt_tokens\":3,\"completion_tokens\":4,\"total_tokens\":7}}\n\n" +
+				"data: [DONE]\n\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			gw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tc.contentType)
+				w.Write([]byte(tc.response))
+			}))
+			defer gw.Close()
+			reg := prometheus.NewRegistry()
+			h := NewHandler(Config{
+				GatewayURL:        gw.URL,
+				MetricsRegisterer: reg,
+				Routes:            []Route{{Path: "/v1/chat/completions", Capability: "llm", Mode: tc.mode, TrackUsage: true}},
+			})
+
+			req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"model":"m","stream":true}`))
+			req.Header.Set("Content-Type", "application/json")
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", rec.Code, rec.Body)
+			}
+			for typ, want := range map[string]float64{"prompt": 3, "completion": 4} {
+				labels := map[string]string{"capability": "llm", "model": "m", "type": typ}
+				if got := counterValue(t, reg, "proxy_tokens_total", labels); got != want {
+					t.Errorf("%s tokens %v, want %v", typ, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestUsageTrailers(t *testing.T) {
+	usage := "data: {\"model\":\"m\",\"choices\":[],\"usage\":{\"prompt_tokens\":3,\"completion_tokens\":4,\"total_tokens\":7}}\n\n"
+	for _, tc := range []struct {
+		name          string
+		mode          string
+		contentType   string
+		response      string
+		wantAnnounced bool
+		want          map[string]string
+	}{
+		{"stream with usage", ModeSSE, "text/event-stream",
+			"data: {\"choices\":[{\"delta\":{\"content\":\"hi\"}}]}\n\n" + usage + "data: [DONE]\n\n",
+			true, map[string]string{usageTrailerPrompt: "3", usageTrailerCompletion: "4", usageTrailerTotal: "7"}},
+		{"stream without usage", ModeSSE, "text/event-stream",
+			"data: {\"choices\":[{\"delta\":{\"content\":\"hi\"}}]}\n\ndata: [DONE]\n\n",
+			true, map[string]string{usageTrailerPrompt: "", usageTrailerCompletion: "", usageTrailerTotal: ""}},
+		{"json", ModeJSON, "application/json",
+			`{"model":"m","choices":[],"usage":{"prompt_tokens":3,"completion_tokens":4,"total_tokens":7}}`,
+			false, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			gw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tc.contentType)
+				w.Write([]byte(tc.response))
+			}))
+			defer gw.Close()
+			srv := httptest.NewServer(New(Config{
+				GatewayURL:    gw.URL,
+				UsageTrailers: true,
+				Routes:        []Route{{Path: "/v1/chat/completions", Capability: "llm", Mode: tc.mode, TrackUsage: true}},
+			}))
+			defer srv.Close()
+
+			resp, err := http.Post(srv.URL+"/v1/chat/completions", "application/json", strings.NewReader(`{"model":"m","stream":true}`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status %d", resp.StatusCode)
+			}
+			// The client moves the announced names from the Trailer header
+			// into resp.Trailer before the body is read.
+			for _, name := range []string{usageTrailerPrompt, usageTrailerCompletion, usageTrailerTotal} {
+				if _, ok := resp.Trailer[name]; ok != tc.wantAnnounced {
+					t.Errorf("%s announced: %v, want %v", name, ok, tc.wantAnnounced)
+				}
+			}
+			if _, err := io.ReadAll(resp.Body); err != nil {
+				t.Fatal(err)
+			}
+			for name, want := range tc.want {
+				if got := resp.Trailer.Get(name); got != want {
+					t.Errorf("trailer %s = %q, want %q", name, got, want)
+				}
+			}
+			if !tc.wantAnnounced && len(resp.Trailer) != 0 {
+				t.Errorf("unexpected trailers %v", resp.Trailer)
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tlsVersions are the accepted TLS_MIN_VERSION values.
+var tlsVersions = map[string]uint16{"1.2": tls.VersionTLS12, "1.3": tls.VersionTLS13}
+
+// certReloader serves certificates from files that may be replaced while
+// the proxy runs, e.g. by certbot renewals: either one key pair, or every
+// <name>.crt with a matching <name>.key in dir, chosen by SNI.
+type certReloader struct {
+	certFile, keyFile string
+	dir               string
+
+	mu    sync.RWMutex
+	certs []*tls.Certificate
+	// stamp identifies the files and modification times loaded.
+	stamp string
+}
+
+func newCertReloader(certFile, keyFile, dir string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile, dir: dir}
+	if _, err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// pairs returns the certificate and key files to load.
+func (c *certReloader) pairs() ([][2]string, error) {
+	if c.dir == "" {
+		return [][2]string{{c.certFile, c.keyFile}}, nil
+	}
+	certs, err := filepath.Glob(filepath.Join(c.dir, "*.crt"))
+	if err != nil {
+		return nil, err
+	}
+	var pairs [][2]string
+	for _, cert := range certs {
+		key := strings.TrimSuffix(cert, ".crt") + ".key"
+		if _, err := os.Stat(key); err == nil {
+			pairs = append(pairs, [2]string{cert, key})
+		}
+	}
+	if len(pairs) == 0 {
+		return nil, fmt.Errorf("no <name>.crt and <name>.key pairs in %s", c.dir)
+	}
+	return pairs, nil
+}
+
+// reload loads the key pairs if any file changed since the last load,
+// reporting whether it did.
+func (c *certReloader) reload() (bool, error) {
+	pairs, err := c.pairs()
+	if err != nil {
+		return false, err
+	}
+	stamp, err := filesStamp(pairs)
+	if err != nil {
+		return false, err
+	}
+	c.mu.RLock()
+	unchanged := c.certs != nil && stamp == c.stamp
+	c.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+	certs := make([]*tls.Certificate, len(pairs))
+	for i, p := range pairs {
+		cert, err := tls.LoadX509KeyPair(p[0], p[1])
+		if err != nil {
+			return false, fmt.Errorf("%s: %w", p[0], err)
+		}
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return false, fmt.Errorf("%s: %w", p[0], err)
+		}
+		certs[i] = &cert
+	}
+	c.mu.Lock()
+	c.certs, c.stamp = certs, stamp
+	c.mu.Unlock()
+	return true, nil
+}
+
+func filesStamp(pairs [][2]string) (string, error) {
+	var b strings.Builder
+	for _, p := range pairs {
+		for _, name := range p {
+			fi, err := os.Stat(name)
+			if err != nil {
+				return "", err
+			}
+			fmt.Fprintf(&b, "%s@%d;", name, fi.ModTime().UnixNano())
+		}
+	}
+	return b.String(), nil
+}
+
+// watch checks the files every interval. Pairs that fail to load are
+// logged and the previous certificates kept.
+func (c *certReloader) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		reloaded, err := c.reload()
+		switch {
+		case err != nil:
+			slog.Error("failed to reload TLS certificate, keeping the current one", "cert_file", c.certFile, "cert_dir", c.dir, "error", err)
+		case reloaded:
+			slog.Info("TLS certificate reloaded", "cert_file", c.certFile, "cert_dir", c.dir)
+		}
+	}
+}
+
+// getCertificate returns the first certificate valid for the client's
+// server name, or the first one if none is.
+func (c *certReloader) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if len(c.certs) == 0 {
+		return nil, errors.New("no TLS certificate loaded")
+	}
+	for _, cert := range c.certs {
+		if hello.SupportsCertificate(cert) == nil {
+			return cert, nil
+		}
+	}
+	return c.certs[0], nil
+}